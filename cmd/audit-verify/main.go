@@ -0,0 +1,31 @@
+// Command audit-verify checks an audit trail written by pkg/audit for gaps and
+// modifications. It exits 1 if any problem is found.
+//
+//	audit-verify /var/lib/etcd-cache/audit
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/audit"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: audit-verify <audit dir>")
+		os.Exit(2)
+	}
+	rep, err := audit.Verify(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "audit-verify:", err)
+		os.Exit(2)
+	}
+	for _, p := range rep.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d files, %d records (seq %d-%d), %d problems\n", rep.Files, rep.Records, rep.FirstSeq, rep.LastSeq, len(rep.Problems))
+	if !rep.OK() {
+		os.Exit(1)
+	}
+}
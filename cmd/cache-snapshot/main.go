@@ -0,0 +1,149 @@
+// Command cache-snapshot exports cache state to portable snapshot files and loads it back.
+//
+//	cache-snapshot export -endpoints localhost:2379 -prefix /registry/ -o dump.jsonl
+//	cache-snapshot export -cache-snapshot /var/lib/etcd-cache/cache.snap -o dump.db
+//	cache-snapshot import -i dump.jsonl -cache-snapshot ./cache.snap
+//	cache-snapshot convert -i member/snap/db -o dump.jsonl
+//
+// The file format follows the extension (.jsonl or .db) unless -format is given.
+// import writes a WatchCache snapshot a proxy can boot from, which is how test
+// environments are seeded.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/adapter"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/snapshot"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/watcher"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	case "convert":
+		err = runConvert(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cache-snapshot:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: cache-snapshot export|import|convert [flags]; run a command with -h for its flags")
+	os.Exit(2)
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	endpoints := fs.String("endpoints", "", "comma-separated etcd endpoints to list from")
+	prefix := fs.String("prefix", "/", "key prefix to list from etcd")
+	cacheSnap := fs.String("cache-snapshot", "", "WatchCache snapshot file to export instead of etcd")
+	out := fs.String("o", "", "output file")
+	format := fs.String("format", "", "output format: jsonl or db (default: from the -o extension)")
+	fs.Parse(args)
+
+	if *out == "" || (*endpoints == "") == (*cacheSnap == "") {
+		return fmt.Errorf("export needs -o and exactly one of -endpoints or -cache-snapshot")
+	}
+	cache := proxy.NewWatchCache(nil)
+	if *cacheSnap != "" {
+		if _, err := cache.LoadSnapshot(*cacheSnap); err != nil {
+			return err
+		}
+	} else {
+		cli, err := clientv3.New(clientv3.Config{Endpoints: strings.Split(*endpoints, ","), DialTimeout: 5 * time.Second})
+		if err != nil {
+			return err
+		}
+		defer cli.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if _, err := watcher.Relist(ctx, cli, *prefix, adapter.NewEtcdAdapter(), cache); err != nil {
+			return err
+		}
+	}
+	d, err := snapshot.FromView(cache.Snapshot())
+	if err != nil {
+		return err
+	}
+	return write(*out, *format, d)
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("i", "", "input file")
+	format := fs.String("format", "", "input format: jsonl or db (default: from the -i extension)")
+	cacheSnap := fs.String("cache-snapshot", "", "WatchCache snapshot file to write")
+	fs.Parse(args)
+
+	if *in == "" || *cacheSnap == "" {
+		return fmt.Errorf("import needs -i and -cache-snapshot")
+	}
+	d, err := read(*in, *format)
+	if err != nil {
+		return err
+	}
+	cache := proxy.NewWatchCache(nil)
+	d.Load(cache)
+	_, err = cache.WriteSnapshot(*cacheSnap)
+	return err
+}
+
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	in := fs.String("i", "", "input file")
+	out := fs.String("o", "", "output file")
+	inFormat := fs.String("from", "", "input format (default: from the -i extension)")
+	outFormat := fs.String("to", "", "output format (default: from the -o extension)")
+	fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		return fmt.Errorf("convert needs -i and -o")
+	}
+	d, err := read(*in, *inFormat)
+	if err != nil {
+		return err
+	}
+	return write(*out, *outFormat, d)
+}
+
+func read(path, format string) (*snapshot.Dump, error) {
+	f, err := resolveFormat(path, format)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.ReadFile(path, f)
+}
+
+func write(path, format string, d *snapshot.Dump) error {
+	f, err := resolveFormat(path, format)
+	if err != nil {
+		return err
+	}
+	return snapshot.WriteFile(path, f, d)
+}
+
+func resolveFormat(path, format string) (snapshot.Format, error) {
+	if format != "" {
+		return snapshot.Format(format), nil
+	}
+	return snapshot.FormatFromPath(path)
+}
@@ -0,0 +1,180 @@
+// Command etcd-cache-proxy serves etcd clients from a WatchCache kept in sync
+// with an etcd cluster.
+//
+//	etcd-cache-proxy -config /etc/etcd-cache/config.yaml
+//	etcd-cache-proxy -endpoints https://etcd-0:2379 -etcd-cacert ca.pem -etcd-user cache:secret \
+//	    -prefix /registry/pods/,/registry/services/ -listen-client :23790 -listen-http :23791
+//
+// The configuration file has the format of stack.LoadConfig; flags given on the
+// command line override it. etcd's KV and Watch gRPC services are served on
+// -listen-client (see package kvserver) and the JSON gateway on -listen-http
+// (see package gateway), both over TLS when -cert-file and -key-file are set.
+//
+// Everything the proxy forwards to etcd runs with its own etcd credentials
+// (-etcd-user, -etcd-cert), whoever the client is. Writes are therefore refused
+// unless -forward-writes is set, which requires -trusted-ca-file so that only
+// clients with a certificate from that CA get to write with those credentials.
+// Reads outside the cached prefixes are forwarded either way, so give the
+// proxy's etcd user no more than the access every such client may have.
+//
+// SIGHUP re-reads the configuration file and applies what can change while
+// running (see stack.Stack.Reload). SIGTERM and SIGINT end every watch stream
+// so that clients move to another endpoint, wait up to -drain-timeout for the
+// remaining requests and then stop.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/kvserver"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/stack"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "etcd-cache-proxy:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	o, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: o.logLevel}))
+	s, err := newServer(o, logger)
+	if err != nil {
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	return s.run(context.Background(), sigs)
+}
+
+// options are the parsed command line.
+type options struct {
+	configPath string
+	overrides  []func(*stack.Config) // from the flags that were set, applied on top of the file
+
+	listenClient   string
+	listenHTTP     string
+	serverTLS      transport.TLSInfo
+	forwardWrites  bool
+	catchUpTimeout time.Duration
+	drainTimeout   time.Duration
+	logLevel       slog.Level
+}
+
+func parseFlags(args []string) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("etcd-cache-proxy", flag.ContinueOnError)
+	fs.StringVar(&o.configPath, "config", "", "YAML or JSON configuration file")
+	endpoints := fs.String("endpoints", "", "comma-separated etcd endpoints")
+	prefixes := fs.String("prefix", "", "comma-separated key prefixes to cache (default: every key)")
+	caFile := fs.String("etcd-cacert", "", "CA bundle to verify etcd's certificate")
+	certFile := fs.String("etcd-cert", "", "client certificate for etcd")
+	keyFile := fs.String("etcd-key", "", "client key for etcd")
+	user := fs.String("etcd-user", "", "etcd user as name:password")
+	adminAddr := fs.String("admin-addr", "", "address of the admin HTTP server, e.g. :9090")
+	metricsAddr := fs.String("metrics-addr", "", "address of a separate /metrics listener")
+	snapshotPath := fs.String("snapshot-path", "", "file the cache is persisted to and restored from")
+	capacity := fs.Int("eventlog-capacity", 0, "number of events the EventLog retains")
+	fs.StringVar(&o.listenClient, "listen-client", "127.0.0.1:23790", "address serving etcd's gRPC API")
+	fs.StringVar(&o.listenHTTP, "listen-http", "127.0.0.1:23791", "address serving the JSON gateway; empty disables it")
+	fs.StringVar(&o.serverTLS.CertFile, "cert-file", "", "certificate served to clients")
+	fs.StringVar(&o.serverTLS.KeyFile, "key-file", "", "key of -cert-file")
+	fs.StringVar(&o.serverTLS.TrustedCAFile, "trusted-ca-file", "", "CA bundle clients must present a certificate from")
+	fs.BoolVar(&o.forwardWrites, "forward-writes", false, "forward writes to etcd with the proxy's credentials; needs -trusted-ca-file")
+	fs.DurationVar(&o.catchUpTimeout, "catch-up-timeout", kvserver.DefaultCatchUpTimeout, "how long a linearizable read waits for the cache before going to etcd")
+	fs.DurationVar(&o.drainTimeout, "drain-timeout", 30*time.Second, "how long shutdown waits for in-flight requests")
+	logLevel := fs.String("log-level", "info", "debug, info, warn or error")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	if err := o.logLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+		return nil, err
+	}
+	if (o.serverTLS.CertFile == "") != (o.serverTLS.KeyFile == "") {
+		return nil, errors.New("-cert-file and -key-file must be given together")
+	}
+	o.serverTLS.ClientCertAuth = o.serverTLS.TrustedCAFile != ""
+	if o.forwardWrites && !o.serverTLS.ClientCertAuth {
+		return nil, errors.New("-forward-writes needs -trusted-ca-file: without client certificates any client could write with the proxy's etcd credentials")
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "endpoints":
+			o.override(func(c *stack.Config) { c.Etcd.Endpoints = split(*endpoints) })
+		case "prefix":
+			o.override(func(c *stack.Config) { c.Prefixes = split(*prefixes) })
+		case "etcd-cacert":
+			o.override(func(c *stack.Config) { c.Etcd.TLS.CAFile = *caFile })
+		case "etcd-cert":
+			o.override(func(c *stack.Config) { c.Etcd.TLS.CertFile = *certFile })
+		case "etcd-key":
+			o.override(func(c *stack.Config) { c.Etcd.TLS.KeyFile = *keyFile })
+		case "etcd-user":
+			name, password, ok := strings.Cut(*user, ":")
+			if !ok {
+				err = errors.New("-etcd-user must be name:password")
+			}
+			o.override(func(c *stack.Config) { c.Etcd.Username, c.Etcd.Password = name, password })
+		case "admin-addr":
+			o.override(func(c *stack.Config) { c.Admin.Addr = *adminAddr })
+		case "metrics-addr":
+			o.override(func(c *stack.Config) { c.Metrics.Addr = *metricsAddr })
+		case "snapshot-path":
+			o.override(func(c *stack.Config) { c.Snapshot.Path = *snapshotPath })
+		case "eventlog-capacity":
+			o.override(func(c *stack.Config) { c.EventLog.Capacity = *capacity })
+		}
+	})
+	return o, err
+}
+
+func (o *options) override(fn func(*stack.Config)) {
+	o.overrides = append(o.overrides, fn)
+}
+
+// config reads the configuration file, or starts from stack.DefaultConfig
+// without one, and applies the flags on top.
+func (o *options) config() (stack.Config, error) {
+	cfg := stack.DefaultConfig()
+	if o.configPath != "" {
+		var err error
+		if cfg, err = stack.LoadConfig(o.configPath); err != nil {
+			return stack.Config{}, err
+		}
+	}
+	for _, fn := range o.overrides {
+		fn(&cfg)
+	}
+	return cfg, cfg.Validate()
+}
+
+func split(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
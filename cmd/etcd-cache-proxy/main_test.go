@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/gateway"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// enableAuth turns on etcd authentication with a root user.
+func enableAuth(t *testing.T, endpoint, password string) {
+	t.Helper()
+	ctx := context.Background()
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}})
+	require.NoError(t, err)
+	defer cli.Close()
+	_, err = cli.UserAdd(ctx, "root", password)
+	require.NoError(t, err)
+	_, err = cli.UserGrantRole(ctx, "root", "root")
+	require.NoError(t, err)
+	_, err = cli.AuthEnable(ctx)
+	require.NoError(t, err)
+}
+
+func TestProxy(t *testing.T) {
+	endpoint := etcdtest.Start(t)
+	enableAuth(t, endpoint, "secret")
+	ctx := context.Background()
+	etcd, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, Username: "root", Password: "secret"})
+	require.NoError(t, err)
+	defer etcd.Close()
+	_, err = etcd.Put(ctx, "/a/1", "one")
+	require.NoError(t, err)
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(cfgPath, []byte("etcd:\n  endpoints: ["+endpoint+"]\nadmin:\n  maxRevisionLag: 10\n"), 0o600))
+	o, err := parseFlags([]string{
+		"-config", cfgPath,
+		"-prefix", "/a/",
+		"-etcd-user", "root:secret",
+		"-listen-client", "127.0.0.1:0",
+		"-listen-http", "127.0.0.1:0",
+		"-drain-timeout", "5s",
+	})
+	require.NoError(t, err)
+	s, err := newServer(o, slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	require.NoError(t, err)
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- s.run(ctx, sigs) }()
+
+	proxy, err := clientv3.New(clientv3.Config{Endpoints: []string{s.grpcLn.Addr().String()}})
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	// gRPC: reads come from the cache; writes are refused without -forward-writes.
+	resp, err := proxy.Get(ctx, "/a/1")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, "one", string(resp.Kvs[0].Value))
+	assert.Zero(t, resp.Header.MemberId, "served from the cache")
+	events := proxy.Watch(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+	_, err = proxy.Put(ctx, "/a/2", "two")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = etcd.Put(ctx, "/a/2", "two")
+	require.NoError(t, err)
+	select {
+	case wr := <-events:
+		require.NoError(t, wr.Err())
+		require.Len(t, wr.Events, 1)
+		assert.Equal(t, "/a/2", string(wr.Events[0].Kv.Key))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no watch event")
+	}
+
+	// HTTP: the gateway reads the same cache.
+	httpResp, err := http.Get("http://" + s.httpAddr() + "/v1/kv/" + url.PathEscape("/a/2"))
+	require.NoError(t, err)
+	var kr gateway.KeyResponse
+	require.NoError(t, json.NewDecoder(httpResp.Body).Decode(&kr))
+	httpResp.Body.Close()
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Equal(t, "two", string(kr.KV.Value))
+
+	// SIGHUP applies the changed file; the flags still override it.
+	require.NoError(t, os.WriteFile(cfgPath, []byte("etcd:\n  endpoints: ["+endpoint+"]\nadmin:\n  maxRevisionLag: 3\n"), 0o600))
+	sigs <- syscall.SIGHUP
+	require.Eventually(t, func() bool {
+		return s.stack.Config().Admin.MaxRevisionLag == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"/a/"}, s.stack.Config().Prefixes)
+
+	// SIGTERM ends open watch streams with Unavailable and stops.
+	conn, err := grpc.Dial(s.grpcLn.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := pb.NewWatchClient(conn).Watch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{
+		CreateRequest: &pb.WatchCreateRequest{Key: []byte("/a/"), RangeEnd: []byte("/a0")},
+	}}))
+	created, err := stream.Recv()
+	require.NoError(t, err)
+	require.True(t, created.Created)
+
+	sigs <- syscall.SIGTERM
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("proxy did not stop")
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	o, err := parseFlags([]string{"-endpoints", "a:2379, b:2379", "-eventlog-capacity", "5"})
+	require.NoError(t, err)
+	cfg, err := o.config()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a:2379", "b:2379"}, cfg.Etcd.Endpoints)
+	assert.Equal(t, 5, cfg.EventLog.Capacity)
+	assert.Empty(t, cfg.Prefixes, "unset flags keep the configured value")
+
+	for _, args := range [][]string{
+		{"-etcd-user", "root"},
+		{"-cert-file", "server.pem"},
+		{"-forward-writes"},
+		{"-log-level", "loud"},
+		{"extra"},
+	} {
+		_, err := parseFlags(args)
+		assert.Error(t, err, "%v", args)
+	}
+	o, err = parseFlags([]string{"-eventlog-capacity", "0"})
+	require.NoError(t, err)
+	_, err = o.config()
+	assert.Error(t, err)
+}
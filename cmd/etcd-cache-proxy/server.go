@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/gateway"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/kvserver"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/stack"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// httpShutdownTimeout bounds how long shutdown waits for gateway requests.
+const httpShutdownTimeout = 5 * time.Second
+
+// server is one running proxy: the caching stack and the listeners serving it.
+type server struct {
+	opts   *options
+	logger *slog.Logger
+	stack  *stack.Stack
+	kv     *kvserver.Server
+	grpc   *grpc.Server
+	grpcLn net.Listener
+	httpLn net.Listener // nil if the gateway is disabled
+}
+
+// newServer builds the stack from the configuration and opens the client
+// listeners. Nothing is served until run.
+func newServer(o *options, logger *slog.Logger) (*server, error) {
+	cfg, err := o.config()
+	if err != nil {
+		return nil, err
+	}
+	st, err := stack.New(stack.WithConfig(cfg), stack.WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+	s := &server{opts: o, logger: logger, stack: st}
+	var tlsCfg *tls.Config
+	var grpcOpts []grpc.ServerOption
+	if !o.serverTLS.Empty() {
+		if tlsCfg, err = o.serverTLS.ServerConfig(); err != nil {
+			st.Stop()
+			return nil, err
+		}
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	if s.grpcLn, err = net.Listen("tcp", o.listenClient); err != nil {
+		st.Stop()
+		return nil, err
+	}
+	if o.listenHTTP != "" {
+		if s.httpLn, err = net.Listen("tcp", o.listenHTTP); err != nil {
+			s.grpcLn.Close()
+			st.Stop()
+			return nil, err
+		}
+		if tlsCfg != nil {
+			s.httpLn = tls.NewListener(s.httpLn, tlsCfg)
+		}
+	}
+
+	kvOpts := []kvserver.Option{
+		kvserver.WithPrefixes(cfg.Prefixes...),
+		kvserver.WithCatchUpTimeout(o.catchUpTimeout),
+		kvserver.WithMetrics(st.Metrics()),
+		kvserver.WithLogger(logger),
+	}
+	if o.forwardWrites {
+		kvOpts = append(kvOpts, kvserver.WithForwardedWrites())
+	}
+	s.kv = kvserver.New(st.Cache(), st.EventLog(), st.Client(), kvOpts...)
+	s.grpc = grpc.NewServer(grpcOpts...)
+	s.kv.Register(s.grpc)
+	return s, nil
+}
+
+// run bootstraps the cache, serves clients and handles sigs until a
+// termination signal arrives or ctx is done, then shuts down gracefully.
+func (s *server) run(ctx context.Context, sigs <-chan os.Signal) error {
+	if err := s.stack.Start(ctx); err != nil {
+		s.closeListeners()
+		s.stack.Stop()
+		return err
+	}
+	errc := make(chan error, 2)
+	go func() { errc <- s.grpc.Serve(s.grpcLn) }()
+
+	var httpSrv *http.Server
+	var gw *gateway.Gateway
+	if s.httpLn != nil {
+		var err error
+		if gw, err = gateway.New(s.stack.Cache(), s.stack.ClientLibrary(), gateway.WithLogger(s.logger)); err != nil {
+			return s.shutdown(nil, nil, err)
+		}
+		httpSrv = &http.Server{Handler: gw.Handler(), ReadHeaderTimeout: 10 * time.Second}
+		httpSrv.RegisterOnShutdown(gw.Drain)
+		go func() {
+			if err := httpSrv.Serve(s.httpLn); !errors.Is(err, http.ErrServerClosed) {
+				errc <- err
+			}
+		}()
+	}
+	s.logger.Info("serving", slog.String("grpc", s.grpcLn.Addr().String()), slog.String("http", s.httpAddr()))
+
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				s.reload()
+				continue
+			}
+			s.logger.Info("shutting down", slog.String("signal", sig.String()))
+			return s.shutdown(httpSrv, gw, nil)
+		case <-ctx.Done():
+			return s.shutdown(httpSrv, gw, nil)
+		case err := <-errc:
+			s.logger.Error("listener failed, shutting down", slog.Any("error", err))
+			return s.shutdown(httpSrv, gw, err)
+		}
+	}
+}
+
+// reload re-reads the configuration and applies it to the running stack. A
+// configuration that does not load keeps the current one in effect.
+func (s *server) reload() {
+	cfg, err := s.opts.config()
+	if err == nil {
+		err = s.stack.Reload(cfg)
+	}
+	if err != nil {
+		s.logger.Error("reloading configuration failed", slog.Any("error", err))
+		return
+	}
+	s.logger.Info("configuration reloaded", slog.String("path", s.opts.configPath))
+}
+
+// shutdown drains watch streams, waits up to the drain timeout for the other
+// gRPC calls and gateway requests, and stops the stack. It returns cause joined
+// with the errors of stopping.
+func (s *server) shutdown(httpSrv *http.Server, gw *gateway.Gateway, cause error) error {
+	s.kv.Drain()
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(s.opts.drainTimeout):
+		s.logger.Warn("drain timeout exceeded, closing remaining connections")
+		s.grpc.Stop()
+	}
+
+	errs := []error{cause}
+	if httpSrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		errs = append(errs, httpSrv.Shutdown(ctx))
+		cancel()
+	} else if s.httpLn != nil {
+		s.httpLn.Close()
+	}
+	if gw != nil {
+		errs = append(errs, gw.Close())
+	}
+	errs = append(errs, s.stack.Stop())
+	return errors.Join(errs...)
+}
+
+func (s *server) closeListeners() {
+	s.grpcLn.Close()
+	if s.httpLn != nil {
+		s.httpLn.Close()
+	}
+}
+
+func (s *server) httpAddr() string {
+	if s.httpLn == nil {
+		return ""
+	}
+	return s.httpLn.Addr().String()
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/admin"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/kvserver"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/snapshot"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// pageSize is how many keys snapshot-at-revision, and diff from etcd, read per request.
+const pageSize = 1000
+
+func runGet(ctx context.Context, g *globals, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	prefix := fs.Bool("prefix", false, "get the keys with prefix KEY")
+	rev := fs.Int64("rev", 0, "revision to read at; the proxy forwards reads at other revisions than the cache's to etcd")
+	limit := fs.Int64("limit", 0, "maximum number of results")
+	keysOnly := fs.Bool("keys-only", false, "get only the keys")
+	valueOnly := fs.Bool("print-value-only", false, "print only the values with -w simple")
+	consistency := fs.String("consistency", "l", "linearizable (l) or serializable (s)")
+	args, err := g.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	key, opts, err := keyRange(args, *prefix)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, clientv3.WithRev(*rev), clientv3.WithLimit(*limit))
+	if *keysOnly {
+		opts = append(opts, clientv3.WithKeysOnly())
+	}
+	switch *consistency {
+	case "l":
+	case "s":
+		opts = append(opts, clientv3.WithSerializable())
+	default:
+		return fmt.Errorf("unknown consistency %q, use l or s", *consistency)
+	}
+	p, err := g.printer(out, *valueOnly)
+	if err != nil {
+		return err
+	}
+	cli, err := g.client()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(ctx, g.commandTimeout)
+	defer cancel()
+	resp, err := cli.Get(ctx, key, opts...)
+	if err != nil {
+		return err
+	}
+	p.Get(resp)
+	return nil
+}
+
+// runWatch prints watch responses until the watch fails or ctx is done.
+func runWatch(ctx context.Context, g *globals, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	prefix := fs.Bool("prefix", false, "watch the keys with prefix KEY")
+	rev := fs.Int64("rev", 0, "revision to start watching at")
+	prevKV := fs.Bool("prev-kv", false, "get the previous key-value pair before the event happens")
+	args, err := g.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	key, opts, err := keyRange(args, *prefix)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, clientv3.WithRev(*rev))
+	if *prevKV {
+		opts = append(opts, clientv3.WithPrevKV())
+	}
+	p, err := g.printer(out, false)
+	if err != nil {
+		return err
+	}
+	cli, err := g.client()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	for resp := range cli.Watch(ctx, key, opts...) {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		p.Watch(resp)
+	}
+	return nil
+}
+
+// runSnapshotAtRevision prints or saves every key under a prefix as of a revision.
+func runSnapshotAtRevision(ctx context.Context, g *globals, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("snapshot-at-revision", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only the keys with this prefix")
+	path := fs.String("o", "", "save to this file instead of printing; .jsonl or .db, as read by cache-snapshot import")
+	args, err := g.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("expected REV")
+	}
+	rev, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || rev < 0 {
+		return fmt.Errorf("invalid revision %q", args[0])
+	}
+	p, err := g.printer(out, false)
+	if err != nil {
+		return err
+	}
+	cli, err := g.client()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	kvs, header, err := rangeAll(ctx, cli, *prefix, rev, g.commandTimeout)
+	if err != nil {
+		return err
+	}
+	if *path == "" {
+		p.Get(&clientv3.GetResponse{Header: header, Kvs: kvs, Count: int64(len(kvs))})
+		return nil
+	}
+	format, err := snapshot.FormatFromPath(*path)
+	if err != nil {
+		return err
+	}
+	d := &snapshot.Dump{Revision: header.Revision, KVs: make([]api.KV, 0, len(kvs))}
+	for _, kv := range kvs {
+		d.KVs = append(d.KVs, api.KV{Key: string(kv.Key), Value: kv.Value, Revision: kv.ModRevision})
+	}
+	if err := snapshot.WriteFile(*path, format, d); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Snapshot saved at %s\n", *path)
+	return nil
+}
+
+// rangeAll reads every key under prefix at rev, the latest revision if 0, in
+// pages of pageSize. The returned header carries the revision read at.
+func rangeAll(ctx context.Context, kv clientv3.KV, prefix string, rev int64, timeout time.Duration) ([]*mvccpb.KeyValue, *pb.ResponseHeader, error) {
+	key, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if prefix == "" {
+		key, end = "\x00", "\x00"
+	}
+	var kvs []*mvccpb.KeyValue
+	var header *pb.ResponseHeader
+	for {
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := kv.Get(pctx, key, clientv3.WithRange(end), clientv3.WithRev(rev), clientv3.WithLimit(pageSize))
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+		if header == nil {
+			// Read the following pages at the same revision.
+			if rev == 0 {
+				rev = resp.Header.Revision
+			}
+			header = resp.Header
+			header.Revision = rev
+		}
+		kvs = append(kvs, resp.Kvs...)
+		if !resp.More || len(resp.Kvs) == 0 {
+			return kvs, header, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+func runListSessions(ctx context.Context, g *globals, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("list-sessions", flag.ContinueOnError)
+	args, err := g.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	p, err := g.printer(out, false)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, g.commandTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(g.adminEndpoint, "/")+"/debug", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	var info admin.DebugInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+	p.Sessions(info.Sessions)
+	return nil
+}
+
+// diffResult lists the keys on which the cache and etcd disagree at Revision.
+type diffResult struct {
+	Revision   int64    `json:"revision"`
+	Missing    []string `json:"missing"`    // in etcd, not in the cache
+	Extra      []string `json:"extra"`      // in the cache, not in etcd
+	Mismatched []string `json:"mismatched"` // in both with another value or mod revision
+}
+
+func (d *diffResult) count() int {
+	return len(d.Missing) + len(d.Extra) + len(d.Mismatched)
+}
+
+// runDiff compares the cache's view of a prefix with etcd at the same revision.
+// The cache is read in one request that the proxy must answer itself.
+func runDiff(ctx context.Context, g *globals, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	endpoints := fs.String("etcd-endpoints", "", "comma-separated etcd endpoints to compare with")
+	var info transport.TLSInfo
+	fs.StringVar(&info.TrustedCAFile, "etcd-cacert", "", "CA bundle to verify etcd's certificate")
+	fs.StringVar(&info.CertFile, "etcd-cert", "", "client certificate for etcd")
+	fs.StringVar(&info.KeyFile, "etcd-key", "", "client key for etcd")
+	user := fs.String("etcd-user", "", "etcd user as name:password")
+	args, err := g.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("expected PREFIX")
+	}
+	if *endpoints == "" {
+		return errors.New("--etcd-endpoints is required")
+	}
+	var name, password string
+	if *user != "" {
+		var ok bool
+		if name, password, ok = strings.Cut(*user, ":"); !ok {
+			return errors.New("--etcd-user must be name:password")
+		}
+	}
+	p, err := g.printer(out, false)
+	if err != nil {
+		return err
+	}
+	cli, err := g.client()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	etcd, err := dial(split(*endpoints), info, name, password, g.dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer etcd.Close()
+
+	cached, header, err := readCache(ctx, cli, args[0], g.commandTimeout)
+	if err != nil {
+		return fmt.Errorf("reading the cache: %w", err)
+	}
+	live, _, err := rangeAll(ctx, etcd, args[0], header.Revision, g.commandTimeout)
+	if err != nil {
+		return fmt.Errorf("reading etcd at revision %d: %w", header.Revision, err)
+	}
+	d := compare(header.Revision, cached, live)
+	p.Diff(d)
+	if n := d.count(); n > 0 {
+		return fmt.Errorf("%d keys differ between the cache and etcd at revision %d", n, d.Revision)
+	}
+	return nil
+}
+
+// readCache reads prefix from the proxy's cache in one serializable request,
+// so that every key is read at the same revision. Paging with WithRev would not
+// do: the proxy forwards a page to etcd once the cache has moved past the
+// revision. It fails if the proxy forwarded the read anyway, e.g. because
+// prefix is not cached.
+func readCache(ctx context.Context, kv clientv3.KV, prefix string, timeout time.Duration) ([]*mvccpb.KeyValue, *pb.ResponseHeader, error) {
+	key, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if prefix == "" {
+		key, end = "\x00", "\x00"
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := kv.Get(ctx, key, clientv3.WithRange(end), clientv3.WithSerializable())
+	if err != nil {
+		return nil, nil, err
+	}
+	if !kvserver.ServedFromCache(resp.Header) {
+		return nil, nil, fmt.Errorf("%q was not served by the cache but by etcd", prefix)
+	}
+	return resp.Kvs, resp.Header, nil
+}
+
+func compare(rev int64, cached, live []*mvccpb.KeyValue) *diffResult {
+	d := &diffResult{Revision: rev, Missing: []string{}, Extra: []string{}, Mismatched: []string{}}
+	inCache := make(map[string]*mvccpb.KeyValue, len(cached))
+	for _, kv := range cached {
+		inCache[string(kv.Key)] = kv
+	}
+	for _, kv := range live {
+		c, ok := inCache[string(kv.Key)]
+		delete(inCache, string(kv.Key))
+		switch {
+		case !ok:
+			d.Missing = append(d.Missing, string(kv.Key))
+		case c.ModRevision != kv.ModRevision || string(c.Value) != string(kv.Value):
+			d.Mismatched = append(d.Mismatched, string(kv.Key))
+		}
+	}
+	for key := range inCache {
+		d.Extra = append(d.Extra, key)
+	}
+	sort.Strings(d.Extra)
+	return d
+}
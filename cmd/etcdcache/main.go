@@ -0,0 +1,177 @@
+// Command etcdcache reads from a running etcd-cache-proxy the way etcdctl reads
+// from etcd, for debugging what the cache holds.
+//
+//	etcdcache get /registry/pods/a
+//	etcdcache get --prefix /registry/pods/ -w json
+//	etcdcache watch --prefix /registry/ --rev 120
+//	etcdcache snapshot-at-revision 120 --prefix /registry/ -o pods.jsonl
+//	etcdcache list-sessions --admin-endpoint http://127.0.0.1:9090
+//	etcdcache diff /registry/ --etcd-endpoints etcd-0:2379
+//
+// get, watch and snapshot-at-revision use the proxy's gRPC API, list-sessions
+// its admin server. The simple, json and fields output formats (-w) print what
+// etcdctl prints for the same command. diff exits with status 1 if the cache
+// and etcd disagree.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:], os.Stdout)
+	stop()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "etcdcache:", err)
+		os.Exit(1)
+	}
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, g *globals, args []string, out io.Writer) error
+}
+
+var commands = []command{
+	{"get", "get KEY [RANGE_END] [--prefix] [--rev N] [--limit N] [--keys-only] [--print-value-only] [--consistency l|s]", runGet},
+	{"watch", "watch KEY [RANGE_END] [--prefix] [--rev N] [--prev-kv]", runWatch},
+	{"snapshot-at-revision", "snapshot-at-revision REV [--prefix P] [-o FILE]", runSnapshotAtRevision},
+	{"list-sessions", "list-sessions [--admin-endpoint URL]", runListSessions},
+	{"diff", "diff PREFIX --etcd-endpoints ENDPOINTS [--etcd-cacert F] [--etcd-cert F] [--etcd-key F] [--etcd-user NAME:PASSWORD]", runDiff},
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	g := &globals{
+		endpoints:      "127.0.0.1:23790",
+		adminEndpoint:  "http://127.0.0.1:9090",
+		writeOut:       "simple",
+		dialTimeout:    2 * time.Second,
+		commandTimeout: 5 * time.Second,
+	}
+	fs := flag.NewFlagSet("etcdcache", flag.ContinueOnError)
+	g.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: etcdcache [global flags] COMMAND [flags]")
+		for _, c := range commands {
+			fmt.Fprintln(fs.Output(), "  etcdcache", c.usage)
+		}
+		fmt.Fprintln(fs.Output(), "global flags, accepted before or after the command:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	for _, c := range commands {
+		if c.name == fs.Arg(0) {
+			return c.run(ctx, g, fs.Args()[1:], out)
+		}
+	}
+	return fmt.Errorf("unknown command %q", fs.Arg(0))
+}
+
+// globals are the flags every command accepts.
+type globals struct {
+	endpoints      string
+	adminEndpoint  string
+	writeOut       string
+	dialTimeout    time.Duration
+	commandTimeout time.Duration
+	tls            transport.TLSInfo
+}
+
+// register adds the global flags to fs with their current values as defaults,
+// so that a command's flag set keeps what was given before the command.
+func (g *globals) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.endpoints, "endpoints", g.endpoints, "comma-separated gRPC endpoints of the proxy")
+	fs.StringVar(&g.adminEndpoint, "admin-endpoint", g.adminEndpoint, "URL of the proxy's admin server")
+	fs.StringVar(&g.writeOut, "w", g.writeOut, "output format: simple, json or fields")
+	fs.StringVar(&g.writeOut, "write-out", g.writeOut, "output format: simple, json or fields")
+	fs.DurationVar(&g.dialTimeout, "dial-timeout", g.dialTimeout, "timeout for connecting")
+	fs.DurationVar(&g.commandTimeout, "command-timeout", g.commandTimeout, "timeout for short-running commands")
+	fs.StringVar(&g.tls.TrustedCAFile, "cacert", g.tls.TrustedCAFile, "CA bundle to verify the proxy's certificate")
+	fs.StringVar(&g.tls.CertFile, "cert", g.tls.CertFile, "client certificate for the proxy")
+	fs.StringVar(&g.tls.KeyFile, "key", g.tls.KeyFile, "client key for the proxy")
+}
+
+// parse parses a command's flags, which may come before, between or after its
+// arguments as with etcdctl, and returns the arguments.
+func (g *globals) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	g.register(fs)
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+		pos, args = append(pos, fs.Arg(0)), fs.Args()[1:]
+	}
+}
+
+func (g *globals) printer(out io.Writer, valueOnly bool) (printer, error) {
+	return newPrinter(g.writeOut, out, valueOnly)
+}
+
+// client connects to the proxy.
+func (g *globals) client() (*clientv3.Client, error) {
+	return dial(split(g.endpoints), g.tls, "", "", g.dialTimeout)
+}
+
+func dial(endpoints []string, info transport.TLSInfo, username, password string, timeout time.Duration) (*clientv3.Client, error) {
+	cfg := clientv3.Config{Endpoints: endpoints, DialTimeout: timeout, Username: username, Password: password}
+	if !info.Empty() || info.TrustedCAFile != "" {
+		tls, err := info.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tls
+	}
+	return clientv3.New(cfg)
+}
+
+// keyRange turns the KEY [RANGE_END] arguments and --prefix into etcd's key range.
+func keyRange(args []string, prefix bool) (string, []clientv3.OpOption, error) {
+	switch {
+	case len(args) == 0 || len(args) > 2:
+		return "", nil, errors.New("expected KEY [RANGE_END]")
+	case len(args) == 2 && prefix:
+		return "", nil, errors.New("--prefix and RANGE_END are mutually exclusive")
+	case len(args) == 2:
+		return args[0], []clientv3.OpOption{clientv3.WithRange(args[1])}, nil
+	case prefix:
+		return args[0], []clientv3.OpOption{clientv3.WithPrefix()}, nil
+	}
+	return args[0], nil, nil
+}
+
+func split(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
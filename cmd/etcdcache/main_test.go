@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/admin"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/kvserver"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/snapshot"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/stack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+func TestPrinters(t *testing.T) {
+	resp := &clientv3.GetResponse{
+		Header: &pb.ResponseHeader{ClusterId: 1, MemberId: 2, Revision: 5, RaftTerm: 3},
+		Kvs:    []*mvccpb.KeyValue{{Key: []byte("foo"), Value: []byte("bar"), ModRevision: 5}},
+		Count:  1,
+	}
+	print := func(format string, valueOnly bool, fn func(printer)) string {
+		var buf bytes.Buffer
+		p, err := newPrinter(format, &buf, valueOnly)
+		require.NoError(t, err)
+		fn(p)
+		return buf.String()
+	}
+
+	assert.Equal(t, "foo\nbar\n", print("simple", false, func(p printer) { p.Get(resp) }))
+	assert.Equal(t, "bar\n", print("simple", true, func(p printer) { p.Get(resp) }))
+	assert.Equal(t, `{"header":{"cluster_id":1,"member_id":2,"revision":5,"raft_term":3},"kvs":[{"key":"Zm9v","mod_revision":5,"value":"YmFy"}],"count":1}`+"\n",
+		print("json", false, func(p printer) { p.Get(resp) }))
+	assert.Equal(t, `"ClusterID" : 1
+"MemberID" : 2
+"Revision" : 5
+"RaftTerm" : 3
+"Key" : "foo"
+"CreateRevision" : 0
+"ModRevision" : 5
+"Version" : 0
+"Value" : "bar"
+"Lease" : 0
+"More" : false
+"Count" : 1
+`, print("fields", false, func(p printer) { p.Get(resp) }))
+
+	wr := clientv3.WatchResponse{Events: []*clientv3.Event{{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte("foo"), ModRevision: 6}}}}
+	assert.Equal(t, "DELETE\nfoo\n\n", print("simple", false, func(p printer) { p.Watch(wr) }))
+
+	d := &diffResult{Revision: 5, Missing: []string{"a"}, Extra: []string{}, Mismatched: []string{"b"}}
+	assert.Equal(t, "missing a\nmismatched b\n", print("simple", false, func(p printer) { p.Diff(d) }))
+	assert.Equal(t, `{"revision":5,"missing":["a"],"extra":[],"mismatched":["b"]}`+"\n", print("json", false, func(p printer) { p.Diff(d) }))
+
+	_, err := newPrinter("table", nil, false)
+	assert.Error(t, err)
+}
+
+// syncBuffer is a bytes.Buffer safe to read while a command writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCommands(t *testing.T) {
+	etcd := etcdtest.Client(t)
+	ctx := context.Background()
+	for _, kv := range [][2]string{{"/a/1", "one"}, {"/a/2", "two"}, {"/b/1", "elsewhere"}} {
+		_, err := etcd.Put(ctx, kv[0], kv[1])
+		require.NoError(t, err)
+	}
+	st, err := stack.New(stack.WithEtcdClient(etcd), stack.WithPrefixes("/a/"), stack.WithAdminAddr("127.0.0.1:0"))
+	require.NoError(t, err)
+	require.NoError(t, st.Start(ctx))
+	defer st.Stop()
+	g := grpc.NewServer()
+	kvserver.New(st.Cache(), st.EventLog(), etcd, kvserver.WithPrefixes("/a/")).Register(g)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go g.Serve(ln)
+	defer g.Stop()
+
+	etcdcache := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		args = append([]string{"--endpoints", ln.Addr().String(), "--admin-endpoint", "http://" + st.AdminAddr()}, args...)
+		err := run(ctx, args, &out)
+		return out.String(), err
+	}
+
+	out, err := etcdcache("get", "/a/1")
+	require.NoError(t, err)
+	assert.Equal(t, "/a/1\none\n", out)
+
+	out, err = etcdcache("get", "/a/", "--prefix", "-w", "json")
+	require.NoError(t, err)
+	var rr pb.RangeResponse
+	require.NoError(t, json.Unmarshal([]byte(out), &rr))
+	assert.Equal(t, int64(2), rr.Count)
+
+	rev := st.Cache().Revision()
+	path := filepath.Join(t.TempDir(), "a.jsonl")
+	_, err = etcdcache("snapshot-at-revision", "--prefix", "/a/", "-o", path, "0")
+	require.NoError(t, err)
+	d, err := snapshot.ReadFile(path, snapshot.FormatJSONLines)
+	require.NoError(t, err)
+	assert.Equal(t, rev, d.Revision)
+	assert.Len(t, d.KVs, 2)
+
+	sess, err := st.ClientLibrary().NewSession("operator")
+	require.NoError(t, err)
+	defer sess.Stop()
+	_, err = sess.WatchPrefix("/a/", rev+1)
+	require.NoError(t, err)
+	out, err = etcdcache("list-sessions")
+	require.NoError(t, err)
+	assert.Contains(t, out, sess.ID()+", operator, attached, ")
+	assert.Contains(t, out, "/a/*")
+	out, err = etcdcache("list-sessions", "-w", "json")
+	require.NoError(t, err)
+	var sessions []admin.SessionInfo
+	require.NoError(t, json.Unmarshal([]byte(out), &sessions))
+	assert.NotEmpty(t, sessions)
+
+	// watch runs until its context is done.
+	watchCtx, cancel := context.WithCancel(ctx)
+	var watchOut syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		done <- run(watchCtx, []string{"--endpoints", ln.Addr().String(), "watch", "--prefix", "/a/"}, &watchOut)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := etcd.Put(ctx, "/a/3", "three")
+		require.NoError(t, err)
+		return strings.Contains(watchOut.String(), "PUT\n/a/3\nthree\n")
+	}, 5*time.Second, 100*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	_, err = etcdcache("diff", "/a/", "--etcd-endpoints", etcd.Endpoints()[0])
+	require.NoError(t, err, "the cache matches etcd")
+	_, err = etcdcache("diff", "/b/", "--etcd-endpoints", etcd.Endpoints()[0])
+	assert.ErrorContains(t, err, "not served by the cache", "etcd is not compared with itself")
+
+	// Corrupt the cache at its current revision.
+	require.Eventually(t, func() bool {
+		obj, ok := st.Cache().Get("/a/3")
+		return ok && string(obj.Value) == "three"
+	}, 5*time.Second, 10*time.Millisecond)
+	objs, rev := st.Cache().Range("/a/", clientv3.GetPrefixRangeEnd("/a/"))
+	objs[0].Value = []byte("stale")      // /a/1
+	objs = append(objs[:1], objs[2:]...) // drop /a/2
+	objs = append(objs, &proxy.StoreObj{Key: "/a/x", Value: []byte("x"), Revision: rev, ModRev: rev})
+	st.Cache().Replace(objs, rev)
+	out, err = etcdcache("diff", "/a/", "--etcd-endpoints", etcd.Endpoints()[0])
+	assert.ErrorContains(t, err, "3 keys differ")
+	assert.Equal(t, "missing /a/2\nextra /a/x\nmismatched /a/1\n", out)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/admin"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// printer writes command results in one output format. Get and Watch print
+// exactly what etcdctl's printer of the same name prints.
+type printer interface {
+	Get(resp *clientv3.GetResponse)
+	Watch(resp clientv3.WatchResponse)
+	Sessions(sessions []admin.SessionInfo)
+	Diff(d *diffResult)
+}
+
+func newPrinter(format string, out io.Writer, valueOnly bool) (printer, error) {
+	switch format {
+	case "simple":
+		return &simplePrinter{out: out, valueOnly: valueOnly}, nil
+	case "json":
+		return &jsonPrinter{out: out}, nil
+	case "fields":
+		return &fieldsPrinter{out: out}, nil
+	}
+	return nil, fmt.Errorf("unsupported output format %q, use simple, json or fields", format)
+}
+
+type simplePrinter struct {
+	out       io.Writer
+	valueOnly bool
+}
+
+func (p *simplePrinter) Get(resp *clientv3.GetResponse) {
+	for _, kv := range resp.Kvs {
+		p.kv(kv)
+	}
+}
+
+func (p *simplePrinter) Watch(resp clientv3.WatchResponse) {
+	for _, ev := range resp.Events {
+		fmt.Fprintln(p.out, ev.Type)
+		if ev.PrevKv != nil {
+			p.kv(ev.PrevKv)
+		}
+		p.kv(ev.Kv)
+	}
+}
+
+func (p *simplePrinter) kv(kv *mvccpb.KeyValue) {
+	if !p.valueOnly {
+		fmt.Fprintln(p.out, string(kv.Key))
+	}
+	fmt.Fprintln(p.out, string(kv.Value))
+}
+
+// Sessions prints one line per session like etcdctl member list: ID, client
+// ID, attached or detached, delivered and acked revisions, lag in events, and the
+// subscriptions, prefixes marked with a trailing "*".
+func (p *simplePrinter) Sessions(sessions []admin.SessionInfo) {
+	for _, s := range sessions {
+		state := "detached"
+		if s.Attached {
+			state = "attached"
+		}
+		subs := make([]string, 0, len(s.Subscriptions))
+		for _, sub := range s.Subscriptions {
+			if sub.Prefix {
+				subs = append(subs, sub.Key+"*")
+			} else {
+				subs = append(subs, sub.Key)
+			}
+		}
+		fmt.Fprintln(p.out, strings.Join([]string{
+			s.ID, s.ClientID, state,
+			fmt.Sprint(s.Delivered), fmt.Sprint(s.Acked), fmt.Sprint(s.Lag),
+			strings.Join(subs, " "),
+		}, ", "))
+	}
+}
+
+func (p *simplePrinter) Diff(d *diffResult) {
+	for _, list := range []struct {
+		kind string
+		keys []string
+	}{{"missing", d.Missing}, {"extra", d.Extra}, {"mismatched", d.Mismatched}} {
+		for _, key := range list.keys {
+			fmt.Fprintln(p.out, list.kind, key)
+		}
+	}
+}
+
+// jsonPrinter marshals the responses themselves, as etcdctl does.
+type jsonPrinter struct {
+	out io.Writer
+}
+
+func (p *jsonPrinter) Get(resp *clientv3.GetResponse)        { p.print((*pb.RangeResponse)(resp)) }
+func (p *jsonPrinter) Watch(resp clientv3.WatchResponse)     { p.print(&resp) }
+func (p *jsonPrinter) Sessions(sessions []admin.SessionInfo) { p.print(sessions) }
+func (p *jsonPrinter) Diff(d *diffResult)                    { p.print(d) }
+
+func (p *jsonPrinter) print(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintln(p.out, err)
+		return
+	}
+	fmt.Fprintln(p.out, string(b))
+}
+
+// fieldsPrinter prints one "Name" : value line per field.
+type fieldsPrinter struct {
+	out io.Writer
+}
+
+func (p *fieldsPrinter) hdr(h *pb.ResponseHeader) {
+	fmt.Fprintln(p.out, `"ClusterID" :`, h.ClusterId)
+	fmt.Fprintln(p.out, `"MemberID" :`, h.MemberId)
+	if h.Revision != 0 {
+		fmt.Fprintln(p.out, `"Revision" :`, h.Revision)
+	}
+	fmt.Fprintln(p.out, `"RaftTerm" :`, h.RaftTerm)
+}
+
+func (p *fieldsPrinter) kv(pfx string, kv *mvccpb.KeyValue) {
+	fmt.Fprintf(p.out, "\"%sKey\" : %q\n", pfx, string(kv.Key))
+	fmt.Fprintf(p.out, "\"%sCreateRevision\" : %d\n", pfx, kv.CreateRevision)
+	fmt.Fprintf(p.out, "\"%sModRevision\" : %d\n", pfx, kv.ModRevision)
+	fmt.Fprintf(p.out, "\"%sVersion\" : %d\n", pfx, kv.Version)
+	fmt.Fprintf(p.out, "\"%sValue\" : %q\n", pfx, string(kv.Value))
+	fmt.Fprintf(p.out, "\"%sLease\" : %d\n", pfx, kv.Lease)
+}
+
+func (p *fieldsPrinter) Get(resp *clientv3.GetResponse) {
+	p.hdr(resp.Header)
+	for _, kv := range resp.Kvs {
+		p.kv("", kv)
+	}
+	fmt.Fprintln(p.out, `"More" :`, resp.More)
+	fmt.Fprintln(p.out, `"Count" :`, resp.Count)
+}
+
+func (p *fieldsPrinter) Watch(resp clientv3.WatchResponse) {
+	p.hdr(&resp.Header)
+	for _, ev := range resp.Events {
+		fmt.Fprintln(p.out, `"Type" :`, ev.Type)
+		if ev.PrevKv != nil {
+			p.kv("Prev", ev.PrevKv)
+		}
+		p.kv("", ev.Kv)
+	}
+}
+
+func (p *fieldsPrinter) Sessions(sessions []admin.SessionInfo) {
+	for _, s := range sessions {
+		fmt.Fprintf(p.out, "\"ID\" : %q\n", s.ID)
+		fmt.Fprintf(p.out, "\"ClientID\" : %q\n", s.ClientID)
+		fmt.Fprintln(p.out, `"Attached" :`, s.Attached)
+		fmt.Fprintln(p.out, `"Delivered" :`, s.Delivered)
+		fmt.Fprintln(p.out, `"Acked" :`, s.Acked)
+		fmt.Fprintln(p.out, `"Lag" :`, s.Lag)
+		fmt.Fprintf(p.out, "\"LastActive\" : %q\n", s.LastActive.Format(time.RFC3339))
+		for _, sub := range s.Subscriptions {
+			fmt.Fprintf(p.out, "\"SubscriptionKey\" : %q\n", sub.Key)
+			fmt.Fprintln(p.out, `"SubscriptionPrefix" :`, sub.Prefix)
+			fmt.Fprintln(p.out, `"SubscriptionRevision" :`, sub.Revision)
+			fmt.Fprintln(p.out, `"SubscriptionLag" :`, sub.Lag)
+		}
+	}
+}
+
+func (p *fieldsPrinter) Diff(d *diffResult) {
+	fmt.Fprintln(p.out, `"Revision" :`, d.Revision)
+	for _, key := range d.Missing {
+		fmt.Fprintf(p.out, "\"Missing\" : %q\n", key)
+	}
+	for _, key := range d.Extra {
+		fmt.Fprintf(p.out, "\"Extra\" : %q\n", key)
+	}
+	for _, key := range d.Mismatched {
+		fmt.Fprintf(p.out, "\"Mismatched\" : %q\n", key)
+	}
+}
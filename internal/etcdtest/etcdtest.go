@@ -0,0 +1,63 @@
+// Package etcdtest runs an embedded etcd for tests that need a real server.
+package etcdtest
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Option adjusts the embedded etcd configuration.
+type Option func(*embed.Config)
+
+// WithProgressNotify makes etcd send watch progress notifications every d.
+func WithProgressNotify(d time.Duration) Option {
+	return func(cfg *embed.Config) {
+		cfg.ExperimentalWatchProgressNotifyInterval = d
+	}
+}
+
+// Start runs a single-member etcd on random local ports until the test ends
+// and returns its client endpoint.
+func Start(t testing.TB, opts ...Option) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	local, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{*local}, []url.URL{*local}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{*local}, []url.URL{*local}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd did not become ready")
+	}
+	return e.Clients[0].Addr().String()
+}
+
+// Client runs etcd like Start and returns a client connected to it.
+func Client(t testing.TB, opts ...Option) *clientv3.Client {
+	t.Helper()
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{Start(t, opts...)},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
@@ -1 +1,334 @@
-package adapter
\ No newline at end of file
+package adapter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// DefaultCiliumPrefix is the root of Cilium's kvstore keyspace.
+const DefaultCiliumPrefix = "cilium/state/"
+
+// Cilium kvstore prefixes, relative to DefaultCiliumPrefix.
+const (
+	ciliumIdentityIDs    = "identities/v1/id/"    // id/<numeric id> -> "k8s:app=web;k8s:io.kubernetes.pod.namespace=default;"
+	ciliumIdentityValues = "identities/v1/value/" // value/<labels>/<node ip> -> "<numeric id>", attached to the node's lease
+	ciliumIPs            = "ip/v1/"               // ip/v1/<cluster or namespace>/<ip> -> JSON IPIdentity
+	ciliumNodes          = "nodes/v1/"            // nodes/v1/<cluster>/<node> -> JSON Node
+	ciliumServices       = "services/v1/"         // services/v1/<cluster>/<namespace>/<name> -> JSON Service
+)
+
+// Identity is a security identity allocated in the kvstore.
+type Identity struct {
+	ID     int64
+	Labels []string // e.g. "k8s:app=web"
+}
+
+// IPIdentity maps an endpoint IP to its security identity.
+type IPIdentity struct {
+	IP           string `json:"IP"`
+	HostIP       string `json:"HostIP,omitempty"`
+	ID           int64  `json:"ID"`
+	Key          uint8  `json:"Key,omitempty"`
+	Metadata     string `json:"Metadata,omitempty"`
+	K8sNamespace string `json:"K8sNamespace,omitempty"`
+	K8sPodName   string `json:"K8sPodName,omitempty"`
+}
+
+// NodeAddress is one address of a Node.
+type NodeAddress struct {
+	Type string `json:"Type"`
+	IP   string `json:"IP"`
+}
+
+// Node is a node registration written by each cilium-agent.
+type Node struct {
+	Name          string        `json:"Name"`
+	Cluster       string        `json:"Cluster"`
+	ClusterID     uint32        `json:"ClusterID,omitempty"`
+	IPAddresses   []NodeAddress `json:"IPAddresses,omitempty"`
+	IPv4AllocCIDR string        `json:"IPv4AllocCIDR,omitempty"`
+	IPv6AllocCIDR string        `json:"IPv6AllocCIDR,omitempty"`
+}
+
+// Service is a cluster service shared through the kvstore (ClusterMesh).
+type Service struct {
+	Cluster   string                       `json:"cluster"`
+	Namespace string                       `json:"namespace"`
+	Name      string                       `json:"name"`
+	Frontends map[string]map[string]uint16 `json:"frontends,omitempty"` // ip -> port name -> port
+	Backends  map[string]map[string]uint16 `json:"backends,omitempty"`
+	Labels    map[string]string            `json:"labels,omitempty"`
+	Selector  map[string]string            `json:"selector,omitempty"`
+	Shared    bool                         `json:"shared,omitempty"`
+}
+
+// CiliumEvent is a typed change under one of the Cilium prefixes.
+// Object is the zero value for deletes; Err is set if the value could not be decoded.
+type CiliumEvent[T any] struct {
+	Type     api.EventType
+	Key      string
+	Revision int64
+	Object   T
+	Err      error
+}
+
+// CiliumAdapter models Cilium's kvstore on top of a WatchCache, so all agents on a
+// node can share one cache instead of each opening its own etcd watches.
+type CiliumAdapter struct {
+	cache  proxy.WatchCacheInterface
+	log    eventlog.EventLog
+	prefix string
+	users  indexedCache // indexes the value keys by identity, nil if the cache has no indexes
+	leases LeaseChecker // nil trusts every lease the cache still holds keys of
+}
+
+// LeaseChecker reports whether an etcd lease is still granted, e.g. with a
+// LeaseTimeToLive call; see EtcdLeaseChecker.
+type LeaseChecker func(ctx context.Context, lease int64) (bool, error)
+
+// EtcdLeaseChecker checks leases with etcd's LeaseTimeToLive. etcd answers an
+// expired or revoked lease with a TTL of -1.
+func EtcdLeaseChecker(l clientv3.Lease) LeaseChecker {
+	return func(ctx context.Context, lease int64) (bool, error) {
+		resp, err := l.TimeToLive(ctx, clientv3.LeaseID(lease))
+		if err != nil {
+			return false, err
+		}
+		return resp.TTL > 0, nil
+	}
+}
+
+// CiliumOption configures a CiliumAdapter.
+type CiliumOption func(*CiliumAdapter)
+
+// WithLeaseChecker makes IdentityAlive ask fn whether the lease of a value key
+// is still granted, instead of trusting it until etcd's delete reaches the cache.
+func WithLeaseChecker(fn LeaseChecker) CiliumOption {
+	return func(a *CiliumAdapter) {
+		a.leases = fn
+	}
+}
+
+// indexedCache is implemented by *proxy.WatchCache.
+type indexedCache interface {
+	AddIndexers(proxy.Indexers) error
+	ByIndex(name, value string) ([]*proxy.StoreObj, error)
+}
+
+// NewCiliumAdapter builds an adapter over cache and the EventLog the cache appends to.
+// prefix defaults to DefaultCiliumPrefix when empty. If cache supports indexes
+// (a *proxy.WatchCache does), the adapter registers one for IdentityAlive.
+func NewCiliumAdapter(cache proxy.WatchCacheInterface, log eventlog.EventLog, prefix string, opts ...CiliumOption) *CiliumAdapter {
+	if prefix == "" {
+		prefix = DefaultCiliumPrefix
+	}
+	a := &CiliumAdapter{cache: cache, log: log, prefix: strings.TrimSuffix(prefix, "/") + "/"}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if ic, ok := cache.(indexedCache); ok {
+		// An adapter over the same cache and prefix may have registered it already.
+		_ = ic.AddIndexers(proxy.Indexers{a.identityIndex(): a.identityUsers})
+		a.users = ic
+	}
+	return a
+}
+
+// identityIndex names the index from an identity ID to the value keys of the
+// nodes using it.
+func (a *CiliumAdapter) identityIndex() string {
+	return "cilium-identity-users:" + a.prefix
+}
+
+func (a *CiliumAdapter) identityUsers(obj *proxy.StoreObj) []string {
+	if !strings.HasPrefix(obj.Key, a.prefix+ciliumIdentityValues) {
+		return nil
+	}
+	return []string{strings.TrimSpace(string(obj.Value))}
+}
+
+// Identities lists every allocated identity ordered by ID.
+func (a *CiliumAdapter) Identities() ([]Identity, error) {
+	ids, err := listTyped(a, ciliumIdentityIDs, decodeIdentity)
+	sort.Slice(ids, func(i, j int) bool { return ids[i].ID < ids[j].ID })
+	return ids, err
+}
+
+// WatchIdentities streams identity allocations and releases. See watchTyped for fromRev.
+func (a *CiliumAdapter) WatchIdentities(ctx context.Context, fromRev int64) (<-chan CiliumEvent[Identity], error) {
+	return watchTyped(ctx, a, ciliumIdentityIDs, fromRev, decodeIdentity)
+}
+
+// IdentityAlive reports whether any node still uses the identity.
+//
+// Every agent using an identity keeps a value/<labels>/<node> key attached to its
+// etcd lease. An identity is alive while one of its cached value keys has a
+// lease: a key without one is a leftover no agent keeps alive, or was cached
+// without its lease, e.g. from a snapshot that predates leases. The master
+// id/<id> key alone does not count, it lingers until the operator
+// garbage-collects it. The lookup goes through the adapter's index of value
+// keys by identity; without one it scans every value key.
+//
+// The cache only learns of an expired lease from the deletes etcd issues for
+// its keys. With WithLeaseChecker a lease is also checked, once per call, and
+// the keys of an expired one are dead before those deletes arrive; without it
+// a dead agent's identities are alive until then.
+func (a *CiliumAdapter) IdentityAlive(ctx context.Context, id int64) (bool, error) {
+	want := strconv.FormatInt(id, 10)
+	var objs []*proxy.StoreObj
+	if a.users != nil {
+		var err error
+		if objs, err = a.users.ByIndex(a.identityIndex(), want); err != nil {
+			return false, err
+		}
+	} else {
+		kvs, err := a.cache.Snapshot().List(a.prefix + ciliumIdentityValues)
+		if err != nil {
+			return false, err
+		}
+		for _, kv := range kvs {
+			if strings.TrimSpace(string(kv.Value)) != want {
+				continue
+			}
+			if obj, ok := a.cache.Get(kv.Key); ok {
+				objs = append(objs, obj)
+			}
+		}
+	}
+	expired := make(map[int64]bool)
+	for _, obj := range objs {
+		if obj.Lease == 0 || expired[obj.Lease] {
+			continue
+		}
+		if a.leases == nil {
+			return true, nil
+		}
+		granted, err := a.leases(ctx, obj.Lease)
+		if err != nil {
+			return false, fmt.Errorf("lease %x: %w", obj.Lease, err)
+		}
+		if granted {
+			return true, nil
+		}
+		expired[obj.Lease] = true
+	}
+	return false, nil
+}
+
+// IPIdentities lists ip→identity mappings; cluster "" lists all of them.
+func (a *CiliumAdapter) IPIdentities(cluster string) ([]IPIdentity, error) {
+	return listTyped(a, scoped(ciliumIPs, cluster), decodeJSONValue[IPIdentity])
+}
+
+// WatchIPIdentities streams ip→identity changes; cluster "" watches all of them.
+func (a *CiliumAdapter) WatchIPIdentities(ctx context.Context, cluster string, fromRev int64) (<-chan CiliumEvent[IPIdentity], error) {
+	return watchTyped(ctx, a, scoped(ciliumIPs, cluster), fromRev, decodeJSONValue[IPIdentity])
+}
+
+// Nodes lists node registrations; cluster "" lists all of them.
+func (a *CiliumAdapter) Nodes(cluster string) ([]Node, error) {
+	return listTyped(a, scoped(ciliumNodes, cluster), decodeJSONValue[Node])
+}
+
+// WatchNodes streams node registrations; cluster "" watches all of them.
+func (a *CiliumAdapter) WatchNodes(ctx context.Context, cluster string, fromRev int64) (<-chan CiliumEvent[Node], error) {
+	return watchTyped(ctx, a, scoped(ciliumNodes, cluster), fromRev, decodeJSONValue[Node])
+}
+
+// Services lists shared services; cluster "" lists all of them.
+func (a *CiliumAdapter) Services(cluster string) ([]Service, error) {
+	return listTyped(a, scoped(ciliumServices, cluster), decodeJSONValue[Service])
+}
+
+// WatchServices streams shared service changes; cluster "" watches all of them.
+func (a *CiliumAdapter) WatchServices(ctx context.Context, cluster string, fromRev int64) (<-chan CiliumEvent[Service], error) {
+	return watchTyped(ctx, a, scoped(ciliumServices, cluster), fromRev, decodeJSONValue[Service])
+}
+
+func scoped(prefix, cluster string) string {
+	if cluster == "" {
+		return prefix
+	}
+	return prefix + cluster + "/"
+}
+
+// listTyped decodes every cached value under rel, ordered by key.
+func listTyped[T any](a *CiliumAdapter, rel string, decode func(key string, val []byte) (T, error)) ([]T, error) {
+	kvs, err := a.cache.Snapshot().List(a.prefix + rel)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	out := make([]T, 0, len(kvs))
+	for _, kv := range kvs {
+		obj, err := decode(kv.Key, kv.Value)
+		if err != nil {
+			return out, fmt.Errorf("%s: %w", kv.Key, err)
+		}
+		out = append(out, obj)
+	}
+	return out, nil
+}
+
+// watchTyped streams decoded changes under rel from the EventLog until ctx is done.
+// fromRev <= 0 starts after the current cache revision, i.e. only new changes;
+// pair it with the matching list call for a list-then-watch.
+func watchTyped[T any](ctx context.Context, a *CiliumAdapter, rel string, fromRev int64, decode func(key string, val []byte) (T, error)) (<-chan CiliumEvent[T], error) {
+	if fromRev <= 0 {
+		fromRev = a.cache.Revision() + 1
+	}
+	events, err := a.log.Watch(ctx, fromRev)
+	if err != nil {
+		return nil, err
+	}
+	prefix := a.prefix + rel
+	out := make(chan CiliumEvent[T])
+	go func() {
+		defer close(out)
+		for ev := range events {
+			if !strings.HasPrefix(ev.Key, prefix) {
+				continue
+			}
+			tev := CiliumEvent[T]{Type: ev.Type, Key: ev.Key, Revision: ev.Revision}
+			if ev.Type == api.EventPut {
+				tev.Object, tev.Err = decode(ev.Key, ev.Value)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- tev:
+			}
+		}
+	}()
+	return out, nil
+}
+
+func decodeIdentity(key string, val []byte) (Identity, error) {
+	idStr := key[strings.LastIndex(key, "/")+1:]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid identity %q", idStr)
+	}
+	var labels []string
+	for _, l := range strings.Split(string(val), ";") {
+		if l = strings.TrimSpace(l); l != "" {
+			labels = append(labels, l)
+		}
+	}
+	return Identity{ID: id, Labels: labels}, nil
+}
+
+func decodeJSONValue[T any](_ string, val []byte) (T, error) {
+	var obj T
+	err := json.Unmarshal(val, &obj)
+	return obj, err
+}
@@ -0,0 +1,152 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCiliumFixture(t *testing.T) (*proxy.WatchCache, *CiliumAdapter) {
+	log := eventlog.NewMemoryEventLog(100)
+	wc := proxy.NewWatchCacheWithLog(nil, log)
+	fixtures := []struct {
+		key, value string
+		lease      int64
+	}{
+		{"cilium/state/identities/v1/id/1001", "k8s:app=web;k8s:io.kubernetes.pod.namespace=default;", 0},
+		{"cilium/state/identities/v1/id/1002", "k8s:app=db;k8s:io.kubernetes.pod.namespace=default;", 0},
+		{"cilium/state/identities/v1/value/k8s:app=web;k8s:io.kubernetes.pod.namespace=default;/10.0.0.1", "1001", 0x51},
+		{"cilium/state/ip/v1/default/10.1.0.5", `{"IP":"10.1.0.5","HostIP":"10.0.0.1","ID":1001,"K8sNamespace":"default","K8sPodName":"web-1"}`, 0},
+		{"cilium/state/nodes/v1/cluster-a/node-1", `{"Name":"node-1","Cluster":"cluster-a","IPAddresses":[{"Type":"InternalIP","IP":"10.0.0.1"}]}`, 0},
+		{"cilium/state/nodes/v1/cluster-b/node-9", `{"Name":"node-9","Cluster":"cluster-b"}`, 0},
+		{"cilium/state/services/v1/cluster-a/default/web", `{"cluster":"cluster-a","namespace":"default","name":"web","frontends":{"10.96.0.10":{"http":80}},"shared":true}`, 0},
+	}
+	for i, f := range fixtures {
+		require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: f.key, Value: []byte(f.value), Revision: int64(i + 1), Lease: f.lease}))
+	}
+	return wc, NewCiliumAdapter(wc, log, "")
+}
+
+func TestCiliumAdapter_TypedLists(t *testing.T) {
+	_, a := newCiliumFixture(t)
+
+	ids, err := a.Identities()
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+	assert.Equal(t, int64(1001), ids[0].ID)
+	assert.Equal(t, []string{"k8s:app=web", "k8s:io.kubernetes.pod.namespace=default"}, ids[0].Labels)
+
+	ips, err := a.IPIdentities("")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, int64(1001), ips[0].ID)
+	assert.Equal(t, "web-1", ips[0].K8sPodName)
+
+	nodes, err := a.Nodes("cluster-a")
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "10.0.0.1", nodes[0].IPAddresses[0].IP)
+
+	svcs, err := a.Services("")
+	require.NoError(t, err)
+	require.Len(t, svcs, 1)
+	assert.Equal(t, uint16(80), svcs[0].Frontends["10.96.0.10"]["http"])
+}
+
+func TestCiliumAdapter_IdentityAlive(t *testing.T) {
+	wc, a := newCiliumFixture(t)
+	ctx := context.Background()
+
+	alive, err := a.IdentityAlive(ctx, 1001)
+	require.NoError(t, err)
+	assert.True(t, alive)
+
+	// A second adapter over the same cache shares the identity index.
+	alive, err = NewCiliumAdapter(wc, nil, "").IdentityAlive(ctx, 1001)
+	require.NoError(t, err)
+	assert.True(t, alive)
+
+	// 1002 still has its master key but no node references it.
+	alive, err = a.IdentityAlive(ctx, 1002)
+	require.NoError(t, err)
+	assert.False(t, alive)
+
+	// A value key without a lease is kept alive by no agent.
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "cilium/state/identities/v1/value/k8s:app=db;k8s:io.kubernetes.pod.namespace=default;/10.0.0.2", Value: []byte("1002"), Revision: 8}))
+	alive, err = a.IdentityAlive(ctx, 1002)
+	require.NoError(t, err)
+	assert.False(t, alive)
+
+	// The node's lease expires: etcd deletes its value keys.
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventDelete, Key: "cilium/state/identities/v1/value/k8s:app=web;k8s:io.kubernetes.pod.namespace=default;/10.0.0.1", Revision: 9}))
+	alive, err = a.IdentityAlive(ctx, 1001)
+	require.NoError(t, err)
+	assert.False(t, alive)
+}
+
+func TestCiliumAdapter_IdentityAliveChecksLeases(t *testing.T) {
+	wc, _ := newCiliumFixture(t)
+	ctx := context.Background()
+	// A second node uses 1001 under lease 0x52.
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "cilium/state/identities/v1/value/k8s:app=web;k8s:io.kubernetes.pod.namespace=default;/10.0.0.2", Value: []byte("1001"), Revision: 8, Lease: 0x52}))
+
+	granted := map[int64]bool{0x51: true, 0x52: true}
+	var checks int
+	a := NewCiliumAdapter(wc, nil, "", WithLeaseChecker(func(_ context.Context, lease int64) (bool, error) {
+		checks++
+		return granted[lease], nil
+	}))
+	alive, err := a.IdentityAlive(ctx, 1001)
+	require.NoError(t, err)
+	assert.True(t, alive)
+
+	// Both leases expired before etcd's deletes reached the cache.
+	granted = nil
+	checks = 0
+	alive, err = a.IdentityAlive(ctx, 1001)
+	require.NoError(t, err)
+	assert.False(t, alive)
+	assert.Equal(t, 2, checks)
+
+	failing := NewCiliumAdapter(wc, nil, "", WithLeaseChecker(func(context.Context, int64) (bool, error) {
+		return false, errors.New("etcd unavailable")
+	}))
+	_, err = failing.IdentityAlive(ctx, 1001)
+	assert.ErrorContains(t, err, "etcd unavailable")
+}
+
+func TestCiliumAdapter_WatchNodes(t *testing.T) {
+	wc, a := newCiliumFixture(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := a.WatchNodes(ctx, "cluster-a", 0)
+	require.NoError(t, err)
+
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "cilium/state/nodes/v1/cluster-b/node-10", Value: []byte(`{"Name":"node-10"}`), Revision: 8}))
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "cilium/state/nodes/v1/cluster-a/node-2", Value: []byte(`{"Name":"node-2","Cluster":"cluster-a"}`), Revision: 9}))
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventDelete, Key: "cilium/state/nodes/v1/cluster-a/node-1", Revision: 10}))
+
+	for _, want := range []struct {
+		typ  api.EventType
+		name string
+		rev  int64
+	}{{api.EventPut, "node-2", 9}, {api.EventDelete, "", 10}} {
+		select {
+		case ev := <-ch:
+			require.NoError(t, ev.Err)
+			assert.Equal(t, want.typ, ev.Type)
+			assert.Equal(t, want.name, ev.Object.Name)
+			assert.Equal(t, want.rev, ev.Revision)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for node event")
+		}
+	}
+}
@@ -0,0 +1,18 @@
+/*
+Package adapter exposes the generic WatchCache through the APIs of specific downstream systems.
+
+Core components:
+
+  - K8sAdapter: serves Kubernetes list/watch semantics (resourceVersion, continue tokens,
+    label selectors, ADDED/MODIFIED/DELETED/BOOKMARK watch events) over a cache that
+    mirrors kube-apiserver's /registry/ keyspace. Objects are decoded from both JSON and
+    Kubernetes protobuf storage encodings without depending on generated API types.
+  - EtcdAdapter: the ingestion-side adapter used by the watcher pipeline; it filters keys by
+    include/exclude prefixes, rewrites keys, limits value sizes and sends malformed events
+    to a dead-letter channel instead of the cache.
+  - CiliumAdapter: typed list/watch helpers for Cilium's kvstore prefixes (identities,
+    ip→identity, nodes, services) and a lease-aware identity liveness query.
+
+Apart from EtcdAdapter, adapters only read from the cache and its EventLog; they never write to etcd.
+*/
+package adapter
@@ -0,0 +1,178 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+)
+
+var (
+	// ErrNotWatchable is returned for keys the include/exclude rules filter out.
+	// Such events are expected and are not sent to the dead-letter channel.
+	ErrNotWatchable   = errors.New("key is not watchable")
+	ErrMalformedEvent = errors.New("malformed etcd event")
+	ErrValueTooLarge  = errors.New("value exceeds size limit")
+)
+
+// DeadLetter is an etcd event the adapter refused to let into the cache.
+type DeadLetter struct {
+	KV  api.EtcdKV
+	Err error
+}
+
+// KeyRewrite replaces the From prefix of a key with To, e.g. to strip a
+// tenant prefix before keys reach the cache.
+type KeyRewrite struct {
+	From string
+	To   string
+}
+
+// EtcdAdapter is the single place where raw etcd events become cache events.
+// It filters keys by prefix rules, rewrites keys, enforces a value size limit and
+// rejects malformed events into a dead-letter channel instead of the cache.
+type EtcdAdapter struct {
+	include      []string
+	exclude      []string
+	rewrites     []KeyRewrite
+	maxValueSize int
+
+	deadLetters chan DeadLetter
+	dropped     atomic.Int64 // dead letters lost because the channel was full
+}
+
+var _ api.EtcdAdapter = (*EtcdAdapter)(nil)
+
+// EtcdOption configures an EtcdAdapter.
+type EtcdOption func(*EtcdAdapter)
+
+// WithIncludePrefixes only admits keys under one of the prefixes.
+func WithIncludePrefixes(prefixes ...string) EtcdOption {
+	return func(a *EtcdAdapter) {
+		a.include = append(a.include, prefixes...)
+	}
+}
+
+// WithExcludePrefixes drops keys under any of the prefixes; exclusion wins over inclusion.
+func WithExcludePrefixes(prefixes ...string) EtcdOption {
+	return func(a *EtcdAdapter) {
+		a.exclude = append(a.exclude, prefixes...)
+	}
+}
+
+// WithKeyRewrite rewrites admitted keys; the first matching rule applies.
+// Include/exclude rules always see the original etcd key.
+func WithKeyRewrite(from, to string) EtcdOption {
+	return func(a *EtcdAdapter) {
+		a.rewrites = append(a.rewrites, KeyRewrite{From: from, To: to})
+	}
+}
+
+// WithMaxValueSize rejects put events whose value is larger than n bytes.
+func WithMaxValueSize(n int) EtcdOption {
+	return func(a *EtcdAdapter) {
+		a.maxValueSize = n
+	}
+}
+
+// WithDeadLetterBuffer sets the capacity of the dead-letter channel (default 64).
+func WithDeadLetterBuffer(n int) EtcdOption {
+	return func(a *EtcdAdapter) {
+		a.deadLetters = make(chan DeadLetter, n)
+	}
+}
+
+// NewEtcdAdapter builds an adapter; without options every well-formed event passes.
+func NewEtcdAdapter(opts ...EtcdOption) *EtcdAdapter {
+	a := &EtcdAdapter{deadLetters: make(chan DeadLetter, 64)}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// DeadLetters returns the channel of rejected events. It is never closed.
+// When nobody drains it, further rejections are counted in Dropped instead of blocking ingestion.
+func (a *EtcdAdapter) DeadLetters() <-chan DeadLetter {
+	return a.deadLetters
+}
+
+// Dropped returns how many dead letters were discarded because the channel was full.
+func (a *EtcdAdapter) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// IsWatchableKey applies the include and exclude prefix rules to an etcd key.
+func (a *EtcdAdapter) IsWatchableKey(key string) bool {
+	for _, p := range a.exclude {
+		if strings.HasPrefix(key, p) {
+			return false
+		}
+	}
+	if len(a.include) == 0 {
+		return true
+	}
+	for _, p := range a.include {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// TranslateEtcdEvent validates kv and converts it into a cache event.
+// Revision and ModRev are both kv.ModRevision: etcd reports the revision of the
+// change itself there, for puts and deletes alike.
+func (a *EtcdAdapter) TranslateEtcdEvent(kv api.EtcdKV) (api.Event, error) {
+	if !a.IsWatchableKey(kv.Key) {
+		return api.Event{}, ErrNotWatchable
+	}
+	if err := a.validate(kv); err != nil {
+		a.reject(kv, err)
+		return api.Event{}, err
+	}
+	ev := api.Event{
+		Type:     kv.Type,
+		Key:      a.rewriteKey(kv.Key),
+		Revision: kv.ModRevision,
+		ModRev:   kv.ModRevision,
+	}
+	if kv.Type == api.EventPut {
+		ev.Value = kv.Value
+		ev.CreateRev, ev.Version, ev.Lease = kv.CreateRevision, kv.Version, kv.Lease
+	}
+	return ev, nil
+}
+
+func (a *EtcdAdapter) validate(kv api.EtcdKV) error {
+	switch {
+	case kv.Key == "":
+		return fmt.Errorf("%w: empty key", ErrMalformedEvent)
+	case kv.ModRevision <= 0:
+		return fmt.Errorf("%w: non-positive revision %d", ErrMalformedEvent, kv.ModRevision)
+	case kv.Type != api.EventPut && kv.Type != api.EventDelete:
+		return fmt.Errorf("%w: unsupported event type %v", ErrMalformedEvent, kv.Type)
+	case kv.Type == api.EventPut && a.maxValueSize > 0 && len(kv.Value) > a.maxValueSize:
+		return fmt.Errorf("%w: %d > %d bytes", ErrValueTooLarge, len(kv.Value), a.maxValueSize)
+	}
+	return nil
+}
+
+func (a *EtcdAdapter) rewriteKey(key string) string {
+	for _, r := range a.rewrites {
+		if strings.HasPrefix(key, r.From) {
+			return r.To + strings.TrimPrefix(key, r.From)
+		}
+	}
+	return key
+}
+
+func (a *EtcdAdapter) reject(kv api.EtcdKV, err error) {
+	select {
+	case a.deadLetters <- DeadLetter{KV: kv, Err: err}:
+	default:
+		a.dropped.Add(1)
+	}
+}
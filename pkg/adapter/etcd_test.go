@@ -0,0 +1,51 @@
+package adapter
+
+import (
+	"testing"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEtcdAdapter_FilterAndRewrite(t *testing.T) {
+	a := NewEtcdAdapter(
+		WithIncludePrefixes("/tenant-a/"),
+		WithExcludePrefixes("/tenant-a/secrets/"),
+		WithKeyRewrite("/tenant-a/", "/"),
+	)
+
+	assert.True(t, a.IsWatchableKey("/tenant-a/config"))
+	assert.False(t, a.IsWatchableKey("/tenant-a/secrets/db"))
+	assert.False(t, a.IsWatchableKey("/tenant-b/config"))
+
+	ev, err := a.TranslateEtcdEvent(api.EtcdKV{Type: api.EventPut, Key: "/tenant-a/config", Value: []byte("v"), ModRevision: 42, CreateRevision: 40})
+	require.NoError(t, err)
+	assert.Equal(t, api.Event{Type: api.EventPut, Key: "/config", Value: []byte("v"), Revision: 42, ModRev: 42, CreateRev: 40}, ev)
+
+	ev, err = a.TranslateEtcdEvent(api.EtcdKV{Type: api.EventDelete, Key: "/tenant-a/config", ModRevision: 43})
+	require.NoError(t, err)
+	assert.Equal(t, api.Event{Type: api.EventDelete, Key: "/config", Revision: 43, ModRev: 43}, ev)
+
+	_, err = a.TranslateEtcdEvent(api.EtcdKV{Type: api.EventPut, Key: "/tenant-b/config", ModRevision: 44})
+	assert.ErrorIs(t, err, ErrNotWatchable)
+	assert.Len(t, a.DeadLetters(), 0, "filtered keys are not dead letters")
+}
+
+func TestEtcdAdapter_DeadLetters(t *testing.T) {
+	a := NewEtcdAdapter(WithMaxValueSize(4), WithDeadLetterBuffer(2))
+
+	_, err := a.TranslateEtcdEvent(api.EtcdKV{Type: api.EventPut, Key: "/big", Value: []byte("too large"), ModRevision: 1})
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+	_, err = a.TranslateEtcdEvent(api.EtcdKV{Type: api.EventPut, Key: "/bad", Value: []byte("v"), ModRevision: 0})
+	assert.ErrorIs(t, err, ErrMalformedEvent)
+	_, err = a.TranslateEtcdEvent(api.EtcdKV{Type: api.EventPut, Key: "", ModRevision: 3})
+	assert.ErrorIs(t, err, ErrMalformedEvent)
+
+	dl := <-a.DeadLetters()
+	assert.Equal(t, "/big", dl.KV.Key)
+	assert.ErrorIs(t, dl.Err, ErrValueTooLarge)
+	dl = <-a.DeadLetters()
+	assert.Equal(t, "/bad", dl.KV.Key)
+	assert.Equal(t, int64(1), a.Dropped(), "a full dead-letter channel must not block ingestion")
+}
@@ -1 +1,432 @@
-package adapter
\ No newline at end of file
+package adapter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+)
+
+// DefaultK8sPrefix is the etcd prefix kube-apiserver stores objects under:
+// /registry/<resource>/<namespace>/<name>, or /registry/<resource>/<name> for
+// cluster-scoped resources.
+const DefaultK8sPrefix = "/registry/"
+
+// continueSnapshots is how many list snapshots are kept to serve continue tokens.
+const continueSnapshots = 16
+
+var (
+	// ErrTooLargeResourceVersion mirrors the apiserver's "Too large resource version"
+	// error: the cache has not caught up with the requested revision yet.
+	ErrTooLargeResourceVersion = errors.New("too large resource version")
+	// ErrResourceVersionExpired mirrors HTTP 410 Gone: the requested revision or
+	// continue token is older than the history the cache still holds.
+	ErrResourceVersionExpired = errors.New("resource version expired")
+	ErrInvalidContinue        = errors.New("invalid continue token")
+)
+
+// Watch event types as defined by k8s.io/apimachinery/pkg/watch.
+const (
+	WatchAdded    = "ADDED"
+	WatchModified = "MODIFIED"
+	WatchDeleted  = "DELETED"
+	WatchBookmark = "BOOKMARK"
+)
+
+// K8sAdapter serves Kubernetes list and watch semantics from a WatchCache that
+// mirrors kube-apiserver's etcd keyspace, with the EventLog providing watch history.
+type K8sAdapter struct {
+	cache            proxy.WatchCacheInterface
+	log              eventlog.EventLog
+	prefix           string
+	bookmarkInterval time.Duration
+	logger           *slog.Logger
+
+	mu        sync.Mutex
+	snapshots map[int64]api.SnapshotView // recent list snapshots by revision, for continue tokens
+	order     []int64
+
+	ctx    context.Context // parent of ServeWatch streams, cancelled by Close
+	cancel context.CancelFunc
+}
+
+var _ api.K8sAdapter = (*K8sAdapter)(nil)
+
+// K8sOption configures a K8sAdapter.
+type K8sOption func(*K8sAdapter)
+
+// WithK8sPrefix overrides the storage prefix, like kube-apiserver's --etcd-prefix.
+func WithK8sPrefix(prefix string) K8sOption {
+	return func(a *K8sAdapter) {
+		a.prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+}
+
+// WithK8sBookmarkInterval makes watch streams send BOOKMARK events every d.
+func WithK8sBookmarkInterval(d time.Duration) K8sOption {
+	return func(a *K8sAdapter) {
+		a.bookmarkInterval = d
+	}
+}
+
+// WithK8sLogger sets the logger for objects a watch stream has to skip (default slog.Default()).
+func WithK8sLogger(l *slog.Logger) K8sOption {
+	return func(a *K8sAdapter) {
+		a.logger = l
+	}
+}
+
+// NewK8sAdapter builds an adapter over cache and the EventLog the cache appends to.
+func NewK8sAdapter(cache proxy.WatchCacheInterface, log eventlog.EventLog, opts ...K8sOption) *K8sAdapter {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &K8sAdapter{
+		cache:     cache,
+		log:       log,
+		prefix:    DefaultK8sPrefix,
+		snapshots: make(map[int64]api.SnapshotView),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.logger = logging.Component(a.logger, "k8s-adapter")
+	return a
+}
+
+// Close ends every stream returned by ServeWatch.
+func (a *K8sAdapter) Close() {
+	a.cancel()
+}
+
+// storagePrefix returns the etcd prefix holding resource objects, optionally
+// restricted to one namespace.
+func (a *K8sAdapter) storagePrefix(resource, namespace string) string {
+	if namespace == "" {
+		return a.prefix + resource + "/"
+	}
+	return a.prefix + resource + "/" + namespace + "/"
+}
+
+type continueToken struct {
+	Revision int64  `json:"rv"`
+	Start    string `json:"start"` // last key returned by the previous page
+}
+
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+	Continue        string `json:"continue,omitempty"`
+}
+
+type listResponse struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   listMeta          `json:"metadata"`
+	Items      []json.RawMessage `json:"items"`
+}
+
+// ServeList returns a JSON list of the resource's objects in namespace ("" for all
+// namespaces or cluster-scoped resources). Supported opts are resourceVersion,
+// limit, continue and labelSelector, with apiserver semantics: resourceVersion ""
+// or "0" serves the latest cached state, any other value requires the cache to
+// have reached it. Every page of a continued list is served from the same snapshot.
+// Objects that cannot be decoded are left out and logged, as Watch does.
+func (a *K8sAdapter) ServeList(kind string, namespace string, opts map[string]string) ([]byte, error) {
+	sel, err := parseLabelSelector(opts["labelSelector"])
+	if err != nil {
+		return nil, err
+	}
+	limit := 0
+	if l := opts["limit"]; l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", l)
+		}
+	}
+
+	var view api.SnapshotView
+	start := ""
+	if tok := opts["continue"]; tok != "" {
+		ct, err := decodeContinue(tok)
+		if err != nil {
+			return nil, err
+		}
+		if view = a.snapshotAt(ct.Revision); view == nil {
+			return nil, ErrResourceVersionExpired
+		}
+		start = ct.Start
+	} else {
+		if err := a.checkResourceVersion(opts["resourceVersion"]); err != nil {
+			return nil, err
+		}
+		view = a.cache.Snapshot()
+	}
+
+	kvs, err := view.List(a.storagePrefix(kind, namespace))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+
+	resp := listResponse{
+		APIVersion: "v1",
+		Kind:       "List",
+		Metadata:   listMeta{ResourceVersion: strconv.FormatInt(view.Revision(), 10)},
+		Items:      []json.RawMessage{},
+	}
+	for i, kv := range kvs {
+		if kv.Key <= start {
+			continue
+		}
+		if limit > 0 && len(resp.Items) == limit {
+			resp.Metadata.Continue = encodeContinue(continueToken{Revision: view.Revision(), Start: kvs[i-1].Key})
+			a.rememberSnapshot(view)
+			break
+		}
+		obj, err := decodeObject(kv.Value)
+		if err != nil {
+			a.logger.Warn("skipping undecodable object in list", logging.Key(kv.Key), logging.Revision(kv.Revision), slog.Any("error", err))
+			continue
+		}
+		if !sel.matches(obj.Labels) {
+			continue
+		}
+		item, err := encodeObject(obj, strconv.FormatInt(kv.Revision, 10))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kv.Key, err)
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	return json.Marshal(resp)
+}
+
+// checkResourceVersion rejects a resourceVersion the cache has not reached yet.
+func (a *K8sAdapter) checkResourceVersion(rv string) error {
+	if rv == "" || rv == "0" {
+		return nil
+	}
+	n, err := strconv.ParseInt(rv, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid resourceVersion %q", rv)
+	}
+	if n > a.cache.Revision() {
+		return ErrTooLargeResourceVersion
+	}
+	return nil
+}
+
+// rememberSnapshot keeps view for the continue tokens issued at its revision.
+func (a *K8sAdapter) rememberSnapshot(view api.SnapshotView) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rev := view.Revision()
+	if _, ok := a.snapshots[rev]; ok {
+		return
+	}
+	a.snapshots[rev] = view
+	a.order = append(a.order, rev)
+	if len(a.order) > continueSnapshots {
+		delete(a.snapshots, a.order[0])
+		a.order = a.order[1:]
+	}
+}
+
+func (a *K8sAdapter) snapshotAt(rev int64) api.SnapshotView {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.snapshots[rev]
+}
+
+func encodeContinue(ct continueToken) string {
+	b, _ := json.Marshal(ct)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeContinue(tok string) (continueToken, error) {
+	var ct continueToken
+	b, err := base64.RawURLEncoding.DecodeString(tok)
+	if err != nil {
+		return ct, ErrInvalidContinue
+	}
+	if err := json.Unmarshal(b, &ct); err != nil {
+		return ct, ErrInvalidContinue
+	}
+	return ct, nil
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// ServeWatch streams JSON watch events for the resource until Close is called.
+// See Watch for the meaning of fromResourceVersion.
+func (a *K8sAdapter) ServeWatch(kind string, namespace string, fromResourceVersion string) (<-chan []byte, error) {
+	return a.Watch(a.ctx, kind, namespace, fromResourceVersion)
+}
+
+// Watch streams JSON watch events ({"type": ..., "object": ...}) until ctx is done.
+// With fromResourceVersion "" or "0" it first sends an ADDED event for every
+// existing object, as the apiserver does; otherwise it replays the EventLog from
+// the revision after fromResourceVersion, failing with ErrResourceVersionExpired
+// if that history has already been dropped. A replayed put is MODIFIED when the
+// object existed before it (per its etcd create revision) and ADDED otherwise.
+func (a *K8sAdapter) Watch(ctx context.Context, kind string, namespace string, fromResourceVersion string) (<-chan []byte, error) {
+	prefix := a.storagePrefix(kind, namespace)
+	view := a.cache.Snapshot()
+	kvs, err := view.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// last holds the latest value of every object the stream has announced,
+	// to tell ADDED from MODIFIED and to fill the object of DELETED events.
+	last := make(map[string][]byte, len(kvs))
+	var initial [][]byte
+	var startRev int64
+	if fromResourceVersion == "" || fromResourceVersion == "0" {
+		sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+		for _, kv := range kvs {
+			b, err := a.encodeEvent(WatchAdded, kv.Key, kv.Value, kv.Revision)
+			if err != nil {
+				return nil, err
+			}
+			initial = append(initial, b)
+			last[kv.Key] = kv.Value
+		}
+		startRev = view.Revision() + 1
+	} else {
+		rv, err := strconv.ParseInt(fromResourceVersion, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resourceVersion %q", fromResourceVersion)
+		}
+		if rv > view.Revision() {
+			return nil, ErrTooLargeResourceVersion
+		}
+		if oldest := eventlog.BoundsOf(a.log).Oldest; rv < view.Revision() && (oldest == 0 || oldest > rv+1) {
+			return nil, ErrResourceVersionExpired
+		}
+		// Objects untouched since rv certainly existed at rv; whether a newer one
+		// did is told by the create revision of its first replayed put.
+		for _, kv := range kvs {
+			if kv.Revision <= rv {
+				last[kv.Key] = kv.Value
+			}
+		}
+		startRev = rv + 1
+	}
+
+	revs, err := a.cache.WatchWithBookmarks(ctx, startRev, a.bookmarkInterval)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		send := func(b []byte) bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case out <- b:
+				return true
+			}
+		}
+		for _, b := range initial {
+			if !send(b) {
+				return
+			}
+		}
+		for evs := range revs {
+			for _, ev := range evs {
+				var b []byte
+				var err error
+				switch {
+				case ev.Type == api.EventBookmark:
+					b, err = json.Marshal(watchEvent{
+						Type:   WatchBookmark,
+						Object: json.RawMessage(fmt.Sprintf(`{"metadata":{"resourceVersion":"%d"}}`, ev.Revision)),
+					})
+				case !strings.HasPrefix(ev.Key, prefix):
+					continue
+				case ev.Type == api.EventPut:
+					typ := WatchAdded
+					if _, ok := last[ev.Key]; ok || ev.CreateRev > 0 && ev.CreateRev < ev.ModRev {
+						typ = WatchModified
+					}
+					last[ev.Key] = ev.Value
+					b, err = a.encodeEvent(typ, ev.Key, ev.Value, ev.Revision)
+				case ev.Type == api.EventDelete:
+					prev, ok := last[ev.Key]
+					delete(last, ev.Key)
+					if !ok {
+						prev = a.placeholderObject(ev.Key)
+					}
+					b, err = a.encodeEvent(WatchDeleted, ev.Key, prev, ev.Revision)
+				default:
+					continue
+				}
+				if err != nil {
+					// An undecodable object must not stall the stream for every other key.
+					a.logger.Warn("skipping undecodable object in watch", logging.Key(ev.Key), logging.Revision(ev.Revision), slog.Any("error", err))
+					continue
+				}
+				if !send(b) {
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (a *K8sAdapter) encodeEvent(typ, key string, value []byte, rev int64) ([]byte, error) {
+	obj, err := decodeObject(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	b, err := encodeObject(obj, strconv.FormatInt(rev, 10))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return json.Marshal(watchEvent{Type: typ, Object: b})
+}
+
+// placeholderObject builds a minimal JSON object from the storage key, used when
+// a deleted object was never seen by the stream.
+func (a *K8sAdapter) placeholderObject(key string) []byte {
+	parts := strings.Split(strings.TrimPrefix(key, a.prefix), "/")
+	meta := objectMeta{Name: parts[len(parts)-1]}
+	if len(parts) == 3 {
+		meta.Namespace = parts[1]
+	}
+	b, _ := json.Marshal(struct {
+		Metadata objectMeta `json:"metadata"`
+	}{meta})
+	return b
+}
+
+// Encode renders an *Object as JSON the way the apiserver returns it; any other
+// value is marshalled with encoding/json.
+func (a *K8sAdapter) Encode(obj interface{}) ([]byte, error) {
+	if o, ok := obj.(*Object); ok {
+		return encodeObject(o, o.ResourceVersion)
+	}
+	return json.Marshal(obj)
+}
+
+// Decode parses a JSON or protobuf encoded object as stored by kube-apiserver
+// and returns it as an *Object.
+func (a *K8sAdapter) Decode(data []byte) (interface{}, error) {
+	return decodeObject(data)
+}
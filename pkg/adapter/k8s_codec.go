@@ -0,0 +1,217 @@
+package adapter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Content types of objects stored by kube-apiserver.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/vnd.kubernetes.protobuf"
+)
+
+// protobufMagic prefixes every protobuf-encoded object kube-apiserver writes to etcd.
+var protobufMagic = []byte("k8s\x00")
+
+var ErrUnknownEncoding = errors.New("value is neither JSON nor Kubernetes protobuf")
+
+// Object is the decoded form of a Kubernetes object stored in etcd.
+// Only the type and object metadata are interpreted; the body is kept in Raw
+// so the adapter works for every resource without generated Go types.
+type Object struct {
+	APIVersion      string
+	Kind            string
+	Name            string
+	Namespace       string
+	ResourceVersion string
+	Labels          map[string]string
+	ContentType     string // ContentTypeJSON or ContentTypeProtobuf
+	Raw             []byte // the value as stored in etcd
+}
+
+// objectMeta mirrors the fields of metav1.ObjectMeta the adapter needs.
+type objectMeta struct {
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// decodeObject detects the storage encoding of data and extracts its metadata.
+func decodeObject(data []byte) (*Object, error) {
+	if bytes.HasPrefix(data, protobufMagic) {
+		return decodeProtobuf(data)
+	}
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return decodeJSON(data)
+	}
+	return nil, ErrUnknownEncoding
+}
+
+func decodeJSON(data []byte) (*Object, error) {
+	var head struct {
+		APIVersion string     `json:"apiVersion"`
+		Kind       string     `json:"kind"`
+		Metadata   objectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("decode JSON object: %w", err)
+	}
+	return &Object{
+		APIVersion:      head.APIVersion,
+		Kind:            head.Kind,
+		Name:            head.Metadata.Name,
+		Namespace:       head.Metadata.Namespace,
+		ResourceVersion: head.Metadata.ResourceVersion,
+		Labels:          head.Metadata.Labels,
+		ContentType:     ContentTypeJSON,
+		Raw:             data,
+	}, nil
+}
+
+// decodeProtobuf parses the runtime.Unknown envelope
+//
+//	message Unknown { TypeMeta typeMeta = 1; bytes raw = 2; string contentEncoding = 3; string contentType = 4; }
+//	message TypeMeta { string apiVersion = 1; string kind = 2; }
+//
+// and the ObjectMeta found in field 1 of every top-level Kubernetes object.
+func decodeProtobuf(data []byte) (*Object, error) {
+	obj := &Object{ContentType: ContentTypeProtobuf, Raw: data}
+	var raw []byte
+	err := walkFields(data[len(protobufMagic):], func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			return walkFields(v, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					obj.APIVersion = string(v)
+				case 2:
+					obj.Kind = string(v)
+				}
+				return nil
+			})
+		case 2:
+			raw = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode protobuf envelope: %w", err)
+	}
+	err = walkFields(raw, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		return walkFields(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				obj.Name = string(v)
+			case 3:
+				obj.Namespace = string(v)
+			case 6:
+				obj.ResourceVersion = string(v)
+			case 11:
+				var key, val string
+				if err := walkFields(v, func(num protowire.Number, v []byte) error {
+					if num == 1 {
+						key = string(v)
+					} else if num == 2 {
+						val = string(v)
+					}
+					return nil
+				}); err != nil {
+					return err
+				}
+				if obj.Labels == nil {
+					obj.Labels = make(map[string]string)
+				}
+				obj.Labels[key] = val
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode protobuf object metadata: %w", err)
+	}
+	return obj, nil
+}
+
+// walkFields calls fn for every length-delimited field of a protobuf message
+// and skips all other wire types.
+func walkFields(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// encodeObject renders obj as JSON with metadata.resourceVersion set to rv, the
+// way kube-apiserver fills it in from the etcd ModRevision on every read.
+// Protobuf objects cannot be converted without their Go types, so they are
+// rendered with their metadata and the stored bytes in a "protobuf" field.
+func encodeObject(obj *Object, rv string) ([]byte, error) {
+	if obj.ContentType == ContentTypeJSON {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(obj.Raw, &fields); err != nil {
+			return nil, err
+		}
+		var meta map[string]interface{}
+		if m, ok := fields["metadata"]; ok {
+			if err := json.Unmarshal(m, &meta); err != nil {
+				return nil, err
+			}
+		}
+		if meta == nil {
+			meta = make(map[string]interface{})
+		}
+		meta["resourceVersion"] = rv
+		m, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		fields["metadata"] = m
+		return json.Marshal(fields)
+	}
+	return json.Marshal(struct {
+		APIVersion string     `json:"apiVersion,omitempty"`
+		Kind       string     `json:"kind,omitempty"`
+		Metadata   objectMeta `json:"metadata"`
+		Protobuf   []byte     `json:"protobuf"`
+	}{
+		APIVersion: obj.APIVersion,
+		Kind:       obj.Kind,
+		Metadata: objectMeta{
+			Name:            obj.Name,
+			Namespace:       obj.Namespace,
+			ResourceVersion: rv,
+			Labels:          obj.Labels,
+		},
+		Protobuf: obj.Raw,
+	})
+}
@@ -0,0 +1,135 @@
+package adapter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// labelSelector is a parsed Kubernetes label selector, e.g.
+// "app=web,tier!=db,env in (prod,staging),!canary".
+type labelSelector []labelRequirement
+
+type labelOp int
+
+const (
+	opEquals labelOp = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opDoesNotExist
+)
+
+type labelRequirement struct {
+	key    string
+	op     labelOp
+	values []string
+}
+
+// parseLabelSelector supports the equality- and set-based selector syntax of
+// kubectl -l. An empty string selects everything.
+func parseLabelSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	for _, term := range splitSelector(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		req, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// splitSelector splits on commas that are not inside a (...) value set.
+func splitSelector(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func parseRequirement(term string) (labelRequirement, error) {
+	if strings.HasPrefix(term, "!") {
+		return labelRequirement{key: strings.TrimSpace(term[1:]), op: opDoesNotExist}, nil
+	}
+	if i := strings.Index(term, "!="); i >= 0 {
+		return labelRequirement{key: strings.TrimSpace(term[:i]), op: opNotEquals, values: []string{strings.TrimSpace(term[i+2:])}}, nil
+	}
+	if i := strings.Index(term, "=="); i >= 0 {
+		return labelRequirement{key: strings.TrimSpace(term[:i]), op: opEquals, values: []string{strings.TrimSpace(term[i+2:])}}, nil
+	}
+	if i := strings.Index(term, "="); i >= 0 {
+		return labelRequirement{key: strings.TrimSpace(term[:i]), op: opEquals, values: []string{strings.TrimSpace(term[i+1:])}}, nil
+	}
+	fields := strings.Fields(term)
+	if len(fields) == 1 {
+		return labelRequirement{key: fields[0], op: opExists}, nil
+	}
+	if len(fields) >= 3 && (fields[1] == "in" || fields[1] == "notin") {
+		set := strings.TrimSpace(strings.Join(fields[2:], " "))
+		if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+			return labelRequirement{}, fmt.Errorf("invalid label selector %q: value set must be parenthesized", term)
+		}
+		var values []string
+		for _, v := range strings.Split(set[1:len(set)-1], ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+		op := opIn
+		if fields[1] == "notin" {
+			op = opNotIn
+		}
+		return labelRequirement{key: fields[0], op: op, values: values}, nil
+	}
+	return labelRequirement{}, fmt.Errorf("invalid label selector %q", term)
+}
+
+// matches reports whether labels satisfy every requirement.
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		val, ok := labels[req.key]
+		switch req.op {
+		case opEquals, opIn:
+			if !ok || !contains(req.values, val) {
+				return false
+			}
+		case opNotEquals, opNotIn:
+			if ok && contains(req.values, val) {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opDoesNotExist:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package adapter
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func podJSON(ns, name, app string) []byte {
+	return []byte(fmt.Sprintf(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":%q,"namespace":%q,"labels":{"app":%q}},"spec":{"nodeName":"node-1"}}`, name, ns, app))
+}
+
+// podProtobuf builds a value the way kube-apiserver stores a v1.Pod in protobuf.
+func podProtobuf(ns, name, app string) []byte {
+	var label []byte
+	label = protowire.AppendTag(label, 1, protowire.BytesType)
+	label = protowire.AppendString(label, "app")
+	label = protowire.AppendTag(label, 2, protowire.BytesType)
+	label = protowire.AppendString(label, app)
+
+	var meta []byte
+	meta = protowire.AppendTag(meta, 1, protowire.BytesType)
+	meta = protowire.AppendString(meta, name)
+	meta = protowire.AppendTag(meta, 3, protowire.BytesType)
+	meta = protowire.AppendString(meta, ns)
+	meta = protowire.AppendTag(meta, 7, protowire.VarintType) // generation, skipped by the decoder
+	meta = protowire.AppendVarint(meta, 3)
+	meta = protowire.AppendTag(meta, 11, protowire.BytesType)
+	meta = protowire.AppendBytes(meta, label)
+
+	var pod []byte
+	pod = protowire.AppendTag(pod, 1, protowire.BytesType)
+	pod = protowire.AppendBytes(pod, meta)
+
+	var typeMeta []byte
+	typeMeta = protowire.AppendTag(typeMeta, 1, protowire.BytesType)
+	typeMeta = protowire.AppendString(typeMeta, "v1")
+	typeMeta = protowire.AppendTag(typeMeta, 2, protowire.BytesType)
+	typeMeta = protowire.AppendString(typeMeta, "Pod")
+
+	out := append([]byte(nil), protobufMagic...)
+	out = protowire.AppendTag(out, 1, protowire.BytesType)
+	out = protowire.AppendBytes(out, typeMeta)
+	out = protowire.AppendTag(out, 2, protowire.BytesType)
+	out = protowire.AppendBytes(out, pod)
+	return out
+}
+
+func newFixtureCache(t *testing.T) (*proxy.WatchCache, eventlog.EventLog) {
+	log := eventlog.NewMemoryEventLog(100)
+	wc := proxy.NewWatchCacheWithLog(nil, log)
+	fixtures := []struct {
+		key   string
+		value []byte
+	}{
+		{"/registry/pods/default/web-1", podJSON("default", "web-1", "web")},
+		{"/registry/pods/default/web-2", podJSON("default", "web-2", "web")},
+		{"/registry/pods/default/db-1", podProtobuf("default", "db-1", "db")},
+		{"/registry/pods/kube-system/dns-1", podJSON("kube-system", "dns-1", "dns")},
+		{"/registry/services/default/web", []byte(`{"apiVersion":"v1","kind":"Service","metadata":{"name":"web","namespace":"default"}}`)},
+	}
+	for i, f := range fixtures {
+		require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: f.key, Value: f.value, Revision: int64(i + 1), ModRev: int64(i + 1)}))
+	}
+	return wc, log
+}
+
+type listResult struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+		Continue        string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name            string `json:"name"`
+			Namespace       string `json:"namespace"`
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Protobuf []byte `json:"protobuf"`
+	} `json:"items"`
+}
+
+func serveList(t *testing.T, a *K8sAdapter, ns string, opts map[string]string) listResult {
+	t.Helper()
+	b, err := a.ServeList("pods", ns, opts)
+	require.NoError(t, err)
+	var res listResult
+	require.NoError(t, json.Unmarshal(b, &res))
+	return res
+}
+
+func TestK8sAdapter_ListDecodesJSONAndProtobuf(t *testing.T) {
+	wc, log := newFixtureCache(t)
+	a := NewK8sAdapter(wc, log)
+	defer a.Close()
+
+	res := serveList(t, a, "default", nil)
+	assert.Equal(t, "5", res.Metadata.ResourceVersion)
+	require.Len(t, res.Items, 3)
+	assert.Equal(t, "db-1", res.Items[0].Metadata.Name)
+	assert.Equal(t, "3", res.Items[0].Metadata.ResourceVersion)
+	assert.Equal(t, podProtobuf("default", "db-1", "db"), res.Items[0].Protobuf)
+	assert.Equal(t, "web-1", res.Items[1].Metadata.Name)
+	assert.Equal(t, "1", res.Items[1].Metadata.ResourceVersion)
+
+	all := serveList(t, a, "", nil)
+	assert.Len(t, all.Items, 4, "empty namespace lists pods of every namespace")
+}
+
+func TestK8sAdapter_ListLabelSelectorAndPaging(t *testing.T) {
+	wc, log := newFixtureCache(t)
+	a := NewK8sAdapter(wc, log)
+	defer a.Close()
+
+	res := serveList(t, a, "", map[string]string{"labelSelector": "app in (web,db),app!=db"})
+	require.Len(t, res.Items, 2)
+	assert.Equal(t, "web-1", res.Items[0].Metadata.Name)
+
+	page1 := serveList(t, a, "", map[string]string{"limit": "2"})
+	require.Len(t, page1.Items, 2)
+	require.NotEmpty(t, page1.Metadata.Continue)
+
+	// Writes between pages must not leak into the continued list.
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "/registry/pods/default/zz-new", Value: podJSON("default", "zz-new", "web"), Revision: 6}))
+
+	page2 := serveList(t, a, "", map[string]string{"limit": "2", "continue": page1.Metadata.Continue})
+	require.Len(t, page2.Items, 2)
+	assert.Equal(t, "5", page2.Metadata.ResourceVersion)
+	assert.Equal(t, "dns-1", page2.Items[1].Metadata.Name)
+	assert.Empty(t, page2.Metadata.Continue)
+
+	_, err := a.ServeList("pods", "", map[string]string{"resourceVersion": "100"})
+	assert.ErrorIs(t, err, ErrTooLargeResourceVersion)
+}
+
+func nextWatchEvent(t *testing.T, ch <-chan []byte) (string, string, string) {
+	t.Helper()
+	select {
+	case b := <-ch:
+		var ev struct {
+			Type   string `json:"type"`
+			Object struct {
+				Metadata struct {
+					Name            string `json:"name"`
+					ResourceVersion string `json:"resourceVersion"`
+				} `json:"metadata"`
+			} `json:"object"`
+		}
+		require.NoError(t, json.Unmarshal(b, &ev))
+		return ev.Type, ev.Object.Metadata.Name, ev.Object.Metadata.ResourceVersion
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch event")
+		return "", "", ""
+	}
+}
+
+func TestK8sAdapter_WatchEventTypes(t *testing.T) {
+	wc, log := newFixtureCache(t)
+	a := NewK8sAdapter(wc, log, WithK8sBookmarkInterval(50*time.Millisecond))
+	defer a.Close()
+
+	ch, err := a.ServeWatch("pods", "default", "5")
+	require.NoError(t, err)
+
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "/registry/pods/default/web-3", Value: podJSON("default", "web-3", "web"), Revision: 6}))
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "/registry/pods/default/web-1", Value: podJSON("default", "web-1", "web"), Revision: 7}))
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "/registry/pods/kube-system/dns-2", Value: podJSON("kube-system", "dns-2", "dns"), Revision: 8}))
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventDelete, Key: "/registry/pods/default/db-1", Revision: 9}))
+	wc.Progress(9)
+
+	typ, name, rv := nextWatchEvent(t, ch)
+	assert.Equal(t, []string{WatchAdded, "web-3", "6"}, []string{typ, name, rv})
+	typ, name, rv = nextWatchEvent(t, ch)
+	assert.Equal(t, []string{WatchModified, "web-1", "7"}, []string{typ, name, rv})
+	typ, name, rv = nextWatchEvent(t, ch)
+	assert.Equal(t, []string{WatchDeleted, "db-1", "9"}, []string{typ, name, rv})
+	// Revision 9 is complete, so the bookmark reaches it.
+	typ, _, rv = nextWatchEvent(t, ch)
+	assert.Equal(t, []string{WatchBookmark, "9"}, []string{typ, rv})
+}
+
+func TestK8sAdapter_ResumedWatchReportsModifiedObjects(t *testing.T) {
+	wc, log := newFixtureCache(t)
+	a := NewK8sAdapter(wc, log)
+	defer a.Close()
+
+	// Both writes come after the resourceVersion the watch resumes from.
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "/registry/pods/default/web-1", Value: podJSON("default", "web-1", "web"), Revision: 6, ModRev: 6, CreateRev: 1}))
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "/registry/pods/default/web-4", Value: podJSON("default", "web-4", "web"), Revision: 7, ModRev: 7, CreateRev: 7}))
+	wc.Progress(7)
+
+	ch, err := a.ServeWatch("pods", "default", "5")
+	require.NoError(t, err)
+	typ, name, _ := nextWatchEvent(t, ch)
+	assert.Equal(t, []string{WatchModified, "web-1"}, []string{typ, name})
+	typ, name, _ = nextWatchEvent(t, ch)
+	assert.Equal(t, []string{WatchAdded, "web-4"}, []string{typ, name})
+}
+
+func TestK8sAdapter_ListSkipsUndecodableObjects(t *testing.T) {
+	wc, log := newFixtureCache(t)
+	a := NewK8sAdapter(wc, log)
+	defer a.Close()
+	require.NoError(t, wc.AddEvent(api.Event{Type: api.EventPut, Key: "/registry/pods/default/broken", Value: []byte("not an object"), Revision: 6}))
+
+	res := serveList(t, a, "default", nil)
+	assert.Len(t, res.Items, 3)
+	assert.Empty(t, a.snapshots, "a list without a continue token keeps no snapshot")
+
+	page := serveList(t, a, "default", map[string]string{"limit": "1"})
+	require.NotEmpty(t, page.Metadata.Continue)
+	assert.Len(t, a.snapshots, 1)
+}
+
+func TestK8sAdapter_WatchFromZeroSendsInitialState(t *testing.T) {
+	wc, log := newFixtureCache(t)
+	a := NewK8sAdapter(wc, log)
+	defer a.Close()
+
+	ch, err := a.ServeWatch("pods", "kube-system", "0")
+	require.NoError(t, err)
+	typ, name, rv := nextWatchEvent(t, ch)
+	assert.Equal(t, []string{WatchAdded, "dns-1", "4"}, []string{typ, name, rv})
+
+	_, err = a.ServeWatch("pods", "", "100")
+	assert.ErrorIs(t, err, ErrTooLargeResourceVersion)
+}
@@ -0,0 +1,17 @@
+/*
+Package admin serves the operational HTTP endpoints of a cache proxy.
+
+- /healthz: the process is up.
+- /readyz: the initial list from etcd has been applied (MarkSynced) and the
+  cache revision is within the configured lag of etcd's.
+- /debug: revision, key count, EventLog bounds and sessions with their
+  subscriptions and lag, as JSON.
+- /debug/key?key=K: the StoreObj of one key.
+- /debug/hash?key=K&end=E&rev=R: the proxy.RangeHash of a key range, which
+  verify.Bisect compares between two proxies.
+- /metrics: mounted when WithMetricsHandler is given.
+
+Everything is read from the in-process components, so the server can be
+tested without an etcd connection.
+*/
+package admin
@@ -0,0 +1,331 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+)
+
+// shutdownTimeout bounds how long Serve waits for in-flight requests once ctx is done.
+const shutdownTimeout = 5 * time.Second
+
+// Server is the admin HTTP server of one WatchCache.
+type Server struct {
+	cache    *proxy.WatchCache
+	log      eventlog.EventLog
+	lib      api.ClientLibrary
+	upstream func() int64
+	maxLag   atomic.Int64
+	metrics  http.Handler
+
+	synced atomic.Bool
+	mux    *http.ServeMux
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithEventLog reports the bounds of log under /debug.
+func WithEventLog(log eventlog.EventLog) Option {
+	return func(s *Server) {
+		s.log = log
+	}
+}
+
+// WithClientLibrary reports the sessions of lib under /debug.
+func WithClientLibrary(lib api.ClientLibrary) Option {
+	return func(s *Server) {
+		s.lib = lib
+	}
+}
+
+// WithUpstreamRevision tells the server etcd's latest revision, e.g.
+// metrics.Prometheus.UpstreamRevision fed by watcher.WithWatchMetrics.
+// It returns 0 while the revision is unknown.
+func WithUpstreamRevision(fn func() int64) Option {
+	return func(s *Server) {
+		s.upstream = fn
+	}
+}
+
+// WithMaxRevisionLag makes /readyz fail while the cache is more than n revisions
+// behind the upstream revision. 0, the default, does not check the lag.
+func WithMaxRevisionLag(n int64) Option {
+	return func(s *Server) {
+		s.maxLag.Store(n)
+	}
+}
+
+// WithMetricsHandler serves h on /metrics, e.g. metrics.Prometheus.Handler.
+func WithMetricsHandler(h http.Handler) Option {
+	return func(s *Server) {
+		s.metrics = h
+	}
+}
+
+// NewServer creates the admin server of cache. It reports not ready until MarkSynced.
+func NewServer(cache *proxy.WatchCache, opts ...Option) *Server {
+	s := &Server{cache: cache, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("GET /healthz", s.healthz)
+	s.mux.HandleFunc("GET /readyz", s.readyz)
+	s.mux.HandleFunc("GET /debug", s.debug)
+	s.mux.HandleFunc("GET /debug/key", s.debugKey)
+	s.mux.HandleFunc("GET /debug/hash", s.debugHash)
+	if s.metrics != nil {
+		s.mux.Handle("GET /metrics", s.metrics)
+	}
+	return s
+}
+
+// MarkSynced records that the initial list from etcd has been applied.
+func (s *Server) MarkSynced() {
+	s.synced.Store(true)
+}
+
+// SetMaxRevisionLag changes the lag /readyz tolerates, see WithMaxRevisionLag.
+func (s *Server) SetMaxRevisionLag(n int64) {
+	s.maxLag.Store(n)
+}
+
+// Handler returns the handler serving every endpoint.
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Serve serves on ln until ctx is done, then shuts down gracefully.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	return ServeHandler(ctx, ln, s.mux)
+}
+
+// ServeHandler serves h on ln until ctx is done, then shuts down gracefully.
+// It is Serve for handlers other than the admin endpoints, such as /metrics.
+func ServeHandler(ctx context.Context, ln net.Listener, h http.Handler) error {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ListenAndServe listens on addr and calls Serve.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) readyz(w http.ResponseWriter, _ *http.Request) {
+	if err := s.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// ready returns why the cache cannot serve yet, or nil.
+func (s *Server) ready() error {
+	if !s.synced.Load() {
+		return errors.New("initial list not synced")
+	}
+	maxLag := s.maxLag.Load()
+	if lag, known := s.lag(); known && maxLag > 0 && lag > maxLag {
+		return fmt.Errorf("revision lag %d exceeds %d", lag, maxLag)
+	}
+	return nil
+}
+
+// lag returns how far the cache is behind etcd, and false while etcd's revision is unknown.
+func (s *Server) lag() (int64, bool) {
+	if s.upstream == nil {
+		return 0, false
+	}
+	up := s.upstream()
+	if up <= 0 {
+		return 0, false
+	}
+	return max(up-s.cache.Revision(), 0), true
+}
+
+// DebugInfo is the body of /debug.
+type DebugInfo struct {
+	Ready            bool          `json:"ready"`
+	NotReadyReason   string        `json:"notReadyReason,omitempty"`
+	Revision         int64         `json:"revision"`
+	UpstreamRevision int64         `json:"upstreamRevision,omitempty"`
+	RevisionLag      int64         `json:"revisionLag,omitempty"`
+	Keys             int           `json:"keys"`
+	Bytes            int64         `json:"bytes"`
+	Hits             uint64        `json:"hits"`
+	Misses           uint64        `json:"misses"`
+	EventLog         *EventLogInfo `json:"eventLog,omitempty"`
+	Sessions         []SessionInfo `json:"sessions,omitempty"`
+}
+
+// SessionInfo is one ClientLibrary session in DebugInfo.
+type SessionInfo struct {
+	ID            string             `json:"id"`
+	ClientID      string             `json:"clientID"`
+	Attached      bool               `json:"attached"`
+	Delivered     int64              `json:"delivered"`
+	Acked         int64              `json:"acked"`
+	Lag           int64              `json:"lag"`
+	LastActive    time.Time          `json:"lastActive"`
+	Subscriptions []SubscriptionInfo `json:"subscriptions"`
+}
+
+// SubscriptionInfo is one watch of a session. Lag counts the EventLog events
+// after the last revision delivered on it, 0 once its watch has caught up.
+type SubscriptionInfo struct {
+	Key      string `json:"key"`
+	Prefix   bool   `json:"prefix"`
+	Revision int64  `json:"revision"`
+	Lag      int64  `json:"lag"`
+}
+
+// EventLogInfo is the EventLog part of DebugInfo.
+type EventLogInfo struct {
+	Length            int   `json:"length"`
+	OldestRevision    int64 `json:"oldestRevision"`
+	LatestRevision    int64 `json:"latestRevision"`
+	CompactedRevision int64 `json:"compactedRevision"`
+}
+
+func (s *Server) debug(w http.ResponseWriter, _ *http.Request) {
+	st := s.cache.Stats()
+	info := DebugInfo{
+		Ready:    true,
+		Revision: st.Revision,
+		Keys:     st.Keys,
+		Bytes:    st.Bytes,
+		Hits:     st.Hits,
+		Misses:   st.Misses,
+	}
+	if err := s.ready(); err != nil {
+		info.Ready, info.NotReadyReason = false, err.Error()
+	}
+	if s.upstream != nil {
+		info.UpstreamRevision = s.upstream()
+		info.RevisionLag, _ = s.lag()
+	}
+	if s.log != nil {
+		b := eventlog.BoundsOf(s.log)
+		info.EventLog = &EventLogInfo{Length: b.Len, OldestRevision: b.Oldest, LatestRevision: b.Latest, CompactedRevision: b.Compacted}
+	}
+	if s.lib != nil {
+		info.Sessions = sessionInfos(s.lib.Cursors(), s.log)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// sessionInfos converts cursors; the lag of a subscription is counted in log,
+// if there is one.
+func sessionInfos(cursors []api.SessionCursor, log eventlog.EventLog) []SessionInfo {
+	out := make([]SessionInfo, 0, len(cursors))
+	for _, c := range cursors {
+		info := SessionInfo{
+			ID:            c.SessionID,
+			ClientID:      c.ClientID,
+			Attached:      c.Attached,
+			Delivered:     c.Delivered,
+			Acked:         c.Acked,
+			Lag:           c.Lag,
+			LastActive:    c.LastActive,
+			Subscriptions: make([]SubscriptionInfo, 0, len(c.Subscriptions)),
+		}
+		for _, sub := range c.Subscriptions {
+			si := SubscriptionInfo{Key: sub.Key, Prefix: sub.Prefix, Revision: sub.Revision}
+			if log != nil {
+				si.Lag = int64(eventlog.CountSince(log, sub.Revision+1))
+			}
+			info.Subscriptions = append(info.Subscriptions, si)
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+// KeyInfo is the body of /debug/key. Value is base64 encoded.
+type KeyInfo struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	Revision    int64  `json:"revision"`
+	ModRevision int64  `json:"modRevision"`
+}
+
+func (s *Server) debugKey(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "missing key parameter", http.StatusBadRequest)
+		return
+	}
+	obj, ok := s.cache.Get(key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("key %q not found", key), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyInfo{Key: obj.Key, Value: obj.Value, Revision: obj.Revision, ModRevision: obj.ModRev})
+}
+
+// debugHash serves WatchCache.Hash: key and end select the etcd key range, rev
+// the revision (0 or absent for the cache revision). It answers 409 Conflict
+// when the cache cannot hash the range at rev.
+func (s *Server) debugHash(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var rev int64
+	if v := q.Get("rev"); v != "" {
+		var err error
+		if rev, err = strconv.ParseInt(v, 10, 64); err != nil || rev < 0 {
+			http.Error(w, fmt.Sprintf("invalid rev %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	h, err := s.cache.Hash(q.Get("key"), q.Get("end"), rev)
+	switch {
+	case errors.Is(err, proxy.ErrInvalidRevision), errors.Is(err, proxy.ErrRangeChanged), errors.Is(err, proxy.ErrHistoryUnavailable):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
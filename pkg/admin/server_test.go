@@ -0,0 +1,164 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/clientlibrary"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, h http.Handler, target string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	cache := proxy.NewWatchCache(nil)
+	var upstream int64
+	s := NewServer(cache, WithUpstreamRevision(func() int64 { return upstream }), WithMaxRevisionLag(2))
+	h := s.Handler()
+
+	code, _ := get(t, h, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := get(t, h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "not synced")
+
+	s.MarkSynced()
+	code, _ = get(t, h, "/readyz")
+	assert.Equal(t, http.StatusOK, code, "an unknown upstream revision does not block readiness")
+
+	upstream = 5
+	code, body = get(t, h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "revision lag 5 exceeds 2")
+
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "k", Value: []byte("v"), Revision: 3}))
+	code, _ = get(t, h, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+
+	s.SetMaxRevisionLag(1)
+	code, body = get(t, h, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "revision lag 2 exceeds 1")
+}
+
+func TestDebug(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cache := proxy.NewWatchCacheWithLog(nil, log)
+	lib := clientlibrary.NewClientLibrary(cache, log)
+	defer lib.Close()
+	s := NewServer(cache, WithEventLog(log), WithClientLibrary(lib), WithUpstreamRevision(func() int64 { return 4 }))
+	s.MarkSynced()
+
+	sess, err := lib.NewSession("client-a")
+	require.NoError(t, err)
+	defer sess.Stop()
+	events, err := sess.WatchPrefix("/app/", 3)
+	require.NoError(t, err)
+	go func() {
+		for range events {
+		}
+	}()
+	for rev := int64(1); rev <= 3; rev++ {
+		require.NoError(t, lib.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "/other", Value: []byte("v"), Revision: rev}))
+	}
+	log.Compact(1)
+	// The watch passes revision 3, which has no change under /app/.
+	require.Eventually(t, func() bool { return sess.Subscriptions()[0].Revision == 3 }, time.Second, time.Millisecond)
+
+	code, body := get(t, s.Handler(), "/debug")
+	require.Equal(t, http.StatusOK, code)
+	var info DebugInfo
+	require.NoError(t, json.Unmarshal([]byte(body), &info))
+	assert.True(t, info.Ready)
+	assert.Equal(t, int64(3), info.Revision)
+	assert.Equal(t, int64(4), info.UpstreamRevision)
+	assert.Equal(t, int64(1), info.RevisionLag)
+	assert.Equal(t, 1, info.Keys)
+	assert.Equal(t, &EventLogInfo{Length: 2, OldestRevision: 2, LatestRevision: 3, CompactedRevision: 1}, info.EventLog)
+	require.Len(t, info.Sessions, 1)
+	assert.Equal(t, sess.ID(), info.Sessions[0].ID)
+	assert.Equal(t, "client-a", info.Sessions[0].ClientID)
+	assert.Equal(t, []SubscriptionInfo{{Key: "/app/", Prefix: true, Revision: 3, Lag: 0}}, info.Sessions[0].Subscriptions)
+}
+
+func TestDebugKey(t *testing.T) {
+	cache := proxy.NewWatchCache(nil)
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "/a b", Value: []byte("v"), Revision: 7, ModRev: 7}))
+	h := NewServer(cache).Handler()
+
+	code, body := get(t, h, "/debug/key?key=%2Fa+b")
+	require.Equal(t, http.StatusOK, code)
+	var obj KeyInfo
+	require.NoError(t, json.Unmarshal([]byte(body), &obj))
+	assert.Equal(t, KeyInfo{Key: "/a b", Value: []byte("v"), Revision: 7, ModRevision: 7}, obj)
+
+	code, _ = get(t, h, "/debug/key?key=/missing")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get(t, h, "/debug/key")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestDebugHash(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cache := proxy.NewWatchCacheWithLog(nil, log)
+	for i, key := range []string{"/a/1", "/a/2", "/b"} {
+		require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: key, Value: []byte("v"), Revision: int64(i + 1), ModRev: int64(i + 1)}))
+	}
+	h := NewServer(cache).Handler()
+
+	code, body := get(t, h, "/debug/hash?key=/a/&end=/a0&rev=2")
+	require.Equal(t, http.StatusOK, code)
+	var got proxy.RangeHash
+	require.NoError(t, json.Unmarshal([]byte(body), &got))
+	want, err := cache.Hash("/a/", "/a0", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), got.Revision)
+	assert.Equal(t, want.Hash, got.Hash)
+	assert.Equal(t, 2, got.Count)
+
+	code, _ = get(t, h, "/debug/hash?key=/a/&end=/c&rev=2")
+	assert.Equal(t, http.StatusConflict, code, "/b changed at 3")
+	code, _ = get(t, h, "/debug/hash?key=/a/&rev=x")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestServeAndMetrics(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { io.WriteString(w, "metric 1\n") })
+	s := NewServer(proxy.NewWatchCache(nil), WithMetricsHandler(metrics))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, ln) }()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.True(t, strings.HasPrefix(string(body), "metric 1"))
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+}
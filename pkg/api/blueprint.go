@@ -3,6 +3,11 @@
 
 package api
 
+import (
+    "context"
+    "time"
+)
+
 // ======================================================
 //                  COMPONENT: GENERIC PROXY
 // ======================================================
@@ -57,8 +62,26 @@ type VersionValidator interface {
 
 // MetricsCollector observes internal cache components.
 type MetricsCollector interface {
-    ObserveStoreSize(size int)
     ObserveRequestRate(endpoint string, count int)
+    // ObserveCompaction is called after every EventLog compaction with the number
+    // of events removed and the new "compacted up to" revision.
+    ObserveCompaction(removed int, watermark int64)
+    // ObserveDeliveryLatency is called for every put or delete a session delivers
+    // that happened after its watch started, with the time since the event was
+    // observed upstream. Replayed history, e.g. of a resumed session, is left out.
+    ObserveDeliveryLatency(d time.Duration)
+    // ObserveUpstreamRevision is called with the latest revision etcd reported to
+    // the watcher, including progress notifications.
+    ObserveUpstreamRevision(rev int64)
+    // ObserveApplyLatency is called with the time one event took to apply to the cache.
+    ObserveApplyLatency(d time.Duration)
+    // ObserveSlowConsumer is called when a session watch fell so far behind that
+    // events it had not read yet were compacted or evicted from the EventLog.
+    ObserveSlowConsumer()
+    // ObserveConsistencyCheck is called after the cache was compared with etcd,
+    // with the keys found missing from the cache, extra in it, and cached with
+    // another value or mod revision.
+    ObserveConsistencyCheck(missing, extra, mismatched int)
 }
 
 // MetricsExporter exposes metrics to Prometheus or others.
@@ -75,7 +98,7 @@ type ClientSession interface {
     // --- Lifecycle management ---
     Start() error     // Starts session: init resources, register, etc.
     Stop() error      // Terminates session, releases any goroutine or channel
-    ID() string       // Returns session ID for tracking
+    ID() string       // Returns a durable session ID that can be passed to ClientLibrary.ResumeSession
 
     // --- View and watch capabilities ---
     CacheView() SnapshotView
@@ -83,12 +106,71 @@ type ClientSession interface {
     Watch(key string, fromRev int64) (<-chan Event, error)
     // WatchPrefix subscribes to changes on a key prefix
     WatchPrefix(prefix string, fromRev int64) (<-chan Event, error)
+    // WatchPrefixRevisions is WatchPrefix handing out the changes of one
+    // revision, every key of an etcd transaction, in one slice.
+    WatchPrefixRevisions(prefix string, fromRev int64) (<-chan []Event, error)
+    // Subscriptions lists every Watch/WatchPrefix made on this session ID and how far each got.
+    // A fromRev <= 0 on Watch/WatchPrefix resumes a recorded subscription after its Revision.
+    Subscriptions() []Subscription
+    // Ack marks every event up to rev as processed. In acknowledged delivery mode
+    // a resumed session restarts after the last acked revision, or after the
+    // subscription's Revision if the client acked a revision it got only part of.
+    Ack(rev int64) error
+
+    // --- Write-through to etcd ---
+    // Each write returns etcd's revision only after the cache has reached it,
+    // so a following CacheView().Get observes the write (read-your-writes).
+    Put(ctx context.Context, key string, value []byte) (int64, error)
+    Delete(ctx context.Context, key string) (int64, error)
+    // CompareAndSwap puts value only if key's current ModRevision equals modRev;
+    // modRev 0 means the key must not exist. It reports whether the swap happened.
+    CompareAndSwap(ctx context.Context, key string, modRev int64, value []byte) (bool, int64, error)
+}
+
+// Subscription records one watch of a session and the last revision delivered
+// on it in full: every event of it the watch matches was handed out.
+type Subscription struct {
+    Key      string
+    Prefix   bool
+    Revision int64
 }
 
 // ClientLibrary provides an interface for SDK-level usage.
 type ClientLibrary interface {
     NewSession(clientID string) (ClientSession, error)
-    BroadcastUpdate(ev Event)
+    // ResumeSession reattaches to a session created earlier, replacing any session
+    // still attached to that ID. Missed events are replayed from the EventLog.
+    ResumeSession(id string) (ClientSession, error)
+    // RemoveSession stops the session with the given ID and forgets it, so
+    // it can no longer be resumed.
+    RemoveSession(id string) error
+    // BroadcastUpdate applies a local event to the cache, its EventLog and all
+    // session watches. It fails if ev.Revision is not newer than the cache revision.
+    BroadcastUpdate(ev Event) error
+    // Cursors reports how far each known session has got, for operators.
+    Cursors() []SessionCursor
+    // Close stops all sessions and background work of the library.
+    Close() error
+}
+
+// SessionCursor is the delivery position of one session.
+type SessionCursor struct {
+    SessionID     string
+    ClientID      string
+    Attached      bool
+    Delivered     int64 // highest revision handed to the client
+    Acked         int64 // highest revision the client acknowledged
+    Lag           int64 // events in the EventLog after the revision a resume would restart after
+    LastActive    time.Time
+    Subscriptions []Subscription // Revision is the last revision delivered in full on each
+    Watches       []WatchCursor  // the watch streams running on the attached session
+}
+
+// WatchCursor is one running watch stream of a session.
+type WatchCursor struct {
+    Key     string
+    Prefix  bool
+    Backlog int64 // events in the EventLog the stream has not handed to the client yet, 0 once caught up
 }
 
 // ======================================================
@@ -111,9 +193,18 @@ type EtcdAdapter interface {
 
 // EtcdKV is a simplified placeholder for etcd's key-value event.
 type EtcdKV struct {
+    Type  EventType // EventPut or EventDelete
     Key   string
     Value []byte
+    // ModRevision is the etcd revision of the change; for deletes etcd reports
+    // the revision of the deletion here. It becomes both Event.Revision and Event.ModRev.
     ModRevision int64
+    // CreateRevision is the revision that created the key, 0 for deletes.
+    // It becomes Event.CreateRev.
+    CreateRevision int64
+    // Version and Lease are etcd's version and lease of the key, 0 for deletes.
+    Version int64
+    Lease   int64
 }
 
 // ======================================================
@@ -124,6 +215,8 @@ type SnapshotView interface {
     Get(key string) (KV, bool)
     List(prefix string) ([]KV, error)
     Page(page, size int) ([]KV, error)
+    // ByIndex lists the entries a secondary index maps value to, as of this view.
+    ByIndex(name, value string) ([]KV, error)
     Revision() int64
 }
 
@@ -141,13 +234,55 @@ const (
     // These values must match mvccpb.Event_EventType for safe type casting.
     EventPut EventType = iota   // 类似 Java 中的 enum，用来表示是一次 PUT 操作
     EventDelete                 // 表示是一次 DELETE 操作
+    // EventBookmark is synthetic and has no etcd counterpart. It carries no key or
+    // value; its Revision tells the consumer it has seen every change up to that revision.
+    EventBookmark
+    // EventCompacted is synthetic as well: history at or below its Revision has been
+    // compacted away, so a watch can no longer be resumed from there.
+    EventCompacted
 )
 
 // Event represents a single operation that occurred in the system.
 type Event struct {
-    Type      EventType // Type of operation: PUT or DELETE
+    Type      EventType // Type of operation: PUT, DELETE, BOOKMARK or COMPACTED
     Key       string    // The key that was operated on
     Value     []byte    // The new value (nil if DELETE)
     Revision int64     // Monotonic revision assigned by the watch cache, used for local event ordering
     ModRev    int64     // etcd's original ModRevision for this key
+    CreateRev int64     // etcd's CreateRevision for this key; 0 for deletes and when unknown
+    Version   int64     // etcd's version of the key; 0 for deletes and when unknown
+    Lease     int64     // ID of the lease attached to the key, 0 for none
+    IngestedAt time.Time // when the watch cache applied the event; set by WatchCache.AddEvent
+    ObservedAt time.Time // when the event was received from upstream (the etcd watch response, or BroadcastUpdate)
+    Origin     Origin    // where the event entered the cache
+    // TraceContext carries the W3C trace context ("traceparent", "tracestate") of
+    // the span that received the event, so later stages join its trace. Nil when
+    // tracing is off; see pkg/tracing.
+    TraceContext map[string]string
+}
+
+// OriginKind tells which path an event entered the cache through.
+type OriginKind int
+
+const (
+    OriginUnknown OriginKind = iota
+    OriginEtcd               // an etcd watch response
+    OriginLocal              // ClientLibrary.BroadcastUpdate
+)
+
+func (k OriginKind) String() string {
+    switch k {
+    case OriginEtcd:
+        return "etcd"
+    case OriginLocal:
+        return "local"
+    }
+    return "unknown"
+}
+
+// Origin identifies the source of an event.
+type Origin struct {
+    Kind      OriginKind
+    ClusterID uint64 // etcd cluster ID from the watch response header (OriginEtcd only)
+    MemberID  uint64 // etcd member that served the watch (OriginEtcd only)
 }
\ No newline at end of file
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTrail feeds n puts through an audited WatchCache into dir.
+func writeTrail(t *testing.T, dir string, from, n int64, opts ...WriterOption) {
+	t.Helper()
+	w, err := NewWriter(dir, opts...)
+	require.NoError(t, err)
+	defer w.Close()
+	cache := proxy.NewWatchCacheWithLog(nil, NewEventLog(eventlog.NewMemoryEventLog(16), w))
+	for rev := from; rev < from+n; rev++ {
+		require.NoError(t, cache.AddEvent(api.Event{
+			Type: api.EventPut, Key: fmt.Sprintf("k%d", rev), Value: []byte("value"), Revision: rev,
+			Origin: api.Origin{Kind: api.OriginEtcd, ClusterID: 0xabc, MemberID: 0x1},
+		}))
+	}
+}
+
+func TestAuditedEventLogRecordsEveryMutation(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir)
+	require.NoError(t, err)
+	log := NewEventLog(eventlog.NewMemoryEventLog(16), w)
+	cache := proxy.NewWatchCacheWithLog(nil, log)
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "a", Value: []byte("1"), Revision: 1, Origin: api.Origin{Kind: api.OriginLocal}}))
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventDelete, Key: "a", Revision: 2}))
+	require.NoError(t, w.AuditWrite("sess-1", "b", 3, []byte("2"), false))
+	require.NoError(t, w.Close())
+
+	// The decorated log still behaves like the inner one.
+	events, err := log.ListSince(0)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	rec, ok, err := lastRecord(filepath.Join(dir, "audit-00000001.log"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, int64(3), rec.Seq)
+	assert.Equal(t, OpWrite, rec.Op)
+	assert.Equal(t, "sess-1", rec.Session)
+	assert.Equal(t, HashValue([]byte("2")), rec.ValueHash)
+
+	rep, err := Verify(dir)
+	require.NoError(t, err)
+	assert.True(t, rep.OK(), "%v", rep.Problems)
+	assert.Equal(t, int64(3), rep.Records)
+}
+
+func TestWriterRotatesAndResumesChain(t *testing.T) {
+	dir := t.TempDir()
+	writeTrail(t, dir, 1, 20, WithMaxFileSize(1024))
+	writeTrail(t, dir, 21, 5, WithMaxFileSize(1024)) // a restart continues the chain
+
+	rep, err := Verify(dir)
+	require.NoError(t, err)
+	assert.True(t, rep.OK(), "%v", rep.Problems)
+	assert.Greater(t, rep.Files, 1)
+	assert.Equal(t, int64(25), rep.LastSeq)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	t.Run("modified record", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTrail(t, dir, 1, 5)
+		path := filepath.Join(dir, "audit-00000001.log")
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, bytes.Replace(data, []byte(`"key":"k3"`), []byte(`"key":"kX"`), 1), 0o640))
+
+		rep, err := Verify(dir)
+		require.NoError(t, err)
+		require.Len(t, rep.Problems, 1)
+		assert.Equal(t, int64(3), rep.Problems[0].Seq)
+	})
+
+	t.Run("removed record", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTrail(t, dir, 1, 5)
+		path := filepath.Join(dir, "audit-00000001.log")
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		require.NoError(t, os.WriteFile(path, bytes.Join(append(lines[:2:2], lines[3:]...), nil), 0o640))
+
+		rep, err := Verify(dir)
+		require.NoError(t, err)
+		assert.False(t, rep.OK())
+		assert.Contains(t, rep.Problems[0].Msg, "gap")
+	})
+
+	t.Run("removed file", func(t *testing.T) {
+		dir := t.TempDir()
+		writeTrail(t, dir, 1, 30, WithMaxFileSize(1024))
+		require.NoError(t, os.Remove(filepath.Join(dir, "audit-00000002.log")))
+
+		rep, err := Verify(dir)
+		require.NoError(t, err)
+		assert.False(t, rep.OK())
+	})
+}
@@ -0,0 +1,11 @@
+/*
+Package audit keeps a tamper-evident trail of every change that flows through the cache.
+
+- Writer appends Records as JSON lines to size-rotated files in a directory.
+  Each record carries a sequence number and the SHA-256 of the previous record,
+  so the files form one hash chain across rotations.
+- NewEventLog decorates any eventlog.EventLog: every appended event is also
+  written to the audit trail. Pass the decorated log to proxy.NewWatchCacheWithLog.
+- Verify walks a directory and reports modified, reordered or missing records.
+*/
+package audit
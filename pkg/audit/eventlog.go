@@ -0,0 +1,34 @@
+package audit
+
+import (
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+)
+
+// auditedLog is an eventlog.EventLog that also writes every appended event to an audit trail.
+type auditedLog struct {
+	eventlog.EventLog
+	w *Writer
+}
+
+// NewEventLog wraps inner so that every Append is also recorded by w:
+//
+//	log := audit.NewEventLog(eventlog.NewMemoryEventLog(1024), w)
+//	cache := proxy.NewWatchCacheWithLog(nil, log)
+//
+// Because WatchCache appends every event it applies, the trail covers every
+// mutation of the cache. The event is appended to inner first so the cache
+// stays consistent; a failing audit write is then returned to the caller.
+func NewEventLog(inner eventlog.EventLog, w *Writer) eventlog.EventLog {
+	return &auditedLog{EventLog: inner, w: w}
+}
+
+func (l *auditedLog) Append(ev api.Event) error {
+	if err := l.EventLog.Append(ev); err != nil {
+		return err
+	}
+	r := RecordFromEvent(ev)
+	r.Time = ev.IngestedAt
+	_, err := l.w.Write(r)
+	return err
+}
@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+)
+
+// Operations recorded in the trail.
+const (
+	OpPut    = "put"    // a put applied to the cache
+	OpDelete = "delete" // a delete applied to the cache
+	OpWrite  = "write"  // a session wrote through to etcd; the put/delete follows when the cache applies it
+)
+
+// Record is one audit entry. Hash is the SHA-256 of the record's JSON encoding
+// with Hash empty; Prev is the Hash of the record before it ("" for the first).
+type Record struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key"`
+	Revision  int64     `json:"revision"`
+	ValueHash string    `json:"valueHash,omitempty"` // SHA-256 of the value, hex
+	Origin    string    `json:"origin,omitempty"`    // api.OriginKind, or "session" for OpWrite
+	ClusterID string    `json:"clusterId,omitempty"`
+	MemberID  string    `json:"memberId,omitempty"`
+	Session   string    `json:"session,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+// RecordFromEvent builds the record of an event applied to the cache.
+func RecordFromEvent(ev api.Event) Record {
+	r := Record{Op: OpPut, Key: ev.Key, Revision: ev.Revision, Origin: ev.Origin.Kind.String()}
+	if ev.Type == api.EventDelete {
+		r.Op = OpDelete
+	} else {
+		r.ValueHash = HashValue(ev.Value)
+	}
+	if ev.Origin.Kind == api.OriginEtcd {
+		r.ClusterID = strconv.FormatUint(ev.Origin.ClusterID, 16)
+		r.MemberID = strconv.FormatUint(ev.Origin.MemberID, 16)
+	}
+	return r
+}
+
+// HashValue returns the hex SHA-256 of a value as stored in records.
+func HashValue(v []byte) string {
+	sum := sha256.Sum256(v)
+	return hex.EncodeToString(sum[:])
+}
+
+// computeHash returns the hash r should carry.
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
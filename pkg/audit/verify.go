@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Problem is one inconsistency found by Verify.
+type Problem struct {
+	File string
+	Line int
+	Seq  int64
+	Msg  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: seq %d: %s", filepath.Base(p.File), p.Line, p.Seq, p.Msg)
+}
+
+// Report is the result of Verify.
+type Report struct {
+	Files    int
+	Records  int64
+	FirstSeq int64
+	LastSeq  int64
+	Problems []Problem
+}
+
+// OK reports whether the trail is intact.
+func (r *Report) OK() bool { return len(r.Problems) == 0 }
+
+// Verify checks every audit file in dir: each record's hash must match its
+// content, each Prev must equal the previous record's hash, and sequence numbers
+// must be contiguous across files. Edited or reordered records break the hash
+// chain; removed records or files leave a gap in the sequence.
+// The error is only for I/O failures; findings are in the report.
+func Verify(dir string) (*Report, error) {
+	files, err := auditFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	rep := &Report{Files: len(files)}
+	var prevHash string
+	var prevSeq int64
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 16<<20)
+		line := 0
+		for sc.Scan() {
+			line++
+			problem := func(seq int64, format string, args ...interface{}) {
+				rep.Problems = append(rep.Problems, Problem{File: path, Line: line, Seq: seq, Msg: fmt.Sprintf(format, args...)})
+			}
+			var r Record
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				problem(0, "unparsable record: %v", err)
+				continue
+			}
+			rep.Records++
+			if rep.Records == 1 {
+				rep.FirstSeq = r.Seq
+				if r.Seq != 1 {
+					problem(r.Seq, "trail starts at seq %d, records before it are missing", r.Seq)
+				}
+			} else {
+				if r.Seq != prevSeq+1 {
+					problem(r.Seq, "gap: expected seq %d", prevSeq+1)
+				}
+				if r.Prev != prevHash {
+					problem(r.Seq, "hash chain broken: prev does not match the preceding record")
+				}
+			}
+			if want, err := r.computeHash(); err != nil || want != r.Hash {
+				problem(r.Seq, "record hash mismatch: content was modified")
+			}
+			prevSeq, prevHash = r.Seq, r.Hash
+			rep.LastSeq = r.Seq
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rep, nil
+}
@@ -0,0 +1,212 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMaxFileSize is the size at which a Writer starts a new file.
+const DefaultMaxFileSize = 64 << 20
+
+// filePattern names audit files so that lexical order is chain order.
+const filePattern = "audit-%08d.log"
+
+// Writer appends records to rotating files in a directory. It is safe for concurrent use.
+type Writer struct {
+	dir     string
+	maxSize int64
+	sync    bool
+	now     func() time.Time
+
+	mu    sync.Mutex
+	file  *os.File
+	index int   // number in the current file name
+	size  int64 // bytes in the current file
+	seq   int64 // Seq of the last record written
+	last  string
+}
+
+// WriterOption configures a Writer.
+type WriterOption func(*Writer)
+
+// WithMaxFileSize rotates to a new file once the current one reaches n bytes.
+func WithMaxFileSize(n int64) WriterOption {
+	return func(w *Writer) {
+		w.maxSize = n
+	}
+}
+
+// WithSync fsyncs the file after every record.
+func WithSync() WriterOption {
+	return func(w *Writer) {
+		w.sync = true
+	}
+}
+
+// NewWriter opens the audit trail in dir, creating it if needed. An existing
+// trail is continued: the last record's sequence number and hash are picked up
+// so the chain stays unbroken across restarts.
+func NewWriter(dir string, opts ...WriterOption) (*Writer, error) {
+	w := &Writer{dir: dir, maxSize: DefaultMaxFileSize, now: time.Now}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	files, err := auditFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	w.index = 1
+	if len(files) > 0 {
+		lastFile := files[len(files)-1]
+		if _, err := fmt.Sscanf(filepath.Base(lastFile), filePattern, &w.index); err != nil {
+			return nil, fmt.Errorf("unexpected audit file name %s", lastFile)
+		}
+		if err := w.resume(files); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.openFile(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// resume loads the chain head from the newest file holding a record.
+func (w *Writer) resume(files []string) error {
+	for i := len(files) - 1; i >= 0; i-- {
+		rec, ok, err := lastRecord(files[i])
+		if err != nil {
+			return err
+		}
+		if ok {
+			w.seq, w.last = rec.Seq, rec.Hash
+			return nil
+		}
+	}
+	return nil
+}
+
+func (w *Writer) openFile() error {
+	path := filepath.Join(w.dir, fmt.Sprintf(filePattern, w.index))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, st.Size()
+	return nil
+}
+
+// Write appends r to the trail, filling in Seq, Time (if zero), Prev and Hash,
+// and returns the completed record.
+func (w *Writer) Write(r Record) (Record, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return r, os.ErrClosed
+	}
+	if r.Time.IsZero() {
+		r.Time = w.now()
+	}
+	r.Time = r.Time.Round(0).UTC() // drop the monotonic reading so the JSON round-trips
+	r.Seq, r.Prev = w.seq+1, w.last
+	hash, err := r.computeHash()
+	if err != nil {
+		return r, err
+	}
+	r.Hash = hash
+	line, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+	line = append(line, '\n')
+
+	if w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return r, err
+		}
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return r, err
+	}
+	if w.sync {
+		if err := w.file.Sync(); err != nil {
+			return r, err
+		}
+	}
+	w.seq, w.last = r.Seq, r.Hash
+	return r, nil
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.index++
+	return w.openFile()
+}
+
+// AuditWrite records a session's write-through to etcd. It lets a Writer serve
+// as the clientlibrary's auditor.
+func (w *Writer) AuditWrite(session, key string, rev int64, value []byte, deleted bool) error {
+	r := Record{Op: OpWrite, Key: key, Revision: rev, Origin: "session", Session: session}
+	if !deleted {
+		r.ValueHash = HashValue(value)
+	}
+	_, err := w.Write(r)
+	return err
+}
+
+// Close closes the current file. Further writes fail with os.ErrClosed.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// auditFiles lists the audit files in dir in chain order.
+func auditFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	sort.Strings(files)
+	return files, err
+}
+
+// lastRecord returns the last complete record in path.
+func lastRecord(path string) (Record, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Record{}, false, err
+	}
+	defer f.Close()
+	var last Record
+	var found bool
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for sc.Scan() {
+		var r Record
+		if json.Unmarshal(sc.Bytes(), &r) == nil {
+			last, found = r, true
+		}
+	}
+	return last, found, sc.Err()
+}
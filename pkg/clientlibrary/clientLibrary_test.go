@@ -2,15 +2,22 @@
 package clientlibrary
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"testing"
+	"time"
 
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/metrics"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy" // 假造一个 in-memory proxy
 )
 
 func TestClientSession_MVP(t *testing.T) {
-    // 1. 构造一个 fake proxy，预先放入一些事件
+    // 1. 构造一个 in-memory proxy，预先放入一些事件；library 必须和 cache 共用同一个 log
     log := eventlog.NewMemoryEventLog(5)
 	fp := proxy.NewWatchCacheWithLog(nil, log)
     
@@ -34,27 +41,551 @@ func TestClientSession_MVP(t *testing.T) {
     fp.AddEvent(ev1)  
     fp.AddEvent(ev2) 
 
-    el := eventlog.NewMemoryEventLog(10)
-    cl := NewClientLibrary(fp, el)
+    cl := NewClientLibrary(fp, log)
+    defer cl.Close()
     sess, err := cl.NewSession("test-client")
     if err != nil {
         t.Fatal(err)
     }
     defer sess.Stop()
     view := sess.CacheView()
-    // 2. 初始 snapshot 应该看到 rev<=1 的内容
+    // 2. 初始 snapshot 应该看到 key1，key2 已被删除
     
     if _, ok := view.Get("key1"); !ok {
         t.Errorf("expected key1 in snapshot")
     }
-    if _, ok := view.Get("key2"); ok {  // key2 rev=2 不应出现在 snapshot
-        t.Errorf("did not expect key2 in snapshot")
+    if _, ok := view.Get("key2"); ok {
+        t.Errorf("did not expect deleted key2 in snapshot")
     }
 
-    // 3. Watch 应该能收到 rev>1 的事件
-    events,_ := sess.Watch("key1",1)
-    ev := <-events
-    if ev.Key != "key2" {
-        t.Errorf("expected key2 event, got %v", ev)
+    // 3. Watch 应该能收到之后通过 BroadcastUpdate 写入的事件，CacheView 也能读到同一个值
+    events, err := sess.Watch("key1", 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "key1", Value: []byte("Bob"), Revision: 3, ModRev: 102}); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case ev := <-events:
+        if ev.Key != "key1" || string(ev.Value) != "Bob" {
+            t.Errorf("expected key1=Bob event, got %v", ev)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("BroadcastUpdate was not delivered to the session watch")
+    }
+    if kv, ok := sess.CacheView().Get("key1"); !ok || string(kv.Value) != "Bob" || kv.Revision != 3 {
+        t.Errorf("expected CacheView to agree with Watch, got %+v", kv)
+    }
+}
+
+func TestClientLibrary_BroadcastUpdateRejectsOutOfOrder(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(5)
+    cl := NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log)
+    defer cl.Close()
+
+    if err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "a", Value: []byte("1"), Revision: 10}); err != nil {
+        t.Fatal(err)
+    }
+    err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "b", Value: []byte("2"), Revision: 9})
+    if !errors.Is(err, proxy.ErrInvalidRevision) {
+        t.Fatalf("expected ErrInvalidRevision, got %v", err)
+    }
+    if events, _ := log.ListSince(0); len(events) != 1 {
+        t.Fatalf("rejected event must not reach the log, got %v", events)
+    }
+}
+
+func TestClientSession_WatchBookmarks(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    wc := proxy.NewWatchCacheWithLog(nil, log)
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "other", Value: []byte("x"), Revision: 5, ModRev: 5})
+    wc.Progress(5)
+
+    cl := NewClientLibrary(wc, log, WithBookmarkInterval(20*time.Millisecond))
+    sess, err := cl.NewSession("bookmark-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sess.Stop()
+
+    events, err := sess.Watch("idle", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case ev := <-events:
+        // The idle watch's bookmark reaches the complete revision.
+        if ev.Type != api.EventBookmark || ev.Revision != 5 {
+            t.Fatalf("expected bookmark at revision 5, got %+v", ev)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("no bookmark received on idle watch")
+    }
+}
+
+func TestClientLibrary_ResumeSession(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    wc := proxy.NewWatchCacheWithLog(nil, log)
+    cl := NewClientLibrary(wc, log)
+    defer cl.Close()
+
+    sess, err := cl.NewSession("resume-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    events, err := sess.Watch("a", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "a", Value: []byte("v1"), Revision: 1, ModRev: 1})
+    wc.Progress(1)
+    if ev := <-events; ev.Revision != 1 {
+        t.Fatalf("expected revision 1, got %+v", ev)
+    }
+    // The delivered revision is recorded just after the send completes.
+    for deadline := time.Now().Add(time.Second); sess.Subscriptions()[0].Revision != 1; {
+        if time.Now().After(deadline) {
+            t.Fatal("delivery of revision 1 was not recorded")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    id := sess.ID()
+    sess.Stop()
+
+    // Changes made while the client was away must be replayed on resume.
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "a", Value: []byte("v2"), Revision: 2, ModRev: 2})
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "a", Value: []byte("v3"), Revision: 3, ModRev: 3})
+    wc.Progress(3)
+
+    resumed, err := cl.ResumeSession(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resumed.Stop()
+    if resumed.ID() != id {
+        t.Fatalf("expected resumed ID %q, got %q", id, resumed.ID())
+    }
+    subs := resumed.Subscriptions()
+    if len(subs) != 1 || subs[0].Key != "a" || subs[0].Revision != 1 {
+        t.Fatalf("unexpected subscriptions %+v", subs)
+    }
+
+    events, err = resumed.Watch("a", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []int64{2, 3} {
+        select {
+        case ev := <-events:
+            if ev.Revision != want {
+                t.Fatalf("expected revision %d, got %+v", want, ev)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("missed event at revision %d", want)
+        }
+    }
+}
+
+func TestClientLibrary_IdleSessionsExpire(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    cl := NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log, WithIdleTimeout(20*time.Millisecond))
+    defer cl.Close()
+
+    sess, err := cl.NewSession("idle-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    sess.Stop()
+    time.Sleep(100 * time.Millisecond)
+
+    if _, err := cl.ResumeSession(sess.ID()); err != ErrSessionNotFound {
+        t.Fatalf("expected ErrSessionNotFound, got %v", err)
+    }
+}
+
+func TestClientLibrary_UnreadSessionsExpire(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    wc := proxy.NewWatchCacheWithLog(nil, log)
+    cl := NewClientLibrary(wc, log, WithIdleTimeout(20*time.Millisecond))
+    defer cl.Close()
+
+    idle, err := cl.NewSession("idle-watcher")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := idle.WatchPrefix("quiet/", 1); err != nil {
+        t.Fatal(err)
+    }
+    gone, err := cl.NewSession("gone-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    events, err := gone.WatchPrefix("jobs/", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := wc.AddEvent(api.Event{Type: api.EventPut, Key: "jobs/1", Value: []byte("a"), Revision: 1}); err != nil {
+        t.Fatal(err)
+    }
+    wc.Progress(1)
+    time.Sleep(100 * time.Millisecond)
+
+    // The client never read the event, so its session is stopped and its
+    // channel closes once the pending event is dropped.
+    for range events {
+    }
+    if _, err := cl.ResumeSession(gone.ID()); err != ErrSessionNotFound {
+        t.Fatalf("expected ErrSessionNotFound, got %v", err)
+    }
+    // A watch that is only waiting for changes keeps its session.
+    if _, err := cl.ResumeSession(idle.ID()); err != nil {
+        t.Fatalf("idle watcher expired: %v", err)
+    }
+}
+
+func TestClientLibrary_AckedDelivery(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    wc := proxy.NewWatchCacheWithLog(nil, log)
+    cl := NewClientLibrary(wc, log, WithAckedDelivery())
+    defer cl.Close()
+
+    sess, err := cl.NewSession("acking-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    events, err := sess.WatchPrefix("jobs/", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "jobs/1", Value: []byte("a"), Revision: 1, ModRev: 1})
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "jobs/2", Value: []byte("b"), Revision: 2, ModRev: 2})
+    wc.Progress(2)
+    // An event can be acked as soon as it has been received.
+    if err := sess.Ack((<-events).Revision); err != nil {
+        t.Fatal(err)
+    }
+    <-events
+
+    if err := sess.Ack(5); err != ErrAckAhead {
+        t.Fatalf("expected ErrAckAhead, got %v", err)
+    }
+    // The consumer crashes after handling only the first job.
+    sess.Stop()
+
+    cursors := cl.Cursors()
+    if len(cursors) != 1 {
+        t.Fatalf("expected 1 cursor, got %+v", cursors)
+    }
+    if c := cursors[0]; c.Attached || c.Delivered != 2 || c.Acked != 1 || c.Lag != 1 {
+        t.Fatalf("unexpected cursor %+v", c)
+    }
+
+    resumed, err := cl.ResumeSession(sess.ID())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resumed.Stop()
+    events, err = resumed.WatchPrefix("jobs/", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case ev := <-events:
+        if ev.Key != "jobs/2" {
+            t.Fatalf("expected unacked jobs/2 to be redelivered, got %+v", ev)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("unacked event was not redelivered")
+    }
+}
+
+func TestClientSession_CompactionWatermark(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    cl := NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log)
+    defer cl.Close()
+    sess, err := cl.NewSession("c")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sess.Stop()
+
+    for rev := int64(1); rev <= 3; rev++ {
+        if err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "other", Value: []byte("v"), Revision: rev}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    events, err := sess.Watch("key1", 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    compactor := eventlog.NewCompactor(log, eventlog.WithPolicies(eventlog.KeepRevisions(1)))
+    if _, err := compactor.CompactOnce(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case ev := <-events:
+        if ev.Type != api.EventCompacted || ev.Revision != 2 {
+            t.Errorf("expected compaction watermark 2, got %+v", ev)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("compaction watermark was not delivered to the session")
+    }
+    // The watermark is not a delivery position: the subscription still starts at 4.
+    for _, sub := range sess.Subscriptions() {
+        if sub.Revision != 3 {
+            t.Errorf("watermark recorded as delivered: %+v", sub)
+        }
+    }
+}
+
+func TestClientSession_OriginAndDeliveryLatency(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    prom := metrics.NewPrometheus()
+    cl := NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log, WithMetrics(prom))
+    defer cl.Close()
+    // History from before the session started is a replay, not a delivery.
+    if err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "k", Value: []byte("old"), Revision: 1}); err != nil {
+        t.Fatal(err)
+    }
+    sess, err := cl.NewSession("c")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sess.Stop()
+    events, err := sess.Watch("k", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    <-events
+
+    if err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "k", Value: []byte("v"), Revision: 2}); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case ev := <-events:
+        if ev.Origin.Kind != api.OriginLocal {
+            t.Errorf("expected local origin, got %v", ev.Origin.Kind)
+        }
+        if ev.ObservedAt.IsZero() || ev.IngestedAt.Before(ev.ObservedAt) {
+            t.Errorf("expected observed <= ingested timestamps, got %v / %v", ev.ObservedAt, ev.IngestedAt)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("event not delivered")
+    }
+    // The latency is recorded right after the send returns.
+    deadline := time.Now().Add(time.Second)
+    for deliveries(t, prom) != 1 {
+        if time.Now().After(deadline) {
+            t.Fatal("delivery latency was not observed")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    time.Sleep(10 * time.Millisecond)
+    if n := deliveries(t, prom); n != 1 {
+        t.Fatalf("expected one observed delivery, got %d", n)
+    }
+}
+
+// deliveries returns how many delivery latencies prom has observed.
+func deliveries(t *testing.T, prom *metrics.Prometheus) uint64 {
+    t.Helper()
+    families, err := prom.Registry().Gather()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, mf := range families {
+        if mf.GetName() == "etcdcache_delivery_latency_seconds" {
+            return mf.GetMetric()[0].GetHistogram().GetSampleCount()
+        }
+    }
+    return 0
+}
+
+func TestClientLibrary_LogsWithSessionID(t *testing.T) {
+    var out bytes.Buffer
+    log := eventlog.NewMemoryEventLog(10)
+    cl := NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log, WithLogger(slog.New(slog.NewJSONHandler(&out, nil))))
+    defer cl.Close()
+    sess, err := cl.NewSession("client-a")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sess.Stop()
+
+    var rec map[string]any
+    if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+        t.Fatalf("expected one JSON log record, got %q: %v", out.String(), err)
+    }
+    if rec["msg"] != "session created" || rec["component"] != "clientlibrary" ||
+        rec["session_id"] != sess.ID() || rec["client_id"] != "client-a" {
+        t.Errorf("unexpected log record %v", rec)
+    }
+}
+
+func TestClientLibrary_ResumeRepeatsPartialRevision(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    wc := proxy.NewWatchCacheWithLog(nil, log)
+    cl := NewClientLibrary(wc, log)
+    defer cl.Close()
+
+    sess, err := cl.NewSession("txn-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    events, err := sess.WatchPrefix("t/", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // One etcd transaction writes both keys at revision 5.
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "t/a", Value: []byte("1"), Revision: 5, ModRev: 5})
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "t/b", Value: []byte("1"), Revision: 5, ModRev: 5})
+    wc.Progress(5)
+    if ev := <-events; ev.Key != "t/a" {
+        t.Fatalf("expected t/a, got %+v", ev)
+    }
+    // The client goes away before taking t/b.
+    sess.Stop()
+    if subs := sess.Subscriptions(); subs[0].Revision != 0 {
+        t.Fatalf("revision 5 recorded before it was delivered in full: %+v", subs)
+    }
+
+    resumed, err := cl.ResumeSession(sess.ID())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resumed.Stop()
+    events, err = resumed.WatchPrefix("t/", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{"t/a", "t/b"} {
+        select {
+        case ev := <-events:
+            if ev.Key != want || ev.Revision != 5 {
+                t.Fatalf("expected %s at revision 5, got %+v", want, ev)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("%s was not delivered after the resume", want)
+        }
+    }
+    for deadline := time.Now().Add(time.Second); resumed.Subscriptions()[0].Revision != 5; {
+        if time.Now().After(deadline) {
+            t.Fatal("revision 5 was not recorded once delivered in full")
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestClientLibrary_CursorLag(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    wc := proxy.NewWatchCacheWithLog(nil, log)
+    cl := NewClientLibrary(wc, log)
+    defer cl.Close()
+
+    sess, err := cl.NewSession("lag-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    events, err := sess.WatchPrefix("quiet/", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Other keys keep changing: a caught-up watch of a quiet key has no lag.
+    for rev := int64(1); rev <= 3; rev++ {
+        if err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "busy", Value: []byte("v"), Revision: rev}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for deadline := time.Now().Add(time.Second); sess.Subscriptions()[0].Revision != 3; {
+        if time.Now().After(deadline) {
+            t.Fatal("the watch did not pass revision 3")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    if c := cl.Cursors()[0]; c.Lag != 0 {
+        t.Fatalf("expected no lag on a caught-up watch, got %+v", c)
+    }
+
+    // Two changes the client has not taken yet.
+    for rev := int64(4); rev <= 5; rev++ {
+        if err := cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "quiet/k", Value: []byte("v"), Revision: rev}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for deadline := time.Now().Add(time.Second); cl.Cursors()[0].Lag != 2; {
+        if time.Now().After(deadline) {
+            t.Fatalf("expected a lag of 2 events, got %+v", cl.Cursors()[0])
+        }
+        time.Sleep(time.Millisecond)
+    }
+    <-events
+    <-events
+    for deadline := time.Now().Add(time.Second); cl.Cursors()[0].Lag != 0; {
+        if time.Now().After(deadline) {
+            t.Fatalf("expected no lag once delivered, got %+v", cl.Cursors()[0])
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestClientSession_WatchPrefixRevisions(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    wc := proxy.NewWatchCacheWithLog(nil, log)
+    cl := NewClientLibrary(wc, log)
+    defer cl.Close()
+
+    sess, err := cl.NewSession("revisions-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    revs, err := sess.WatchPrefixRevisions("a/", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // One transaction touching two keys under the prefix and one outside it.
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "a/1", Value: []byte("1"), Revision: 1})
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "b/1", Value: []byte("1"), Revision: 1})
+    wc.AddEvent(api.Event{Type: api.EventPut, Key: "a/2", Value: []byte("2"), Revision: 1})
+    wc.Progress(1)
+    select {
+    case evs := <-revs:
+        if len(evs) != 2 || evs[0].Key != "a/1" || evs[1].Key != "a/2" {
+            t.Fatalf("expected the revision's changes under a/ together, got %+v", evs)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("no revision received")
+    }
+}
+
+func TestClientLibrary_RemoveSession(t *testing.T) {
+    log := eventlog.NewMemoryEventLog(10)
+    cl := NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log)
+    defer cl.Close()
+
+    sess, err := cl.NewSession("removed-client")
+    if err != nil {
+        t.Fatal(err)
+    }
+    events, err := sess.Watch("k", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := cl.RemoveSession(sess.ID()); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case _, ok := <-events:
+        if ok {
+            t.Fatal("expected the watch to end")
+        }
+    case <-time.After(time.Second):
+        t.Fatal("the watch did not end")
+    }
+    if _, err := cl.ResumeSession(sess.ID()); !errors.Is(err, ErrSessionNotFound) {
+        t.Fatalf("expected ErrSessionNotFound on resume, got %v", err)
+    }
+    if err := cl.RemoveSession(sess.ID()); !errors.Is(err, ErrSessionNotFound) {
+        t.Fatalf("expected ErrSessionNotFound, got %v", err)
     }
-}
\ No newline at end of file
+}
@@ -3,21 +3,132 @@ package clientlibrary
 
 import (
 	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/tracing"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ClientLibrary 实现 api.ClientLibrary
 type clientLibrary struct {
-    cache proxy.WatchCacheInterface
-    log   eventlog.EventLog
+    cache            proxy.WatchCacheInterface
+    log              eventlog.EventLog
+    bookmarkInterval time.Duration
+    idleTimeout      time.Duration
+    ackMode          bool
+    kv               clientv3.KV // etcd client for write-through; nil makes sessions read-only
+    metrics          api.MetricsCollector
+    auditor          WriteAuditor
+    tracer           trace.Tracer
+    logger           *slog.Logger
+
+    mu       sync.Mutex
+    sessions map[string]*sessionState // keyed by session ID
+    closed   bool
+    stopGC   chan struct{}
+}
+
+// Option configures optional behaviour of the ClientLibrary.
+type Option func(*clientLibrary)
+
+// WithBookmarkInterval makes every session watch stream emit an api.EventBookmark
+// every d, even if no watched key changed. It carries the newest revision the
+// stream has completely passed (see proxy.WatchCache.WatchWithBookmarks); on a
+// quiet stream that is the cache's complete revision.
+// A reconnecting client can resume from the last bookmark instead of re-listing.
+// Bookmarks are disabled by default.
+func WithBookmarkInterval(d time.Duration) Option {
+    return func(cl *clientLibrary) {
+        cl.bookmarkInterval = d
+    }
+}
+
+// WithIdleTimeout garbage-collects sessions whose client has been gone for d:
+// stopped and not resumed, or still open but not taking the events sent to it.
+// Until then ResumeSession can pick them up again. An expired open session is
+// stopped, closing its watch channels.
+// Without this option sessions are kept until Stop and Close.
+func WithIdleTimeout(d time.Duration) Option {
+    return func(cl *clientLibrary) {
+        cl.idleTimeout = d
+    }
+}
+
+// WithAckedDelivery switches sessions to at-least-once delivery: a session
+// resumed with ResumeSession restarts every Watch with fromRev <= 0 right after
+// the last revision passed to Ack, so events a crashed consumer received but
+// never acknowledged are delivered again.
+func WithAckedDelivery() Option {
+    return func(cl *clientLibrary) {
+        cl.ackMode = true
+    }
+}
+
+// WithEtcdClient enables Put, Delete and CompareAndSwap on sessions by forwarding
+// them to etcd through kv. The cache must be fed by a watcher on the written keys,
+// or writes block until their context expires waiting for the cache to catch up.
+func WithEtcdClient(kv clientv3.KV) Option {
+    return func(cl *clientLibrary) {
+        cl.kv = kv
+    }
+}
+
+// WithMetrics reports the delivery latency of every event sessions hand out to m,
+// measured from Event.ObservedAt.
+func WithMetrics(m api.MetricsCollector) Option {
+    return func(cl *clientLibrary) {
+        cl.metrics = m
+    }
+}
+
+// WithWriteAuditor records every successful session write-through with a, e.g. an *audit.Writer.
+func WithWriteAuditor(a WriteAuditor) Option {
+    return func(cl *clientLibrary) {
+        cl.auditor = a
+    }
+}
+
+// WithTracerProvider traces the fan-out of every event to each session watch
+// with a session.deliver span, joined to the event's trace through Event.TraceContext.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+    return func(cl *clientLibrary) {
+        cl.tracer = tracing.Tracer(tp)
+    }
+}
+
+// WithLogger sets the logger of the library and its sessions (default slog.Default()).
+// Session records carry the session ID.
+func WithLogger(l *slog.Logger) Option {
+    return func(cl *clientLibrary) {
+        cl.logger = l
+    }
 }
 
 // NewClientLibrary 构造
-func NewClientLibrary(cache proxy.WatchCacheInterface, log eventlog.EventLog) api.ClientLibrary {
-    return &clientLibrary{cache: cache, log: log}
+// log must be the EventLog the cache appends to.
+func NewClientLibrary(cache proxy.WatchCacheInterface, log eventlog.EventLog, opts ...Option) api.ClientLibrary {
+    cl := &clientLibrary{
+        cache:    cache,
+        log:      log,
+        sessions: make(map[string]*sessionState),
+        stopGC:   make(chan struct{}),
+    }
+    for _, opt := range opts {
+        opt(cl)
+    }
+    cl.logger = logging.Component(cl.logger, "clientlibrary")
+    if cl.idleTimeout > 0 {
+        go cl.collectIdleSessions()
+    }
+    return cl
 }
 
 // NewSession 创建一个新会话
@@ -25,13 +136,140 @@ func (cl *clientLibrary) NewSession(clientID string) (api.ClientSession, error)
     if cl.log == nil {
         return nil, errors.New("event log is nil")
     }
+    st, err := newSessionState(clientID, cl.ackMode)
+    if err != nil {
+        return nil, err
+    }
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    if cl.closed {
+        return nil, ErrLibraryClosed
+    }
+    cl.sessions[st.id] = st
+    cl.logger.Info("session created", logging.Session(st.id), slog.String("client_id", clientID))
+    return cl.attachSession(st), nil
+}
+
+// ResumeSession reattaches to the session with the given ID.
+func (cl *clientLibrary) ResumeSession(id string) (api.ClientSession, error) {
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    if cl.closed {
+        return nil, ErrLibraryClosed
+    }
+    st, ok := cl.sessions[id]
+    if !ok {
+        return nil, ErrSessionNotFound
+    }
+    cl.logger.Info("session resumed", logging.Session(id))
+    return cl.attachSession(st), nil
+}
+
+// RemoveSession stops the session with the given ID and drops its state
+// instead of keeping it resumable until the idle timeout.
+func (cl *clientLibrary) RemoveSession(id string) error {
+    cl.mu.Lock()
+    st, ok := cl.sessions[id]
+    delete(cl.sessions, id)
+    cl.mu.Unlock()
+    if !ok {
+        return ErrSessionNotFound
+    }
+    st.attach(nil)
+    cl.logger.Debug("session removed", logging.Session(id))
+    return nil
+}
+
+// attachSession starts a session on st; cl.mu must be held.
+func (cl *clientLibrary) attachSession(st *sessionState) *session {
     rv := cl.log.LatestRevision()
-    sess := newSession(cl.cache, cl.log, rv)
-    return sess, nil
+    sess := newSession(cl.cache, cl.log, rv, cl.bookmarkInterval, st, cl.logger)
+    sess.kv = cl.kv
+    sess.metrics = cl.metrics
+    sess.auditor = cl.auditor
+    sess.tracer = cl.tracer
+    st.attach(sess)
+    return sess
 }
 
-// BroadcastUpdate broadcasts an event into the EventLog.
-func (cl *clientLibrary) BroadcastUpdate(ev api.Event) {
-    // Append into the underlying EventLog.
-    _ = cl.log.Append(ev)
+// collectIdleSessions drops abandoned sessions until Close is called.
+func (cl *clientLibrary) collectIdleSessions() {
+    ticker := time.NewTicker(cl.idleTimeout / 2)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-cl.stopGC:
+            return
+        case now := <-ticker.C:
+            cutoff := now.Add(-cl.idleTimeout)
+            var expired []*sessionState
+            cl.mu.Lock()
+            for id, st := range cl.sessions {
+                if st.abandoned(cutoff) {
+                    delete(cl.sessions, id)
+                    expired = append(expired, st)
+                    cl.logger.Info("idle session expired", logging.Session(id))
+                }
+            }
+            cl.mu.Unlock()
+            for _, st := range expired {
+                // Stops the watches of a session whose client went away without Stop.
+                st.attach(nil)
+            }
+        }
+    }
+}
+
+// Cursors lists the delivery position of every known session, ordered by session ID.
+func (cl *clientLibrary) Cursors() []api.SessionCursor {
+    pending := func(after int64) int64 {
+        return int64(eventlog.CountSince(cl.log, after+1))
+    }
+    cl.mu.Lock()
+    cursors := make([]api.SessionCursor, 0, len(cl.sessions))
+    for _, st := range cl.sessions {
+        cursors = append(cursors, st.cursor(pending))
+    }
+    cl.mu.Unlock()
+    sort.Slice(cursors, func(i, j int) bool { return cursors[i].SessionID < cursors[j].SessionID })
+    return cursors
+}
+
+// Close stops every attached session and the idle collector.
+func (cl *clientLibrary) Close() error {
+    cl.mu.Lock()
+    if cl.closed {
+        cl.mu.Unlock()
+        return nil
+    }
+    cl.closed = true
+    close(cl.stopGC)
+    states := cl.sessions
+    cl.sessions = make(map[string]*sessionState)
+    cl.mu.Unlock()
+
+    for _, st := range states {
+        st.attach(nil)
+    }
+    return nil
+}
+
+// BroadcastUpdate ingests a local event: the WatchCache applies it and appends
+// it to its EventLog in one step, and every session watching that log is woken
+// up to receive it. A local event is a revision of its own, complete once it
+// is applied. Out-of-order revisions are rejected with proxy.ErrInvalidRevision.
+// The cache must have been built with the same EventLog that was passed to
+// NewClientLibrary, otherwise sessions never see the update.
+func (cl *clientLibrary) BroadcastUpdate(ev api.Event) error {
+    if ev.Origin.Kind == api.OriginUnknown {
+        ev.Origin = api.Origin{Kind: api.OriginLocal}
+    }
+    if ev.ObservedAt.IsZero() {
+        ev.ObservedAt = time.Now()
+    }
+    if err := cl.cache.AddEvent(ev); err != nil {
+        return err
+    }
+    cl.cache.Progress(ev.Revision)
+    return nil
 }
\ No newline at end of file
@@ -4,83 +4,225 @@ package clientlibrary
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/tracing"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // session 实现 api.ClientSession
 type session struct {
-    cache           proxy.WatchCacheInterface
-    log             eventlog.EventLog
-    startRevision   int64
-    initialSnapshot []api.KV
-    eventsCh        <-chan eventlog.Event
-    cancelWatch     context.CancelFunc
-}
-
-func newSession(cache proxy.WatchCacheInterface, log eventlog.EventLog, rv int64) api.ClientSession {
-    // 1. 获取初始快照（Snapshot）
-    snaps := cache.Snapshot()
-    ssdata,_ := snaps.List("")
-    // 2. 启动 watch
+    cache            proxy.WatchCacheInterface
+    log              eventlog.EventLog
+    startRevision    int64
+    ctx              context.Context // parent of every watch stream; cancelled by Stop
+    cancelWatch      context.CancelFunc
+    bookmarkInterval time.Duration
+    state            *sessionState // durable ID, subscriptions and cursors shared across resumes
+    kv               clientv3.KV   // write-through target, see write.go
+    metrics          api.MetricsCollector
+    auditor          WriteAuditor
+    tracer           trace.Tracer
+    logger           *slog.Logger // tagged with the session ID
+}
+
+func newSession(cache proxy.WatchCacheInterface, log eventlog.EventLog, rv int64, bookmarkInterval time.Duration, state *sessionState, logger *slog.Logger) *session {
     ctx, cancel := context.WithCancel(context.Background())
-    events, _ := log.Watch(ctx, rv+1)
     return &session{
-        cache:           cache,
-        log:             log,
-        startRevision:   rv,
-        initialSnapshot: ssdata,
-        eventsCh:        events,
-        cancelWatch:     cancel,
+        logger:           logger.With(logging.Session(state.id)),
+        cache:            cache,
+        log:              log,
+        startRevision:    rv,
+        ctx:              ctx,
+        cancelWatch:      cancel,
+        bookmarkInterval: bookmarkInterval,
+        state:            state,
     }
 }
 
-// List 返回 snapshot
-func (s *session) List() []api.KV {
-    return s.initialSnapshot
-}
-
 // WatchSingle subscribes to changes on a single key
 func (s *session) Watch(key string, fromRev int64) (<-chan api.Event, error) {
-	ctx, _ := context.WithCancel(context.Background())
-	events, err := s.log.Watch(ctx, fromRev)
+	return s.watchEvents(key, false, fromRev)
+}
+
+// WatchPrefix subscribes to changes on a key prefix
+func (s *session) WatchPrefix(prefix string, fromRev int64) (<-chan api.Event, error) {
+	return s.watchEvents(prefix, true, fromRev)
+}
+
+// WatchPrefixRevisions subscribes to changes on a key prefix like WatchPrefix,
+// handing out the changes of one revision in one slice.
+func (s *session) WatchPrefixRevisions(prefix string, fromRev int64) (<-chan []api.Event, error) {
+	out := make(chan []api.Event)
+	err := s.watch(prefix, true, fromRev, func() { close(out) }, func(evs []api.Event) bool {
+		return send(s, out, evs, evs, prefix)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return out, nil
+}
+
+func (s *session) watchEvents(key string, prefix bool, fromRev int64) (<-chan api.Event, error) {
 	out := make(chan api.Event)
-	go func() {
-		defer close(out)
-		for ev := range events {
-			if ev.Key == key {
-				out <- ev
+	err := s.watch(key, prefix, fromRev, func() { close(out) }, func(evs []api.Event) bool {
+		for _, ev := range evs {
+			if !send(s, out, ev, []api.Event{ev}, key) {
+				return false
 			}
 		}
-	}()
-	// 暂不追踪 substream cancel，可加字段做管理
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
-// WatchPrefix subscribes to changes on a key prefix
-func (s *session) WatchPrefix(prefix string, fromRev int64) (<-chan api.Event, error) {
-	ctx, _ := context.WithCancel(context.Background())
-	events, err := s.log.Watch(ctx, fromRev)
+// watch streams events for key (or every key under it if prefix is set), plus bookmarks
+// if enabled and the log's api.EventCompacted watermarks. The subscription is recorded in the session state so it can be resumed;
+// fromRev <= 0 continues after the last revision delivered on it in full, so
+// the events of an etcd transaction the client got only some of come again.
+// emit is called with a lone marker, or the matching events of one revision,
+// and returns false once the session is stopped; done is called when the
+// stream ends, which it does when the session is stopped.
+func (s *session) watch(key string, prefix bool, fromRev int64, done func(), emit func(evs []api.Event) bool) error {
+	match := func(k string) bool { return k == key }
+	if prefix {
+		match = func(k string) bool { return strings.HasPrefix(k, key) }
+	}
+	startRev := s.state.subscribe(key, prefix, fromRev)
+	revs, err := s.cache.WatchWithBookmarks(s.ctx, startRev, s.bookmarkInterval)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	out := make(chan api.Event)
+	s.logger.Debug("watch started", logging.Key(key), slog.Bool("prefix", prefix), logging.Revision(startRev))
+	s.state.watchStarted(key, prefix)
 	go func() {
-		defer close(out)
-		for ev := range events {
-			if strings.HasPrefix(ev.Key, prefix) {
-				out <- ev
+		defer done()
+		defer s.state.watchEnded(key, prefix)
+		read := startRev - 1 // highest revision read from the log
+		first := true
+		for evs := range revs {
+			head := evs[0]
+			if head.Type == api.EventCompacted {
+				// A leading marker only means the requested history was already gone.
+				if !first && min(head.Revision, s.log.LatestRevision()) > read {
+					// Events this watch had not read yet are gone.
+					s.logger.Warn("watch fell behind, events were compacted before delivery",
+						logging.Key(key), logging.Revision(head.Revision), slog.Int64("last_read", read))
+					s.observeSlowConsumer()
+				}
+				first = false
+				if !emit(evs[:1]) {
+					return
+				}
+				continue
 			}
+			read, first = max(read, head.Revision), false
+			var matched []api.Event
+			for _, ev := range evs {
+				if ev.Type == api.EventBookmark || match(ev.Key) {
+					matched = append(matched, ev)
+				}
+			}
+			if len(matched) > 0 && !emit(matched) {
+				return
+			}
+			// Only a revision handed out in full is one a resume may start after.
+			s.state.passed(key, prefix, head.Revision)
 		}
 	}()
-	return out, nil
+	return nil
+}
+
+// send hands v, which holds evs of one revision, to the client on out. It
+// returns false if the session was stopped first. An api.EventCompacted is not
+// a delivery position: it only tells the client how far back it could resume.
+func send[T any](s *session, out chan<- T, v T, evs []api.Event, key string) bool {
+	if evs[0].Type == api.EventCompacted {
+		select {
+		case <-s.ctx.Done():
+			return false
+		case out <- v:
+			return true
+		}
+	}
+	var spans []trace.Span
+	for _, ev := range evs {
+		if span := s.startDelivery(ev, key); span != nil {
+			spans = append(spans, span)
+		}
+	}
+	s.state.offer(evs[0].Revision)
+	select {
+	case <-s.ctx.Done():
+		s.state.sendAborted()
+		for _, span := range spans {
+			tracing.End(span, s.ctx.Err())
+		}
+		return false
+	case out <- v:
+		s.state.sent()
+		for _, ev := range evs {
+			s.observeDelivery(ev)
+		}
+		for _, span := range spans {
+			span.End()
+		}
+		return true
+	}
+}
+
+// startDelivery starts the session.deliver span of ev on the watch of key,
+// or returns nil when tracing is off or ev is a bookmark.
+func (s *session) startDelivery(ev api.Event, key string) trace.Span {
+	if s.tracer == nil || ev.Type == api.EventBookmark {
+		return nil
+	}
+	attrs := append(tracing.EventAttributes(ev),
+		tracing.SessionAttr.String(s.state.id), tracing.WatchAttr.String(key))
+	_, span := s.tracer.Start(tracing.Extract(s.ctx, ev), "session.deliver", trace.WithAttributes(attrs...))
+	return span
+}
+
+// observeDelivery reports how long ev took from upstream to the client. Events
+// the cache already held when the session started or resumed are replays whose
+// age says nothing about delivery, so they are left out.
+func (s *session) observeDelivery(ev api.Event) {
+	if s.metrics == nil || ev.Type == api.EventBookmark || ev.Revision <= s.startRevision {
+		return
+	}
+	start := ev.ObservedAt
+	if start.IsZero() {
+		start = ev.IngestedAt
+	}
+	if !start.IsZero() {
+		s.metrics.ObserveDeliveryLatency(time.Since(start))
+	}
+}
+
+func (s *session) observeSlowConsumer() {
+	if s.metrics != nil {
+		s.metrics.ObserveSlowConsumer()
+	}
+}
+
+// Ack records that every event up to rev has been processed by the client.
+func (s *session) Ack(rev int64) error {
+	return s.state.ack(rev)
+}
+
+// Subscriptions returns the watches recorded for this session ID.
+func (s *session) Subscriptions() []api.Subscription {
+	return s.state.subscriptions()
 }
 
 // Close 取消 watch
@@ -95,17 +237,20 @@ func (s *session) Start() error {
 }
 
 // Stop stops the session and releases resources.
+// The session ID stays resumable until the library's idle timeout expires.
 func (s *session) Stop() error {
     s.Close()
+    s.state.release(s)
     return nil
 }
 
-// ID returns a unique identifier for this session.
+// ID returns the durable identifier for this session.
 func (s *session) ID() string {
-    return fmt.Sprintf("%p", s)
+    return s.state.id
 }
 
 // CacheView returns a read-only snapshot view of the cache.
 func (s *session) CacheView() api.SnapshotView {
+    s.state.touch()
     return s.cache.Snapshot()
 }
\ No newline at end of file
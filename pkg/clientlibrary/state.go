@@ -0,0 +1,273 @@
+package clientlibrary
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found or expired")
+	ErrLibraryClosed   = errors.New("client library is closed")
+	ErrAckAhead        = errors.New("ack revision is newer than any delivered event")
+)
+
+// sessionState is the part of a session that outlives a single connection.
+// It is owned by the clientLibrary and handed to each session attached to it,
+// so a client that reconnects with ResumeSession continues where it left off.
+type sessionState struct {
+	id       string
+	clientID string
+	ackMode  bool // resume after the acked cursor instead of the last delivered event
+
+	mu         sync.Mutex
+	subs       map[subKey]*api.Subscription
+	delivered  int64 // highest revision sent to the client on any subscription
+	acked      int64 // per-session cursor advanced by Ack
+	lastActive time.Time
+	attached   *session // the session currently using this state, nil once stopped
+
+	watches      map[subKey]int // watch streams still running, by subscription
+	sending      int       // of those, the ones waiting for the client to take an event
+	sendingSince time.Time // when the oldest of those sends started
+}
+
+type subKey struct {
+	key    string
+	prefix bool
+}
+
+func newSessionState(clientID string, ackMode bool) (*sessionState, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionState{
+		id:         id,
+		clientID:   clientID,
+		ackMode:    ackMode,
+		subs:       make(map[subKey]*api.Subscription),
+		watches:    make(map[subKey]int),
+		lastActive: time.Now(),
+	}, nil
+}
+
+// newSessionID returns a random 128-bit hex ID, unique across processes.
+func newSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// touch records client activity for the idle timeout.
+func (st *sessionState) touch() {
+	st.mu.Lock()
+	st.lastActive = time.Now()
+	st.mu.Unlock()
+}
+
+// subscribe records a subscription and returns the revision its stream should start at.
+// fromRev <= 0 resumes an existing subscription right after the last revision
+// it delivered in full, or right after the session's acked cursor in
+// acknowledged delivery mode if that is older.
+func (st *sessionState) subscribe(key string, prefix bool, fromRev int64) int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastActive = time.Now()
+
+	k := subKey{key: key, prefix: prefix}
+	sub, ok := st.subs[k]
+	if !ok {
+		sub = &api.Subscription{Key: key, Prefix: prefix}
+		st.subs[k] = sub
+	}
+	if fromRev <= 0 {
+		if st.ackMode {
+			// An acked revision may be one the client got only part of.
+			return min(st.acked, sub.Revision) + 1
+		}
+		return sub.Revision + 1
+	}
+	sub.Revision = fromRev - 1
+	return fromRev
+}
+
+// watchStarted and watchEnded count the running watch streams.
+func (st *sessionState) watchStarted(key string, prefix bool) {
+	st.mu.Lock()
+	st.watches[subKey{key: key, prefix: prefix}]++
+	st.mu.Unlock()
+}
+
+func (st *sessionState) watchEnded(key string, prefix bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	k := subKey{key: key, prefix: prefix}
+	if st.watches[k]--; st.watches[k] == 0 {
+		delete(st.watches, k)
+	}
+}
+
+// offer is called right before an event is sent, so a client that acks the
+// event as soon as it arrives is never rejected with ErrAckAhead. Every offer
+// is followed by sent or, if the watch ends first, sendAborted.
+func (st *sessionState) offer(rev int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if rev > st.delivered {
+		st.delivered = rev
+	}
+	if st.sending == 0 {
+		st.sendingSince = time.Now()
+	}
+	st.sending++
+}
+
+// sent records that the client took an offered event.
+func (st *sessionState) sent() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastActive = time.Now()
+	st.sending--
+}
+
+// passed advances a subscription once every event of rev it matches has been
+// handed to the client.
+func (st *sessionState) passed(key string, prefix bool, rev int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sub, ok := st.subs[subKey{key: key, prefix: prefix}]; ok && rev > sub.Revision {
+		sub.Revision = rev
+	}
+}
+
+func (st *sessionState) sendAborted() {
+	st.mu.Lock()
+	st.sending--
+	st.mu.Unlock()
+}
+
+// ack advances the session cursor. Acking an older revision is a no-op.
+func (st *sessionState) ack(rev int64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastActive = time.Now()
+	if rev > st.delivered {
+		return ErrAckAhead
+	}
+	if rev > st.acked {
+		st.acked = rev
+	}
+	return nil
+}
+
+// cursor snapshots the delivery position; pending counts the EventLog events
+// after a revision. A subscription is advanced past every revision its watch
+// has read, matching or not, so the count is what the client has yet to
+// receive and stays 0 on a caught-up watch of a quiet key.
+func (st *sessionState) cursor(pending func(after int64) int64) api.SessionCursor {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var lag int64
+	if len(st.subs) > 0 {
+		resumeAfter := int64(math.MaxInt64)
+		for _, sub := range st.subs {
+			resumeAfter = min(resumeAfter, sub.Revision)
+		}
+		if st.ackMode {
+			resumeAfter = min(resumeAfter, st.acked)
+		}
+		lag = pending(resumeAfter)
+	}
+	var watches []api.WatchCursor
+	if st.attached != nil {
+		for k, n := range st.watches {
+			backlog := pending(st.subs[k].Revision)
+			for range n {
+				watches = append(watches, api.WatchCursor{Key: k.key, Prefix: k.prefix, Backlog: backlog})
+			}
+		}
+		sort.Slice(watches, func(i, j int) bool {
+			if watches[i].Key != watches[j].Key {
+				return watches[i].Key < watches[j].Key
+			}
+			return !watches[i].Prefix && watches[j].Prefix
+		})
+	}
+	return api.SessionCursor{
+		SessionID:     st.id,
+		ClientID:      st.clientID,
+		Attached:      st.attached != nil,
+		Delivered:     st.delivered,
+		Acked:         st.acked,
+		Lag:           lag,
+		LastActive:    st.lastActive,
+		Subscriptions: st.subscriptionsLocked(),
+		Watches:       watches,
+	}
+}
+
+// subscriptions returns a copy of the recorded subscriptions ordered by key.
+func (st *sessionState) subscriptions() []api.Subscription {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.subscriptionsLocked()
+}
+
+func (st *sessionState) subscriptionsLocked() []api.Subscription {
+	subs := make([]api.Subscription, 0, len(st.subs))
+	for _, sub := range st.subs {
+		subs = append(subs, *sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Key != subs[j].Key {
+			return subs[i].Key < subs[j].Key
+		}
+		return !subs[i].Prefix && subs[j].Prefix
+	})
+	return subs
+}
+
+// attach makes s the session using this state and stops the one it replaces.
+func (st *sessionState) attach(s *session) {
+	st.mu.Lock()
+	prev := st.attached
+	st.attached = s
+	st.lastActive = time.Now()
+	st.mu.Unlock()
+	if prev != nil {
+		prev.cancelWatch()
+	}
+}
+
+// release detaches s if it is still the attached session.
+func (st *sessionState) release(s *session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.attached == s {
+		st.attached = nil
+	}
+	st.lastActive = time.Now()
+}
+
+// abandoned reports whether the client has been gone since cutoff: nothing
+// happened on the session since then and it is detached, or attached without a
+// watch, or a watch has been waiting since then for the client to take an
+// event. An attached session whose watches are just waiting for changes is
+// kept, however long that takes.
+func (st *sessionState) abandoned(cutoff time.Time) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.lastActive.Before(cutoff) {
+		return false
+	}
+	return st.attached == nil || len(st.watches) == 0 || st.sending > 0 && st.sendingSince.Before(cutoff)
+}
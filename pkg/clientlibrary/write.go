@@ -0,0 +1,100 @@
+package clientlibrary
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ErrReadOnly is returned by session writes when the library has no etcd client.
+var ErrReadOnly = errors.New("session is read-only: no etcd client configured")
+
+// WriteAuditor records which session wrote what to etcd; see WithWriteAuditor.
+type WriteAuditor interface {
+	AuditWrite(session, key string, rev int64, value []byte, deleted bool) error
+}
+
+// Put writes key=value to etcd and waits until the cache has applied it.
+func (s *session) Put(ctx context.Context, key string, value []byte) (int64, error) {
+	if s.kv == nil {
+		return 0, ErrReadOnly
+	}
+	s.state.touch()
+	resp, err := s.kv.Put(ctx, key, string(value))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.audit(key, resp.Header.Revision, value, false); err != nil {
+		return resp.Header.Revision, err
+	}
+	return s.awaitCache(ctx, resp.Header.Revision)
+}
+
+// Delete removes key from etcd and waits until the cache has applied it.
+// Deleting a missing key does not create a revision, so there is nothing to wait for.
+func (s *session) Delete(ctx context.Context, key string) (int64, error) {
+	if s.kv == nil {
+		return 0, ErrReadOnly
+	}
+	s.state.touch()
+	resp, err := s.kv.Delete(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Deleted == 0 {
+		return resp.Header.Revision, nil
+	}
+	if err := s.audit(key, resp.Header.Revision, nil, true); err != nil {
+		return resp.Header.Revision, err
+	}
+	return s.awaitCache(ctx, resp.Header.Revision)
+}
+
+// CompareAndSwap runs a single-key Txn in etcd: put value if the key's ModRevision
+// equals modRev (0 for "does not exist"). Only a successful swap waits for the cache.
+func (s *session) CompareAndSwap(ctx context.Context, key string, modRev int64, value []byte) (bool, int64, error) {
+	if s.kv == nil {
+		return false, 0, ErrReadOnly
+	}
+	s.state.touch()
+	resp, err := s.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRev)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	if !resp.Succeeded {
+		return false, resp.Header.Revision, nil
+	}
+	if err := s.audit(key, resp.Header.Revision, value, false); err != nil {
+		return true, resp.Header.Revision, err
+	}
+	rev, err := s.awaitCache(ctx, resp.Header.Revision)
+	return true, rev, err
+}
+
+// awaitCache blocks until the cache reaches rev so the caller can read its own write.
+func (s *session) awaitCache(ctx context.Context, rev int64) (int64, error) {
+	if err := s.cache.WaitForRevision(ctx, rev); err != nil {
+		return rev, err
+	}
+	return rev, nil
+}
+
+// audit records a successful write. The write is already committed in etcd, so
+// an error here means only the audit record is missing; it is returned alongside
+// the revision and must not be treated as a failed write.
+func (s *session) audit(key string, rev int64, value []byte, deleted bool) error {
+	if s.auditor == nil {
+		return nil
+	}
+	err := s.auditor.AuditWrite(s.state.id, key, rev, value, deleted)
+	if err != nil {
+		s.logger.Error("write committed without audit record", logging.Key(key), logging.Revision(rev), slog.Any("error", err))
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package clientlibrary
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/adapter"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/watcher"
+)
+
+func TestSession_WriteThroughReadYourWrites(t *testing.T) {
+	cli := etcdtest.Client(t)
+
+	log := eventlog.NewMemoryEventLog(10)
+	wc := proxy.NewWatchCacheWithLog(nil, log)
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	defer stopWatch()
+	// Start from a known revision so no write can slip in before the watch is registered.
+	head, err := cli.Get(watchCtx, "/app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go watcher.WatchWithAdapter(watchCtx, cli, "/app/", head.Header.Revision+1, adapter.NewEtcdAdapter(), wc)
+
+	auditor := &writeRecorder{}
+	cl := NewClientLibrary(wc, log, WithEtcdClient(cli), WithWriteAuditor(auditor))
+	defer cl.Close()
+	sess, err := cl.NewSession("writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rev, err := sess.Put(ctx, "/app/config", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, ok := sess.CacheView().Get("/app/config")
+	if !ok || string(kv.Value) != "v1" || kv.Revision != rev {
+		t.Fatalf("expected /app/config=v1@%d in cache right after Put, got %+v (found=%v)", rev, kv, ok)
+	}
+
+	// A stale compare must fail without touching etcd or the cache.
+	swapped, _, err := sess.CompareAndSwap(ctx, "/app/config", rev-1, []byte("stale"))
+	if err != nil || swapped {
+		t.Fatalf("expected stale CAS to fail, got swapped=%v err=%v", swapped, err)
+	}
+	swapped, casRev, err := sess.CompareAndSwap(ctx, "/app/config", rev, []byte("v2"))
+	if err != nil || !swapped {
+		t.Fatalf("expected CAS to succeed, got swapped=%v err=%v", swapped, err)
+	}
+	if kv, _ := sess.CacheView().Get("/app/config"); string(kv.Value) != "v2" || kv.Revision != casRev {
+		t.Fatalf("expected /app/config=v2@%d after CAS, got %+v", casRev, kv)
+	}
+
+	if _, err := sess.Delete(ctx, "/app/config"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sess.CacheView().Get("/app/config"); ok {
+		t.Fatal("expected /app/config to be gone from the cache after Delete")
+	}
+	// Put, the successful CAS and Delete were audited; the failed CAS was not.
+	if len(auditor.writes) != 3 || auditor.writes[0] != sess.ID()+" /app/config put" || auditor.writes[2] != sess.ID()+" /app/config delete" {
+		t.Fatalf("unexpected audited writes %q", auditor.writes)
+	}
+}
+
+type writeRecorder struct {
+	writes []string
+}
+
+func (r *writeRecorder) AuditWrite(session, key string, _ int64, _ []byte, deleted bool) error {
+	op := "put"
+	if deleted {
+		op = "delete"
+	}
+	r.writes = append(r.writes, session+" "+key+" "+op)
+	return nil
+}
+
+func TestSession_ReadOnlyWithoutEtcdClient(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cl := NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log)
+	defer cl.Close()
+	sess, err := cl.NewSession("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Stop()
+	if _, err := sess.Put(context.Background(), "k", []byte("v")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package codec provides pluggable value encodings for typed views over the cache.
+//
+// A Codec[T] turns the raw []byte stored for a key into a T and back. JSON, YAML,
+// protobuf and raw codecs are provided; any other format only needs to implement
+// the two-method interface.
+package codec
+
+import (
+	"encoding/json"
+
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Codec converts between a stored value and its typed form.
+type Codec[T any] interface {
+	Decode(data []byte) (T, error)
+	Encode(v T) ([]byte, error)
+}
+
+type jsonCodec[T any] struct{}
+
+// JSON decodes values with encoding/json.
+func JSON[T any]() Codec[T] { return jsonCodec[T]{} }
+
+func (jsonCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+func (jsonCodec[T]) Encode(v T) ([]byte, error) { return json.Marshal(v) }
+
+type yamlCodec[T any] struct{}
+
+// YAML decodes values with gopkg.in/yaml.v3.
+func YAML[T any]() Codec[T] { return yamlCodec[T]{} }
+
+func (yamlCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := yaml.Unmarshal(data, &v)
+	return v, err
+}
+
+func (yamlCodec[T]) Encode(v T) ([]byte, error) { return yaml.Marshal(v) }
+
+type protoCodec[T proto.Message] struct {
+	newMsg func() T
+}
+
+// Protobuf decodes values into messages created by newMsg, e.g.
+// codec.Protobuf(func() *pb.Endpoint { return new(pb.Endpoint) }).
+func Protobuf[T proto.Message](newMsg func() T) Codec[T] { return protoCodec[T]{newMsg: newMsg} }
+
+func (c protoCodec[T]) Decode(data []byte) (T, error) {
+	msg := c.newMsg()
+	err := proto.Unmarshal(data, msg)
+	return msg, err
+}
+
+func (protoCodec[T]) Encode(v T) ([]byte, error) { return proto.Marshal(v) }
+
+type rawCodec struct{}
+
+// Raw passes values through unchanged, copying them so callers cannot alias cache memory.
+func Raw() Codec[[]byte] { return rawCodec{} }
+
+func (rawCodec) Decode(data []byte) ([]byte, error) { return append([]byte(nil), data...), nil }
+
+func (rawCodec) Encode(v []byte) ([]byte, error) { return append([]byte(nil), v...), nil }
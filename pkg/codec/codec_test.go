@@ -0,0 +1,45 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type sample struct {
+	Name  string `json:"name" yaml:"name"`
+	Ports []int  `json:"ports" yaml:"ports"`
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	want := sample{Name: "web", Ports: []int{80, 443}}
+	for name, c := range map[string]Codec[sample]{"json": JSON[sample](), "yaml": YAML[sample]()} {
+		data, err := c.Encode(want)
+		require.NoError(t, err, name)
+		got, err := c.Decode(data)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+
+	pb := Protobuf(func() *wrapperspb.StringValue { return new(wrapperspb.StringValue) })
+	data, err := pb.Encode(wrapperspb.String("hello"))
+	require.NoError(t, err)
+	msg, err := pb.Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", msg.GetValue())
+}
+
+func TestRawCodecCopies(t *testing.T) {
+	in := []byte("abc")
+	out, err := Raw().Decode(in)
+	require.NoError(t, err)
+	in[0] = 'x'
+	assert.Equal(t, "abc", string(out))
+}
+
+func TestJSONDecodeError(t *testing.T) {
+	_, err := JSON[sample]().Decode([]byte("{"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,202 @@
+package eventlog
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+)
+
+// CompactionPolicy decides how far a log may be compacted. Given the retained
+// events (oldest first) it returns the revision up to which they may be removed,
+// or 0 to keep everything.
+type CompactionPolicy func(ctx context.Context, events []Event, now time.Time) (int64, error)
+
+// KeepRevisions retains the last n revisions of history; n <= 0 sets no limit.
+func KeepRevisions(n int64) CompactionPolicy {
+	return func(_ context.Context, events []Event, _ time.Time) (int64, error) {
+		if n <= 0 || len(events) == 0 {
+			return 0, nil
+		}
+		return events[len(events)-1].Revision - n, nil
+	}
+}
+
+// KeepDuration retains events ingested within d. It relies on Event.IngestedAt;
+// events without a timestamp never expire by age.
+func KeepDuration(d time.Duration) CompactionPolicy {
+	return func(_ context.Context, events []Event, now time.Time) (int64, error) {
+		cutoff := now.Add(-d)
+		var rev int64
+		for _, ev := range events {
+			if ev.IngestedAt.IsZero() {
+				continue
+			}
+			if !ev.IngestedAt.Before(cutoff) {
+				break
+			}
+			rev = ev.Revision
+		}
+		return rev, nil
+	}
+}
+
+// KeepBytes retains the newest events whose keys and values add up to at most m bytes.
+func KeepBytes(m int) CompactionPolicy {
+	return func(_ context.Context, events []Event, _ time.Time) (int64, error) {
+		total := 0
+		for i := len(events) - 1; i >= 0; i-- {
+			total += EventSize(events[i])
+			if total > m {
+				return events[i].Revision, nil
+			}
+		}
+		return 0, nil
+	}
+}
+
+// UpstreamCompaction follows etcd's own compaction: compactedRev reports etcd's
+// compact revision (see watcher.EtcdCompactRevision), and history etcd can no
+// longer serve is dropped from the log as well, so a watch resumed from the cache
+// fails the same way it would against etcd.
+func UpstreamCompaction(compactedRev func(ctx context.Context) (int64, error)) CompactionPolicy {
+	return func(ctx context.Context, _ []Event, _ time.Time) (int64, error) {
+		rev, err := compactedRev(ctx)
+		if err != nil || rev <= 0 {
+			return 0, err
+		}
+		// etcd still serves its compact revision itself.
+		return rev - 1, nil
+	}
+}
+
+// EventSize is the number of bytes an event accounts for in KeepBytes.
+func EventSize(ev Event) int {
+	return len(ev.Key) + len(ev.Value)
+}
+
+// CompactionResult describes one run of a Compactor.
+type CompactionResult struct {
+	Revision int64 // the watermark after the run
+	Removed  int   // events removed by this run
+}
+
+// Compactor applies compaction policies to any EventLog. The most aggressive
+// policy wins: the log is compacted up to the highest revision any of them allows.
+type Compactor struct {
+	log      EventLog
+	policies []CompactionPolicy
+	interval time.Duration
+	metrics  api.MetricsCollector
+	logger   *slog.Logger
+	now      func() time.Time
+
+	mu      sync.Mutex
+	runs    int64
+	removed int64
+}
+
+// CompactorOption configures a Compactor.
+type CompactorOption func(*Compactor)
+
+// WithPolicies adds compaction policies.
+func WithPolicies(policies ...CompactionPolicy) CompactorOption {
+	return func(c *Compactor) {
+		c.policies = append(c.policies, policies...)
+	}
+}
+
+// WithCompactionInterval sets how often Run evaluates the policies (default one minute).
+func WithCompactionInterval(d time.Duration) CompactorOption {
+	return func(c *Compactor) {
+		c.interval = d
+	}
+}
+
+// WithCompactionMetrics reports every compaction to m.
+func WithCompactionMetrics(m api.MetricsCollector) CompactorOption {
+	return func(c *Compactor) {
+		c.metrics = m
+	}
+}
+
+// WithCompactionLogger sets the logger Run reports compactions and failed rounds to
+// (default slog.Default()).
+func WithCompactionLogger(l *slog.Logger) CompactorOption {
+	return func(c *Compactor) {
+		c.logger = l
+	}
+}
+
+// NewCompactor creates a compactor for log. Without policies it never compacts.
+func NewCompactor(log EventLog, opts ...CompactorOption) *Compactor {
+	c := &Compactor{log: log, interval: time.Minute, now: time.Now}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.logger = logging.Component(c.logger, "compactor")
+	return c
+}
+
+// CompactOnce evaluates every policy and compacts the log if any of them allows
+// it. Watchers of the log learn the new watermark through an EventCompacted.
+func (c *Compactor) CompactOnce(ctx context.Context) (CompactionResult, error) {
+	events, err := c.log.ListSince(0)
+	if err != nil {
+		return CompactionResult{}, err
+	}
+	now := c.now()
+	var target int64
+	for _, p := range c.policies {
+		rev, err := p(ctx, events, now)
+		if err != nil {
+			return CompactionResult{}, err
+		}
+		target = max(target, rev)
+	}
+	watermark := c.log.CompactedRevision()
+	if target <= watermark {
+		return CompactionResult{Revision: watermark}, nil
+	}
+
+	res := CompactionResult{Removed: c.log.Compact(target), Revision: c.log.CompactedRevision()}
+	c.mu.Lock()
+	c.runs++
+	c.removed += int64(res.Removed)
+	c.mu.Unlock()
+	if c.metrics != nil {
+		c.metrics.ObserveCompaction(res.Removed, res.Revision)
+	}
+	return res, nil
+}
+
+// Run calls CompactOnce every interval until ctx is done. A failing policy, e.g.
+// etcd being unreachable, skips that round rather than stopping the loop.
+func (c *Compactor) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := c.CompactOnce(ctx)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				c.logger.Warn("compaction round skipped", slog.Any("error", err))
+			case res.Removed > 0:
+				c.logger.Info("compacted event log", logging.Revision(res.Revision), slog.Int("removed", res.Removed))
+			}
+		}
+	}
+}
+
+// Stats returns how many compactions ran and how many events they removed in total.
+func (c *Compactor) Stats() (runs, removed int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.runs, c.removed
+}
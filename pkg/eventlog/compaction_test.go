@@ -0,0 +1,173 @@
+package eventlog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type compactionRecorder struct {
+	removed   []int
+	watermark []int64
+}
+
+func (r *compactionRecorder) ObserveRequestRate(string, int)        {}
+func (r *compactionRecorder) ObserveDeliveryLatency(time.Duration)  {}
+func (r *compactionRecorder) ObserveUpstreamRevision(int64)         {}
+func (r *compactionRecorder) ObserveApplyLatency(time.Duration)     {}
+func (r *compactionRecorder) ObserveSlowConsumer()                  {}
+func (r *compactionRecorder) ObserveConsistencyCheck(int, int, int) {}
+func (r *compactionRecorder) ObserveCompaction(n int, w int64) {
+	r.removed = append(r.removed, n)
+	r.watermark = append(r.watermark, w)
+}
+
+func appendRevs(t *testing.T, log EventLog, from, to int64, at time.Time) {
+	for rev := from; rev <= to; rev++ {
+		require.NoError(t, log.Append(Event{Type: EventPut, Key: "k", Value: []byte("0123456789"), Revision: rev, IngestedAt: at}))
+	}
+}
+
+func TestCompactionPolicies(t *testing.T) {
+	now := time.Now()
+	ctx := context.Background()
+	log := NewMemoryEventLog(100)
+	appendRevs(t, log, 1, 5, now.Add(-time.Hour))
+	appendRevs(t, log, 6, 10, now)
+	events, _ := log.ListSince(0)
+
+	rev, _ := KeepRevisions(3)(ctx, events, now)
+	assert.Equal(t, int64(7), rev)
+	rev, _ = KeepRevisions(0)(ctx, events, now)
+	assert.Equal(t, int64(0), rev, "no limit, not an empty history")
+	rev, _ = KeepDuration(time.Minute)(ctx, events, now)
+	assert.Equal(t, int64(5), rev)
+	rev, _ = KeepBytes(3*11)(ctx, events, now) // each event is 11 bytes
+	assert.Equal(t, int64(7), rev)
+	rev, _ = UpstreamCompaction(func(context.Context) (int64, error) { return 4, nil })(ctx, events, now)
+	assert.Equal(t, int64(3), rev)
+}
+
+func TestCompactor_MostAggressivePolicyWins(t *testing.T) {
+	log := NewMemoryEventLog(100)
+	appendRevs(t, log, 1, 10, time.Now())
+	rec := &compactionRecorder{}
+	c := NewCompactor(log,
+		WithPolicies(KeepRevisions(8), KeepRevisions(4)),
+		WithCompactionMetrics(rec))
+
+	res, err := c.CompactOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, CompactionResult{Revision: 6, Removed: 6}, res)
+	assert.Equal(t, int64(6), log.CompactedRevision())
+
+	// Nothing new to compact: no second compaction is reported.
+	_, err = c.CompactOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []int{6}, rec.removed)
+	assert.Equal(t, []int64{6}, rec.watermark)
+	runs, removed := c.Stats()
+	assert.Equal(t, int64(1), runs)
+	assert.Equal(t, int64(6), removed)
+}
+
+func TestWatchReportsCompactionWatermark(t *testing.T) {
+	log := NewMemoryEventLog(100)
+	appendRevs(t, log, 1, 3, time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := log.Watch(ctx, 4)
+	require.NoError(t, err)
+
+	log.Compact(2)
+	appendRevs(t, log, 4, 4, time.Now())
+	assert.Equal(t, Event{Type: EventCompacted, Revision: 2}, recv(t, ch))
+	assert.Equal(t, int64(4), recv(t, ch).Revision)
+
+	// A watch from compacted history starts with the watermark.
+	late, err := log.Watch(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, Event{Type: EventCompacted, Revision: 2}, recv(t, late))
+	assert.Equal(t, int64(3), recv(t, late).Revision)
+}
+
+func TestWatchReportsEvictionOnlyToLaggingWatchers(t *testing.T) {
+	log := NewMemoryEventLog(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := log.Watch(ctx, 1)
+	require.NoError(t, err)
+
+	appendRevs(t, log, 1, 3, time.Now()) // evicts revision 1 from the ring
+	assert.Equal(t, int64(1), log.CompactedRevision())
+	var got []Event
+	for len(got) < 3 {
+		got = append(got, recv(t, ch))
+	}
+	if got[0].Type == EventCompacted {
+		// The watcher was slower than the ring: it is told what it missed.
+		assert.Equal(t, int64(1), got[0].Revision)
+		assert.Equal(t, int64(2), got[1].Revision)
+	} else {
+		assert.Equal(t, []int64{1, 2, 3}, []int64{got[0].Revision, got[1].Revision, got[2].Revision})
+	}
+}
+
+func recv(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to log into from another goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCompactorRunLogsFailedRounds(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	failing := func(context.Context, []Event, time.Time) (int64, error) {
+		return 0, errors.New("etcd unreachable")
+	}
+	c := NewCompactor(NewMemoryEventLog(4), WithPolicies(failing),
+		WithCompactionInterval(time.Millisecond), WithCompactionLogger(logger))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return strings.Contains(out.String(), "etcd unreachable") }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.Contains(t, out.String(), `"component":"compactor"`)
+	assert.Contains(t, out.String(), `"level":"WARN"`)
+}
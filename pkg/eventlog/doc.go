@@ -5,6 +5,7 @@ This package defines:
 - Event: the internal representation of a cache-level change event, including key, value, revision info.
 - EventLog: the core interface for event sinks that store or process historical events.
 - MemoryEventLog: an in-memory circular buffer implementation of EventLog.
+- Compactor: applies retention policies (revisions, age, bytes, etcd's compaction) to any EventLog.
 - EtcdLog and WALLog: planned extensions for persistent event log storage.
 
 This subpackage enables features such as replay, audit, snapshot recovery, and diff-based views
@@ -1,7 +1,9 @@
 package eventlog
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -40,4 +42,23 @@ func TestEventLogInterface(t *testing.T) {
     // - Compact when multiple events have the same Revision:
     //     Although Revision is expected to be unique and monotonically increasing,
     //     if duplicates occur (e.g. from replayed events or WAL bugs), all matching entries should be evicted.
-}
\ No newline at end of file
+}
+func TestWatchDeliversEventsSharingARevision(t *testing.T) {
+    log := NewMemoryEventLog(5)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    ch, err := log.Watch(ctx, 1)
+    assert.NoError(t, err)
+
+    // Two keys written by one etcd transaction carry the same revision.
+    assert.NoError(t, log.Append(Event{Key: "a", Revision: 3}))
+    assert.Equal(t, "a", (<-ch).Key)
+    assert.NoError(t, log.Append(Event{Key: "b", Revision: 3}))
+
+    select {
+    case ev := <-ch:
+        assert.Equal(t, "b", ev.Key)
+    case <-time.After(time.Second):
+        t.Fatal("second event of the same revision was skipped")
+    }
+}
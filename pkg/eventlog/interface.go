@@ -10,6 +10,47 @@ type EventLog interface {
     ListSince(fromRev int64) ([]Event, error)    // Returns all events with Revision > fromRev
     Compact(rev int64) int 
     LatestRevision() int64                       // Returns the current max Revision in the log
+    // CompactedRevision returns the watermark below which history is gone: events
+    // at or below it were removed by Compact or evicted, so a replay from there is incomplete.
+    CompactedRevision() int64
     // Watch returns a channel streaming events with Revision > sinceRev.
     Watch(ctx context.Context, sinceRev int64) (<-chan Event, error)
 }
+
+// Bounds describes the history an EventLog currently holds.
+type Bounds struct {
+    Len       int   // retained events
+    Oldest    int64 // revision of the oldest retained event, 0 if the log is empty
+    Latest    int64
+    Compacted int64
+}
+
+// BoundsOf returns the bounds of log. A MemoryEventLog answers directly; other
+// logs are listed from the start.
+func BoundsOf(log EventLog) Bounds {
+    b := Bounds{Latest: log.LatestRevision(), Compacted: log.CompactedRevision()}
+    if l, ok := log.(interface {
+        Len() int
+        OldestRevision() int64
+    }); ok {
+        b.Len, b.Oldest = l.Len(), l.OldestRevision()
+        return b
+    }
+    if evs, err := log.ListSince(0); err == nil && len(evs) > 0 {
+        b.Len, b.Oldest = len(evs), evs[0].Revision
+    }
+    return b
+}
+
+// CountSince returns the number of events in log with Revision >= fromRev. A
+// MemoryEventLog answers directly; other logs are listed.
+func CountSince(log EventLog, fromRev int64) int {
+    if l, ok := log.(interface{ CountSince(int64) int }); ok {
+        return l.CountSince(fromRev)
+    }
+    evs, err := log.ListSince(fromRev)
+    if err != nil {
+        return 0
+    }
+    return len(evs)
+}
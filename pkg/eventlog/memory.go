@@ -2,42 +2,80 @@ package eventlog
 
 import (
 	"context"
-	"time"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
 )
 
 // MemoryEventLog is the default in-memory implementation of EventLog.
 // It uses a slice as a ring buffer to store recent events.
+// All methods are safe for concurrent use.
 type MemoryEventLog struct {
+    mu          sync.RWMutex
     events      []Event
     capacity    int
     startIndex  int
     count       int
     latestRev   int64
+    appended    int64         // total number of appends, used as a position by watchers
+    compactedRev int64        // events at or below this revision have been removed or evicted
+    compactCalled int64       // the highest revision passed to Compact
+    notify      chan struct{} // closed and replaced on every Append to wake watchers
+    logger      *slog.Logger
+}
+
+// MemoryOption configures a MemoryEventLog.
+type MemoryOption func(*MemoryEventLog)
+
+// WithLogger sets the logger for compactions and watchers that fall behind (default slog.Default()).
+func WithLogger(l *slog.Logger) MemoryOption {
+    return func(log *MemoryEventLog) {
+        log.logger = l
+    }
 }
 
 // NewMemoryEventLog initializes a new MemoryEventLog with a fixed capacity.
-func NewMemoryEventLog(capacity int) *MemoryEventLog {
-    return &MemoryEventLog{
+func NewMemoryEventLog(capacity int, opts ...MemoryOption) *MemoryEventLog {
+    l := &MemoryEventLog{
         events:   make([]Event, capacity),
         capacity: capacity,
+        notify:   make(chan struct{}),
     }
+    for _, opt := range opts {
+        opt(l)
+    }
+    l.logger = logging.Component(l.logger, "eventlog")
+    return l
 }
 
 // Append adds a new event to the log, maintaining a fixed-size ring buffer.
 func (l *MemoryEventLog) Append(ev Event) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
     l.latestRev = ev.Revision
     pos := (l.startIndex + l.count) % l.capacity
+    if l.count == l.capacity && l.events[pos].Revision > l.compactedRev {
+        // The ring is full: the oldest event is overwritten, which is a compaction too.
+        l.compactedRev = l.events[pos].Revision
+    }
     l.events[pos] = ev
     if l.count < l.capacity {
         l.count++
     } else {
         l.startIndex = (l.startIndex + 1) % l.capacity
     }
+    l.appended++
+    close(l.notify)
+    l.notify = make(chan struct{})
     return nil
 }
 
 // ListSince returns all events with Revision >= fromRev.
 func (l *MemoryEventLog) ListSince(fromRev int64) ([]Event, error) {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
     result := []Event{}
     for i := 0; i < l.count; i++ {
         idx := (l.startIndex + i) % l.capacity
@@ -49,13 +87,28 @@ func (l *MemoryEventLog) ListSince(fromRev int64) ([]Event, error) {
     return result, nil
 }
 
+// CountSince returns the number of events with Revision >= fromRev.
+func (l *MemoryEventLog) CountSince(fromRev int64) int {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    i := sort.Search(l.count, func(i int) bool {
+        return l.events[(l.startIndex+i)%l.capacity].Revision >= fromRev
+    })
+    return l.count - i
+}
+
 // LatestRevision returns the highest Revision seen so far.
 func (l *MemoryEventLog) LatestRevision() int64 {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
     return l.latestRev
 }
 
 // Compact removes all events with Revision <= rev and returns the count of removed events.
+// It raises CompactedRevision to rev and wakes watchers so they can report it.
 func (l *MemoryEventLog) Compact(rev int64) int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
     removed := 0
     for l.count > 0 {
         ev := l.events[l.startIndex]
@@ -66,45 +119,109 @@ func (l *MemoryEventLog) Compact(rev int64) int {
         l.count--
         removed++
     }
+    if rev > l.compactedRev {
+        l.compactedRev = rev
+    }
+    if rev > l.compactCalled {
+        l.compactCalled = rev
+        close(l.notify)
+        l.notify = make(chan struct{})
+    }
+    l.logger.Debug("compacted", logging.Revision(rev), slog.Int("removed", removed))
     return removed
 }
 
+// Len returns the number of events currently retained.
+func (l *MemoryEventLog) Len() int {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    return l.count
+}
+
+// OldestRevision returns the revision of the oldest retained event, or 0 if the log is empty.
+func (l *MemoryEventLog) OldestRevision() int64 {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    if l.count == 0 {
+        return 0
+    }
+    return l.events[l.startIndex].Revision
+}
+
+// CompactedRevision returns the highest revision removed by Compact or evicted
+// from the full ring buffer.
+func (l *MemoryEventLog) CompactedRevision() int64 {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    return l.compactedRev
+}
+
 // Watch returns a channel streaming events with Revision >= sinceRev.
-// It first emits historical events, then polls for new events periodically.
+// It first emits historical events, then wakes up on every Append to fan the
+// new events out to all watchers.
+//
+// Every Compact raises the watermark and the stream carries an EventCompacted
+// with the new CompactedRevision before any later event. Evictions from the full
+// ring buffer are only reported to watchers that missed events because of them,
+// and a watch asking for history that is already gone starts with the marker.
 func (l *MemoryEventLog) Watch(ctx context.Context, sinceRev int64) (<-chan Event, error) {
     ch := make(chan Event)
+    l.mu.RLock()
+    pos := l.appended - int64(l.count) // the oldest retained event
+    reported := l.compactedRev
+    l.mu.RUnlock()
+    if sinceRev <= reported {
+        reported = 0
+    }
     go func() {
         defer close(ch)
-        rev := sinceRev
-        // Emit historical events
-        evs, _ := l.ListSince(rev)
-        for _, ev := range evs {
-            select {
-            case <-ctx.Done():
-                return
-            case ch <- ev:
-                rev = ev.Revision
-            }
-        }
-        // Poll for new events
-        ticker := time.NewTicker(100 * time.Millisecond)
-        defer ticker.Stop()
         for {
+            evs, next, compacted, wake := l.readFrom(pos, sinceRev)
+            if compacted > reported {
+                // Compact was called, or this watcher lost events to eviction.
+                reported = compacted
+                evs = append([]Event{{Type: EventCompacted, Revision: compacted}}, evs...)
+            }
+            for _, ev := range evs {
+                select {
+                case <-ctx.Done():
+                    return
+                case ch <- ev:
+                }
+            }
+            pos = next
             select {
             case <-ctx.Done():
                 return
-            case <-ticker.C:
-                evs, _ := l.ListSince(rev + 1)
-                for _, ev := range evs {
-                    select {
-                    case <-ctx.Done():
-                        return
-                    case ch <- ev:
-                        rev = ev.Revision
-                    }
-                }
+            case <-wake:
             }
         }
     }()
     return ch, nil
-}
\ No newline at end of file
+}
+
+// readFrom returns the retained events at append position >= pos with
+// Revision >= sinceRev, the position to continue from, the compaction
+// watermark to report (see Watch) and a channel closed by the next Append or Compact. Tracking
+// positions rather than revisions keeps watchers from skipping events that
+// share a revision (several keys written by one etcd txn).
+func (l *MemoryEventLog) readFrom(pos, sinceRev int64) ([]Event, int64, int64, <-chan struct{}) {
+    l.mu.RLock()
+    defer l.mu.RUnlock()
+    first := l.appended - int64(l.count)
+    compacted := l.compactCalled
+    if pos < first {
+        l.logger.Warn("watcher fell behind, evicted events are lost to it",
+            slog.Int64("lost", first-pos), logging.Revision(l.compactedRev))
+        compacted = l.compactedRev
+        pos = first
+    }
+    var result []Event
+    for i := int(pos - first); i < l.count; i++ {
+        ev := l.events[(l.startIndex+i)%l.capacity]
+        if ev.Revision >= sinceRev {
+            result = append(result, ev)
+        }
+    }
+    return result, l.appended, compacted, l.notify
+}
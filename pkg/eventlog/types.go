@@ -6,4 +6,6 @@ type Event = api.Event
 const (
     EventPut    = api.EventPut
     EventDelete = api.EventDelete
+    EventBookmark = api.EventBookmark
+    EventCompacted = api.EventCompacted
 )
\ No newline at end of file
@@ -0,0 +1,31 @@
+/*
+Package gateway serves the cache to clients that do not speak gRPC, as JSON
+over HTTP.
+
+- GET /v1/kv/{key}: one key. Keys containing "/" are sent path-escaped, e.g.
+  /v1/kv/%2Fregistry%2Fpods%2Fa.
+- GET /v1/kv?prefix=P&limit=N: every key under P, ordered by key, at most N
+  per response. A response cut short carries a continue token; passing it as
+  continue=T returns the next page from the same revision, once, while the
+  gateway keeps the rest of the list (see WithContinueTTL) or the cache is
+  still at that revision; otherwise the response is 410 Gone. rev=R lists at
+  R, which must be the current revision.
+- GET /v1/watch?prefix=P&fromRev=R: the changes under P from revision R on,
+  as Server-Sent Events. Every message holds the changes of one revision and
+  has that revision as its ID, so a reconnecting EventSource resumes through
+  Last-Event-ID without missing or repeating a change. Without fromRev the
+  stream starts after the complete revision of the cache.
+
+The watch stream also sends "bookmark" messages, when it has been idle while
+revisions without changes under P went by, so that a reconnect resumes after
+them, and "compacted" messages: history up to that revision is gone from the
+EventLog, so a client that fell behind it may have missed changes and should
+list again. Both have their revision as ID.
+
+Responses carry the cache revision they were read at; values are base64
+encoded. Reads are served from the WatchCache and never reach etcd. Every
+watch stream is a session of the ClientLibrary built on that cache, removed
+when the stream ends, and gets the changes of one complete revision at a time
+from ClientSession.WatchPrefixRevisions.
+*/
+package gateway
@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Gateway serves a WatchCache and the ClientLibrary built on it as JSON over HTTP.
+type Gateway struct {
+	cache       *proxy.WatchCache
+	lib         api.ClientLibrary // watch streams go through its sessions
+	keepAlive   time.Duration
+	continueTTL time.Duration
+	retainLimit int64 // bytes of keys and values the retained lists may hold
+	logger      *slog.Logger
+	mux         *http.ServeMux
+
+	mu       sync.Mutex
+	lists    map[string]retainedList // the rest of paginated lists, by continue token
+	retained int64                   // bytes held by lists
+
+	drain     chan struct{} // closed by Drain to end watch streams
+	drainOnce sync.Once
+}
+
+// Option configures a Gateway.
+type Option func(*Gateway)
+
+// WithLogger sets the logger of the gateway (default slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(g *Gateway) {
+		g.logger = l
+	}
+}
+
+// WithKeepAlive sets how often an idle watch stream sends a comment, so that
+// proxies do not time the connection out (default 15 seconds).
+func WithKeepAlive(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.keepAlive = d
+	}
+}
+
+// WithContinueTTL sets how long the rest of a paginated list is kept for its
+// next page (default one minute). A continue token used later fails with 410
+// Gone once the cache has moved on.
+func WithContinueTTL(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.continueTTL = d
+	}
+}
+
+// WithRetainLimit bounds the bytes of keys and values kept for the next pages
+// of paginated lists (default 64 MiB). Lists closest to expiry are dropped to
+// make room; their continue tokens then work only while the cache is still at
+// their revision.
+func WithRetainLimit(n int64) Option {
+	return func(g *Gateway) {
+		g.retainLimit = n
+	}
+}
+
+// New creates a gateway reading from cache and watching through a session
+// of lib, which must be built on cache.
+func New(cache *proxy.WatchCache, lib api.ClientLibrary, opts ...Option) (*Gateway, error) {
+	g := &Gateway{
+		cache:       cache,
+		lib:         lib,
+		keepAlive:   15 * time.Second,
+		continueTTL: time.Minute,
+		retainLimit: 64 << 20,
+		mux:         http.NewServeMux(),
+		lists:       make(map[string]retainedList),
+		drain:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.logger = logging.Component(g.logger, "gateway")
+	g.mux.HandleFunc("GET /v1/kv/{key...}", g.getKey)
+	g.mux.HandleFunc("GET /v1/kv", g.list)
+	g.mux.HandleFunc("GET /v1/watch", g.watch)
+	return g, nil
+}
+
+// Handler returns the handler serving every endpoint.
+func (g *Gateway) Handler() http.Handler {
+	return g.mux
+}
+
+// Drain ends every watch stream, so that http.Server.Shutdown does not wait
+// for them; clients reconnect elsewhere from their Last-Event-ID. Register it
+// with http.Server.RegisterOnShutdown.
+func (g *Gateway) Drain() {
+	g.drainOnce.Do(func() { close(g.drain) })
+}
+
+// Close ends the watch streams.
+func (g *Gateway) Close() error {
+	g.Drain()
+	return nil
+}
+
+// KV is one key-value pair in a response. Value is base64 encoded.
+type KV struct {
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	Revision int64  `json:"revision"`
+}
+
+// KeyResponse is the body of GET /v1/kv/{key}.
+type KeyResponse struct {
+	Revision int64 `json:"revision"`
+	KV       KV    `json:"kv"`
+}
+
+// ListResponse is the body of GET /v1/kv. Continue is set when the limit cut
+// the list short; passing it back returns the next page at the same Revision.
+type ListResponse struct {
+	Revision int64  `json:"revision"`
+	KVs      []KV   `json:"kvs"`
+	Continue string `json:"continue,omitempty"`
+}
+
+// Error is the body of every error response.
+type Error struct {
+	Error string `json:"error"`
+}
+
+func (g *Gateway) getKey(w http.ResponseWriter, r *http.Request) {
+	objs, rev := g.cache.Range(r.PathValue("key"), "")
+	if len(objs) == 0 {
+		writeJSON(w, http.StatusNotFound, Error{Error: "key not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyResponse{Revision: rev, KV: toKV(objs[0])})
+}
+
+// list serves GET /v1/kv. The cache holds no history, so rev= is only served
+// while it names the current revision, or the revision of a continue token
+// whose list is still retained; any other revision is 410 Gone.
+func (g *Gateway) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, err := queryInt(q.Get("limit"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Error: "invalid limit: " + err.Error()})
+		return
+	}
+	rev, err := queryInt(q.Get("rev"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Error: "invalid rev: " + err.Error()})
+		return
+	}
+	prefix := q.Get("prefix")
+	key, end := prefix, "\x00"
+	if prefix != "" {
+		end = clientv3.GetPrefixRangeEnd(prefix)
+	}
+	c := q.Get("continue")
+	var objs []*proxy.StoreObj
+	var retained bool
+	if c != "" {
+		tok, err := decodeContinue(c)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Error{Error: err.Error()})
+			return
+		}
+		if rev != 0 && rev != tok.Revision {
+			writeJSON(w, http.StatusBadRequest, Error{Error: fmt.Sprintf("rev %d does not match the continue token", rev)})
+			return
+		}
+		if objs, retained, err = g.continued(c, prefix); err != nil {
+			writeJSON(w, http.StatusBadRequest, Error{Error: err.Error()})
+			return
+		}
+		rev, key = tok.Revision, tok.Key+"\x00"
+	}
+	if !retained {
+		// Only the current revision can be read from the cache itself.
+		var cur int64
+		objs, cur = g.cache.Range(key, end)
+		if rev != 0 && rev != cur {
+			writeJSON(w, http.StatusGone, Error{Error: fmt.Sprintf("revision %d is not available, the cache is at %d; list again without rev", rev, cur)})
+			return
+		}
+		rev = cur
+	}
+
+	resp := ListResponse{Revision: rev}
+	if limit > 0 && int64(len(objs)) > limit {
+		rest := append([]*proxy.StoreObj(nil), objs[limit:]...)
+		objs = objs[:limit]
+		resp.Continue = encodeContinue(continueToken{Revision: rev, Key: objs[limit-1].Key})
+		g.retain(resp.Continue, prefix, rest)
+	}
+	resp.KVs = make([]KV, 0, len(objs))
+	for _, obj := range objs {
+		resp.KVs = append(resp.KVs, toKV(obj))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// queryInt parses a non-negative query parameter, 0 if absent.
+func queryInt(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("%d is negative", n)
+	}
+	return n, err
+}
+
+func toKV(obj *proxy.StoreObj) KV {
+	return KV{Key: obj.Key, Value: obj.Value, Revision: obj.Revision}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
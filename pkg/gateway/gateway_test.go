@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/clientlibrary"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fixture struct {
+	srv   *httptest.Server
+	g     *Gateway
+	cache *proxy.WatchCache
+	log   *eventlog.MemoryEventLog
+	lib   api.ClientLibrary
+}
+
+func newGateway(t *testing.T, events ...api.Event) *fixture {
+	t.Helper()
+	log := eventlog.NewMemoryEventLog(100)
+	cache := proxy.NewWatchCacheWithLog(nil, log)
+	for _, ev := range events {
+		require.NoError(t, cache.AddEvent(ev))
+	}
+	if len(events) > 0 {
+		cache.Progress(events[len(events)-1].Revision)
+	}
+	lib := clientlibrary.NewClientLibrary(cache, log)
+	g, err := New(cache, lib, WithKeepAlive(50*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { g.Close() })
+	srv := httptest.NewServer(g.Handler())
+	t.Cleanup(srv.Close)
+	return &fixture{srv: srv, g: g, cache: cache, log: log, lib: lib}
+}
+
+// apply adds events to the cache as the watcher does with one etcd watch
+// response: their revisions are complete afterwards.
+func (f *fixture) apply(t *testing.T, events ...api.Event) {
+	t.Helper()
+	for _, ev := range events {
+		require.NoError(t, f.cache.AddEvent(ev))
+	}
+	f.cache.Progress(events[len(events)-1].Revision)
+}
+
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	return resp.StatusCode
+}
+
+func put(key, val string, rev int64) api.Event {
+	return api.Event{Type: api.EventPut, Key: key, Value: []byte(val), Revision: rev}
+}
+
+func TestGetKey(t *testing.T) {
+	srv := newGateway(t, put("/a/1", "one", 1), put("plain", "p", 2)).srv
+
+	var kr KeyResponse
+	require.Equal(t, http.StatusOK, getJSON(t, srv.URL+"/v1/kv/"+url.PathEscape("/a/1"), &kr))
+	assert.Equal(t, KeyResponse{Revision: 2, KV: KV{Key: "/a/1", Value: []byte("one"), Revision: 1}}, kr)
+
+	require.Equal(t, http.StatusOK, getJSON(t, srv.URL+"/v1/kv/plain", &kr))
+	assert.Equal(t, "p", string(kr.KV.Value))
+
+	var e Error
+	assert.Equal(t, http.StatusNotFound, getJSON(t, srv.URL+"/v1/kv/missing", &e))
+	assert.NotEmpty(t, e.Error)
+}
+
+func TestList(t *testing.T) {
+	srv := newGateway(t, put("/a/2", "two", 1), put("/a/1", "one", 2), put("/b/1", "b", 3)).srv
+
+	var lr ListResponse
+	require.Equal(t, http.StatusOK, getJSON(t, srv.URL+"/v1/kv?prefix=/a/", &lr))
+	assert.Equal(t, int64(3), lr.Revision)
+	require.Len(t, lr.KVs, 2)
+	assert.Equal(t, "/a/1", lr.KVs[0].Key)
+	assert.Equal(t, "/a/2", lr.KVs[1].Key)
+
+	require.Equal(t, http.StatusOK, getJSON(t, srv.URL+"/v1/kv?prefix=/c/", &lr))
+	assert.NotNil(t, lr.KVs)
+	assert.Empty(t, lr.KVs)
+}
+
+func TestListPages(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1), put("/a/2", "2", 2), put("/a/3", "3", 3), put("/a/4", "4", 4), put("/a/5", "5", 5))
+
+	var keys []string
+	var lr ListResponse
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?prefix=/a/&limit=2", &lr))
+	for {
+		assert.Equal(t, int64(5), lr.Revision, "every page is read at the first page's revision")
+		for _, kv := range lr.KVs {
+			keys = append(keys, kv.Key)
+		}
+		if lr.Continue == "" {
+			break
+		}
+		// A write between pages does not show up in them.
+		f.apply(t, put("/a/0", "new", lr.Revision+int64(len(keys))))
+		cont := lr.Continue
+		lr = ListResponse{}
+		require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?prefix=/a/&limit=2&continue="+url.QueryEscape(cont), &lr))
+	}
+	assert.Equal(t, []string{"/a/1", "/a/2", "/a/3", "/a/4", "/a/5"}, keys)
+
+	// The latest revision can be asked for explicitly; older ones are gone.
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?prefix=/a/&rev=9", &lr))
+	assert.Len(t, lr.KVs, 6)
+	var e Error
+	assert.Equal(t, http.StatusGone, getJSON(t, f.srv.URL+"/v1/kv?prefix=/a/&rev=5", &e))
+
+	// The rest of a list is kept for its own prefix only.
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?prefix=/a/&limit=2", &lr))
+	assert.Equal(t, http.StatusBadRequest, getJSON(t, f.srv.URL+"/v1/kv?prefix=/b/&limit=2&continue="+url.QueryEscape(lr.Continue), &e))
+
+	for _, q := range []string{"limit=x", "limit=-1", "rev=-1", "continue=bogus", "rev=9&continue=" + encodeContinue(continueToken{Revision: 5, Key: "/a/2"})} {
+		assert.Equal(t, http.StatusBadRequest, getJSON(t, f.srv.URL+"/v1/kv?prefix=/a/&"+q, &e), q)
+	}
+}
+
+func TestContinueExpires(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1), put("/a/2", "2", 2))
+	f.g.continueTTL = 0
+
+	var lr ListResponse
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?limit=1", &lr))
+	require.NotEmpty(t, lr.Continue)
+	var next ListResponse
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?limit=1&continue="+url.QueryEscape(lr.Continue), &next),
+		"read from the cache while it is still at the token's revision")
+	require.Len(t, next.KVs, 1)
+	assert.Equal(t, "/a/2", next.KVs[0].Key)
+	f.apply(t, put("/a/3", "3", 3))
+	var e Error
+	assert.Equal(t, http.StatusGone, getJSON(t, f.srv.URL+"/v1/kv?limit=1&continue="+url.QueryEscape(lr.Continue), &e))
+}
+
+func TestRetainLimit(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1), put("/a/2", "2", 2), put("/a/3", "3", 3))
+	f.g.retainLimit = 12
+
+	var first, second ListResponse
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?limit=1", &first))  // keeps "/a/2" "2" "/a/3" "3"
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?limit=2", &second)) // keeps "/a/3" "3"
+	f.g.mu.Lock()
+	assert.Len(t, f.g.lists, 1, "the first list was dropped to make room")
+	assert.Equal(t, int64(5), f.g.retained)
+	f.g.mu.Unlock()
+
+	f.apply(t, put("/a/4", "4", 4))
+	var e Error
+	assert.Equal(t, http.StatusGone, getJSON(t, f.srv.URL+"/v1/kv?limit=1&continue="+url.QueryEscape(first.Continue), &e))
+	var lr ListResponse
+	require.Equal(t, http.StatusOK, getJSON(t, f.srv.URL+"/v1/kv?limit=1&continue="+url.QueryEscape(second.Continue), &lr))
+	assert.Equal(t, int64(3), lr.Revision)
+	f.g.mu.Lock()
+	assert.Zero(t, f.g.retained)
+	f.g.mu.Unlock()
+}
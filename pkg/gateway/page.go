@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+)
+
+// continueToken is the position of a paginated list: the next page holds the
+// keys after Key at Revision.
+type continueToken struct {
+	Revision int64  `json:"rev"`
+	Key      string `json:"key"`
+}
+
+func encodeContinue(tok continueToken) string {
+	b, _ := json.Marshal(tok)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeContinue(s string) (continueToken, error) {
+	var tok continueToken
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &tok)
+	}
+	if err == nil && tok.Revision <= 0 {
+		err = errors.New("no revision")
+	}
+	if err != nil {
+		return continueToken{}, fmt.Errorf("invalid continue token: %w", err)
+	}
+	return tok, nil
+}
+
+type retainedList struct {
+	prefix  string
+	objs    []*proxy.StoreObj // the keys after the token's, at its revision
+	size    int64             // bytes of their keys and values
+	expires time.Time
+}
+
+// retain keeps the rest of a list for the page continuing at token, evicting
+// the lists closest to expiry while the retain limit would be exceeded. A list
+// larger than the limit is not kept.
+func (g *Gateway) retain(token, prefix string, rest []*proxy.StoreObj) {
+	var size int64
+	for _, obj := range rest {
+		size += int64(len(obj.Key) + len(obj.Value))
+	}
+	if size > g.retainLimit {
+		return
+	}
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expireLocked(now)
+	g.dropLocked(token)
+	for g.retained+size > g.retainLimit {
+		var oldest string
+		for tok, l := range g.lists {
+			if oldest == "" || l.expires.Before(g.lists[oldest].expires) {
+				oldest = tok
+			}
+		}
+		g.dropLocked(oldest)
+	}
+	g.lists[token] = retainedList{prefix: prefix, objs: rest, size: size, expires: now.Add(g.continueTTL)}
+	g.retained += size
+}
+
+func (g *Gateway) expireLocked(now time.Time) {
+	for tok, l := range g.lists {
+		if now.After(l.expires) {
+			g.dropLocked(tok)
+		}
+	}
+}
+
+func (g *Gateway) dropLocked(token string) {
+	g.retained -= g.lists[token].size
+	delete(g.lists, token)
+}
+
+// continued takes the rest of the list token continues, if it is still kept.
+// A token continues one page only.
+func (g *Gateway) continued(token, prefix string) ([]*proxy.StoreObj, bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expireLocked(time.Now())
+	l, ok := g.lists[token]
+	if !ok {
+		return nil, false, nil
+	}
+	if l.prefix != prefix {
+		return nil, false, fmt.Errorf("the continue token is for prefix %q", l.prefix)
+	}
+	g.dropLocked(token)
+	return l.objs, true, nil
+}
@@ -0,0 +1,194 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+)
+
+// WatchResponse is the data of every message of GET /v1/watch. A message
+// without an event type holds the changes of one revision; a "bookmark" or
+// "compacted" message only carries the revision.
+type WatchResponse struct {
+	Revision int64        `json:"revision"`
+	Events   []WatchEvent `json:"events,omitempty"`
+}
+
+// WatchEvent is one change. KV.Value is empty for a DELETE.
+type WatchEvent struct {
+	Type string `json:"type"` // PUT or DELETE
+	KV   KV     `json:"kv"`
+}
+
+// watch streams the changes under prefix as Server-Sent Events whose IDs are
+// revisions. A reconnecting EventSource sends the last ID in Last-Event-ID,
+// which takes precedence over fromRev; without either the stream starts after
+// the complete revision of the cache.
+func (g *Gateway) watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, Error{Error: "streaming is not supported"})
+		return
+	}
+	from, err := watchStart(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Error: err.Error()})
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if from == 0 {
+		// A revision only partly applied yet is sent whole once complete.
+		from = g.cache.CompleteRevision() + 1
+	}
+
+	// The watches of a session end only when it stops, so every stream gets
+	// its own. A reconnect resumes through Last-Event-ID, not the session.
+	sess, err := g.lib.NewSession("gateway-watch")
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, Error{Error: err.Error()})
+		return
+	}
+	defer g.lib.RemoveSession(sess.ID())
+	revs, err := sess.WatchPrefixRevisions(prefix, from)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Error{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	g.logger.Debug("watch stream opened", slog.String("prefix", prefix), logging.Revision(from))
+
+	s := &sseStream{w: w, flusher: flusher, last: from - 1, seen: from - 1}
+	keepAlive := time.NewTicker(g.keepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case evs, ok := <-revs:
+			if !ok {
+				return // the session was removed
+			}
+			if s.send(evs) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			// The subscription has passed every revision up to its Revision,
+			// with or without changes under the prefix.
+			if subs := sess.Subscriptions(); len(subs) == 1 {
+				s.seen = max(s.seen, subs[0].Revision)
+			}
+			if s.idle() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-g.drain:
+			return
+		}
+	}
+}
+
+// watchStart returns the first revision a watch request asks for, 0 if none.
+func watchStart(r *http.Request) (int64, error) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || last < 0 {
+			return 0, fmt.Errorf("invalid Last-Event-ID %q", id)
+		}
+		return last + 1, nil
+	}
+	from, err := queryInt(r.URL.Query().Get("fromRev"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid fromRev: %w", err)
+	}
+	return from, nil
+}
+
+// sseStream writes the messages of one watch stream.
+type sseStream struct {
+	w       io.Writer
+	flusher http.Flusher
+	last    int64 // ID of the last message written
+	seen    int64 // the last revision read, with or without changes under prefix
+}
+
+// send writes the changes under the prefix of one revision, as
+// ClientSession.WatchPrefixRevisions hands them out, or a marker.
+func (s *sseStream) send(evs []api.Event) error {
+	switch ev := evs[0]; ev.Type {
+	case api.EventPut, api.EventDelete:
+		s.seen = max(s.seen, ev.Revision)
+		resp := WatchResponse{Revision: ev.Revision}
+		for _, ev := range evs {
+			resp.Events = append(resp.Events, watchEvent(ev))
+		}
+		return s.message("", resp)
+	case api.EventBookmark:
+		// Progress without changes; idle reports it.
+		s.seen = max(s.seen, ev.Revision)
+	case api.EventCompacted:
+		if ev.Revision <= s.last {
+			return nil // history this stream has already passed
+		}
+		s.seen = max(s.seen, ev.Revision)
+		// Changes after the last message up to ev.Revision may be gone; the
+		// client should list again at a newer revision.
+		return s.message("compacted", WatchResponse{Revision: ev.Revision})
+	}
+	return nil
+}
+
+// idle keeps a quiet stream open. When revisions without changes under the
+// prefix went by since the last message it sends a bookmark at the last of
+// them, so a reconnect resumes after them; otherwise a comment.
+func (s *sseStream) idle() error {
+	if s.seen > s.last {
+		return s.message("bookmark", WatchResponse{Revision: s.seen})
+	}
+	return s.comment("keepalive")
+}
+
+// message writes and flushes one event whose ID is resp.Revision.
+func (s *sseStream) message(kind string, resp WatchResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if kind != "" {
+		if _, err := fmt.Fprintf(s.w, "event: %s\n", kind); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "id: %d\ndata: %s\n\n", resp.Revision, data); err != nil {
+		return err
+	}
+	s.last = resp.Revision
+	s.flusher.Flush()
+	return nil
+}
+
+// comment writes an SSE comment, which clients ignore.
+func (s *sseStream) comment(text string) error {
+	if _, err := fmt.Fprintf(s.w, ": %s\n\n", text); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func watchEvent(ev api.Event) WatchEvent {
+	typ := "PUT"
+	if ev.Type == api.EventDelete {
+		typ = "DELETE"
+	}
+	return WatchEvent{Type: typ, KV: KV{Key: ev.Key, Value: ev.Value, Revision: ev.Revision}}
+}
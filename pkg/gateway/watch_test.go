@@ -0,0 +1,229 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sseMessage is one Server-Sent Event as a client sees it.
+type sseMessage struct {
+	Event string
+	ID    string
+	Data  WatchResponse
+}
+
+type sseClient struct {
+	t    *testing.T
+	body io.ReadCloser
+	msgs chan sseMessage // closed at the end of the stream
+}
+
+func openWatch(t *testing.T, url, lastEventID string) *sseClient {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	c := &sseClient{t: t, body: resp.Body, msgs: make(chan sseMessage, 16)}
+	t.Cleanup(func() { c.body.Close() })
+	go c.read(bufio.NewReader(resp.Body))
+	return c
+}
+
+// read parses the stream into c.msgs, skipping comments.
+func (c *sseClient) read(r *bufio.Reader) {
+	defer close(c.msgs)
+	var msg sseMessage
+	var data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data == "" {
+				continue // end of a comment
+			}
+			if json.Unmarshal([]byte(data), &msg.Data) != nil {
+				return
+			}
+			c.msgs <- msg
+			msg, data = sseMessage{}, ""
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event: "):
+			msg.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			msg.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// next returns the next message.
+func (c *sseClient) next() sseMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		require.True(c.t, ok, "the watch stream ended")
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no message on the watch stream")
+		return sseMessage{}
+	}
+}
+
+// none asserts that no message arrives for a while.
+func (c *sseClient) none() {
+	c.t.Helper()
+	select {
+	case msg := <-c.msgs:
+		c.t.Fatalf("unexpected message %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func del(key string, rev int64) api.Event {
+	return api.Event{Type: api.EventDelete, Key: key, Revision: rev}
+}
+
+func TestWatch(t *testing.T) {
+	f := newGateway(t, put("/a/1", "one", 1), put("/b/1", "b", 2))
+
+	c := openWatch(t, f.srv.URL+"/v1/watch?prefix=/a/&fromRev=1", "")
+	msg := c.next()
+	assert.Equal(t, "", msg.Event)
+	assert.Equal(t, "1", msg.ID)
+	assert.Equal(t, WatchResponse{Revision: 1, Events: []WatchEvent{{Type: "PUT", KV: KV{Key: "/a/1", Value: []byte("one"), Revision: 1}}}}, msg.Data)
+
+	f.apply(t, put("/b/2", "b", 3), put("/a/2", "two", 4), del("/a/1", 5))
+	msg = c.next()
+	assert.Equal(t, "4", msg.ID, "changes outside the prefix are not sent")
+	msg = c.next()
+	assert.Equal(t, "5", msg.ID)
+	require.Len(t, msg.Data.Events, 1)
+	assert.Equal(t, "DELETE", msg.Data.Events[0].Type)
+	assert.Equal(t, "/a/1", msg.Data.Events[0].KV.Key)
+
+	// A reconnecting EventSource resumes after Last-Event-ID, which wins over fromRev.
+	resumed := openWatch(t, f.srv.URL+"/v1/watch?prefix=/a/&fromRev=1", "4")
+	assert.Equal(t, "5", resumed.next().ID)
+
+	// Without a start revision only new changes are sent.
+	latest := openWatch(t, f.srv.URL+"/v1/watch?prefix=/a/", "")
+	f.apply(t, put("/a/3", "three", 6))
+	assert.Equal(t, "6", latest.next().ID)
+}
+
+func TestWatchTransaction(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1))
+	c := openWatch(t, f.srv.URL+"/v1/watch?prefix=/a/", "")
+
+	// The keys of one transaction are applied one at a time.
+	require.NoError(t, f.cache.AddEvent(put("/a/2", "2", 2)))
+	c.none()
+	require.NoError(t, f.cache.AddEvent(del("/a/1", 2)))
+	c.none()
+	f.cache.Progress(2)
+	msg := c.next()
+	assert.Equal(t, "2", msg.ID)
+	require.Len(t, msg.Data.Events, 2, "a revision is one message")
+	assert.Equal(t, "/a/2", msg.Data.Events[0].KV.Key)
+	assert.Equal(t, "/a/1", msg.Data.Events[1].KV.Key)
+}
+
+func TestWatchStartsAtCompleteRevision(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1))
+	require.NoError(t, f.cache.AddEvent(put("/a/2", "2", 2)))
+
+	// Revision 2 is only partly applied, so a stream without fromRev gets it whole.
+	c := openWatch(t, f.srv.URL+"/v1/watch?prefix=/a/", "")
+	require.NoError(t, f.cache.AddEvent(put("/a/3", "3", 2)))
+	f.cache.Progress(2)
+	msg := c.next()
+	assert.Equal(t, "2", msg.ID)
+	assert.Len(t, msg.Data.Events, 2)
+}
+
+func TestWatchRemovesSession(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1))
+	c := openWatch(t, f.srv.URL+"/v1/watch?fromRev=1", "")
+	assert.Equal(t, "1", c.next().ID)
+	assert.Len(t, f.lib.Cursors(), 1, "the stream has a session")
+
+	c.body.Close()
+	assert.Eventually(t, func() bool { return len(f.lib.Cursors()) == 0 }, 5*time.Second, 10*time.Millisecond,
+		"the session goes with the stream")
+}
+
+func TestWatchBookmark(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1))
+	c := openWatch(t, f.srv.URL+"/v1/watch?prefix=/a/", "")
+
+	f.apply(t, put("/b/1", "b", 2), put("/b/2", "b", 3))
+	msg := c.next()
+	assert.Equal(t, "bookmark", msg.Event, "an idle stream tells how far it got")
+	assert.Equal(t, "3", msg.ID)
+	c.none()
+}
+
+func TestWatchCompacted(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1), put("/a/2", "2", 2), put("/a/3", "3", 3))
+	f.log.Compact(2)
+
+	c := openWatch(t, f.srv.URL+"/v1/watch?prefix=/a/&fromRev=1", "")
+	msg := c.next()
+	assert.Equal(t, "compacted", msg.Event)
+	assert.Equal(t, "2", msg.ID, "a reconnect resumes after the compacted history")
+	assert.Equal(t, WatchResponse{Revision: 2}, msg.Data)
+	assert.Equal(t, "3", c.next().ID)
+}
+
+func TestWatchBadRequest(t *testing.T) {
+	f := newGateway(t)
+	for _, tc := range []struct{ query, lastEventID string }{
+		{"fromRev=x", ""},
+		{"fromRev=-1", ""},
+		{"", "not-a-revision"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, f.srv.URL+"/v1/watch?"+tc.query, nil)
+		require.NoError(t, err)
+		if tc.lastEventID != "" {
+			req.Header.Set("Last-Event-ID", tc.lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, tc)
+	}
+}
+
+func TestDrainEndsWatches(t *testing.T) {
+	f := newGateway(t, put("/a/1", "1", 1))
+	c := openWatch(t, f.srv.URL+"/v1/watch?fromRev=1", "")
+	assert.Equal(t, "1", c.next().ID)
+
+	f.g.Drain()
+	select {
+	case _, ok := <-c.msgs:
+		assert.False(t, ok, "the stream ends")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream did not end")
+	}
+}
@@ -0,0 +1,21 @@
+/*
+Package kvserver serves etcd's KV and Watch gRPC services from a WatchCache, so
+that unmodified etcd clients (clientv3, etcdctl) can point at the cache proxy.
+
+- Range is answered from the cache when the range lies within the cached
+  prefixes. A linearizable Range waits until the cache has reached etcd's
+  current revision, asking the cache's watch for a progress notification;
+  Serializable ones are answered right away.
+- Watch is served from the EventLog, one response per revision, with the
+  cancellation etcd sends once the history a watch needs is compacted.
+- Ranges outside the cache, reads at past revisions, read-only Txns and
+  watches asking for previous key-values go to etcd unchanged.
+- Put, DeleteRange, Compact and Txns that write are refused unless the server
+  is built WithForwardedWrites, and then go to etcd unchanged as well.
+
+Clients are not authenticated by the server; everything forwarded runs with the
+credentials of the proxy's etcd client. That is why writes are refused by
+default: forwarding them hands the proxy's etcd permissions to any client that
+can reach it.
+*/
+package kvserver
@@ -0,0 +1,335 @@
+package kvserver
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultCatchUpTimeout bounds how long a linearizable Range waits for the
+	// cache before it is forwarded to etcd instead.
+	DefaultCatchUpTimeout = time.Second
+	// DefaultProgressInterval is how often watches created with ProgressNotify
+	// get a progress notification, as in etcd.
+	DefaultProgressInterval = 10 * time.Minute
+)
+
+// Server implements etcd's KV and Watch gRPC services on top of a WatchCache
+// and its EventLog, forwarding to etcd whatever the cache cannot answer.
+type Server struct {
+	cache            *proxy.WatchCache
+	log              eventlog.EventLog
+	cli              *clientv3.Client
+	kv               pb.KVClient
+	prefixes         []string
+	catchUpTimeout   time.Duration
+	progressInterval time.Duration
+	metrics          api.MetricsCollector
+	logger           *slog.Logger
+	forwardWrites    bool
+
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+var (
+	_ pb.KVServer    = (*Server)(nil)
+	_ pb.WatchServer = (*Server)(nil)
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithPrefixes tells the server which key prefixes the cache holds; requests
+// for keys outside them go to etcd. Without it the cache is assumed to hold
+// every key.
+func WithPrefixes(prefixes ...string) Option {
+	return func(s *Server) {
+		s.prefixes = prefixes
+	}
+}
+
+// WithCatchUpTimeout sets how long a linearizable Range waits for the cache to
+// reach etcd's revision, and any Range for the cache to complete a transaction
+// it has applied only part of, before it is forwarded (default
+// DefaultCatchUpTimeout).
+func WithCatchUpTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.catchUpTimeout = d
+	}
+}
+
+// WithProgressInterval sets how often watches that asked for progress
+// notifications get one (default DefaultProgressInterval).
+func WithProgressInterval(d time.Duration) Option {
+	return func(s *Server) {
+		s.progressInterval = d
+	}
+}
+
+// WithForwardedWrites forwards Put, DeleteRange, Compact and Txns that write
+// to etcd. They run with the credentials of the server's etcd client, whoever
+// the caller is, so enable it only when every client that can reach the server
+// may write with them, e.g. behind client certificate authentication. Without
+// it those requests fail with codes.PermissionDenied.
+func WithForwardedWrites() Option {
+	return func(s *Server) {
+		s.forwardWrites = true
+	}
+}
+
+// WithMetrics counts requests per RPC with m.ObserveRequestRate.
+func WithMetrics(m api.MetricsCollector) Option {
+	return func(s *Server) {
+		s.metrics = m
+	}
+}
+
+// WithLogger sets the logger of the server (default slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// New creates a server for cache and its EventLog log. cli must be the client
+// the cache's watch runs on: it forwards requests to etcd and asks that watch
+// for progress notifications when a linearizable read waits for the cache.
+func New(cache *proxy.WatchCache, log eventlog.EventLog, cli *clientv3.Client, opts ...Option) *Server {
+	s := &Server{
+		cache:            cache,
+		log:              log,
+		cli:              cli,
+		kv:               pb.NewKVClient(cli.ActiveConnection()),
+		catchUpTimeout:   DefaultCatchUpTimeout,
+		progressInterval: DefaultProgressInterval,
+		draining:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.logger = logging.Component(s.logger, "kvserver")
+	return s
+}
+
+// Register registers the KV and Watch services with g.
+func (s *Server) Register(g *grpc.Server) {
+	pb.RegisterKVServer(g, s)
+	pb.RegisterWatchServer(g, s)
+}
+
+// Drain ends every watch stream with codes.Unavailable and refuses new ones, so
+// that clients move to another endpoint while grpc.Server.GracefulStop waits
+// for the remaining unary calls.
+func (s *Server) Drain() {
+	s.drainOnce.Do(func() { close(s.draining) })
+}
+
+func (s *Server) observe(rpc string) {
+	if s.metrics != nil {
+		s.metrics.ObserveRequestRate(rpc, 1)
+	}
+}
+
+// Range serves the request from the cache when it can: the range lies within
+// the cached prefixes, it asks for the current revision and it sorts by key if
+// at all. A linearizable request first waits for the cache to reach etcd's
+// current revision. Everything else is forwarded to etcd.
+//
+// The cache is read at its complete revision: one whose transaction it has
+// applied only part of is waited for, up to the catch-up timeout, so a
+// response never holds half of a transaction.
+//
+// The returned KeyValues carry the create revision, version and lease etcd
+// reported with the last change of each key.
+func (s *Server) Range(ctx context.Context, r *pb.RangeRequest) (*pb.RangeResponse, error) {
+	s.observe("range")
+	if !s.servable(r) || (!r.Serializable && !s.catchUp(ctx)) {
+		return s.kv.Range(ctx, r)
+	}
+	rctx, cancel := context.WithTimeout(ctx, s.catchUpTimeout)
+	defer cancel()
+	objs, rev, err := s.cache.RangeComplete(rctx, string(r.Key), string(r.RangeEnd))
+	if err != nil || r.Revision > 0 && r.Revision != rev {
+		// The transaction did not complete in time, or the revision is not
+		// the current one, the only one cached.
+		return s.kv.Range(ctx, r)
+	}
+	return rangeResponse(r, objs, rev), nil
+}
+
+func (s *Server) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
+	s.observe("put")
+	if !s.forwardWrites {
+		return nil, errWritesRefused
+	}
+	return s.kv.Put(ctx, r)
+}
+
+func (s *Server) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	s.observe("delete_range")
+	if !s.forwardWrites {
+		return nil, errWritesRefused
+	}
+	return s.kv.DeleteRange(ctx, r)
+}
+
+// Txn forwards the transaction to etcd. One that only reads is forwarded
+// without WithForwardedWrites too.
+func (s *Server) Txn(ctx context.Context, r *pb.TxnRequest) (*pb.TxnResponse, error) {
+	s.observe("txn")
+	if !s.forwardWrites && txnWrites(r) {
+		return nil, errWritesRefused
+	}
+	return s.kv.Txn(ctx, r)
+}
+
+func (s *Server) Compact(ctx context.Context, r *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	s.observe("compact")
+	if !s.forwardWrites {
+		return nil, errWritesRefused
+	}
+	return s.kv.Compact(ctx, r)
+}
+
+// errWritesRefused is returned for writes without WithForwardedWrites.
+var errWritesRefused = status.Error(codes.PermissionDenied, "etcd cache proxy does not forward writes")
+
+// txnWrites reports whether any branch of r, nested transactions included, writes.
+func txnWrites(r *pb.TxnRequest) bool {
+	for _, ops := range [][]*pb.RequestOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			switch req := op.Request.(type) {
+			case *pb.RequestOp_RequestPut, *pb.RequestOp_RequestDeleteRange:
+				return true
+			case *pb.RequestOp_RequestTxn:
+				if txnWrites(req.RequestTxn) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) servable(r *pb.RangeRequest) bool {
+	// etcd sorts by any other target in ascending order, even without a sort order.
+	if r.SortTarget != pb.RangeRequest_KEY {
+		return false
+	}
+	if r.MinCreateRevision != 0 || r.MaxCreateRevision != 0 {
+		return false
+	}
+	return s.cached(string(r.Key), string(r.RangeEnd))
+}
+
+// cached reports whether the etcd key range [key, end) lies within one cached prefix.
+func (s *Server) cached(key, end string) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	for _, p := range s.prefixes {
+		if !strings.HasPrefix(key, p) {
+			continue
+		}
+		if end == "" {
+			return true
+		}
+		if pe := clientv3.GetPrefixRangeEnd(p); pe == "\x00" || (end != "\x00" && end <= pe) {
+			return true
+		}
+	}
+	return false
+}
+
+// catchUp waits until the cache has applied everything etcd had committed when
+// the read arrived, which makes reading the cache linearizable. The watch only
+// moves the cache on changes under the cached prefixes, so it asks for a
+// progress notification to cover writes elsewhere. It reports false if etcd
+// cannot be asked or the cache does not catch up within the timeout.
+func (s *Server) catchUp(ctx context.Context) bool {
+	resp, err := s.kv.Range(ctx, &pb.RangeRequest{Key: []byte{0}, CountOnly: true})
+	if err != nil {
+		return false
+	}
+	rev := resp.Header.Revision
+	if s.cache.CompleteRevision() >= rev {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.catchUpTimeout)
+	defer cancel()
+	if err := s.cli.RequestProgress(ctx); err != nil {
+		s.logger.Debug("requesting watch progress failed", slog.Any("error", err))
+	}
+	if err := s.cache.WaitForRevision(ctx, rev); err != nil {
+		s.logger.Debug("cache did not catch up, forwarding read", logging.Revision(rev), slog.Int64("cache_revision", s.cache.CompleteRevision()))
+		return false
+	}
+	return true
+}
+
+// rangeResponse applies the filters, sort order and limit of r to objs the
+// way etcd does: Count is the number of keys in the range before filtering.
+func rangeResponse(r *pb.RangeRequest, objs []*proxy.StoreObj, rev int64) *pb.RangeResponse {
+	resp := &pb.RangeResponse{Header: header(rev), Count: int64(len(objs))}
+	if r.CountOnly {
+		return resp
+	}
+	kvs := make([]*mvccpb.KeyValue, 0, len(objs))
+	for _, obj := range objs {
+		kv := keyValue(obj)
+		if (r.MinModRevision > 0 && kv.ModRevision < r.MinModRevision) ||
+			(r.MaxModRevision > 0 && kv.ModRevision > r.MaxModRevision) {
+			continue
+		}
+		if r.KeysOnly {
+			kv.Value = nil
+		}
+		kvs = append(kvs, kv)
+	}
+	if r.SortOrder == pb.RangeRequest_DESCEND {
+		for i, j := 0, len(kvs)-1; i < j; i, j = i+1, j-1 {
+			kvs[i], kvs[j] = kvs[j], kvs[i]
+		}
+	}
+	if r.Limit > 0 && int64(len(kvs)) > r.Limit {
+		kvs, resp.More = kvs[:r.Limit], true
+	}
+	resp.Kvs = kvs
+	return resp
+}
+
+func keyValue(obj *proxy.StoreObj) *mvccpb.KeyValue {
+	modRev := obj.ModRev
+	if modRev == 0 {
+		modRev = obj.Revision
+	}
+	return &mvccpb.KeyValue{Key: []byte(obj.Key), Value: obj.Value, ModRevision: modRev,
+		CreateRevision: obj.CreateRev, Version: obj.Version, Lease: obj.Lease}
+}
+
+// header is the header of every response the server answers itself: only the
+// revision is set, see ServedFromCache.
+func header(rev int64) *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: rev}
+}
+
+// ServedFromCache reports whether a response with header h was answered by
+// the server rather than forwarded to etcd, which sets its member ID.
+func ServedFromCache(h *pb.ResponseHeader) bool {
+	return h != nil && h.MemberId == 0
+}
@@ -0,0 +1,250 @@
+package kvserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/stack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+type fixture struct {
+	etcd  *clientv3.Client // talks to etcd directly
+	proxy *clientv3.Client // talks to the Server
+	stack *stack.Stack
+	srv   *Server
+	addr  string
+}
+
+// startServer caches /a/ from a fresh etcd and serves it on a local port.
+func startServer(t *testing.T, opts ...Option) *fixture {
+	t.Helper()
+	f := &fixture{etcd: etcdtest.Client(t)}
+	var err error
+	f.stack, err = stack.New(stack.WithEtcdClient(f.etcd), stack.WithPrefixes("/a/"))
+	require.NoError(t, err)
+	require.NoError(t, f.stack.Start(context.Background()))
+	t.Cleanup(func() { f.stack.Stop() })
+
+	f.srv = New(f.stack.Cache(), f.stack.EventLog(), f.etcd, append([]Option{WithPrefixes("/a/"), WithCatchUpTimeout(5 * time.Second)}, opts...)...)
+	g := grpc.NewServer()
+	f.srv.Register(g)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go g.Serve(ln)
+	t.Cleanup(g.Stop)
+	f.addr = ln.Addr().String()
+
+	f.proxy, err = clientv3.New(clientv3.Config{Endpoints: []string{f.addr}})
+	require.NoError(t, err)
+	t.Cleanup(func() { f.proxy.Close() })
+	return f
+}
+
+func (f *fixture) put(t *testing.T, key, val string) int64 {
+	t.Helper()
+	resp, err := f.etcd.Put(context.Background(), key, val)
+	require.NoError(t, err)
+	return resp.Header.Revision
+}
+
+func TestRange(t *testing.T) {
+	f := startServer(t)
+	ctx := context.Background()
+	f.put(t, "/a/1", "one")
+	f.put(t, "/a/2", "two")
+	other := f.put(t, "/b/1", "elsewhere")
+
+	// A linearizable read waits for the cache to reach etcd's revision, even
+	// though nothing under /a/ changed since the last event.
+	resp, err := f.proxy.Get(ctx, "/a/1")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, "one", string(resp.Kvs[0].Value))
+	assert.Zero(t, resp.Header.MemberId, "served from the cache")
+	assert.Equal(t, int64(1), resp.Kvs[0].Version)
+	assert.Equal(t, resp.Kvs[0].ModRevision, resp.Kvs[0].CreateRevision)
+	assert.GreaterOrEqual(t, resp.Header.Revision, other)
+
+	resp, err = f.proxy.Get(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithLimit(1), clientv3.WithSerializable())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Count)
+	assert.True(t, resp.More)
+	require.Len(t, resp.Kvs, 1)
+	assert.Equal(t, "/a/1", string(resp.Kvs[0].Key))
+
+	resp, err = f.proxy.Get(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithKeysOnly())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 2)
+	assert.Equal(t, "/a/2", string(resp.Kvs[0].Key))
+	assert.Empty(t, resp.Kvs[0].Value)
+
+	// etcd sorts by any target but the key in ascending order, even without a sort order.
+	f.put(t, "/a/0", "zero")
+	resp, err = f.proxy.Get(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortNone))
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 3)
+	assert.Equal(t, []string{"/a/1", "/a/2", "/a/0"}, []string{string(resp.Kvs[0].Key), string(resp.Kvs[1].Key), string(resp.Kvs[2].Key)})
+	assert.NotZero(t, resp.Header.MemberId, "forwarded to etcd")
+
+	resp, err = f.proxy.Get(ctx, "/b/1")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	assert.NotZero(t, resp.Header.MemberId, "forwarded to etcd")
+}
+
+func TestWritesAreForwarded(t *testing.T) {
+	f := startServer(t, WithForwardedWrites())
+	ctx := context.Background()
+	put, err := f.proxy.Put(ctx, "/a/k", "v")
+	require.NoError(t, err)
+	resp, err := f.etcd.Get(ctx, "/a/k")
+	require.NoError(t, err)
+	assert.Equal(t, put.Header.Revision, resp.Kvs[0].ModRevision)
+
+	txn, err := f.proxy.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision("/a/k"), "=", put.Header.Revision)).
+		Then(clientv3.OpDelete("/a/k")).Commit()
+	require.NoError(t, err)
+	assert.True(t, txn.Succeeded)
+}
+
+func TestWritesAreRefusedByDefault(t *testing.T) {
+	f := startServer(t)
+	ctx := context.Background()
+	_, err := f.proxy.Put(ctx, "/a/k", "v")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = f.proxy.Txn(ctx).Then(clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpDelete("/a/k")}, nil)).Commit()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "nested writes count")
+	_, err = f.proxy.Compact(ctx, 1)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	txn, err := f.proxy.Txn(ctx).Then(clientv3.OpGet("/a/k")).Commit()
+	require.NoError(t, err, "reads are forwarded")
+	assert.True(t, txn.Succeeded)
+}
+
+func TestWatch(t *testing.T) {
+	f := startServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := f.put(t, "/a/0", "before") + 1
+
+	events := f.proxy.Watch(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithRev(start))
+	deletes := f.proxy.Watch(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithRev(start), clientv3.WithFilterPut())
+	f.put(t, "/a/1", "one")
+	f.put(t, "/b/1", "elsewhere")
+	_, err := f.etcd.Txn(ctx).Then(clientv3.OpPut("/a/2", "two"), clientv3.OpDelete("/a/0")).Commit()
+	require.NoError(t, err)
+
+	next := func(ch clientv3.WatchChan) clientv3.WatchResponse {
+		t.Helper()
+		select {
+		case resp := <-ch:
+			require.NoError(t, resp.Err())
+			return resp
+		case <-time.After(5 * time.Second):
+			t.Fatal("no watch response")
+		}
+		return clientv3.WatchResponse{}
+	}
+	resp := next(events)
+	require.Len(t, resp.Events, 1)
+	assert.Equal(t, "/a/1", string(resp.Events[0].Kv.Key))
+	assert.True(t, resp.Events[0].IsCreate())
+	resp = next(events)
+	require.Len(t, resp.Events, 2, "one response per revision")
+	assert.Equal(t, clientv3.EventTypePut, resp.Events[0].Type)
+	assert.Equal(t, clientv3.EventTypeDelete, resp.Events[1].Type)
+
+	resp = next(deletes)
+	require.Len(t, resp.Events, 1)
+	assert.Equal(t, "/a/0", string(resp.Events[0].Kv.Key))
+}
+
+func TestWatchDoesNotSplitRevisions(t *testing.T) {
+	f := startServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := f.stack.Cache()
+	rev := cache.Revision() + 1
+	events := f.proxy.Watch(ctx, "/a/", clientv3.WithPrefix(), clientv3.WithRev(rev))
+
+	// The keys of one transaction reach the cache one at a time.
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "/a/1", Value: []byte("one"), Revision: rev, ModRev: rev}))
+	select {
+	case resp := <-events:
+		t.Fatalf("revision sent before it was complete: %v", resp.Events)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "/a/2", Value: []byte("two"), Revision: rev, ModRev: rev}))
+	cache.Progress(rev)
+	select {
+	case resp := <-events:
+		require.NoError(t, resp.Err())
+		require.Len(t, resp.Events, 2)
+		assert.Equal(t, rev, resp.Events[1].Kv.ModRevision)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no watch response")
+	}
+}
+
+func TestWatchHistoryFromEtcd(t *testing.T) {
+	f := startServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rev := f.put(t, "/a/1", "one")
+	f.put(t, "/a/1", "two")
+	require.NoError(t, f.stack.Cache().WaitForRevision(ctx, rev+1))
+	f.stack.EventLog().(*eventlog.MemoryEventLog).Compact(rev)
+
+	// The EventLog no longer has rev, etcd still does; prev_kv needs etcd too.
+	for _, opts := range [][]clientv3.OpOption{{clientv3.WithRev(rev)}, {clientv3.WithRev(rev + 1), clientv3.WithPrevKV()}} {
+		select {
+		case resp := <-f.proxy.Watch(ctx, "/a/1", opts...):
+			require.NoError(t, resp.Err())
+			require.NotEmpty(t, resp.Events)
+			last := resp.Events[len(resp.Events)-1]
+			assert.Equal(t, "two", string(last.Kv.Value))
+			assert.Equal(t, int64(2), last.Kv.Version)
+			assert.NotZero(t, resp.Header.MemberId, "relayed from etcd")
+		case <-time.After(5 * time.Second):
+			t.Fatal("no watch response")
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	f := startServer(t)
+	conn, err := grpc.Dial(f.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := pb.NewWatchClient(conn).Watch(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{
+		CreateRequest: &pb.WatchCreateRequest{Key: []byte("/a/"), RangeEnd: []byte("/a0")},
+	}}))
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, resp.Created)
+
+	f.srv.Drain()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	stream, err = pb.NewWatchClient(conn).Watch(context.Background())
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err), "new watches are refused")
+}
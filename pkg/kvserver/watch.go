@@ -0,0 +1,328 @@
+package kvserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errDraining ends watch streams on Drain; clients retry on another endpoint.
+var errDraining = status.Error(codes.Unavailable, "etcd cache proxy is shutting down")
+
+// Watch serves one watch stream. Watches on cached ranges are served from the
+// EventLog as long as it still holds the requested history; those asking for
+// previous key-values, or for history the EventLog no longer has, are opened
+// against etcd and relayed.
+func (s *Server) Watch(stream pb.Watch_WatchServer) error {
+	s.observe("watch")
+	select {
+	case <-s.draining:
+		return errDraining
+	default:
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	ws := &watchStream{s: s, stream: stream, ctx: ctx, watches: make(map[int64]*watch)}
+	defer func() {
+		cancel()
+		ws.close()
+	}()
+
+	errc := make(chan error, 1)
+	go func() { errc <- ws.recvLoop() }()
+	select {
+	case err := <-errc:
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	case <-s.draining:
+		return errDraining
+	}
+}
+
+type watchStream struct {
+	s      *Server
+	stream pb.Watch_WatchServer
+	ctx    context.Context
+
+	sendMu sync.Mutex
+	closed bool
+
+	mu      sync.Mutex
+	nextID  int64
+	watches map[int64]*watch
+}
+
+type watch struct {
+	id     int64
+	cancel context.CancelFunc
+	local  bool         // served from the EventLog
+	last   atomic.Int64 // revision of the last EventLog event consumed and, if it matched, sent
+}
+
+// send serializes responses on the stream and drops them once the handler has returned.
+func (ws *watchStream) send(resp *pb.WatchResponse) error {
+	ws.sendMu.Lock()
+	defer ws.sendMu.Unlock()
+	if ws.closed {
+		return io.EOF
+	}
+	return ws.stream.Send(resp)
+}
+
+func (ws *watchStream) close() {
+	ws.sendMu.Lock()
+	ws.closed = true
+	ws.sendMu.Unlock()
+}
+
+func (ws *watchStream) recvLoop() error {
+	for {
+		req, err := ws.stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch r := req.RequestUnion.(type) {
+		case *pb.WatchRequest_CreateRequest:
+			err = ws.create(r.CreateRequest)
+		case *pb.WatchRequest_CancelRequest:
+			err = ws.cancel(r.CancelRequest.WatchId)
+		case *pb.WatchRequest_ProgressRequest:
+			err = ws.send(&pb.WatchResponse{Header: header(ws.progress()), WatchId: clientv3.InvalidWatchID})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (ws *watchStream) create(cr *pb.WatchCreateRequest) error {
+	rev := ws.s.cache.CompleteRevision()
+	ws.mu.Lock()
+	id := cr.WatchId
+	if id == clientv3.AutoWatchID {
+		for ws.watches[ws.nextID] != nil {
+			ws.nextID++
+		}
+		id = ws.nextID
+		ws.nextID++
+	} else if ws.watches[id] != nil {
+		ws.mu.Unlock()
+		return ws.send(&pb.WatchResponse{Header: header(rev), WatchId: id, Created: true, Canceled: true,
+			CancelReason: "mvcc: duplicate watch ID provided on the WatchStream"})
+	}
+	ctx, cancel := context.WithCancel(ws.ctx)
+	w := &watch{id: id, cancel: cancel}
+	since := cr.StartRevision
+	if since <= 0 {
+		since = rev + 1
+	}
+	w.local = !cr.PrevKv && ws.s.cached(string(cr.Key), string(cr.RangeEnd)) && since > ws.historyStart()
+	w.last.Store(since - 1)
+	ws.watches[id] = w
+	ws.mu.Unlock()
+
+	if err := ws.send(&pb.WatchResponse{Header: header(rev), WatchId: id, Created: true}); err != nil {
+		cancel()
+		return err
+	}
+	if w.local {
+		go ws.serveLog(ctx, w, cr, since)
+	} else {
+		go ws.serveUpstream(ctx, w, cr)
+	}
+	return nil
+}
+
+// historyStart is the newest revision the EventLog has no events up to.
+func (ws *watchStream) historyStart() int64 {
+	return max(ws.s.log.CompactedRevision(), ws.s.cache.ReplacedRevision())
+}
+
+func (ws *watchStream) cancel(id int64) error {
+	if !ws.remove(id) {
+		return nil
+	}
+	return ws.send(&pb.WatchResponse{Header: header(ws.s.cache.Revision()), WatchId: id, Canceled: true})
+}
+
+// remove stops watch id and reports whether it existed.
+func (ws *watchStream) remove(id int64) bool {
+	ws.mu.Lock()
+	w, ok := ws.watches[id]
+	delete(ws.watches, id)
+	ws.mu.Unlock()
+	if ok {
+		w.cancel()
+	}
+	return ok
+}
+
+// progress returns the revision every watch of the stream has delivered all
+// events up to.
+func (ws *watchStream) progress() int64 {
+	rev := ws.s.cache.CompleteRevision()
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, w := range ws.watches {
+		if w.local {
+			rev = min(rev, ws.watchProgress(w))
+		}
+	}
+	return rev
+}
+
+// watchProgress is the complete cache revision once w has consumed the whole
+// EventLog, and the last revision it consumed while it is still behind.
+func (ws *watchStream) watchProgress(w *watch) int64 {
+	rev := ws.s.cache.CompleteRevision() // read first: the log has every event up to it
+	last := w.last.Load()
+	if last >= ws.s.log.LatestRevision() {
+		return max(rev, last)
+	}
+	return last
+}
+
+// serveLog relays the EventLog events in the watched range, one response per
+// revision. A revision goes out only once all its events are in, see
+// proxy.WatchCache.WatchRevisions: clientv3 resumes a broken stream after the
+// revision of the last event it got and would miss the rest.
+func (ws *watchStream) serveLog(ctx context.Context, w *watch, cr *pb.WatchCreateRequest, since int64) {
+	revs, err := ws.s.cache.WatchRevisions(ctx, since)
+	if err != nil {
+		ws.fail(w, err)
+		return
+	}
+	key, end := string(cr.Key), string(cr.RangeEnd)
+	var noPut, noDelete bool
+	for _, f := range cr.Filters {
+		noPut = noPut || f == pb.WatchCreateRequest_NOPUT
+		noDelete = noDelete || f == pb.WatchCreateRequest_NODELETE
+	}
+	var tick <-chan time.Time
+	if cr.ProgressNotify {
+		t := time.NewTicker(ws.s.progressInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		var evs []api.Event
+		var ok bool
+		select {
+		case evs, ok = <-revs:
+		case <-tick:
+			if ws.send(&pb.WatchResponse{Header: header(ws.watchProgress(w)), WatchId: w.id}) != nil {
+				return
+			}
+			continue
+		}
+		if !ok {
+			return // ctx is done
+		}
+		rev := evs[0].Revision
+		switch evs[0].Type {
+		case api.EventCompacted:
+			if rev <= w.last.Load() {
+				continue // history this watch has already passed
+			}
+			// Events the client has not seen are gone; like etcd, cancel the
+			// watch with the first revision it could restart from.
+			ws.remove(w.id)
+			ws.send(&pb.WatchResponse{Header: header(ws.s.cache.Revision()), WatchId: w.id, Canceled: true,
+				CompactRevision: rev + 1, CancelReason: "mvcc: required revision has been compacted"})
+			return
+		case api.EventPut, api.EventDelete:
+		default:
+			continue
+		}
+		var out []*mvccpb.Event
+		for _, ev := range evs {
+			if !proxy.InRange(ev.Key, key, end) || (ev.Type == api.EventPut && noPut) || (ev.Type == api.EventDelete && noDelete) {
+				continue
+			}
+			out = append(out, watchEvent(ev))
+		}
+		if len(out) > 0 && ws.send(&pb.WatchResponse{Header: header(rev), WatchId: w.id, Events: out}) != nil {
+			return
+		}
+		w.last.Store(rev)
+	}
+}
+
+// serveUpstream relays an etcd watch opened with the same parameters.
+func (ws *watchStream) serveUpstream(ctx context.Context, w *watch, cr *pb.WatchCreateRequest) {
+	opts := []clientv3.OpOption{clientv3.WithRev(cr.StartRevision)}
+	if len(cr.RangeEnd) > 0 {
+		opts = append(opts, clientv3.WithRange(string(cr.RangeEnd)))
+	}
+	if cr.PrevKv {
+		opts = append(opts, clientv3.WithPrevKV())
+	}
+	if cr.ProgressNotify {
+		opts = append(opts, clientv3.WithProgressNotify())
+	}
+	if cr.Fragment {
+		opts = append(opts, clientv3.WithFragment())
+	}
+	for _, f := range cr.Filters {
+		switch f {
+		case pb.WatchCreateRequest_NOPUT:
+			opts = append(opts, clientv3.WithFilterPut())
+		case pb.WatchCreateRequest_NODELETE:
+			opts = append(opts, clientv3.WithFilterDelete())
+		}
+	}
+	for resp := range ws.s.cli.Watch(ctx, string(cr.Key), opts...) {
+		h := resp.Header
+		out := &pb.WatchResponse{Header: &h, WatchId: w.id, CompactRevision: resp.CompactRevision, Canceled: resp.Canceled}
+		for _, ev := range resp.Events {
+			out.Events = append(out.Events, (*mvccpb.Event)(ev))
+		}
+		if err := resp.Err(); err != nil && resp.Canceled {
+			out.CancelReason = err.Error()
+		}
+		if ws.send(out) != nil {
+			return
+		}
+		if resp.Canceled {
+			ws.remove(w.id)
+			return
+		}
+	}
+}
+
+// fail cancels watch w with err as the reason.
+func (ws *watchStream) fail(w *watch, err error) {
+	ws.s.logger.Warn("watch failed", slog.Int64("watch_id", w.id), slog.Any("error", err))
+	if ws.remove(w.id) {
+		ws.send(&pb.WatchResponse{Header: header(ws.s.cache.Revision()), WatchId: w.id, Canceled: true, CancelReason: err.Error()})
+	}
+}
+
+func watchEvent(ev api.Event) *mvccpb.Event {
+	modRev := ev.ModRev
+	if modRev == 0 {
+		modRev = ev.Revision
+	}
+	out := &mvccpb.Event{Kv: &mvccpb.KeyValue{Key: []byte(ev.Key), ModRevision: modRev}}
+	if ev.Type == api.EventDelete {
+		out.Type = mvccpb.DELETE
+	} else {
+		out.Kv.Value = ev.Value
+		out.Kv.CreateRevision, out.Kv.Version, out.Kv.Lease = ev.CreateRev, ev.Version, ev.Lease
+	}
+	return out
+}
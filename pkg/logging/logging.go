@@ -0,0 +1,40 @@
+// Package logging holds the log/slog conventions shared by every component.
+//
+// Components take a *slog.Logger through a WithLogger-style option and tag it
+// with their name; records about one key or session use the attribute names
+// below, so a single filter (e.g. key=/registry/pods/a) follows a change
+// through the watcher, the cache, the EventLog and the sessions.
+package logging
+
+import "log/slog"
+
+// Attribute names used across components.
+const (
+	ComponentKey = "component"
+	KeyKey       = "key"
+	RevisionKey  = "revision"
+	SessionKey   = "session_id"
+)
+
+// Component returns l, or slog.Default() if l is nil, tagged with the component name.
+func Component(l *slog.Logger, name string) *slog.Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l.With(ComponentKey, name)
+}
+
+// Key is the attribute for a cache or etcd key.
+func Key(k string) slog.Attr {
+	return slog.String(KeyKey, k)
+}
+
+// Revision is the attribute for a revision.
+func Revision(rev int64) slog.Attr {
+	return slog.Int64(RevisionKey, rev)
+}
+
+// Session is the attribute for a durable session ID.
+func Session(id string) slog.Attr {
+	return slog.String(SessionKey, id)
+}
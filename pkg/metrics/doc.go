@@ -0,0 +1,9 @@
+/*
+Package metrics implements api.MetricsCollector.
+
+- Prometheus: exports the observations, among them the end-to-end delivery
+  latency ("etcd commit to client delivery"), plus the live state of a
+  WatchCache, EventLog and ClientLibrary under the "etcdcache_" namespace;
+  serve its Handler on /metrics.
+*/
+package metrics
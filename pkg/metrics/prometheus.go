@@ -0,0 +1,294 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes every metric name.
+const Namespace = "etcdcache"
+
+// DefaultLatencyBuckets are upper bounds from 100µs to 10s.
+var DefaultLatencyBuckets = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// Prometheus is an api.MetricsCollector that exports to Prometheus.
+//
+// Events reported through the collector methods (latencies, compactions, slow
+// consumers) are recorded as they happen. The state of the attached WatchCache,
+// EventLog and ClientLibrary is read when the registry is scraped, so attaching
+// them costs nothing between scrapes.
+type Prometheus struct {
+	registry *prometheus.Registry
+
+	applyLatency    prometheus.Histogram
+	deliveryLatency prometheus.Histogram
+	compactions     prometheus.Counter
+	compacted       prometheus.Counter
+	watermark       prometheus.Gauge
+	slowConsumers   prometheus.Counter
+	requests        *prometheus.CounterVec
+	checks          prometheus.Counter
+	divergent       *prometheus.GaugeVec
+
+	upstreamRev atomic.Int64
+
+	mu    sync.Mutex
+	cache *proxy.WatchCache
+	log   eventlog.EventLog
+	lib   api.ClientLibrary
+}
+
+var (
+	_ api.MetricsCollector = (*Prometheus)(nil)
+	_ api.MetricsExporter  = (*Prometheus)(nil)
+)
+
+// NewPrometheus creates a collector with its own registry. The latency
+// histograms use DefaultLatencyBuckets.
+func NewPrometheus() *Prometheus {
+	buckets := make([]float64, len(DefaultLatencyBuckets))
+	for i, b := range DefaultLatencyBuckets {
+		buckets[i] = b.Seconds()
+	}
+	p := &Prometheus{
+		registry: prometheus.NewRegistry(),
+		applyLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace, Name: "apply_latency_seconds",
+			Help:    "Time taken to apply one watch event to the cache.",
+			Buckets: buckets,
+		}),
+		deliveryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace, Name: "delivery_latency_seconds",
+			Help:    "Time from an event being observed upstream to a session handing it to its client; replayed history is not counted.",
+			Buckets: buckets,
+		}),
+		compactions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace, Name: "eventlog_compactions_total",
+			Help: "EventLog compactions that removed history.",
+		}),
+		compacted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace, Name: "eventlog_compacted_events_total",
+			Help: "Events removed from the EventLog by compaction.",
+		}),
+		watermark: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace, Name: "eventlog_compacted_revision",
+			Help: "Revision up to which the EventLog has been compacted.",
+		}),
+		slowConsumers: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace, Name: "slow_consumers_dropped_total",
+			Help: "Session watches that lost events because they fell behind the EventLog.",
+		}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace, Name: "requests_total",
+			Help: "Requests served, by endpoint.",
+		}, []string{"endpoint"}),
+		checks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace, Name: "consistency_checks_total",
+			Help: "Comparisons of the cache with etcd.",
+		}),
+		divergent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: Namespace, Name: "consistency_divergent_keys",
+			Help: "Keys on which the last comparison found the cache and etcd to differ, by kind: missing, extra or mismatched.",
+		}, []string{"kind"}),
+	}
+	p.registry.MustRegister(p.applyLatency, p.deliveryLatency, p.compactions, p.compacted,
+		p.watermark, p.slowConsumers, p.requests, p.checks, p.divergent, stateCollector{p})
+	return p
+}
+
+// Registry returns the registry the metrics are registered with, e.g. to add
+// process or Go runtime collectors.
+func (p *Prometheus) Registry() *prometheus.Registry {
+	return p.registry
+}
+
+// Handler serves the metrics in the Prometheus text format; mount it on /metrics.
+func (p *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+// Export gathers every metric once and reports the first collection error.
+// Prometheus scrapes Handler itself, so there is nothing to push.
+func (p *Prometheus) Export() error {
+	_, err := p.registry.Gather()
+	return err
+}
+
+// AttachCache exports the size, revision and Get hit/miss counters of cache.
+func (p *Prometheus) AttachCache(cache *proxy.WatchCache) {
+	p.mu.Lock()
+	p.cache = cache
+	p.mu.Unlock()
+}
+
+// AttachEventLog exports the length and revision bounds of log.
+func (p *Prometheus) AttachEventLog(log eventlog.EventLog) {
+	p.mu.Lock()
+	p.log = log
+	p.mu.Unlock()
+}
+
+// AttachClientLibrary exports the sessions and watches of lib and how far their
+// watches are behind, as a histogram over all watches and the maximum.
+func (p *Prometheus) AttachClientLibrary(lib api.ClientLibrary) {
+	p.mu.Lock()
+	p.lib = lib
+	p.mu.Unlock()
+}
+
+func (p *Prometheus) ObserveRequestRate(endpoint string, count int) {
+	p.requests.WithLabelValues(endpoint).Add(float64(count))
+}
+
+func (p *Prometheus) ObserveCompaction(removed int, watermark int64) {
+	p.compactions.Inc()
+	p.compacted.Add(float64(removed))
+	p.watermark.Set(float64(watermark))
+}
+
+func (p *Prometheus) ObserveDeliveryLatency(d time.Duration) {
+	p.deliveryLatency.Observe(d.Seconds())
+}
+
+func (p *Prometheus) ObserveUpstreamRevision(rev int64) {
+	for {
+		cur := p.upstreamRev.Load()
+		if rev <= cur || p.upstreamRev.CompareAndSwap(cur, rev) {
+			return
+		}
+	}
+}
+
+// UpstreamRevision returns the highest revision passed to ObserveUpstreamRevision.
+func (p *Prometheus) UpstreamRevision() int64 {
+	return p.upstreamRev.Load()
+}
+
+func (p *Prometheus) ObserveApplyLatency(d time.Duration) {
+	p.applyLatency.Observe(d.Seconds())
+}
+
+func (p *Prometheus) ObserveSlowConsumer() {
+	p.slowConsumers.Inc()
+}
+
+func (p *Prometheus) ObserveConsistencyCheck(missing, extra, mismatched int) {
+	p.checks.Inc()
+	p.divergent.WithLabelValues("missing").Set(float64(missing))
+	p.divergent.WithLabelValues("extra").Set(float64(extra))
+	p.divergent.WithLabelValues("mismatched").Set(float64(mismatched))
+}
+
+func desc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(Namespace, "", name), help, labels, nil)
+}
+
+var (
+	storeKeysDesc       = desc("store_keys", "Keys in the cache.")
+	storeBytesDesc      = desc("store_bytes", "Bytes of keys and values in the cache.")
+	revisionDesc        = desc("revision", "Revision of the cache.")
+	upstreamRevDesc     = desc("upstream_revision", "Latest revision reported by etcd.")
+	revisionLagDesc     = desc("revision_lag", "Upstream etcd revision minus the cache revision.")
+	hitsDesc            = desc("cache_hits_total", "Get calls that found the key.")
+	missesDesc          = desc("cache_misses_total", "Get calls that did not find the key.")
+	logLengthDesc       = desc("eventlog_length", "Events retained in the EventLog.")
+	logOldestDesc       = desc("eventlog_oldest_revision", "Revision of the oldest retained event.")
+	logLatestDesc       = desc("eventlog_latest_revision", "Revision of the newest event.")
+	sessionsDesc        = desc("sessions_active", "Sessions attached to a client.")
+	watchesDesc         = desc("watches_active", "Watch streams running on attached sessions.")
+	watchQueueDepthDesc = desc("watch_queue_depth", "Events in the EventLog a running watch has not handed to its client yet, over the watches of attached sessions.")
+	watchQueueMaxDesc   = desc("watch_queue_depth_max", "Events in the EventLog the watch furthest behind has not handed to its client yet.")
+)
+
+// queueDepthBuckets are the upper bounds of the watch_queue_depth histogram.
+var queueDepthBuckets = []float64{0, 1, 10, 100, 1000, 10000, 100000}
+
+// stateCollector reads the attached components at scrape time.
+type stateCollector struct {
+	p *Prometheus
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		storeKeysDesc, storeBytesDesc, revisionDesc, upstreamRevDesc, revisionLagDesc,
+		hitsDesc, missesDesc, logLengthDesc, logOldestDesc, logLatestDesc,
+		sessionsDesc, watchesDesc, watchQueueDepthDesc, watchQueueMaxDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.p.mu.Lock()
+	cache, log, lib := c.p.cache, c.p.log, c.p.lib
+	c.p.mu.Unlock()
+
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	upstream := c.p.upstreamRev.Load()
+	gauge(upstreamRevDesc, float64(upstream))
+
+	if cache != nil {
+		st := cache.Stats()
+		gauge(storeKeysDesc, float64(st.Keys))
+		gauge(storeBytesDesc, float64(st.Bytes))
+		gauge(revisionDesc, float64(st.Revision))
+		if upstream > 0 {
+			gauge(revisionLagDesc, float64(max(upstream-st.Revision, 0)))
+		}
+		ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(st.Hits))
+		ch <- prometheus.MustNewConstMetric(missesDesc, prometheus.CounterValue, float64(st.Misses))
+	}
+
+	if log != nil {
+		b := eventlog.BoundsOf(log)
+		gauge(logLengthDesc, float64(b.Len))
+		gauge(logOldestDesc, float64(b.Oldest))
+		gauge(logLatestDesc, float64(b.Latest))
+	}
+
+	if lib != nil {
+		var sessions, watches int
+		var sum, deepest int64
+		buckets := make(map[float64]uint64, len(queueDepthBuckets))
+		for _, b := range queueDepthBuckets {
+			buckets[b] = 0
+		}
+		for _, cur := range lib.Cursors() {
+			if !cur.Attached {
+				continue
+			}
+			sessions++
+			for _, w := range cur.Watches {
+				watches++
+				depth := w.Backlog
+				sum += depth
+				deepest = max(deepest, depth)
+				for _, b := range queueDepthBuckets {
+					if float64(depth) <= b {
+						buckets[b]++
+					}
+				}
+			}
+		}
+		gauge(sessionsDesc, float64(sessions))
+		gauge(watchesDesc, float64(watches))
+		ch <- prometheus.MustNewConstHistogram(watchQueueDepthDesc, uint64(watches), float64(sum), buckets)
+		gauge(watchQueueMaxDesc, float64(deepest))
+	}
+}
@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/clientlibrary"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func put(t *testing.T, cl api.ClientLibrary, key string, rev int64) {
+	t.Helper()
+	require.NoError(t, cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: key, Value: []byte("val"), Revision: rev}))
+}
+
+func sampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, h.Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPrometheusState(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cache := proxy.NewWatchCacheWithLog(nil, log)
+	p := NewPrometheus()
+	cl := clientlibrary.NewClientLibrary(cache, log, clientlibrary.WithMetrics(p))
+	defer cl.Close()
+	p.AttachCache(cache)
+	p.AttachEventLog(log)
+	p.AttachClientLibrary(cl)
+
+	sess, err := cl.NewSession("c")
+	require.NoError(t, err)
+	defer sess.Stop()
+	events, err := sess.WatchPrefix("/a/", 1)
+	require.NoError(t, err)
+
+	put(t, cl, "/a/1", 1)
+	put(t, cl, "/b/1", 2)
+	put(t, cl, "/a/2", 3)
+	for _, want := range []string{"/a/1", "/a/2"} {
+		select {
+		case ev := <-events:
+			assert.Equal(t, want, ev.Key)
+		case <-time.After(time.Second):
+			t.Fatal("event not delivered")
+		}
+	}
+	// The delivery is recorded right after the send returns.
+	require.Eventually(t, func() bool {
+		return sampleCount(t, p.deliveryLatency) == 2 && sess.Subscriptions()[0].Revision == 3
+	}, time.Second, time.Millisecond)
+
+	cache.Get("/a/1")
+	cache.Get("/missing")
+	cache.Snapshot().Get("/b/1")
+	p.ObserveUpstreamRevision(5)
+	p.ObserveUpstreamRevision(4) // never goes backwards
+
+	expected := `
+# HELP etcdcache_cache_hits_total Get calls that found the key.
+# TYPE etcdcache_cache_hits_total counter
+etcdcache_cache_hits_total 2
+# HELP etcdcache_cache_misses_total Get calls that did not find the key.
+# TYPE etcdcache_cache_misses_total counter
+etcdcache_cache_misses_total 1
+# HELP etcdcache_eventlog_length Events retained in the EventLog.
+# TYPE etcdcache_eventlog_length gauge
+etcdcache_eventlog_length 3
+# HELP etcdcache_eventlog_oldest_revision Revision of the oldest retained event.
+# TYPE etcdcache_eventlog_oldest_revision gauge
+etcdcache_eventlog_oldest_revision 1
+# HELP etcdcache_revision Revision of the cache.
+# TYPE etcdcache_revision gauge
+etcdcache_revision 3
+# HELP etcdcache_revision_lag Upstream etcd revision minus the cache revision.
+# TYPE etcdcache_revision_lag gauge
+etcdcache_revision_lag 2
+# HELP etcdcache_sessions_active Sessions attached to a client.
+# TYPE etcdcache_sessions_active gauge
+etcdcache_sessions_active 1
+# HELP etcdcache_store_bytes Bytes of keys and values in the cache.
+# TYPE etcdcache_store_bytes gauge
+etcdcache_store_bytes 21
+# HELP etcdcache_store_keys Keys in the cache.
+# TYPE etcdcache_store_keys gauge
+etcdcache_store_keys 3
+# HELP etcdcache_watch_queue_depth_max Events in the EventLog the watch furthest behind has not handed to its client yet.
+# TYPE etcdcache_watch_queue_depth_max gauge
+etcdcache_watch_queue_depth_max 0
+# HELP etcdcache_watches_active Watch streams running on attached sessions.
+# TYPE etcdcache_watches_active gauge
+etcdcache_watches_active 1
+`
+	require.NoError(t, testutil.GatherAndCompare(p.Registry(), strings.NewReader(expected),
+		"etcdcache_cache_hits_total", "etcdcache_cache_misses_total",
+		"etcdcache_eventlog_length", "etcdcache_eventlog_oldest_revision",
+		"etcdcache_revision", "etcdcache_revision_lag",
+		"etcdcache_sessions_active", "etcdcache_watches_active", "etcdcache_watch_queue_depth_max",
+		"etcdcache_store_keys", "etcdcache_store_bytes"))
+
+	// A caught-up watch has nothing queued, however much the rest of the
+	// keyspace changes.
+	put(t, cl, "/c/1", 4)
+	require.Eventually(t, func() bool { return sess.Subscriptions()[0].Revision == 4 }, time.Second, time.Millisecond)
+	require.NoError(t, testutil.GatherAndCompare(p.Registry(), strings.NewReader(queueDepth(0)),
+		"etcdcache_watch_queue_depth", "etcdcache_watch_queue_depth_max"))
+
+	// Two changes the client has not taken yet.
+	put(t, cl, "/a/3", 5)
+	put(t, cl, "/a/4", 6)
+	require.NoError(t, testutil.GatherAndCompare(p.Registry(), strings.NewReader(queueDepth(2)),
+		"etcdcache_watch_queue_depth", "etcdcache_watch_queue_depth_max"))
+
+	// An ended watch is not counted.
+	sess.Stop()
+	require.NoError(t, testutil.GatherAndCompare(p.Registry(), strings.NewReader(`
+# HELP etcdcache_watches_active Watch streams running on attached sessions.
+# TYPE etcdcache_watches_active gauge
+etcdcache_watches_active 0
+`), "etcdcache_watches_active"))
+}
+
+// queueDepth renders the watch queue depth metrics of a single watch depth
+// events behind.
+func queueDepth(depth int64) string {
+	var b strings.Builder
+	b.WriteString(`# HELP etcdcache_watch_queue_depth Events in the EventLog a running watch has not handed to its client yet, over the watches of attached sessions.
+# TYPE etcdcache_watch_queue_depth histogram
+`)
+	for _, le := range []string{"0", "1", "10", "100", "1000", "10000", "100000", "+Inf"} {
+		n := 1
+		if bound, err := strconv.ParseInt(le, 10, 64); err == nil && depth > bound {
+			n = 0
+		}
+		fmt.Fprintf(&b, "etcdcache_watch_queue_depth_bucket{le=%q} %d\n", le, n)
+	}
+	fmt.Fprintf(&b, `etcdcache_watch_queue_depth_sum %d
+etcdcache_watch_queue_depth_count 1
+# HELP etcdcache_watch_queue_depth_max Events in the EventLog the watch furthest behind has not handed to its client yet.
+# TYPE etcdcache_watch_queue_depth_max gauge
+etcdcache_watch_queue_depth_max %d
+`, depth, depth)
+	return b.String()
+}
+
+func TestPrometheusCollectorEvents(t *testing.T) {
+	p := NewPrometheus()
+	log := eventlog.NewMemoryEventLog(10)
+	for rev := int64(1); rev <= 5; rev++ {
+		require.NoError(t, log.Append(eventlog.Event{Type: api.EventPut, Key: "k", Value: []byte("v"), Revision: rev}))
+	}
+	c := eventlog.NewCompactor(log, eventlog.WithPolicies(eventlog.KeepRevisions(2)), eventlog.WithCompactionMetrics(p))
+	_, err := c.CompactOnce(t.Context())
+	require.NoError(t, err)
+	p.ObserveApplyLatency(time.Millisecond)
+	p.ObserveRequestRate("range", 3)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.compactions))
+	assert.Equal(t, 3.0, testutil.ToFloat64(p.compacted))
+	assert.Equal(t, 3.0, testutil.ToFloat64(p.watermark))
+	assert.Equal(t, 3.0, testutil.ToFloat64(p.requests.WithLabelValues("range")))
+	assert.Equal(t, uint64(1), sampleCount(t, p.applyLatency))
+	assert.NoError(t, p.Export())
+}
+
+func TestPrometheusSlowConsumer(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(2)
+	p := NewPrometheus()
+	cl := clientlibrary.NewClientLibrary(proxy.NewWatchCacheWithLog(nil, log), log, clientlibrary.WithMetrics(p))
+	defer cl.Close()
+	sess, err := cl.NewSession("c")
+	require.NoError(t, err)
+	defer sess.Stop()
+	events, err := sess.Watch("k", 1)
+	require.NoError(t, err)
+
+	put(t, cl, "k", 1)
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered")
+	}
+	// The client stops reading while the ring buffer wraps around several times.
+	for rev := int64(2); rev <= 10; rev++ {
+		put(t, cl, "k", rev)
+	}
+	deadline := time.After(time.Second)
+	for compacted := false; !compacted; {
+		select {
+		case ev := <-events:
+			compacted = ev.Type == api.EventCompacted
+		case <-deadline:
+			t.Fatal("watch was not told about the lost events")
+		}
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(p.slowConsumers))
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	p := NewPrometheus()
+	p.ObserveDeliveryLatency(3 * time.Millisecond)
+	srv := httptest.NewServer(p.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), `etcdcache_delivery_latency_seconds_bucket{le="0.005"} 1`)
+	assert.Contains(t, string(body), "etcdcache_upstream_revision 0")
+
+	problems, err := testutil.GatherAndLint(p.Registry())
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestPrometheusConsistencyCheck(t *testing.T) {
+	p := NewPrometheus()
+	p.ObserveConsistencyCheck(3, 0, 1)
+	p.ObserveConsistencyCheck(0, 0, 2)
+	assert.Equal(t, 2.0, testutil.ToFloat64(p.checks))
+	require.NoError(t, testutil.GatherAndCompare(p.Registry(), strings.NewReader(`
+# HELP etcdcache_consistency_divergent_keys Keys on which the last comparison found the cache and etcd to differ, by kind: missing, extra or mismatched.
+# TYPE etcdcache_consistency_divergent_keys gauge
+etcdcache_consistency_divergent_keys{kind="extra"} 0
+etcdcache_consistency_divergent_keys{kind="mismatched"} 2
+etcdcache_consistency_divergent_keys{kind="missing"} 0
+`), "etcdcache_consistency_divergent_keys"))
+}
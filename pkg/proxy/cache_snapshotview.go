@@ -11,6 +11,8 @@ import (
 type CacheSnapshotView struct {
   data []*StoreObj
   index map[string]*StoreObj
+  indices map[string]index // copied from the cache when the view was taken
+  counters *readCounters   // the cache's hit/miss counters
   revision int64
 }
 
@@ -44,7 +46,9 @@ func (sv *CacheSnapshotView) Page(page, size int) ([]api.KV, error) {
 
 // Get returns the StoreObj for a single key if present.
 func (sv *CacheSnapshotView) Get(key string) (api.KV, bool) {
-    if obj, ok := sv.index[key]; ok {
+    obj, ok := sv.index[key]
+    sv.counters.record(ok)
+    if ok {
         valCopy := append([]byte(nil), obj.Value...)
         return api.KV{Key: obj.Key, Value: valCopy, Revision: obj.Revision}, true
     }
@@ -73,4 +77,20 @@ func (sv *CacheSnapshotView) List(prefix string) ([]api.KV, error) {
 // Revision returns the highest Revision in this view.
 func (sv *CacheSnapshotView) Revision() int64 {
     return sv.revision
-}
\ No newline at end of file
+}
+
+// ByIndex returns the items indexed under value in the named index as of this view, ordered by key.
+func (sv *CacheSnapshotView) ByIndex(name, value string) ([]api.KV, error) {
+    idx, ok := sv.indices[name]
+    if !ok {
+        return nil, fmt.Errorf("%w: %q", ErrIndexNotFound, name)
+    }
+    keys := sortedKeys(idx[value])
+    result := make([]api.KV, 0, len(keys))
+    for _, key := range keys {
+        obj := sv.index[key]
+        valCopy := append([]byte(nil), obj.Value...)
+        result = append(result, api.KV{Key: obj.Key, Value: valCopy, Revision: obj.Revision})
+    }
+    return result, nil
+}
@@ -9,7 +9,9 @@ Core components:
 - memoryCache: an in-memory key-value store implementing the Cache interface.
 - WatchCache: a higher-level cache with snapshot and compaction support.
 - EventSink: an interface for observing change events (used for replay, metrics, or replication).
+- TypedCache: a decoded view over a WatchCache using a pluggable codec.Codec.
 - StoreObj and SnapshotView: internal data models for consistent snapshotting and versioning.
+- RangeHash: an incrementally kept hash of any key range, for comparing caches with each other or with etcd.
 
 This package serves as the foundation of a generic watch cache proxy, enabling downstream systems
 to build client libraries and adapters on top of it.
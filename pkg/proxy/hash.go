@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+)
+
+// ErrRangeChanged is returned by Hash for a past revision after which the range changed.
+var ErrRangeChanged = errors.New("range changed after the revision")
+
+// RangeHash summarizes the objects in a key range at a revision. Hash is the
+// sum, modulo 2^64, of HashObj over the objects, so it does not depend on the
+// order they were applied in and can be recomputed from an etcd Range at
+// Revision. It detects divergence; it is not a cryptographic digest.
+//
+// etcd's HashKV cannot be matched: it hashes every revision etcd retains,
+// history and keys outside the cached prefixes included.
+type RangeHash struct {
+	Revision int64  `json:"revision"`
+	Count    int    `json:"count"`
+	Hash     uint64 `json:"hash"`
+}
+
+// HashObj is the contribution of one object to a RangeHash: FNV-1a over its
+// key, mod revision and value, each length- or varint-encoded.
+func HashObj(obj *StoreObj) uint64 {
+	h := fnv.New64a()
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(obj.Key)))])
+	h.Write([]byte(obj.Key))
+	h.Write(buf[:binary.PutVarint(buf[:], obj.ModRev)])
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(obj.Value)))])
+	h.Write(obj.Value)
+	return h.Sum64()
+}
+
+// Hash returns the RangeHash of the objects in the etcd key range [key, end)
+// (see InRange) at rev, 0 meaning the cache revision. It takes O(log n) time
+// whatever the size of the range.
+//
+// A past revision is answered only while the range is unchanged since then,
+// which the EventLog must still show; otherwise Hash fails with
+// ErrRangeChanged or ErrHistoryUnavailable. A revision the cache has not
+// reached fails with ErrInvalidRevision; WaitForRevision first.
+func (w *WatchCache) Hash(key, end string, rev int64) (RangeHash, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if rev == 0 {
+		rev = w.revision
+	}
+	if rev > w.revision {
+		return RangeHash{}, fmt.Errorf("%w: %d is newer than the cache revision %d", ErrInvalidRevision, rev, w.revision)
+	}
+	if rev < w.revision {
+		if w.eventLog == nil || w.replacedRev > rev || w.eventLog.CompactedRevision() > rev {
+			return RangeHash{}, fmt.Errorf("%w: revision %d", ErrHistoryUnavailable, rev)
+		}
+		events, err := w.eventLog.ListSince(rev + 1)
+		if err != nil {
+			return RangeHash{}, err
+		}
+		for _, ev := range events {
+			if ev.Revision > rev && InRange(ev.Key, key, end) {
+				return RangeHash{}, fmt.Errorf("%w: %q at %d", ErrRangeChanged, ev.Key, ev.Revision)
+			}
+		}
+	}
+	count, sum := w.tree.rangeSum(key, end)
+	return RangeHash{Revision: rev, Count: count, Hash: sum}, nil
+}
+
+// SplitKey returns the median key of the range [key, end), splitting it into
+// [key, mid) and [mid, end) of nearly equal size, or false if the range holds
+// fewer than two keys.
+func (w *WatchCache) SplitKey(key, end string) (string, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if end == "" {
+		return "", false
+	}
+	lo, hi := w.tree.rank(key), w.tree.size()
+	if end != "\x00" {
+		hi = w.tree.rank(end)
+	}
+	if hi-lo < 2 {
+		return "", false
+	}
+	return w.tree.nth(lo + (hi-lo)/2), true
+}
+
+// hashTree is a treap ordered by key whose nodes carry the count and hash sum
+// of their subtree, so that the hash of any key range is two O(log n) walks.
+type hashTree struct {
+	root *hashNode
+}
+
+type hashNode struct {
+	key         string
+	hash        uint64
+	prio        uint64
+	left, right *hashNode
+	count       int    // nodes in this subtree
+	sum         uint64 // of hash in this subtree
+}
+
+func (n *hashNode) update() {
+	n.count, n.sum = 1, n.hash
+	if n.left != nil {
+		n.count += n.left.count
+		n.sum += n.left.sum
+	}
+	if n.right != nil {
+		n.count += n.right.count
+		n.sum += n.right.sum
+	}
+}
+
+func rotateRight(n *hashNode) *hashNode {
+	l := n.left
+	n.left, l.right = l.right, n
+	n.update()
+	l.update()
+	return l
+}
+
+func rotateLeft(n *hashNode) *hashNode {
+	r := n.right
+	n.right, r.left = r.left, n
+	n.update()
+	r.update()
+	return r
+}
+
+// set inserts key or replaces its hash.
+func (t *hashTree) set(key string, h uint64) {
+	t.root = insertNode(t.root, key, h)
+}
+
+func insertNode(n *hashNode, key string, h uint64) *hashNode {
+	switch {
+	case n == nil:
+		n = &hashNode{key: key, hash: h, prio: rand.Uint64()}
+	case key < n.key:
+		n.left = insertNode(n.left, key, h)
+		if n.left.prio > n.prio {
+			return rotateRight(n)
+		}
+	case key > n.key:
+		n.right = insertNode(n.right, key, h)
+		if n.right.prio > n.prio {
+			return rotateLeft(n)
+		}
+	default:
+		n.hash = h
+	}
+	n.update()
+	return n
+}
+
+// remove deletes key if present.
+func (t *hashTree) remove(key string) {
+	t.root = removeNode(t.root, key)
+}
+
+func removeNode(n *hashNode, key string) *hashNode {
+	switch {
+	case n == nil:
+		return nil
+	case key < n.key:
+		n.left = removeNode(n.left, key)
+	case key > n.key:
+		n.right = removeNode(n.right, key)
+	case n.left == nil:
+		return n.right
+	case n.right == nil:
+		return n.left
+	case n.left.prio > n.right.prio:
+		n = rotateRight(n)
+		n.right = removeNode(n.right, key)
+	default:
+		n = rotateLeft(n)
+		n.left = removeNode(n.left, key)
+	}
+	n.update()
+	return n
+}
+
+func (t *hashTree) size() int {
+	if t.root == nil {
+		return 0
+	}
+	return t.root.count
+}
+
+// below returns the count and hash sum of the keys less than key.
+func (t *hashTree) below(key string) (int, uint64) {
+	var count int
+	var sum uint64
+	for n := t.root; n != nil; {
+		if n.key < key {
+			count, sum = count+1, sum+n.hash
+			if n.left != nil {
+				count, sum = count+n.left.count, sum+n.left.sum
+			}
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return count, sum
+}
+
+// rank returns the number of keys less than key.
+func (t *hashTree) rank(key string) int {
+	count, _ := t.below(key)
+	return count
+}
+
+// rangeSum returns the count and hash sum of the keys in [key, end), see InRange.
+func (t *hashTree) rangeSum(key, end string) (int, uint64) {
+	switch end {
+	case "":
+		for n := t.root; n != nil; {
+			switch {
+			case key < n.key:
+				n = n.left
+			case key > n.key:
+				n = n.right
+			default:
+				return 1, n.hash
+			}
+		}
+		return 0, 0
+	case "\x00":
+		if t.root == nil {
+			return 0, 0
+		}
+		loCount, loSum := t.below(key)
+		return t.root.count - loCount, t.root.sum - loSum
+	}
+	if end <= key {
+		return 0, 0
+	}
+	loCount, loSum := t.below(key)
+	hiCount, hiSum := t.below(end)
+	return hiCount - loCount, hiSum - loSum
+}
+
+// nth returns the i-th smallest key, counting from 0; i must be below size.
+func (t *hashTree) nth(i int) string {
+	n := t.root
+	for {
+		left := 0
+		if n.left != nil {
+			left = n.left.count
+		}
+		switch {
+		case i < left:
+			n = n.left
+		case i == left:
+			return n.key
+		default:
+			i -= left + 1
+			n = n.right
+		}
+	}
+}
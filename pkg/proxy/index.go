@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrIndexNotFound is returned by ByIndex for an index that was never registered.
+var ErrIndexNotFound = errors.New("index not found")
+
+// IndexFunc maps a cached object to the values it is indexed under, e.g. the
+// owner or node name parsed from the value. It must be deterministic and must not
+// retain obj. Returning no values leaves the object out of the index.
+type IndexFunc func(obj *StoreObj) []string
+
+// Indexers names the index functions of a WatchCache.
+type Indexers map[string]IndexFunc
+
+// index maps an index value to the set of keys indexed under it.
+type index map[string]map[string]struct{}
+
+// AddIndexers registers index functions and builds their indexes over the
+// current store. From then on the indexes are maintained on every put and delete.
+// Registering a name twice is an error.
+func (w *WatchCache) AddIndexers(indexers Indexers) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name := range indexers {
+		if _, ok := w.indexers[name]; ok {
+			return fmt.Errorf("index %q already registered", name)
+		}
+	}
+	if w.indexers == nil {
+		w.indexers = make(Indexers)
+		w.indices = make(map[string]index)
+	}
+	for name, fn := range indexers {
+		w.indexers[name] = fn
+		idx := make(index)
+		for key, obj := range w.store {
+			idx.add(key, fn(obj))
+		}
+		w.indices[name] = idx
+	}
+	return nil
+}
+
+// ByIndex returns copies of the objects indexed under value in the named index, ordered by key.
+func (w *WatchCache) ByIndex(name, value string) ([]*StoreObj, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	idx, ok := w.indices[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrIndexNotFound, name)
+	}
+	keys := sortedKeys(idx[value])
+	out := make([]*StoreObj, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, w.store[key].DeepCopy())
+	}
+	return out, nil
+}
+
+// updateIndicesLocked moves key from the index values of old to those of cur;
+// either may be nil. w.mu must be held for writing.
+func (w *WatchCache) updateIndicesLocked(key string, old, cur *StoreObj) {
+	for name, fn := range w.indexers {
+		idx := w.indices[name]
+		if old != nil {
+			idx.remove(key, fn(old))
+		}
+		if cur != nil {
+			idx.add(key, fn(cur))
+		}
+	}
+}
+
+// copyIndicesLocked returns a deep copy of every index for a SnapshotView.
+// w.mu must be held.
+func (w *WatchCache) copyIndicesLocked() map[string]index {
+	if len(w.indices) == 0 {
+		return nil
+	}
+	out := make(map[string]index, len(w.indices))
+	for name, idx := range w.indices {
+		cp := make(index, len(idx))
+		for value, keys := range idx {
+			set := make(map[string]struct{}, len(keys))
+			for k := range keys {
+				set[k] = struct{}{}
+			}
+			cp[value] = set
+		}
+		out[name] = cp
+	}
+	return out
+}
+
+func (idx index) add(key string, values []string) {
+	for _, v := range values {
+		keys, ok := idx[v]
+		if !ok {
+			keys = make(map[string]struct{})
+			idx[v] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (idx index) remove(key string, values []string) {
+	for _, v := range values {
+		keys := idx[v]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(idx, v)
+		}
+	}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
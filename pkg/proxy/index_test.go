@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// byNode indexes endpoint values like {"node":"n1"} by node name.
+func byNode(obj *StoreObj) []string {
+	var v struct {
+		Node string `json:"node"`
+	}
+	if json.Unmarshal(obj.Value, &v) != nil || v.Node == "" {
+		return nil
+	}
+	return []string{v.Node}
+}
+
+func keysOf(objs []*StoreObj) []string {
+	var keys []string
+	for _, o := range objs {
+		keys = append(keys, o.Key)
+	}
+	return keys
+}
+
+func TestWatchCache_ByIndex(t *testing.T) {
+	cache := NewWatchCache(nil)
+	cache.HandlePut("ep/a", `{"node":"n1"}`, 1)
+	require.NoError(t, cache.AddIndexers(Indexers{"node": byNode}))
+	assert.Error(t, cache.AddIndexers(Indexers{"node": byNode}))
+
+	cache.HandlePut("ep/b", `{"node":"n1"}`, 2)
+	cache.HandlePut("ep/c", `{"node":"n2"}`, 3)
+
+	objs, err := cache.ByIndex("node", "n1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ep/a", "ep/b"}, keysOf(objs))
+
+	// Moving a key updates both the old and the new index value.
+	cache.HandlePut("ep/a", `{"node":"n2"}`, 4)
+	objs, _ = cache.ByIndex("node", "n1")
+	assert.Equal(t, []string{"ep/b"}, keysOf(objs))
+	objs, _ = cache.ByIndex("node", "n2")
+	assert.Equal(t, []string{"ep/a", "ep/c"}, keysOf(objs))
+
+	cache.HandleDelete("ep/b", 5)
+	objs, _ = cache.ByIndex("node", "n1")
+	assert.Empty(t, objs)
+
+	_, err = cache.ByIndex("owner", "x")
+	assert.ErrorIs(t, err, ErrIndexNotFound)
+}
+
+func TestSnapshotView_ByIndexIsConsistent(t *testing.T) {
+	cache := NewWatchCache(nil)
+	require.NoError(t, cache.AddIndexers(Indexers{"node": byNode}))
+	cache.HandlePut("ep/a", `{"node":"n1"}`, 1)
+
+	view := cache.Snapshot()
+	cache.HandlePut("ep/b", `{"node":"n1"}`, 2)
+	cache.HandleDelete("ep/a", 3)
+
+	kvs, err := view.ByIndex("node", "n1")
+	require.NoError(t, err)
+	require.Len(t, kvs, 1)
+	assert.Equal(t, "ep/a", kvs[0].Key)
+	assert.Equal(t, int64(1), kvs[0].Revision)
+
+	kvs, _ = cache.Snapshot().ByIndex("node", "n1")
+	require.Len(t, kvs, 1)
+	assert.Equal(t, "ep/b", kvs[0].Key)
+}
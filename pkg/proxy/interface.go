@@ -1,6 +1,11 @@
 package proxy
 
-import "github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+import (
+	"context"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+)
 type WatchCacheInterface interface {
 	// this interface cannot be defined by building upon CacheWithSink, because the methods have different signatures(i.e. rev)
 	HandlePut(key, val string, rev int64)  
@@ -8,6 +13,18 @@ type WatchCacheInterface interface {
 	Get(key string) (*StoreObj, bool)
 	Revision() int64
 	Snapshot() api.SnapshotView
+	// AddEvent applies an event to the cache and its event log atomically.
+	AddEvent(ev api.Event) error
+	// WaitForRevision blocks until every change up to rev, all of its
+	// transaction included, has been applied or ctx is done.
+	WaitForRevision(ctx context.Context, rev int64) error
+	// CompleteRevision returns the revision up to which every event has been applied.
+	CompleteRevision() int64
+	// Progress completes every revision up to rev.
+	Progress(rev int64)
+	// WatchWithBookmarks streams the event log one complete revision at a
+	// time, with a bookmark every interval.
+	WatchWithBookmarks(ctx context.Context, sinceRev int64, interval time.Duration) (<-chan []api.Event, error)
 }
 
 // CacheWithSink represents a cache implementation that can also handle etcd watch events.
@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+)
+
+// ErrCorruptSnapshot is returned when a snapshot file fails its checksum or cannot be parsed.
+var ErrCorruptSnapshot = errors.New("corrupt cache snapshot")
+
+// snapshotMagic starts every snapshot file and versions the format:
+//
+//	magic | uvarint revision | uvarint count | count × entry | crc32c (big endian)
+//	entry = uvarint len(key) key | uvarint len(value) value | varint revision | varint modRev
+//	        | varint createRev | varint version | varint lease
+//
+// The checksum covers everything before it. Files of the first version,
+// snapshotMagicV1, have entries without the last three fields and still load.
+const (
+	snapshotMagic   = "WCSNAP02"
+	snapshotMagicV1 = "WCSNAP01"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteSnapshot writes the store and its complete revision (see
+// CompleteRevision) to path and returns the revision written. Keys of a
+// revision only partly applied are written too; a watch resumed after the
+// snapshot's revision sends them again and they are skipped as replays.
+// The file is written to a temporary file in the same directory, synced and then
+// renamed over path, so a crash mid-write leaves the previous snapshot intact.
+func (w *WatchCache) WriteSnapshot(path string) (int64, error) {
+	// StoreObjs are replaced, never modified, so holding the pointers is enough.
+	w.mu.RLock()
+	rev := w.complete
+	objs := make([]*StoreObj, 0, len(w.store))
+	for _, obj := range w.store {
+		objs = append(objs, obj)
+	}
+	w.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if err := encodeSnapshot(tmp, rev, objs); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return rev, syncDir(filepath.Dir(path))
+}
+
+func encodeSnapshot(f io.Writer, rev int64, objs []*StoreObj) error {
+	crc := crc32.New(castagnoli)
+	bw := bufio.NewWriter(io.MultiWriter(f, crc))
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	varint := func(v int64) {
+		bw.Write(buf[:binary.PutVarint(buf[:], v)])
+	}
+
+	bw.WriteString(snapshotMagic)
+	varint(rev)
+	uvarint(uint64(len(objs)))
+	for _, obj := range objs {
+		uvarint(uint64(len(obj.Key)))
+		bw.WriteString(obj.Key)
+		uvarint(uint64(len(obj.Value)))
+		bw.Write(obj.Value)
+		varint(obj.Revision)
+		varint(obj.ModRev)
+		varint(obj.CreateRev)
+		varint(obj.Version)
+		varint(obj.Lease)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := f.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// LoadSnapshot replaces the store and revision with the snapshot at path and
+// returns its revision. A missing file yields an error satisfying
+// errors.Is(err, os.ErrNotExist); a damaged one wraps ErrCorruptSnapshot. In
+// both cases the cache is left untouched.
+func (w *WatchCache) LoadSnapshot(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	rev, objs, err := decodeSnapshot(data)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrCorruptSnapshot, path, err)
+	}
+	w.Replace(objs, rev)
+	return rev, nil
+}
+
+func decodeSnapshot(data []byte) (int64, []*StoreObj, error) {
+	if len(data) < len(snapshotMagic)+4 {
+		return 0, nil, errors.New("file too short")
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, castagnoli) != sum {
+		return 0, nil, errors.New("checksum mismatch")
+	}
+	magic := string(body[:len(snapshotMagic)])
+	if magic != snapshotMagic && magic != snapshotMagicV1 {
+		return 0, nil, errors.New("unknown format")
+	}
+	b := body[len(snapshotMagic):]
+
+	var bad bool
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			bad = true
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(b)
+		if n <= 0 {
+			bad = true
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	bytesN := func() []byte {
+		n := uvarint()
+		if bad || n > uint64(len(b)) {
+			bad = true
+			return nil
+		}
+		v := b[:n:n]
+		b = b[n:]
+		return v
+	}
+
+	rev := varint()
+	count := uvarint()
+	if bad || count > uint64(len(b)) {
+		return 0, nil, errors.New("invalid header")
+	}
+	objs := make([]*StoreObj, 0, count)
+	for i := uint64(0); i < count; i++ {
+		obj := &StoreObj{Key: string(bytesN()), Value: bytesN()}
+		obj.Revision = varint()
+		obj.ModRev = varint()
+		if magic != snapshotMagicV1 {
+			obj.CreateRev, obj.Version, obj.Lease = varint(), varint(), varint()
+		}
+		if bad {
+			return 0, nil, fmt.Errorf("invalid entry %d", i)
+		}
+		objs = append(objs, obj)
+	}
+	if len(b) != 0 {
+		return 0, nil, errors.New("trailing data")
+	}
+	return rev, objs, nil
+}
+
+// Replace swaps the whole store for objs at revision rev and rebuilds the
+// secondary indexes. It is used to restore a snapshot or a fresh list from etcd.
+// TypedCaches see the keys that changed as changes at rev; the EventSink is not
+// told about them. The EventLog is compacted up to rev: its history no longer
+// leads to the new store, and its watchers get an EventCompacted telling them
+// to list again.
+func (w *WatchCache) Replace(objs []*StoreObj, rev int64) {
+	store := make(map[string]*StoreObj, len(objs))
+	var size int64
+	var tree hashTree
+	for _, obj := range objs {
+		if prev, ok := store[obj.Key]; ok {
+			size -= objSize(prev)
+		}
+		store[obj.Key] = obj
+		size += objSize(obj)
+		tree.set(obj.Key, HashObj(obj))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.listeners) > 0 {
+		diffStores(w.store, store, func(key string, old, cur *StoreObj) {
+			w.notifyListenersLocked(key, old, cur, rev)
+		})
+	}
+	w.store = store
+	w.bytes = size
+	w.tree = tree
+	for name, fn := range w.indexers {
+		idx := make(index)
+		for key, obj := range store {
+			idx.add(key, fn(obj))
+		}
+		w.indices[name] = idx
+	}
+	w.revision = rev
+	w.replacedRev = rev
+	w.tailRev, w.tailCount = rev, 0
+	w.completeLocked(rev)
+	if w.eventLog != nil {
+		w.eventLog.Compact(rev)
+	}
+	w.logger.Info("replaced store", logging.Revision(rev), slog.Int("keys", len(store)))
+}
+
+// diffStores calls fn for every key whose object differs between old and cur,
+// with nil for the side that lacks the key.
+func diffStores(old, cur map[string]*StoreObj, fn func(key string, old, cur *StoreObj)) {
+	for key, prev := range old {
+		if _, ok := cur[key]; !ok {
+			fn(key, prev, nil)
+		}
+	}
+	for key, obj := range cur {
+		prev, ok := old[key]
+		if !ok || prev.ModRev != obj.ModRev || !bytes.Equal(prev.Value, obj.Value) {
+			fn(key, prev, obj)
+		}
+	}
+}
+
+// ReplacedRevision returns the revision of the last Replace, or 0. The changes
+// up to it were not appended to the EventLog, so a watch from that revision or
+// older cannot be served from the log.
+func (w *WatchCache) ReplacedRevision() int64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.replacedRev
+}
+
+// ReplayLog applies the events of the cache's EventLog that are newer than the
+// cache revision, e.g. after LoadSnapshot when the log outlived the snapshot.
+// The events are not appended to the log again. It returns the complete
+// revision afterwards, the one a watch must resume after: the last revision
+// in the log may be missing events of its transaction.
+func (w *WatchCache) ReplayLog() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.eventLog == nil {
+		return w.complete, nil
+	}
+	events, err := w.eventLog.ListSince(w.revision + 1)
+	if err != nil {
+		return w.complete, err
+	}
+	for _, ev := range events {
+		switch ev.Type {
+		case api.EventPut:
+			w.applyPutLocked(NewStoreObjFromEvent(ev))
+		case api.EventDelete:
+			w.applyDeleteLocked(ev.Key, ev.Revision)
+		default:
+			continue
+		}
+		w.eventAppliedLocked(ev.Revision)
+	}
+	if len(events) > 0 {
+		w.logger.Info("replayed event log", logging.Revision(w.revision), slog.Int("events", len(events)))
+	}
+	return w.complete, nil
+}
+
+// RunSnapshotter writes a snapshot to path every interval while the complete
+// revision keeps moving, and once more when ctx is done. It returns the first write error,
+// or nil after the final write.
+func (w *WatchCache) RunSnapshotter(ctx context.Context, path string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	written := int64(-1)
+	for {
+		select {
+		case <-ctx.Done():
+			if w.CompleteRevision() == written {
+				return nil
+			}
+			_, err := w.WriteSnapshot(path)
+			return err
+		case <-ticker.C:
+			if w.CompleteRevision() == written {
+				continue
+			}
+			rev, err := w.WriteSnapshot(path)
+			if err != nil {
+				return err
+			}
+			w.logger.Debug("wrote snapshot", slog.String("path", path), logging.Revision(rev))
+			written = rev
+		}
+	}
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotFile_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	cache := NewWatchCache(nil)
+	cache.HandlePut("a", "1", 3)
+	cache.HandlePut("b", "", 5)
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "c", Value: []byte("3"), Revision: 5, ModRev: 5,
+		CreateRev: 2, Version: 4, Lease: 9}))
+	cache.Progress(5)
+	rev, err := cache.WriteSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), rev)
+
+	restored := NewWatchCache(nil)
+	require.NoError(t, restored.AddIndexers(Indexers{"value": func(o *StoreObj) []string { return []string{string(o.Value)} }}))
+	rev, err = restored.LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), rev)
+	assert.Equal(t, int64(5), restored.Revision())
+	obj, ok := restored.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "1", string(obj.Value))
+	assert.Equal(t, int64(3), obj.Revision)
+	obj, ok = restored.Get("c")
+	require.True(t, ok)
+	assert.Equal(t, [3]int64{2, 4, 9}, [3]int64{obj.CreateRev, obj.Version, obj.Lease})
+	objs, err := restored.ByIndex("value", "1")
+	require.NoError(t, err)
+	assert.Len(t, objs, 1)
+}
+
+func TestSnapshotFile_MidTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	put := func(cache *WatchCache, key string, rev int64) error {
+		return cache.AddEvent(api.Event{Type: api.EventPut, Key: key, Value: []byte(key), Revision: rev, ModRev: rev})
+	}
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	require.NoError(t, put(cache, "x", 4))
+	cache.Progress(4)
+	require.NoError(t, put(cache, "a", 5)) // the first key of a transaction writing a and b
+	rev, err := cache.WriteSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), rev, "revision 5 is not complete")
+
+	restored := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	rev, err = restored.LoadSnapshot(path)
+	require.NoError(t, err)
+	rev, err = restored.ReplayLog()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), rev)
+
+	// The watch resumes at 5 and sends the whole transaction again.
+	assert.ErrorIs(t, put(restored, "a", 5), ErrInvalidRevision, "a replay")
+	require.NoError(t, put(restored, "b", 5))
+	_, ok := restored.Get("b")
+	assert.True(t, ok)
+}
+
+func TestSnapshotFile_LoadsFirstVersion(t *testing.T) {
+	// A WCSNAP01 file holding "a"="1" at revision 3, ModRev 3.
+	b := []byte(snapshotMagicV1)
+	b = binary.AppendVarint(b, 3)
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, 1)
+	b = append(b, 'a')
+	b = binary.AppendUvarint(b, 1)
+	b = append(b, '1')
+	b = binary.AppendVarint(b, 3)
+	b = binary.AppendVarint(b, 3)
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+
+	cache := NewWatchCache(nil)
+	rev, err := cache.LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), rev)
+	obj, ok := cache.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "1", string(obj.Value))
+	assert.Zero(t, obj.CreateRev)
+}
+
+func TestReplace_CompactsTheEventLog(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cache := NewWatchCacheWithLog(nil, log)
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "a", Value: []byte("1"), Revision: 1}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := log.Watch(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), (<-events).Revision)
+
+	// The history up to 7 no longer leads to the replaced store.
+	cache.Replace([]*StoreObj{{Key: "b", Value: []byte("2"), Revision: 7, ModRev: 7}}, 7)
+	assert.Equal(t, int64(7), log.CompactedRevision())
+	select {
+	case ev := <-events:
+		assert.Equal(t, api.Event{Type: api.EventCompacted, Revision: 7}, ev)
+	case <-time.After(time.Second):
+		t.Fatal("watcher was not told about the replace")
+	}
+}
+
+func TestSnapshotFile_DetectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	cache := NewWatchCache(nil)
+	cache.HandlePut("a", "1", 1)
+	_, err := cache.WriteSnapshot(path)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0xff
+	for name, bad := range map[string][]byte{"truncated": data[:len(data)-3], "flipped": flipped, "empty": nil} {
+		require.NoError(t, os.WriteFile(path, bad, 0o600))
+		restored := NewWatchCache(nil)
+		restored.HandlePut("keep", "x", 9)
+		_, err := restored.LoadSnapshot(path)
+		assert.ErrorIs(t, err, ErrCorruptSnapshot, name)
+		_, ok := restored.Get("keep")
+		assert.True(t, ok, "%s: a failed load must leave the cache untouched", name)
+	}
+}
+
+func TestSnapshotter_WritesOnShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	cache := NewWatchCache(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- cache.RunSnapshotter(ctx, path, time.Hour) }()
+	cache.HandlePut("a", "1", 7)
+	cache.Progress(7)
+	cancel()
+	require.NoError(t, <-done)
+
+	rev, err := NewWatchCache(nil).LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), rev)
+}
+
+// snapshotWriterEnv makes the test binary act as a process that writes snapshots
+// in a loop until it is killed.
+const snapshotWriterEnv = "WATCHCACHE_SNAPSHOT_WRITER"
+
+func TestSnapshotFile_CrashMidWrite(t *testing.T) {
+	if path := os.Getenv(snapshotWriterEnv); path != "" {
+		cache := NewWatchCache(nil)
+		value := strings.Repeat("v", 1024)
+		for rev := int64(1); ; rev++ {
+			cache.HandlePut(fmt.Sprintf("key-%d", rev%4096), value, rev)
+			if _, err := cache.WriteSnapshot(path); err != nil {
+				os.Exit(1)
+			}
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	for i := 0; i < 5; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSnapshotFile_CrashMidWrite$")
+		cmd.Env = append(os.Environ(), snapshotWriterEnv+"="+path)
+		require.NoError(t, cmd.Start())
+		// Let it get through a few snapshots, then kill it wherever it is.
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if _, err := os.Stat(path); err == nil {
+				break
+			}
+			require.True(t, time.Now().Before(deadline), "writer never produced a snapshot")
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(time.Duration(20+i*15) * time.Millisecond)
+		require.NoError(t, cmd.Process.Kill())
+		cmd.Wait()
+
+		cache := NewWatchCache(nil)
+		rev, err := cache.LoadSnapshot(path)
+		require.NoError(t, err, "run %d: snapshot must survive a crash mid-write", i)
+		assert.Positive(t, rev)
+		obj, ok := cache.Get(fmt.Sprintf("key-%d", rev%4096))
+		require.True(t, ok)
+		assert.Equal(t, rev, obj.Revision)
+	}
+}
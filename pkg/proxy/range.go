@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+)
+
+// ErrHistoryUnavailable is returned by ReplaceRange when the changes made after
+// the given revision are no longer all in the EventLog.
+var ErrHistoryUnavailable = errors.New("changes after the revision are not in the event log")
+
+// InRange reports whether k is in the etcd key range [key, end): an empty end
+// selects key alone and end "\x00" every key from key on.
+func InRange(k, key, end string) bool {
+	switch end {
+	case "":
+		return k == key
+	case "\x00":
+		return k >= key
+	}
+	return k >= key && k < end
+}
+
+// Range returns copies of the objects with keys in the etcd key range [key, end)
+// (see InRange), ordered by key, and the cache revision they are current at.
+// A single-key Range counts as a Get hit or miss.
+func (w *WatchCache) Range(key, end string) ([]*StoreObj, int64) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.rangeLocked(key, end)
+}
+
+// RangeComplete is Range at the complete revision (see CompleteRevision):
+// while only some of the events of a transaction have been applied it waits
+// for the rest, so the objects never hold half of one. It fails with ctx.Err()
+// if ctx is done first.
+func (w *WatchCache) RangeComplete(ctx context.Context, key, end string) ([]*StoreObj, int64, error) {
+	for {
+		w.mu.RLock()
+		if w.complete >= w.revision {
+			objs, rev := w.rangeLocked(key, end)
+			w.mu.RUnlock()
+			return objs, rev, nil
+		}
+		rev := w.revision
+		w.mu.RUnlock()
+		wake := w.completeWait(rev)
+		if wake == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// rangeLocked is Range with w.mu held.
+func (w *WatchCache) rangeLocked(key, end string) ([]*StoreObj, int64) {
+	if end == "" {
+		obj, ok := w.store[key]
+		w.counters.record(ok)
+		if !ok {
+			return nil, w.revision
+		}
+		return []*StoreObj{obj.DeepCopy()}, w.revision
+	}
+	var out []*StoreObj
+	for k, obj := range w.store {
+		if InRange(k, key, end) {
+			out = append(out, obj.DeepCopy())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, w.revision
+}
+
+// Progress records that every change up to rev has been applied, as an etcd
+// watch progress notification tells, and raises the cache revision to rev
+// without an event. It lets readers that wait for etcd's current revision
+// (WaitForRevision) proceed while nothing under the watched prefixes changes,
+// and completes the revisions up to rev for WatchRevisions and RangeComplete.
+func (w *WatchCache) Progress(rev int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advanceRevisionLocked(rev)
+	w.completeLocked(rev)
+}
+
+// ReplaceRange overwrites the objects with keys in [key, end) with objs, the
+// state of that range at rev as read from etcd, and returns how many keys it
+// added, changed or removed. It repairs a range that diverged from etcd without
+// re-listing the whole cache.
+//
+// Keys changed after rev keep their newer state: those with a later event in
+// the EventLog and those cached at a later revision. So unless rev is the cache
+// revision, every change after it must still be in the log; otherwise
+// ReplaceRange fails with ErrHistoryUnavailable. rev must not be newer than the
+// cache revision.
+//
+// The repair is not appended to the EventLog: watchers that already received
+// the divergent state are not corrected.
+func (w *WatchCache) ReplaceRange(key, end string, objs []*StoreObj, rev int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if rev > w.revision {
+		return 0, fmt.Errorf("%w: %d is newer than the cache revision %d", ErrInvalidRevision, rev, w.revision)
+	}
+	changed := make(map[string]struct{})
+	if rev < w.revision {
+		if w.eventLog == nil || w.replacedRev > rev || w.eventLog.CompactedRevision() > rev {
+			return 0, fmt.Errorf("%w: revision %d", ErrHistoryUnavailable, rev)
+		}
+		events, err := w.eventLog.ListSince(rev + 1)
+		if err != nil {
+			return 0, err
+		}
+		for _, ev := range events {
+			if ev.Revision > rev {
+				changed[ev.Key] = struct{}{}
+			}
+		}
+	}
+	keep := func(k string, existing *StoreObj) bool {
+		_, ok := changed[k]
+		return ok || existing != nil && existing.Revision > rev
+	}
+
+	n := 0
+	want := make(map[string]*StoreObj, len(objs))
+	for _, obj := range objs {
+		if InRange(obj.Key, key, end) {
+			want[obj.Key] = obj
+		}
+	}
+	for k, existing := range w.store {
+		if _, ok := want[k]; ok || !InRange(k, key, end) || keep(k, existing) {
+			continue
+		}
+		delete(w.store, k)
+		w.storeChangedLocked(k, existing, nil, rev)
+		w.tree.remove(k)
+		w.bytes -= objSize(existing)
+		n++
+	}
+	for k, obj := range want {
+		existing, ok := w.store[k]
+		if keep(k, existing) || ok && existing.ModRev == obj.ModRev && bytes.Equal(existing.Value, obj.Value) {
+			continue
+		}
+		obj = obj.DeepCopy()
+		w.store[k] = obj
+		w.storeChangedLocked(k, existing, obj, rev)
+		w.tree.set(k, HashObj(obj))
+		w.bytes += objSize(obj)
+		if ok {
+			w.bytes -= objSize(existing)
+		}
+		n++
+	}
+	if n > 0 {
+		w.logger.Info("replaced range", logging.Key(key), slog.String("end", end), logging.Revision(rev), slog.Int("changed", n))
+	}
+	return n, nil
+}
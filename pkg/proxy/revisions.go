@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+)
+
+// ErrNoEventLog is returned by WatchRevisions on a cache without an EventLog.
+var ErrNoEventLog = errors.New("watch cache has no event log")
+
+// WatchRevisions streams the cache's EventLog from sinceRev on, one revision
+// at a time: every slice holds all the events of one revision, in log order.
+// The events of one etcd transaction share a revision and are applied one
+// AddEvent at a time, so a revision is sent only once it is complete: an event
+// of a later revision was applied, or Progress covered it. WatchWithAdapter
+// calls Progress after every etcd watch response; events added by other means,
+// e.g. BroadcastUpdate, wait for the next revision or Progress.
+//
+// Markers such as api.EventCompacted come as slices of their own. A marker
+// below a revision whose events have been read already is history the stream
+// has passed and is dropped. Once the stream has sent every event in the log
+// and CompleteRevision moves past the last revision sent, e.g. through
+// Progress on a quiet keyspace, it sends an api.EventBookmark at the complete
+// revision: every event up to it has been sent. The channel is closed when ctx
+// is done.
+func (w *WatchCache) WatchRevisions(ctx context.Context, sinceRev int64) (<-chan []api.Event, error) {
+	if w.eventLog == nil {
+		return nil, ErrNoEventLog
+	}
+	events, err := w.eventLog.Watch(ctx, sinceRev)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan []api.Event)
+	go func() {
+		defer close(out)
+		send := func(evs []api.Event) bool {
+			select {
+			case out <- evs:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		var batch []api.Event // the events of one revision read so far
+		// readRev and readN are the last revision read from the log and how
+		// many of its events were read, -1 for all of them; sent is the
+		// revision every event up to which has been sent.
+		readRev, readN, sent := sinceRev-1, -1, sinceRev-1
+		for {
+			var wake <-chan struct{}
+			if len(batch) > 0 {
+				var done bool
+				if done, wake = w.revisionDone(batch[0].Revision, len(batch)); done {
+					if !send(batch) {
+						return
+					}
+					sent = max(sent, batch[0].Revision)
+					batch = nil
+				}
+			}
+			if len(batch) == 0 {
+				var rev int64
+				if rev, wake = w.caughtUp(sent, readRev, readN); rev > sent {
+					if !send([]api.Event{{Type: api.EventBookmark, Revision: rev}}) {
+						return
+					}
+					sent = rev
+					continue
+				}
+			}
+			var ev api.Event
+			var ok bool
+			select {
+			case ev, ok = <-events:
+			case <-wake:
+				continue
+			}
+			if !ok {
+				return // ctx is done
+			}
+			switch {
+			case ev.Type == api.EventPut || ev.Type == api.EventDelete:
+				if ev.Revision == readRev {
+					readN++
+				} else {
+					readRev, readN = ev.Revision, 1
+				}
+				if len(batch) > 0 && ev.Revision != batch[0].Revision {
+					// A later revision shows the pending one complete.
+					if !send(batch) {
+						return
+					}
+					sent = max(sent, batch[0].Revision)
+					batch = nil
+				}
+				batch = append(batch, ev)
+			case len(batch) > 0 && ev.Revision < batch[0].Revision:
+				// History the stream has passed.
+			default:
+				if ev.Type == api.EventCompacted && ev.Revision > readRev {
+					// The log holds nothing up to the compacted revision.
+					readRev, readN = ev.Revision, -1
+				}
+				if len(batch) > 0 {
+					if !send(batch) {
+						return
+					}
+					sent = max(sent, batch[0].Revision)
+				}
+				batch = nil
+				if !send([]api.Event{ev}) {
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// WatchWithBookmarks is WatchRevisions with a bookmark every interval: a slice
+// holding one api.EventBookmark at the revision every event up to which the
+// stream has sent. On a quiet stream the bookmark follows CompleteRevision, so
+// a consumer that reconnects with fromRev = bookmark.Revision+1 neither skips
+// nor repeats an event. The progress bookmarks of WatchRevisions are not passed
+// on; an interval <= 0 sends no bookmarks at all.
+func (w *WatchCache) WatchWithBookmarks(ctx context.Context, sinceRev int64, interval time.Duration) (<-chan []api.Event, error) {
+	revs, err := w.WatchRevisions(ctx, sinceRev)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan []api.Event)
+	go func() {
+		defer close(out)
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		// caught is the revision every event up to which has been sent; it
+		// stays at or below the complete revision, even for a stream started
+		// ahead of it.
+		caught := min(max(sinceRev-1, 0), w.CompleteRevision())
+		for {
+			var evs []api.Event
+			select {
+			case <-ctx.Done():
+				return
+			case r, ok := <-revs:
+				if !ok {
+					return
+				}
+				switch r[0].Type {
+				case api.EventBookmark:
+					caught = max(caught, r[0].Revision)
+					continue
+				case api.EventPut, api.EventDelete:
+					caught = max(caught, r[0].Revision)
+				}
+				evs = r
+			case <-tick:
+				evs = []api.Event{{Type: api.EventBookmark, Revision: caught}}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- evs:
+			}
+		}
+	}()
+	return out, nil
+}
+
+// revisionDone reports whether the n events a reader of the EventLog has read
+// at rev are all the events of rev. Until they are, it returns a channel that
+// is closed when that may have changed.
+func (w *WatchCache) revisionDone(rev int64, n int) (bool, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.complete >= rev && (w.tailRev != rev || n >= w.tailCount) {
+		// A later event is in the log already when tailRev != rev; the reader
+		// gets to it next.
+		return w.tailRev == rev, nil
+	}
+	if w.completeNotify == nil {
+		w.completeNotify = make(chan struct{})
+	}
+	return false, w.completeNotify
+}
+
+// caughtUp returns the complete revision if a reader of the EventLog that has
+// read n events of readRev, or all of them for n < 0, has read every event in
+// the log and the complete revision is past sent. Otherwise it returns 0 and a
+// channel that is closed when the complete revision advances.
+func (w *WatchCache) caughtUp(sent, readRev int64, n int) (int64, <-chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	read := w.tailRev < readRev || w.tailRev == readRev && (n < 0 || n >= w.tailCount)
+	if read && w.complete > sent {
+		return w.complete, nil
+	}
+	if w.completeNotify == nil {
+		w.completeNotify = make(chan struct{})
+	}
+	return 0, w.completeNotify
+}
+
+// eventAppliedLocked records that an event at rev was applied, and appended to
+// the EventLog if there is one. An event of a newer revision completes every
+// revision before it. w.mu must be held for writing.
+func (w *WatchCache) eventAppliedLocked(rev int64) {
+	if rev == w.tailRev {
+		w.tailCount++
+		return
+	}
+	w.tailRev, w.tailCount = rev, 1
+	w.completeLocked(rev - 1)
+}
+
+// CompleteRevision returns the revision up to which every event has been
+// applied. It is behind Revision while only some of the events of an etcd
+// transaction have been applied, until a later event or Progress completes it.
+func (w *WatchCache) CompleteRevision() int64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.complete
+}
+
+// completeWait returns nil once the complete revision has reached rev, and
+// until then a channel that is closed when the complete revision advances.
+func (w *WatchCache) completeWait(rev int64) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.complete >= rev {
+		return nil
+	}
+	if w.completeNotify == nil {
+		w.completeNotify = make(chan struct{})
+	}
+	return w.completeNotify
+}
+
+// completeLocked records that every event up to rev has been applied and wakes
+// WatchRevisions readers, RangeComplete and WaitForRevision waiting for it. w.mu must be held for writing.
+func (w *WatchCache) completeLocked(rev int64) {
+	if rev <= w.complete {
+		return
+	}
+	w.complete = rev
+	if w.completeNotify != nil {
+		close(w.completeNotify)
+		w.completeNotify = nil
+	}
+}
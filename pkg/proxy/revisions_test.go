@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchRevisions_SendsCompleteRevisions(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	put := func(key string, rev int64) {
+		t.Helper()
+		require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: key, Value: []byte(key), Revision: rev, ModRev: rev}))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	revs, err := cache.WatchRevisions(ctx, 1)
+	require.NoError(t, err)
+	next := func() []api.Event {
+		t.Helper()
+		select {
+		case evs := <-revs:
+			return evs
+		case <-time.After(time.Second):
+			t.Fatal("no revision sent")
+		}
+		return nil
+	}
+	keys := func(evs []api.Event) []string {
+		var out []string
+		for _, ev := range evs {
+			out = append(out, ev.Key)
+		}
+		return out
+	}
+
+	// The first key of a transaction alone does not complete its revision.
+	put("a", 2)
+	select {
+	case evs := <-revs:
+		t.Fatalf("revision 2 sent before it was complete: %v", keys(evs))
+	case <-time.After(50 * time.Millisecond):
+	}
+	put("b", 2)
+	cache.Progress(2) // the end of the etcd watch response
+	assert.Equal(t, []string{"a", "b"}, keys(next()))
+
+	// A later revision completes the one before it.
+	put("c", 3)
+	put("d", 4)
+	assert.Equal(t, []string{"c"}, keys(next()))
+
+	// Replace compacts the log; the pending revision goes out before the marker.
+	cache.Replace(nil, 5)
+	assert.Equal(t, []string{"d"}, keys(next()))
+	assert.Equal(t, []api.Event{{Type: api.EventCompacted, Revision: 5}}, next())
+}
+
+func TestWatchRevisions_ProgressBookmark(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	revs, err := cache.WatchRevisions(ctx, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "a", Revision: 2, ModRev: 2}))
+	cache.Progress(2)
+	assert.Equal(t, "a", (<-revs)[0].Key)
+
+	// Nothing under the cache changes, but etcd reports progress: the stream
+	// tells how far it has got.
+	cache.Progress(5)
+	select {
+	case evs := <-revs:
+		assert.Equal(t, []api.Event{{Type: api.EventBookmark, Revision: 5}}, evs)
+	case <-time.After(time.Second):
+		t.Fatal("no progress bookmark")
+	}
+}
+
+func TestWatchWithBookmarks_IdleReachesComplete(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "foo", Revision: 7, ModRev: 7}))
+	cache.Progress(7)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	revs, err := cache.WatchWithBookmarks(ctx, 1, 20*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", (<-revs)[0].Key)
+
+	// An idle stream's bookmark is at the revision the cache has completed,
+	// not one behind its last event.
+	assert.Equal(t, []api.Event{{Type: api.EventBookmark, Revision: 7}}, <-revs)
+	cache.Progress(9)
+	for evs := range revs {
+		assert.Equal(t, api.EventBookmark, evs[0].Type)
+		if evs[0].Revision == 9 {
+			return
+		}
+	}
+}
+
+func TestWatchWithBookmarks_Transaction(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	revs, err := cache.WatchWithBookmarks(ctx, 1, 5*time.Millisecond)
+	require.NoError(t, err)
+	next := func() []api.Event {
+		t.Helper()
+		for {
+			select {
+			case evs := <-revs:
+				if evs[0].Type != api.EventBookmark || evs[0].Revision != 0 {
+					return evs
+				}
+			case <-time.After(time.Second):
+				t.Fatal("nothing on the watch")
+			}
+		}
+	}
+
+	// One transaction writes a and b at revision 3; a bookmark between the
+	// two must not claim revision 3.
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "a", Revision: 3, ModRev: 3}))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "b", Revision: 3, ModRev: 3}))
+	cache.Progress(3)
+	evs := next()
+	require.Len(t, evs, 2)
+	assert.Equal(t, "a", evs[0].Key)
+	assert.Equal(t, "b", evs[1].Key)
+	assert.Equal(t, []api.Event{{Type: api.EventBookmark, Revision: 3}}, next())
+}
+
+func TestWatchWithBookmarks_AheadOfCache(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "foo", Revision: 7, ModRev: 7}))
+	cache.Progress(7)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	revs, err := cache.WatchWithBookmarks(ctx, 100, 5*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, []api.Event{{Type: api.EventBookmark, Revision: 7}}, <-revs, "a bookmark never passes the complete revision")
+}
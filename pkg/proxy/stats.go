@@ -0,0 +1,44 @@
+package proxy
+
+import "sync/atomic"
+
+// CacheStats is a point-in-time summary of a WatchCache for metrics.
+type CacheStats struct {
+	Keys     int
+	Bytes    int64 // keys plus values
+	Revision int64
+	Hits     uint64 // Get calls, on the cache or its SnapshotViews, that found the key
+	Misses   uint64
+}
+
+// readCounters counts Get hits and misses. A nil *readCounters ignores records,
+// which keeps zero-value views usable.
+type readCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (c *readCounters) record(hit bool) {
+	switch {
+	case c == nil:
+	case hit:
+		c.hits.Add(1)
+	default:
+		c.misses.Add(1)
+	}
+}
+
+// Stats returns the current size, revision and read counters.
+func (w *WatchCache) Stats() CacheStats {
+	w.mu.RLock()
+	st := CacheStats{Keys: len(w.store), Bytes: w.bytes, Revision: w.revision}
+	w.mu.RUnlock()
+	if w.counters != nil {
+		st.Hits, st.Misses = w.counters.hits.Load(), w.counters.misses.Load()
+	}
+	return st
+}
+
+func objSize(obj *StoreObj) int64 {
+	return int64(len(obj.Key) + len(obj.Value))
+}
@@ -8,6 +8,11 @@ type StoreObj struct {
     Value          []byte
     Revision      int64 // global revision: indicates the change's order among all operations
     ModRev         int64
+    // CreateRev, Version and Lease are etcd's for the key, 0 when unknown, e.g.
+    // for keys put with HandlePut or restored from a snapshot that predates them.
+    CreateRev      int64
+    Version        int64
+    Lease          int64
     EventType      mvccpb.Event_EventType  // necessary attribute?
 }
 
@@ -12,7 +12,10 @@ func NewStoreObjFromEvent(ev eventlog.Event) *StoreObj {
         Key:            ev.Key,
         Value:          ev.Value,
         Revision:      ev.Revision,
-        ModRev:         ev.Revision, // or ev.ModRev if future events carry it separately
+        ModRev:         ev.ModRev,
+        CreateRev:      ev.CreateRev,
+        Version:        ev.Version,
+        Lease:          ev.Lease,
         EventType:      mvccpb.Event_EventType(ev.Type), // convert to etcd's enum type
     }
 }
\ No newline at end of file
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/codec"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+)
+
+// ErrDecodeFailed is returned by TypedCache.Get for a key whose latest value
+// could not be decoded.
+var ErrDecodeFailed = errors.New("value could not be decoded")
+
+// DefaultTypedHistory is how many typed events a TypedCache keeps for Watch.
+const DefaultTypedHistory = 1024
+
+// TypedObj is the decoded value of one key.
+// Object is shared by every reader and must be treated as immutable.
+type TypedObj[T any] struct {
+	Key      string
+	Object   T
+	Revision int64
+	ModRev   int64
+}
+
+// TypedEvent is a decoded change. Object is the zero value for deletes;
+// Err is set when a put could not be decoded.
+type TypedEvent[T any] struct {
+	Type     api.EventType
+	Key      string
+	Revision int64
+	Object   T
+	Err      error
+}
+
+// DecodeFailure records why the latest value of a key could not be decoded.
+type DecodeFailure struct {
+	Revision int64
+	Err      error
+}
+
+// TypedOption configures a TypedCache.
+type TypedOption func(*typedConfig)
+
+type typedConfig struct {
+	history int
+	prefix  string
+}
+
+// WithTypedHistory sets how many recent events Watch can replay (default DefaultTypedHistory).
+func WithTypedHistory(n int) TypedOption {
+	return func(c *typedConfig) {
+		c.history = n
+	}
+}
+
+// WithTypedPrefix limits the TypedCache to the keys under prefix (default all
+// keys), e.g. the one resource type its codec understands.
+func WithTypedPrefix(prefix string) TypedOption {
+	return func(c *typedConfig) {
+		c.prefix = prefix
+	}
+}
+
+// TypedCache keeps a decoded copy of every value under its prefix in a
+// WatchCache, so consumers read objects instead of bytes and each value is
+// decoded exactly once, when it is ingested. It follows every change to the
+// WatchCache, however it is made: AddEvent, Replace and the repair of a range.
+// Any number of TypedCaches, with different prefixes and codecs, can follow
+// one WatchCache.
+//
+// A value that fails to decode still reaches the WatchCache and its EventLog;
+// the failure is recorded against the key until a later event replaces it.
+type TypedCache[T any] struct {
+	cache  *WatchCache
+	codec  codec.Codec[T]
+	prefix string
+	stop   func() // unregisters from cache
+
+	mu       sync.RWMutex
+	objects  map[string]*TypedObj[T]
+	failures map[string]DecodeFailure
+	revision int64 // revision of the last change seen in cache, under the prefix or not
+
+	history  []TypedEvent[T] // most recent events, oldest first
+	capacity int
+	appended int64         // total number of events appended to history
+	notify   chan struct{} // closed and replaced on every append to wake watchers
+}
+
+// NewTypedCache decodes the current contents of cache under the prefix with c
+// and keeps them in sync with every later change to cache, until Close.
+func NewTypedCache[T any](cache *WatchCache, c codec.Codec[T], opts ...TypedOption) *TypedCache[T] {
+	cfg := typedConfig{history: DefaultTypedHistory}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	tc := &TypedCache[T]{
+		cache:    cache,
+		codec:    c,
+		prefix:   cfg.prefix,
+		objects:  make(map[string]*TypedObj[T]),
+		failures: make(map[string]DecodeFailure),
+		capacity: cfg.history,
+		notify:   make(chan struct{}),
+	}
+	tc.stop = cache.listen(func(store map[string]*StoreObj, rev int64) {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		tc.revision = rev
+		for key, obj := range store {
+			if strings.HasPrefix(key, tc.prefix) {
+				tc.decodeLocked(key, obj.Value, obj.Revision, obj.ModRev)
+			}
+		}
+	}, tc.storeChanged)
+	return tc
+}
+
+// Close stops following the WatchCache. The typed view keeps its last state and
+// open watches see no further events.
+func (c *TypedCache[T]) Close() {
+	c.stop()
+}
+
+// AddEvent applies ev to the underlying WatchCache, which passes it on to the
+// typed view if accepted; it lets a TypedCache stand in as a watcher.EventApplier.
+// Errors from the WatchCache are returned as is.
+func (c *TypedCache[T]) AddEvent(ev api.Event) error {
+	return c.cache.AddEvent(ev)
+}
+
+// storeChanged is the TypedCache's changeListener on the WatchCache.
+func (c *TypedCache[T]) storeChanged(key string, _, cur *StoreObj, rev int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rev > c.revision {
+		c.revision = rev
+	}
+	if !strings.HasPrefix(key, c.prefix) {
+		return
+	}
+	tev := TypedEvent[T]{Type: api.EventDelete, Key: key, Revision: rev}
+	if cur == nil {
+		delete(c.objects, key)
+		delete(c.failures, key)
+	} else {
+		tev.Type = api.EventPut
+		tev.Object, tev.Err = c.decodeLocked(key, cur.Value, cur.Revision, cur.ModRev)
+	}
+	c.appendLocked(tev)
+}
+
+func (c *TypedCache[T]) decodeLocked(key string, val []byte, rev, modRev int64) (T, error) {
+	obj, err := c.codec.Decode(val)
+	if err != nil {
+		c.cache.logger.Warn("value could not be decoded", logging.Key(key), logging.Revision(rev), slog.Any("error", err))
+		delete(c.objects, key)
+		c.failures[key] = DecodeFailure{Revision: rev, Err: err}
+		return obj, err
+	}
+	delete(c.failures, key)
+	c.objects[key] = &TypedObj[T]{Key: key, Object: obj, Revision: rev, ModRev: modRev}
+	return obj, nil
+}
+
+func (c *TypedCache[T]) appendLocked(ev TypedEvent[T]) {
+	if c.capacity <= 0 {
+		return
+	}
+	if len(c.history) == c.capacity {
+		copy(c.history, c.history[1:])
+		c.history = c.history[:len(c.history)-1]
+	}
+	c.history = append(c.history, ev)
+	c.appended++
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// Get returns the decoded value of key. It returns ErrKeyNotFound for missing
+// keys and wraps ErrDecodeFailed when the key's latest value did not decode.
+func (c *TypedCache[T]) Get(key string) (TypedObj[T], error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if f, ok := c.failures[key]; ok {
+		return TypedObj[T]{}, fmt.Errorf("%w: key %q at revision %d: %w", ErrDecodeFailed, key, f.Revision, f.Err)
+	}
+	obj, ok := c.objects[key]
+	if !ok {
+		return TypedObj[T]{}, ErrKeyNotFound
+	}
+	return *obj, nil
+}
+
+// List returns the decoded values under prefix ordered by key.
+// Keys whose latest value did not decode are left out; see DecodeFailures.
+func (c *TypedCache[T]) List(prefix string) []TypedObj[T] {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var out []TypedObj[T]
+	for key, obj := range c.objects {
+		if strings.HasPrefix(key, prefix) {
+			out = append(out, *obj)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// DecodeFailures returns the keys whose latest value could not be decoded.
+func (c *TypedCache[T]) DecodeFailures() map[string]DecodeFailure {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]DecodeFailure, len(c.failures))
+	for k, f := range c.failures {
+		out[k] = f
+	}
+	return out
+}
+
+// Revision returns the revision of the underlying WatchCache.
+func (c *TypedCache[T]) Revision() int64 {
+	return c.cache.Revision()
+}
+
+// Watch streams decoded changes under prefix with Revision >= fromRev until ctx
+// is done. fromRev <= 0 starts after the current revision, i.e. only new
+// changes. It returns ErrInvalidRevision if fromRev is older than the retained
+// history. A consumer that falls more than the history size behind has its
+// channel closed and must list and watch again.
+func (c *TypedCache[T]) Watch(ctx context.Context, prefix string, fromRev int64) (<-chan TypedEvent[T], error) {
+	c.mu.RLock()
+	if fromRev <= 0 {
+		fromRev = c.revision + 1
+	}
+	oldest := c.revision + 1
+	if len(c.history) > 0 {
+		oldest = c.history[0].Revision
+	}
+	if fromRev < oldest {
+		c.mu.RUnlock()
+		return nil, fmt.Errorf("%w: revision %d is older than the typed history (oldest %d)", ErrInvalidRevision, fromRev, oldest)
+	}
+	pos := c.appended - int64(len(c.history))
+	c.mu.RUnlock()
+
+	out := make(chan TypedEvent[T])
+	go func() {
+		defer close(out)
+		for {
+			events, next, wake, ok := c.readFrom(pos)
+			if !ok {
+				return
+			}
+			pos = next
+			for _, ev := range events {
+				if ev.Revision < fromRev || !strings.HasPrefix(ev.Key, prefix) {
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- ev:
+				}
+			}
+			if len(events) == 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-wake:
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// readFrom returns the events appended at or after position pos. ok is false
+// when some of them have already been evicted from the history.
+func (c *TypedCache[T]) readFrom(pos int64) (events []TypedEvent[T], next int64, wake <-chan struct{}, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	first := c.appended - int64(len(c.history))
+	if pos < first {
+		return nil, pos, nil, false
+	}
+	events = append(events, c.history[pos-first:]...)
+	return events, c.appended, c.notify, true
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/codec"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type endpoint struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+func TestTypedCache_DecodeOnceAndGet(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	cache.HandlePut("ep/a", `{"ip":"10.0.0.1","port":80}`, 1)
+
+	tc := NewTypedCache(cache, codec.JSON[endpoint]())
+	obj, err := tc.Get("ep/a")
+	require.NoError(t, err)
+	assert.Equal(t, endpoint{IP: "10.0.0.1", Port: 80}, obj.Object)
+
+	require.NoError(t, tc.AddEvent(api.Event{Type: api.EventPut, Key: "ep/b", Value: []byte(`{"ip":"10.0.0.2","port":443}`), Revision: 2, ModRev: 2}))
+	list := tc.List("ep/")
+	require.Len(t, list, 2)
+	assert.Equal(t, "ep/b", list[1].Key)
+	assert.Equal(t, int64(2), list[1].Revision)
+
+	// The event reached the underlying cache as well.
+	raw, ok := cache.Get("ep/b")
+	require.True(t, ok)
+	assert.Equal(t, int64(2), raw.Revision)
+
+	// Rejections from the WatchCache leave the typed view untouched.
+	err = tc.AddEvent(api.Event{Type: api.EventPut, Key: "ep/b", Value: []byte(`{}`), Revision: 1})
+	assert.ErrorIs(t, err, ErrInvalidRevision)
+	obj, _ = tc.Get("ep/b")
+	assert.Equal(t, 443, obj.Object.Port)
+}
+
+func TestTypedCache_DecodeFailuresTrackedPerKey(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	tc := NewTypedCache(cache, codec.JSON[endpoint]())
+
+	require.NoError(t, tc.AddEvent(api.Event{Type: api.EventPut, Key: "ep/a", Value: []byte("not json"), Revision: 1}))
+	_, err := tc.Get("ep/a")
+	assert.ErrorIs(t, err, ErrDecodeFailed)
+	assert.Equal(t, int64(1), tc.DecodeFailures()["ep/a"].Revision)
+	assert.Empty(t, tc.List("ep/"))
+
+	// The raw value was not dropped.
+	_, ok := cache.Get("ep/a")
+	assert.True(t, ok)
+
+	// A later valid value clears the failure.
+	require.NoError(t, tc.AddEvent(api.Event{Type: api.EventPut, Key: "ep/a", Value: []byte(`{"port":1}`), Revision: 2}))
+	_, err = tc.Get("ep/a")
+	assert.NoError(t, err)
+	assert.Empty(t, tc.DecodeFailures())
+}
+
+func TestTypedCache_Watch(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	tc := NewTypedCache(cache, codec.JSON[endpoint]())
+	require.NoError(t, tc.AddEvent(api.Event{Type: api.EventPut, Key: "ep/a", Value: []byte(`{"port":1}`), Revision: 1}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := tc.Watch(ctx, "ep/", 1)
+	require.NoError(t, err)
+
+	require.NoError(t, tc.AddEvent(api.Event{Type: api.EventPut, Key: "other", Value: []byte(`{}`), Revision: 2}))
+	require.NoError(t, tc.AddEvent(api.Event{Type: api.EventPut, Key: "ep/b", Value: []byte("bad"), Revision: 3}))
+	require.NoError(t, tc.AddEvent(api.Event{Type: api.EventDelete, Key: "ep/a", Revision: 4}))
+
+	var got []TypedEvent[endpoint]
+	for len(got) < 3 {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out, got %d events", len(got))
+		}
+	}
+	assert.Equal(t, 1, got[0].Object.Port)
+	assert.Equal(t, "ep/b", got[1].Key)
+	assert.Error(t, got[1].Err)
+	assert.Equal(t, api.EventDelete, got[2].Type)
+	assert.Equal(t, int64(4), got[2].Revision)
+}
+
+func TestTypedCache_WatchBeyondHistory(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	tc := NewTypedCache(cache, codec.Raw(), WithTypedHistory(2))
+	for rev := int64(1); rev <= 3; rev++ {
+		require.NoError(t, tc.AddEvent(api.Event{Type: api.EventPut, Key: "k", Value: []byte("v"), Revision: rev}))
+	}
+	_, err := tc.Watch(context.Background(), "", 1)
+	assert.ErrorIs(t, err, ErrInvalidRevision)
+}
+
+func TestTypedCache_FollowsTheWatchCache(t *testing.T) {
+	cache := NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(10))
+	endpoints := NewTypedCache(cache, codec.JSON[endpoint](), WithTypedPrefix("ep/"))
+	defer endpoints.Close()
+	raw := NewTypedCache(cache, codec.Raw(), WithTypedPrefix("cfg/"))
+
+	// Changes made on the WatchCache itself reach every TypedCache, each within its prefix.
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "ep/a", Value: []byte(`{"port":1}`), Revision: 1}))
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "cfg/x", Value: []byte("not json"), Revision: 2}))
+	obj, err := endpoints.Get("ep/a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, obj.Object.Port)
+	assert.Empty(t, endpoints.DecodeFailures(), "keys outside the prefix are not decoded")
+	assert.Len(t, raw.List(""), 1)
+
+	// So does a Replace, as the changes it makes.
+	events, err := endpoints.Watch(context.Background(), "", 0)
+	require.NoError(t, err)
+	cache.Replace([]*StoreObj{{Key: "ep/b", Value: []byte(`{"port":2}`), Revision: 5, ModRev: 5}}, 5)
+	_, err = endpoints.Get("ep/a")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	obj, err = endpoints.Get("ep/b")
+	require.NoError(t, err)
+	assert.Equal(t, 2, obj.Object.Port)
+	got := map[string]api.EventType{}
+	for len(got) < 2 {
+		select {
+		case ev := <-events:
+			got[ev.Key] = ev.Type
+		case <-time.After(time.Second):
+			t.Fatalf("timed out, got %v", got)
+		}
+	}
+	assert.Equal(t, map[string]api.EventType{"ep/a": api.EventDelete, "ep/b": api.EventPut}, got)
+
+	// A closed TypedCache stops following.
+	raw.Close()
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "cfg/y", Value: []byte("v"), Revision: 6}))
+	assert.Len(t, raw.List(""), 0, "the Replace removed cfg/x and cfg/y came after Close")
+}
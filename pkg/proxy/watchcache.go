@@ -1,13 +1,19 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -19,27 +25,64 @@ type WatchCache struct {
 	mu            sync.RWMutex
 	store         map[string]*StoreObj // The current latest key-value state snapshot
 	revision      int64                 // revision tracks the total number of write operations across all keys.
+	replacedRev   int64                 // revision of the last Replace; the EventLog has no history up to it
 	eventSink     EventSink             // Downstream sink (observer pattern)
 	eventLog      eventlog.EventLog
+	complete      int64                 // every event up to this revision has been applied, see WatchRevisions
+	tailRev       int64                 // revision of the last event applied
+	tailCount     int                   // events applied at tailRev
+	completeNotify chan struct{}        // created by waiters for complete, closed when it advances
+	indexers      Indexers              // registered by AddIndexers
+	indices       map[string]index      // index name -> value -> keys, kept in step with store
+	listeners     map[int]changeListener // registered by listen, e.g. TypedCaches
+	nextListener  int
+	tree          hashTree              // key order with range hashes, kept in step with store
+	bytes         int64                 // sum of key and value sizes in store
+	counters      *readCounters         // Get hits and misses, shared with SnapshotViews
+	tracer        trace.Tracer          // nil unless WithTracerProvider is given
+	logger        *slog.Logger
 	// Optional: If we need to analyze key write frequency, enable eviction policies,
 	// or track the most updated key, consider adding:
 	// MaxPerKeyRevision int64 // highest key-local revision among all keys
 }
 
-func NewWatchCache(sink EventSink) *WatchCache {
-	return &WatchCache{
-		store:     make(map[string]*StoreObj),
-		eventSink: sink,
+// CacheOption configures a WatchCache.
+type CacheOption func(*WatchCache)
+
+// WithTracerProvider traces every AddEvent, and the EventLog append within it,
+// with tp. Events that arrive without a trace context start a new trace.
+func WithTracerProvider(tp trace.TracerProvider) CacheOption {
+	return func(w *WatchCache) {
+		w.tracer = tracing.Tracer(tp)
 	}
 }
 
-// NewWatchCacheWithLog creates a WatchCache with an optional event log sink.
-func NewWatchCacheWithLog(sink EventSink, log eventlog.EventLog) *WatchCache {
-	return &WatchCache{
+// WithLogger sets the logger of the cache and of TypedCaches built on it
+// (default slog.Default()).
+func WithLogger(l *slog.Logger) CacheOption {
+	return func(w *WatchCache) {
+		w.logger = l
+	}
+}
+
+func NewWatchCache(sink EventSink, opts ...CacheOption) *WatchCache {
+	w := &WatchCache{
 		store:     make(map[string]*StoreObj),
 		eventSink: sink,
-		eventLog:  log,
+		counters:  &readCounters{},
 	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.logger = logging.Component(w.logger, "watchcache")
+	return w
+}
+
+// NewWatchCacheWithLog creates a WatchCache with an optional event log sink.
+func NewWatchCacheWithLog(sink EventSink, log eventlog.EventLog, opts ...CacheOption) *WatchCache {
+	w := NewWatchCache(sink, opts...)
+	w.eventLog = log
+	return w
 }
 
 // HandlePut is a convenience wrapper that accepts string values.
@@ -53,25 +96,34 @@ func (w *WatchCache) HandlePut(key, val string, Revision int64) {
 func (w *WatchCache) HandlePutBytes(key string, valBytes []byte, Revision int64) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.applyPutLocked(&StoreObj{Key: key, Value: valBytes, Revision: Revision, ModRev: Revision}) {
+		w.eventAppliedLocked(Revision)
+	}
+}
 
+// applyPutLocked stores obj unless its key already holds this or a newer
+// revision, and reports whether it did. w.mu must be held for writing.
+func (w *WatchCache) applyPutLocked(obj *StoreObj) bool {
+	key, valBytes, Revision := obj.Key, obj.Value, obj.Revision
 	existing, ok := w.store[key]
 	if ok && Revision <= existing.Revision {
-		return
+		return false
 	}
 
-	w.store[key] = &StoreObj{
-		Key:      key,
-		Value:    valBytes,
-		Revision: Revision,
+	w.store[key] = obj
+	w.storeChangedLocked(key, existing, obj, Revision)
+	w.tree.set(key, HashObj(obj))
+	w.bytes += objSize(obj)
+	if ok {
+		w.bytes -= objSize(existing)
 	}
 
-	if Revision > w.revision {
-		w.revision = Revision
-	}
+	w.advanceRevisionLocked(Revision)
 
 	if w.eventSink != nil {
 		w.eventSink.HandlePut(key, string(valBytes))
 	}
+	return true
 }
 
 // HandleDeleteBytes is the high-throughput version of HandleDelete that accepts raw data.
@@ -79,20 +131,31 @@ func (w *WatchCache) HandlePutBytes(key string, valBytes []byte, Revision int64)
 func (w *WatchCache) HandleDeleteBytes(key string, Revision int64) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if w.applyDeleteLocked(key, Revision) {
+		w.eventAppliedLocked(Revision)
+	}
+}
 
+// applyDeleteLocked removes the key unless it already holds this or a newer
+// revision, and reports whether it did. w.mu must be held for writing.
+func (w *WatchCache) applyDeleteLocked(key string, Revision int64) bool {
 	existing, ok := w.store[key]
 	if ok && Revision <= existing.Revision {
-		return
+		return false
 	}
 
 	delete(w.store, key)
-
-	if Revision > w.revision {
-		w.revision = Revision
+	w.storeChangedLocked(key, existing, nil, Revision)
+	if ok {
+		w.tree.remove(key)
+		w.bytes -= objSize(existing)
 	}
+
+	w.advanceRevisionLocked(Revision)
 	if w.eventSink != nil {
 		w.eventSink.HandleDelete(key)
 	}
+	return true
 }
 
 // HandleDelete is a convenience wrapper for deletion.
@@ -106,6 +169,7 @@ func (w *WatchCache) Get(key string) (*StoreObj, bool) {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 	obj, ok := w.store[key]
+	w.counters.record(ok)
 	if !ok {
 		return nil, false
 	}
@@ -113,19 +177,123 @@ func (w *WatchCache) Get(key string) (*StoreObj, bool) {
 	return obj.DeepCopy(), true
 }
 
+// AddEvent is the single ingestion path for an event: it applies the event to the
+// store and appends it to the event log under one lock, so the log order always
+// matches the cache's revision order. Events older than the current cache
+// revision, or not newer than the key's own revision (replays), are rejected
+// with ErrInvalidRevision and leave both untouched. Several keys may share one
+// revision, as they do when an etcd transaction writes more than one key.
 func (w *WatchCache) AddEvent(ev api.Event) error {
+	if w.tracer == nil {
+		return w.addEvent(context.Background(), ev)
+	}
+	ctx, span := w.tracer.Start(tracing.Extract(context.Background(), ev), "watchcache.apply",
+		trace.WithAttributes(tracing.EventAttributes(ev)...))
+	if ev.TraceContext == nil {
+		ev.TraceContext = tracing.Inject(ctx)
+	}
+	err := w.addEvent(ctx, ev)
+	tracing.End(span, err)
+	return err
+}
+
+func (w *WatchCache) addEvent(ctx context.Context, ev api.Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ev.Revision < w.revision {
+		return fmt.Errorf("%w: event revision %d, cache revision %d", ErrInvalidRevision, ev.Revision, w.revision)
+	}
+	var applied bool
 	switch ev.Type {
 	case api.EventPut:
-		w.HandlePutBytes(ev.Key, ev.Value, ev.Revision)
+		applied = w.applyPutLocked(NewStoreObjFromEvent(ev))
 	case api.EventDelete:
-		w.HandleDeleteBytes(ev.Key, ev.Revision)
+		applied = w.applyDeleteLocked(ev.Key, ev.Revision)
 	default:
 		return fmt.Errorf("unsupported event type: %v", ev.Type)
 	}
-	if w.eventLog != nil {
+	if !applied {
+		return fmt.Errorf("%w: key %q already at revision %d", ErrInvalidRevision, ev.Key, ev.Revision)
+	}
+	if ev.IngestedAt.IsZero() {
+		ev.IngestedAt = time.Now()
+	}
+	w.eventAppliedLocked(ev.Revision)
+	if w.eventLog == nil {
+		return nil
+	}
+	if w.tracer == nil {
 		return w.eventLog.Append(ev)
 	}
-	return nil
+	_, span := w.tracer.Start(ctx, "eventlog.append")
+	err := w.eventLog.Append(ev)
+	tracing.End(span, err)
+	return err
+}
+
+// advanceRevisionLocked raises the cache revision. w.mu must be held for writing.
+func (w *WatchCache) advanceRevisionLocked(rev int64) {
+	if rev <= w.revision {
+		return
+	}
+	w.revision = rev
+}
+
+// changeListener is told about a change to the store: key went from old to cur
+// at rev. old is nil for a new key, cur for a deleted one; a delete of a key that
+// was not cached has both nil. It is called with w.mu held for writing and must
+// not modify old or cur, nor call back into the cache.
+type changeListener func(key string, old, cur *StoreObj, rev int64)
+
+// listen registers fn for every later change to the store. init is first called,
+// under the same lock, with the current store and revision, so no change falls
+// between the two. The returned func unregisters fn.
+func (w *WatchCache) listen(init func(store map[string]*StoreObj, rev int64), fn changeListener) (cancel func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	init(w.store, w.revision)
+	if w.listeners == nil {
+		w.listeners = make(map[int]changeListener)
+	}
+	id := w.nextListener
+	w.nextListener++
+	w.listeners[id] = fn
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.listeners, id)
+	}
+}
+
+// storeChangedLocked updates the secondary indexes and tells the listeners that
+// key went from old to cur at rev. w.mu must be held for writing.
+func (w *WatchCache) storeChangedLocked(key string, old, cur *StoreObj, rev int64) {
+	w.updateIndicesLocked(key, old, cur)
+	w.notifyListenersLocked(key, old, cur, rev)
+}
+
+func (w *WatchCache) notifyListenersLocked(key string, old, cur *StoreObj, rev int64) {
+	for _, fn := range w.listeners {
+		fn(key, old, cur, rev)
+	}
+}
+
+// WaitForRevision blocks until the cache has applied every change up to rev,
+// all the events of rev's transaction included (see CompleteRevision), or ctx
+// is done. It is used to give writers read-your-writes semantics.
+func (w *WatchCache) WaitForRevision(ctx context.Context, rev int64) error {
+	for {
+		wake := w.completeWait(rev)
+		if wake == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
 }
 
 func (w *WatchCache) Revision() int64 {
@@ -140,9 +308,14 @@ func (wc *WatchCache) Snapshot() api.SnapshotView {
     defer wc.mu.RUnlock()
 
     // 1. 收集所有深拷贝的 StoreObj
+    // The index must point at the copies too, otherwise Get on the view would
+    // observe writes made after the snapshot was taken.
     items := make([]*StoreObj, 0, len(wc.store))
-    for _, obj := range wc.store {
-        items = append(items, obj.DeepCopy())
+    index := make(map[string]*StoreObj, len(wc.store))
+    for key, obj := range wc.store {
+        cp := obj.DeepCopy()
+        items = append(items, cp)
+        index[key] = cp
     }
     // 2. 按 Revision 排序，保证顺序稳定
     sort.Slice(items, func(i, j int) bool {
@@ -151,7 +324,9 @@ func (wc *WatchCache) Snapshot() api.SnapshotView {
     // 3. 返回包含数据和当前全局版本号的视图
     return &CacheSnapshotView{
         data: items,
-		index: wc.store,
+		index: index,
+		indices: wc.copyIndicesLocked(),
+		counters: wc.counters,
         revision:  wc.revision,
     }
 }
\ No newline at end of file
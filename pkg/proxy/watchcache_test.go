@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
 	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
@@ -38,7 +40,7 @@ func TestWatchCache_HandlePutAndGet(t *testing.T) {
 	val, ok := cache.Get("foo")
 
 	assert.True(t, ok)
-	assert.Equal(t, "bar", val)
+	assert.Equal(t, "bar", string(val.Value))
 	assert.Equal(t, int64(1), cache.Revision())
 	assert.Equal(t, "bar", sink.puts["foo"])
 }
@@ -65,7 +67,7 @@ func TestWatchCache_IgnoreStaleRevision(t *testing.T) {
 
 	val, ok := cache.Get("foo")
 	assert.True(t, ok)
-	assert.Equal(t, "bar", val)
+	assert.Equal(t, "bar", string(val.Value))
 	assert.Equal(t, int64(5), cache.Revision())
 }
 
@@ -151,4 +153,186 @@ func TestAddEventListSince(t *testing.T) {
 	assert.Equal(t, "bar", string(events[0].Value))
 	assert.Equal(t, "baz", events[1].Key)
 	assert.Equal(t, "qux", string(events[1].Value))
-}
\ No newline at end of file
+}
+
+func TestWatchCache_AddEvent_RejectsOutOfOrder(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cache := NewWatchCacheWithLog(nil, log)
+
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "a", Value: []byte("1"), Revision: 5}))
+	err := cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "b", Value: []byte("2"), Revision: 4})
+	assert.ErrorIs(t, err, ErrInvalidRevision)
+	// A replay of an event the key already holds is rejected as well.
+	err = cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "a", Value: []byte("1"), Revision: 5})
+	assert.ErrorIs(t, err, ErrInvalidRevision)
+
+	_, ok := cache.Get("b")
+	assert.False(t, ok)
+	events, _ := log.ListSince(0)
+	assert.Len(t, events, 1)
+}
+
+func TestWatchCache_AddEvent_SameRevisionTxn(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cache := NewWatchCacheWithLog(nil, log)
+
+	// One etcd transaction writing two keys yields two events with the same revision.
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "a", Value: []byte("1"), Revision: 7, ModRev: 7}))
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "b", Value: []byte("2"), Revision: 7, ModRev: 7}))
+
+	obj, ok := cache.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, "2", string(obj.Value))
+	assert.Equal(t, int64(7), obj.ModRev)
+	events, _ := log.ListSince(0)
+	assert.Len(t, events, 2)
+}
+
+func TestWatchCache_Range(t *testing.T) {
+	cache := NewWatchCache(nil)
+	for i, key := range []string{"/b", "/a/2", "/a/1", "/c"} {
+		assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: key, Value: []byte("v"), Revision: int64(i + 1)}))
+	}
+	keys := func(key, end string) []string {
+		objs, rev := cache.Range(key, end)
+		assert.Equal(t, int64(4), rev)
+		var out []string
+		for _, obj := range objs {
+			out = append(out, obj.Key)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"/a/1"}, keys("/a/1", ""))
+	assert.Nil(t, keys("/a", ""))
+	assert.Equal(t, []string{"/a/1", "/a/2"}, keys("/a/", "/a0"))
+	assert.Equal(t, []string{"/a/2", "/b", "/c"}, keys("/a/2", "\x00"))
+	assert.Equal(t, uint64(1), cache.Stats().Hits)
+	assert.Equal(t, uint64(1), cache.Stats().Misses)
+}
+
+func TestWatchCache_RangeComplete(t *testing.T) {
+	cache := NewWatchCache(nil)
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "a", Revision: 2}))
+	cache.Progress(2)
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "b", Revision: 3})) // half of a transaction
+	assert.Equal(t, int64(2), cache.CompleteRevision())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := cache.RangeComplete(ctx, "a", "\x00")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	type result struct {
+		n   int
+		rev int64
+	}
+	done := make(chan result, 1)
+	go func() {
+		objs, rev, _ := cache.RangeComplete(context.Background(), "a", "\x00")
+		done <- result{len(objs), rev}
+	}()
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "c", Revision: 3}))
+	cache.Progress(3)
+	assert.Equal(t, result{3, 3}, <-done)
+}
+
+func TestWatchCache_Progress(t *testing.T) {
+	cache := NewWatchCache(nil)
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "a", Revision: 3}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- cache.WaitForRevision(ctx, 8) }()
+
+	cache.Progress(2) // never goes backwards
+	assert.Equal(t, int64(3), cache.Revision())
+	cache.Progress(8)
+	assert.NoError(t, <-done)
+	assert.ErrorIs(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: "b", Revision: 7}), ErrInvalidRevision)
+}
+
+func TestWatchCache_ReplaceRange(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(10)
+	cache := NewWatchCacheWithLog(nil, log)
+	put := func(key, val string, rev int64) {
+		assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventPut, Key: key, Value: []byte(val), Revision: rev, ModRev: rev}))
+	}
+	put("/a/1", "stale", 1)
+	put("/a/2", "two", 2)
+	put("/a/extra", "x", 3)
+	put("/b", "b", 4)
+	// /a/3 changed after the state read at revision 4.
+	put("/a/3", "new", 5)
+	assert.NoError(t, cache.AddEvent(eventlog.Event{Type: eventlog.EventDelete, Key: "/a/4", Revision: 6}))
+
+	etcdAt4 := []*StoreObj{
+		{Key: "/a/1", Value: []byte("one"), Revision: 1, ModRev: 1},
+		{Key: "/a/2", Value: []byte("two"), Revision: 2, ModRev: 2},
+		{Key: "/a/3", Value: []byte("old"), Revision: 4, ModRev: 4},
+		{Key: "/a/4", Value: []byte("gone"), Revision: 4, ModRev: 4},
+	}
+	n, err := cache.ReplaceRange("/a/", "/a0", etcdAt4, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n, "/a/1 fixed, /a/extra removed")
+
+	objs, rev := cache.Range("\x00", "\x00")
+	assert.Equal(t, int64(6), rev)
+	got := map[string]string{}
+	for _, obj := range objs {
+		got[obj.Key] = string(obj.Value)
+	}
+	assert.Equal(t, map[string]string{"/a/1": "one", "/a/2": "two", "/a/3": "new", "/b": "b"}, got)
+	assert.Equal(t, int64(len("/a/1one/a/2two/a/3new/bb")), cache.Stats().Bytes)
+
+	_, err = cache.ReplaceRange("/a/", "/a0", etcdAt4, 7)
+	assert.ErrorIs(t, err, ErrInvalidRevision)
+	log.Compact(5)
+	_, err = cache.ReplaceRange("/a/", "/a0", etcdAt4, 4)
+	assert.ErrorIs(t, err, ErrHistoryUnavailable)
+}
+
+func TestWatchCache_Hash(t *testing.T) {
+	log := eventlog.NewMemoryEventLog(1000)
+	cache := NewWatchCacheWithLog(nil, log)
+	// Hashes kept incrementally must match hashes summed from scratch.
+	for rev := int64(1); rev <= 300; rev++ {
+		key := fmt.Sprintf("/k/%02d", rev*7%50)
+		ev := eventlog.Event{Type: eventlog.EventPut, Key: key, Value: []byte(fmt.Sprint(rev)), Revision: rev, ModRev: rev}
+		if rev%5 == 0 {
+			ev = eventlog.Event{Type: eventlog.EventDelete, Key: key, Revision: rev}
+		}
+		assert.NoError(t, cache.AddEvent(ev))
+	}
+	for _, r := range [][2]string{{"/k/", "/k0"}, {"/k/10", "/k/30"}, {"/k/07", ""}, {"/k/20", "\x00"}, {"/k/30", "/k/10"}} {
+		objs, rev := cache.Range(r[0], r[1])
+		var sum uint64
+		for _, obj := range objs {
+			sum += HashObj(obj)
+		}
+		h, err := cache.Hash(r[0], r[1], 0)
+		assert.NoError(t, err)
+		assert.Equal(t, RangeHash{Revision: rev, Count: len(objs), Hash: sum}, h, "%q", r)
+	}
+
+	// A past revision is answered for ranges unchanged since.
+	_, err := cache.Hash("/k/", "/k0", 299)
+	assert.ErrorIs(t, err, ErrRangeChanged)
+	h, err := cache.Hash("/k/01", "/k/02", 299)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(299), h.Revision)
+	_, err = cache.Hash("/k/", "/k0", 301)
+	assert.ErrorIs(t, err, ErrInvalidRevision)
+
+	objs, _ := cache.Range("/k/", "/k0")
+	mid, ok := cache.SplitKey("/k/", "/k0")
+	assert.True(t, ok)
+	assert.Equal(t, objs[len(objs)/2].Key, mid)
+	_, ok = cache.SplitKey("/k/07", "")
+	assert.False(t, ok)
+
+	// Replace rebuilds the hashes.
+	cache.Replace(objs[:2], 300)
+	h, err = cache.Hash("/k/", "/k0", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, HashObj(objs[0])+HashObj(objs[1]), h.Hash)
+}
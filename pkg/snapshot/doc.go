@@ -0,0 +1,15 @@
+/*
+Package snapshot exports cache snapshots to portable files and reads them back.
+
+Two formats are supported:
+
+- JSON lines: a header line {"snapshotRevision":N} followed by one
+  {"key":...,"value":<base64>,"revision":...} object per key, ordered by key,
+  so two dumps can be compared with ordinary diff tools.
+- etcd db: the bbolt file layout of an etcd member's backend and of
+  `etcdctl snapshot save`, written through etcd's mvcc backend packages, so the
+  file can be inspected with etcd tooling or opened with mvcc.NewStore.
+
+A Dump read from either format can seed a WatchCache for tests or debugging.
+*/
+package snapshot
@@ -0,0 +1,134 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/mvcc/backend"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+// revBytesLen is the length of an mvcc revision key: 8-byte main revision,
+// '_', 8-byte sub revision, all big endian. Tombstones append a 't'.
+const revBytesLen = 17
+
+// cacheBucket holds metadata of our own that etcd ignores.
+var cacheBucket = backend.Bucket(bucket{id: 200, name: []byte("etcdcache")})
+
+var snapshotRevisionKey = []byte("snapshot_revision")
+
+type bucket struct {
+	id   backend.BucketID
+	name []byte
+}
+
+func (b bucket) ID() backend.BucketID    { return b.id }
+func (b bucket) Name() []byte            { return b.name }
+func (b bucket) String() string          { return string(b.name) }
+func (b bucket) IsSafeRangeBucket() bool { return false }
+
+// WriteEtcdDB writes d as an etcd backend database at path, replacing any file there.
+// Each key is stored at its own revision; keys sharing a revision get increasing
+// sub revisions, as the keys of one etcd transaction do. The dump's own revision
+// is kept in an extra bucket because it may be newer than every key in it.
+func WriteEtcdDB(path string, d *Dump) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	be := backend.NewDefaultBackend(path)
+
+	kvs := append([]api.KV(nil), d.KVs...)
+	sort.SliceStable(kvs, func(i, j int) bool { return kvs[i].Revision < kvs[j].Revision })
+
+	tx := be.BatchTx()
+	tx.LockOutsideApply()
+	tx.UnsafeCreateBucket(buckets.Key)
+	tx.UnsafeCreateBucket(buckets.Meta)
+	tx.UnsafeCreateBucket(cacheBucket)
+	var sub, lastRev int64
+	for _, kv := range kvs {
+		if kv.Revision != lastRev {
+			lastRev, sub = kv.Revision, 0
+		}
+		val, err := (&mvccpb.KeyValue{
+			Key:            []byte(kv.Key),
+			Value:          kv.Value,
+			CreateRevision: kv.Revision, // the original create revision is not cached
+			ModRevision:    kv.Revision,
+			Version:        1,
+		}).Marshal()
+		if err != nil {
+			tx.Unlock()
+			be.Close()
+			return err
+		}
+		tx.UnsafePut(buckets.Key, revBytes(kv.Revision, sub), val)
+		sub++
+	}
+	tx.UnsafePut(cacheBucket, snapshotRevisionKey, binary.BigEndian.AppendUint64(nil, uint64(d.Revision)))
+	tx.Unlock()
+	be.ForceCommit()
+	return be.Close()
+}
+
+// ReadEtcdDB reads the latest value of every key from an etcd backend database,
+// either one written by WriteEtcdDB or an etcd member/`etcdctl snapshot save` file.
+// For etcd's own files the dump revision is the newest revision found.
+func ReadEtcdDB(path string) (*Dump, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	be := backend.NewDefaultBackend(path)
+	defer be.Close()
+
+	latest := make(map[string]api.KV)
+	var maxRev, snapRev int64
+	tx := be.ReadTx()
+	tx.RLock()
+	defer tx.RUnlock()
+	err := tx.UnsafeForEach(buckets.Key, func(k, v []byte) error {
+		if len(k) < revBytesLen {
+			return fmt.Errorf("invalid revision key %x", k)
+		}
+		var kv mvccpb.KeyValue
+		if err := kv.Unmarshal(v); err != nil {
+			return err
+		}
+		rev := int64(binary.BigEndian.Uint64(k[:8]))
+		maxRev = max(maxRev, rev)
+		if len(k) > revBytesLen && k[revBytesLen] == 't' {
+			delete(latest, string(kv.Key))
+			return nil
+		}
+		latest[string(kv.Key)] = api.KV{Key: string(kv.Key), Value: kv.Value, Revision: kv.ModRevision}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Absent in files not written by WriteEtcdDB; UnsafeRange returns nothing then.
+	_, vals := tx.UnsafeRange(cacheBucket, snapshotRevisionKey, nil, 0)
+	if len(vals) == 1 && len(vals[0]) == 8 {
+		snapRev = int64(binary.BigEndian.Uint64(vals[0]))
+	}
+
+	d := &Dump{Revision: max(maxRev, snapRev)}
+	for _, kv := range latest {
+		d.KVs = append(d.KVs, kv)
+	}
+	sort.Slice(d.KVs, func(i, j int) bool { return d.KVs[i].Key < d.KVs[j].Key })
+	return d, nil
+}
+
+func revBytes(main, sub int64) []byte {
+	b := make([]byte, revBytesLen)
+	binary.BigEndian.PutUint64(b, uint64(main))
+	b[8] = '_'
+	binary.BigEndian.PutUint64(b[9:], uint64(sub))
+	return b
+}
@@ -0,0 +1,82 @@
+package snapshot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+)
+
+type jsonHeader struct {
+	SnapshotRevision int64 `json:"snapshotRevision"`
+}
+
+// jsonEntry is one key; encoding/json renders Value as base64.
+type jsonEntry struct {
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	Revision int64  `json:"revision"`
+}
+
+// WriteJSONLines writes d as a header line followed by one line per key.
+func WriteJSONLines(w io.Writer, d *Dump) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(jsonHeader{SnapshotRevision: d.Revision}); err != nil {
+		return err
+	}
+	for _, kv := range d.KVs {
+		if err := enc.Encode(jsonEntry{Key: kv.Key, Value: kv.Value, Revision: kv.Revision}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadJSONLines parses the output of WriteJSONLines.
+func ReadJSONLines(r io.Reader) (*Dump, error) {
+	dec := json.NewDecoder(r)
+	var head jsonHeader
+	if err := dec.Decode(&head); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	d := &Dump{Revision: head.SnapshotRevision}
+	for line := 2; ; line++ {
+		var e jsonEntry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return d, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.Key == "" {
+			return nil, fmt.Errorf("line %d: missing key", line)
+		}
+		d.KVs = append(d.KVs, api.KV{Key: e.Key, Value: e.Value, Revision: e.Revision})
+	}
+}
+
+func writeJSONLinesFile(path string, d *Dump) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteJSONLines(f, d); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readJSONLinesFile(path string) (*Dump, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadJSONLines(f)
+}
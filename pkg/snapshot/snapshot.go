@@ -0,0 +1,80 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+)
+
+// Format identifies a snapshot file format.
+type Format string
+
+const (
+	FormatJSONLines Format = "jsonl"
+	FormatEtcdDB    Format = "db"
+)
+
+var ErrUnknownFormat = errors.New("unknown snapshot format")
+
+// Dump is the content of an exported snapshot.
+type Dump struct {
+	Revision int64    // revision of the SnapshotView the dump was taken from
+	KVs      []api.KV // ordered by key
+}
+
+// FromView copies every key of view into a Dump.
+func FromView(view api.SnapshotView) (*Dump, error) {
+	kvs, err := view.List("")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return &Dump{Revision: view.Revision(), KVs: kvs}, nil
+}
+
+// Load replaces the contents of cache with the dump.
+func (d *Dump) Load(cache *proxy.WatchCache) {
+	objs := make([]*proxy.StoreObj, 0, len(d.KVs))
+	for _, kv := range d.KVs {
+		objs = append(objs, &proxy.StoreObj{Key: kv.Key, Value: kv.Value, Revision: kv.Revision, ModRev: kv.Revision})
+	}
+	cache.Replace(objs, d.Revision)
+}
+
+// FormatFromPath picks the format from the file extension: .db for etcd db,
+// .jsonl, .ndjson or .json for JSON lines.
+func FormatFromPath(path string) (Format, error) {
+	switch filepath.Ext(path) {
+	case ".db":
+		return FormatEtcdDB, nil
+	case ".jsonl", ".ndjson", ".json":
+		return FormatJSONLines, nil
+	}
+	return "", fmt.Errorf("%w: cannot tell the format of %q from its extension", ErrUnknownFormat, path)
+}
+
+// WriteFile writes d to path in format f.
+func WriteFile(path string, f Format, d *Dump) error {
+	switch f {
+	case FormatJSONLines:
+		return writeJSONLinesFile(path, d)
+	case FormatEtcdDB:
+		return WriteEtcdDB(path, d)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownFormat, f)
+}
+
+// ReadFile reads a dump in format f from path.
+func ReadFile(path string, f Format) (*Dump, error) {
+	switch f {
+	case FormatJSONLines:
+		return readJSONLinesFile(path)
+	case FormatEtcdDB:
+		return ReadEtcdDB(path)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, f)
+}
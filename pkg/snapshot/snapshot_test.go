@@ -0,0 +1,115 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/pkg/v3/traceutil"
+	"go.etcd.io/etcd/server/v3/mvcc"
+	"go.etcd.io/etcd/server/v3/mvcc/backend"
+	"go.uber.org/zap"
+)
+
+func testDump(t *testing.T) *Dump {
+	cache := proxy.NewWatchCache(nil)
+	cache.HandlePutBytes("/app/b", []byte{0x00, 0xff, '\n'}, 4)
+	cache.HandlePut("/app/a", "1", 2)
+	cache.HandlePut("/app/c", "3", 5)
+	cache.HandleDelete("/app/c", 6)
+	d, err := FromView(cache.Snapshot())
+	require.NoError(t, err)
+	return d
+}
+
+func TestRoundTrip(t *testing.T) {
+	want := testDump(t)
+	assert.Equal(t, int64(6), want.Revision)
+	require.Len(t, want.KVs, 2)
+	assert.Equal(t, "/app/a", want.KVs[0].Key)
+
+	for _, name := range []string{"dump.jsonl", "dump.db"} {
+		path := filepath.Join(t.TempDir(), name)
+		f, err := FormatFromPath(path)
+		require.NoError(t, err)
+		require.NoError(t, WriteFile(path, f, want), name)
+		got, err := ReadFile(path, f)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, got, name)
+
+		cache := proxy.NewWatchCache(nil)
+		got.Load(cache)
+		assert.Equal(t, int64(6), cache.Revision())
+		obj, ok := cache.Get("/app/b")
+		require.True(t, ok)
+		assert.Equal(t, []byte{0x00, 0xff, '\n'}, obj.Value)
+	}
+}
+
+func TestJSONLinesLayout(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteJSONLines(&buf, testDump(t)))
+	assert.Equal(t, `{"snapshotRevision":6}
+{"key":"/app/a","value":"MQ==","revision":2}
+{"key":"/app/b","value":"AP8K","revision":4}
+`, buf.String())
+
+	_, err := ReadJSONLines(bytes.NewBufferString(`{"snapshotRevision":6}` + "\n" + `{"value":"MQ=="}`))
+	assert.Error(t, err)
+}
+
+func TestEtcdDBReadableByMVCC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.db")
+	require.NoError(t, WriteEtcdDB(path, testDump(t)))
+
+	be := backend.NewDefaultBackend(path)
+	defer be.Close()
+	s := mvcc.NewStore(zap.NewNop(), be, nil, mvcc.StoreConfig{})
+	defer s.Close()
+
+	txn := s.Read(mvcc.ConcurrentReadTxMode, traceutil.TODO())
+	defer txn.End()
+	res, err := txn.Range(context.Background(), []byte("/app/"), []byte("/app0"), mvcc.RangeOptions{})
+	require.NoError(t, err)
+	require.Len(t, res.KVs, 2)
+	assert.Equal(t, "/app/a", string(res.KVs[0].Key))
+	assert.Equal(t, int64(2), res.KVs[0].ModRevision)
+	assert.Equal(t, int64(4), res.Rev)
+}
+
+func TestReadEtcdSnapshotSave(t *testing.T) {
+	cli := etcdtest.Client(t)
+
+	ctx := context.Background()
+	_, err := cli.Put(ctx, "/app/a", "1")
+	require.NoError(t, err)
+	_, err = cli.Put(ctx, "/app/b", "2")
+	require.NoError(t, err)
+	resp, err := cli.Delete(ctx, "/app/b")
+	require.NoError(t, err)
+
+	// What `etcdctl snapshot save` writes.
+	rc, err := cli.Snapshot(ctx)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "etcd.db")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = io.Copy(f, rc)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	rc.Close()
+
+	d, err := ReadEtcdDB(path)
+	require.NoError(t, err)
+	assert.Equal(t, resp.Header.Revision, d.Revision)
+	require.Len(t, d.KVs, 1)
+	assert.Equal(t, api.KV{Key: "/app/a", Value: []byte("1"), Revision: 2}, d.KVs[0])
+}
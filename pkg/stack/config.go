@@ -0,0 +1,197 @@
+package stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"gopkg.in/yaml.v3"
+)
+
+// BackendMemory is the in-memory ring buffer EventLog, the only backend so far.
+const BackendMemory = "memory"
+
+// Config describes a whole caching stack. LoadConfig reads it from a YAML or
+// JSON file on top of DefaultConfig, so a file only needs the fields it changes.
+type Config struct {
+	Etcd EtcdConfig `json:"etcd" yaml:"etcd"`
+	// Prefixes are the key prefixes to cache. Empty caches every key.
+	Prefixes []string       `json:"prefixes" yaml:"prefixes"`
+	EventLog EventLogConfig `json:"eventLog" yaml:"eventLog"`
+	Eviction EvictionConfig `json:"eviction" yaml:"eviction"`
+	Snapshot SnapshotConfig `json:"snapshot" yaml:"snapshot"`
+	Metrics  MetricsConfig  `json:"metrics" yaml:"metrics"`
+	Admin    AdminConfig    `json:"admin" yaml:"admin"`
+	Verify   VerifyConfig   `json:"verify" yaml:"verify"`
+}
+
+// EtcdConfig is how to reach the etcd cluster being cached.
+type EtcdConfig struct {
+	Endpoints   []string  `json:"endpoints" yaml:"endpoints"`
+	DialTimeout Duration  `json:"dialTimeout" yaml:"dialTimeout"`
+	Username    string    `json:"username,omitempty" yaml:"username,omitempty"`
+	Password    string    `json:"password,omitempty" yaml:"password,omitempty"`
+	TLS         TLSConfig `json:"tls" yaml:"tls"`
+}
+
+// TLSConfig enables TLS to etcd when any field is set. CertFile and KeyFile
+// are the client certificate, CAFile verifies the server.
+type TLSConfig struct {
+	CAFile             string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty" yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+}
+
+// Enabled reports whether any TLS setting is present.
+func (c TLSConfig) Enabled() bool {
+	return c != TLSConfig{}
+}
+
+// info converts c to the form the etcd client tooling loads certificates from.
+func (c TLSConfig) info() transport.TLSInfo {
+	return transport.TLSInfo{
+		CertFile:           c.CertFile,
+		KeyFile:            c.KeyFile,
+		TrustedCAFile:      c.CAFile,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+}
+
+// EventLogConfig selects the EventLog backend. Capacity is the number of events
+// the memory backend retains before the oldest are overwritten.
+type EventLogConfig struct {
+	Backend  string `json:"backend" yaml:"backend"`
+	Capacity int    `json:"capacity" yaml:"capacity"`
+}
+
+// EvictionConfig is the retention policy of the EventLog beyond its capacity.
+// Each non-zero field adds an eventlog.CompactionPolicy; FollowEtcd drops
+// history etcd itself has compacted. Interval is how often they are applied.
+type EvictionConfig struct {
+	KeepRevisions int64    `json:"keepRevisions,omitempty" yaml:"keepRevisions,omitempty"`
+	KeepDuration  Duration `json:"keepDuration,omitempty" yaml:"keepDuration,omitempty"`
+	KeepBytes     int      `json:"keepBytes,omitempty" yaml:"keepBytes,omitempty"`
+	FollowEtcd    bool     `json:"followEtcd,omitempty" yaml:"followEtcd,omitempty"`
+	Interval      Duration `json:"interval" yaml:"interval"`
+}
+
+// SnapshotConfig persists the cache to Path every Interval so a restart can
+// resume the watch instead of re-listing. An empty Path disables snapshots.
+type SnapshotConfig struct {
+	Path     string   `json:"path,omitempty" yaml:"path,omitempty"`
+	Interval Duration `json:"interval" yaml:"interval"`
+}
+
+// MetricsConfig serves /metrics on its own listener at Addr. The admin server
+// serves /metrics too, so Addr may be left empty.
+type MetricsConfig struct {
+	Addr string `json:"addr,omitempty" yaml:"addr,omitempty"`
+}
+
+// AdminConfig serves the admin endpoints at Addr; empty disables the server.
+// MaxRevisionLag is passed to admin.WithMaxRevisionLag.
+type AdminConfig struct {
+	Addr           string `json:"addr,omitempty" yaml:"addr,omitempty"`
+	MaxRevisionLag int64  `json:"maxRevisionLag,omitempty" yaml:"maxRevisionLag,omitempty"`
+}
+
+// VerifyConfig compares the cache with etcd every Interval, reading PageSize
+// keys per request (see package verify); a zero Interval disables the check.
+// Repair re-lists the key intervals found to differ.
+type VerifyConfig struct {
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	PageSize int64    `json:"pageSize,omitempty" yaml:"pageSize,omitempty"`
+	Repair   bool     `json:"repair,omitempty" yaml:"repair,omitempty"`
+}
+
+// DefaultConfig is a stack caching every key of a local etcd in a 1024 event
+// memory EventLog, without eviction, snapshots, listeners or verification.
+func DefaultConfig() Config {
+	return Config{
+		Etcd: EtcdConfig{
+			Endpoints:   []string{"localhost:2379"},
+			DialTimeout: Duration(5 * time.Second),
+		},
+		EventLog: EventLogConfig{Backend: BackendMemory, Capacity: 1024},
+		Eviction: EvictionConfig{Interval: Duration(time.Minute)},
+		Snapshot: SnapshotConfig{Interval: Duration(30 * time.Second)},
+	}
+}
+
+// LoadConfig reads a config file on top of DefaultConfig. Files ending in .json
+// are parsed as JSON, anything else as YAML. Unknown fields are an error so that
+// typos do not silently fall back to defaults.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg := DefaultConfig()
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(&cfg); errors.Is(err, io.EOF) {
+			err = nil // an empty file is the default config
+		}
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate reports the first setting a stack cannot be built from.
+func (c Config) Validate() error {
+	switch {
+	case c.EventLog.Backend != BackendMemory:
+		return fmt.Errorf("eventLog.backend %q is not supported, use %q", c.EventLog.Backend, BackendMemory)
+	case c.EventLog.Capacity <= 0:
+		return fmt.Errorf("eventLog.capacity must be positive, got %d", c.EventLog.Capacity)
+	case c.Eviction.KeepRevisions < 0 || c.Eviction.KeepDuration < 0 || c.Eviction.KeepBytes < 0:
+		return errors.New("eviction limits must not be negative")
+	case c.Eviction.Interval <= 0 && c.Eviction.policies():
+		return errors.New("eviction.interval must be positive")
+	case c.Snapshot.Path != "" && c.Snapshot.Interval <= 0:
+		return errors.New("snapshot.interval must be positive")
+	case c.Admin.MaxRevisionLag < 0:
+		return errors.New("admin.maxRevisionLag must not be negative")
+	case c.Verify.Interval < 0 || c.Verify.PageSize < 0:
+		return errors.New("verify.interval and verify.pageSize must not be negative")
+	}
+	return nil
+}
+
+// policies reports whether any eviction policy is configured.
+func (c EvictionConfig) policies() bool {
+	return c.KeepRevisions > 0 || c.KeepDuration > 0 || c.KeepBytes > 0 || c.FollowEtcd
+}
+
+// Duration is a time.Duration written as a string such as "30s" in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
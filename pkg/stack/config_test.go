@@ -0,0 +1,84 @@
+package stack
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	want := DefaultConfig()
+	want.Etcd.Endpoints = []string{"etcd-0:2379", "etcd-1:2379"}
+	want.Etcd.TLS = TLSConfig{CAFile: "ca.pem", CertFile: "client.pem", KeyFile: "client-key.pem"}
+	want.Prefixes = []string{"/a/", "/b/"}
+	want.EventLog.Capacity = 100
+	want.Eviction = EvictionConfig{KeepDuration: Duration(10 * time.Minute), FollowEtcd: true, Interval: Duration(30 * time.Second)}
+	want.Admin = AdminConfig{Addr: ":9090", MaxRevisionLag: 5}
+	want.Verify = VerifyConfig{Interval: Duration(time.Hour), Repair: true}
+
+	files := map[string]string{
+		"stack.yaml": `
+etcd:
+  endpoints: [etcd-0:2379, etcd-1:2379]
+  tls: {caFile: ca.pem, certFile: client.pem, keyFile: client-key.pem}
+prefixes: [/a/, /b/]
+eventLog: {capacity: 100}
+eviction: {keepDuration: 10m, followEtcd: true, interval: 30s}
+admin: {addr: ":9090", maxRevisionLag: 5}
+verify: {interval: 1h, repair: true}
+`,
+		"stack.json": `{
+  "etcd": {"endpoints": ["etcd-0:2379", "etcd-1:2379"],
+           "tls": {"caFile": "ca.pem", "certFile": "client.pem", "keyFile": "client-key.pem"}},
+  "prefixes": ["/a/", "/b/"],
+  "eventLog": {"capacity": 100},
+  "eviction": {"keepDuration": "10m", "followEtcd": true, "interval": "30s"},
+  "admin": {"addr": ":9090", "maxRevisionLag": 5},
+  "verify": {"interval": "1h", "repair": true}
+}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeFile(t, name, content))
+			require.NoError(t, err)
+			assert.Equal(t, want, cfg)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cfg, err := LoadConfig(writeFile(t, "empty.yaml", ""))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), cfg)
+
+	for name, content := range map[string]string{
+		"typo.yaml":     "prefix: [/a/]\n",
+		"typo.json":     `{"prefix": ["/a/"]}`,
+		"backend.yaml":  "eventLog: {backend: etcd}\n",
+		"capacity.yaml": "eventLog: {capacity: 0}\n",
+		"duration.yaml": "eviction: {keepDuration: ten minutes}\n",
+		"interval.yaml": "eviction: {keepRevisions: 10, interval: 0s}\n",
+		"verify.yaml":   "verify: {pageSize: -1}\n",
+	} {
+		_, err := LoadConfig(writeFile(t, name, content))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	assert.Equal(t, "", commonPrefix(nil))
+	assert.Equal(t, "/a/", commonPrefix([]string{"/a/"}))
+	assert.Equal(t, "/registry/", commonPrefix([]string{"/registry/pods/", "/registry/services/"}))
+	assert.Equal(t, "", commonPrefix([]string{"/a/", "b/"}))
+}
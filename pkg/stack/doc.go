@@ -0,0 +1,29 @@
+/*
+Package stack builds a complete caching stack from one configuration.
+
+New wires what callers otherwise assemble by hand:
+
+- an etcd client, optionally with TLS and authentication,
+- a MemoryEventLog and a WatchCache on top of it,
+- a ClientLibrary serving sessions from the cache, with write-through to etcd,
+- an eventlog.Compactor for the eviction policy,
+- an optional verify.Verifier comparing the cache with etcd,
+- a metrics.Prometheus collector every component reports to,
+- the admin server and an optional separate /metrics listener.
+
+Start loads the cache (from the snapshot if one is configured, otherwise by
+listing etcd) and keeps it in sync with a single etcd watch covering every
+configured prefix; Reload applies a changed eviction policy or readiness lag
+while running; Stop shuts everything down. The configuration is a Config,
+set with Options or read by LoadConfig from a YAML or JSON file:
+
+	etcd:
+	  endpoints: [etcd-0:2379, etcd-1:2379]
+	  tls: {caFile: ca.pem, certFile: client.pem, keyFile: client-key.pem}
+	prefixes: [/registry/pods/, /registry/services/]
+	eventLog: {backend: memory, capacity: 10000}
+	eviction: {keepDuration: 10m, followEtcd: true, interval: 1m}
+	admin: {addr: ":9090", maxRevisionLag: 100}
+	verify: {interval: 1h, repair: true}
+*/
+package stack
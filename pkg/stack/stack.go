@@ -0,0 +1,582 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/adapter"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/admin"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/clientlibrary"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/metrics"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/verify"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/watcher"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// retryInterval is how long the watch loop waits before re-establishing a failed watch.
+const retryInterval = time.Second
+
+// sessionIdleTimeout is how long a stopped ClientLibrary session stays
+// resumable. The gateway removes the session of each watch stream when the
+// stream ends, so only library clients' sessions wait it out.
+const sessionIdleTimeout = 10 * time.Minute
+
+// ErrStarted is returned by Start on a stack that has already been started.
+var ErrStarted = errors.New("stack already started")
+
+// Stack is a WatchCache kept in sync with etcd, its EventLog, a ClientLibrary
+// serving sessions from it, and the listeners exposing its state.
+type Stack struct {
+	cfg     Config // guarded by mu once Reload may run
+	logger  *slog.Logger
+	base    *slog.Logger // handed to the components
+	cli     *clientv3.Client
+	ownsCli bool
+
+	prefix    string // range watched in etcd, covering every configured prefix
+	adapter   *adapter.EtcdAdapter
+	watchOpts []watcher.WatchOption
+
+	log       *eventlog.MemoryEventLog
+	cache     *proxy.WatchCache
+	lib       api.ClientLibrary
+	metrics   *metrics.Prometheus
+	admin     *admin.Server
+	compactor *eventlog.Compactor
+	verifier  *verify.Verifier // nil unless Verify.Interval is set
+
+	mu            sync.Mutex
+	started       bool
+	ctx           context.Context // of the background work, set by Start
+	cancel        context.CancelFunc
+	stopCompactor func()
+	wg            sync.WaitGroup
+	adminAddr     string
+	metricsAddr   string
+	errs          []error
+	stopOnce      sync.Once
+	stopErr       error
+}
+
+type settings struct {
+	cfg    Config
+	logger *slog.Logger
+	tp     trace.TracerProvider
+	cli    *clientv3.Client
+}
+
+// Option configures a Stack on top of DefaultConfig.
+type Option func(*settings)
+
+// WithConfig replaces the whole configuration, e.g. with one from LoadConfig.
+// Options after it override single settings.
+func WithConfig(cfg Config) Option {
+	return func(s *settings) {
+		s.cfg = cfg
+	}
+}
+
+// WithEndpoints sets the etcd endpoints.
+func WithEndpoints(endpoints ...string) Option {
+	return func(s *settings) {
+		s.cfg.Etcd.Endpoints = endpoints
+	}
+}
+
+// WithTLS connects to etcd over TLS.
+func WithTLS(tls TLSConfig) Option {
+	return func(s *settings) {
+		s.cfg.Etcd.TLS = tls
+	}
+}
+
+// WithAuth authenticates to etcd as username.
+func WithAuth(username, password string) Option {
+	return func(s *settings) {
+		s.cfg.Etcd.Username, s.cfg.Etcd.Password = username, password
+	}
+}
+
+// WithPrefixes caches only the keys under prefixes.
+func WithPrefixes(prefixes ...string) Option {
+	return func(s *settings) {
+		s.cfg.Prefixes = prefixes
+	}
+}
+
+// WithEventLogCapacity sets how many events the memory EventLog retains.
+func WithEventLogCapacity(n int) Option {
+	return func(s *settings) {
+		s.cfg.EventLog.Capacity = n
+	}
+}
+
+// WithEviction sets the retention policy of the EventLog.
+func WithEviction(e EvictionConfig) Option {
+	return func(s *settings) {
+		s.cfg.Eviction = e
+	}
+}
+
+// WithSnapshot persists the cache to path every interval and restores from it on Start.
+func WithSnapshot(path string, interval time.Duration) Option {
+	return func(s *settings) {
+		s.cfg.Snapshot = SnapshotConfig{Path: path, Interval: Duration(interval)}
+	}
+}
+
+// WithMetricsAddr serves /metrics on its own listener at addr.
+func WithMetricsAddr(addr string) Option {
+	return func(s *settings) {
+		s.cfg.Metrics.Addr = addr
+	}
+}
+
+// WithAdminAddr serves the admin endpoints at addr.
+func WithAdminAddr(addr string) Option {
+	return func(s *settings) {
+		s.cfg.Admin.Addr = addr
+	}
+}
+
+// WithMaxRevisionLag makes /readyz fail while the cache is more than n revisions behind etcd.
+func WithMaxRevisionLag(n int64) Option {
+	return func(s *settings) {
+		s.cfg.Admin.MaxRevisionLag = n
+	}
+}
+
+// WithVerify compares the cache with etcd in the background.
+func WithVerify(v VerifyConfig) Option {
+	return func(s *settings) {
+		s.cfg.Verify = v
+	}
+}
+
+// WithLogger sets the logger handed to every component; defaults to slog.Default().
+func WithLogger(l *slog.Logger) Option {
+	return func(s *settings) {
+		s.logger = l
+	}
+}
+
+// WithTracerProvider traces events from the etcd watch to session delivery.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *settings) {
+		s.tp = tp
+	}
+}
+
+// WithEtcdClient uses cli instead of dialing the configured endpoints. Stop
+// leaves it open.
+func WithEtcdClient(cli *clientv3.Client) Option {
+	return func(s *settings) {
+		s.cli = cli
+	}
+}
+
+// New validates the configuration and wires the components. It dials etcd
+// lazily, so nothing is read until Start.
+func New(opts ...Option) (*Stack, error) {
+	set := settings{cfg: DefaultConfig()}
+	for _, opt := range opts {
+		opt(&set)
+	}
+	cfg := set.cfg
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Stack{
+		cfg:    cfg,
+		logger: logging.Component(set.logger, "stack"),
+		base:   set.logger,
+		cli:    set.cli,
+		prefix: commonPrefix(cfg.Prefixes),
+	}
+	if s.cli == nil {
+		cli, err := newClient(cfg.Etcd, set.logger)
+		if err != nil {
+			return nil, err
+		}
+		s.cli, s.ownsCli = cli, true
+	}
+
+	s.metrics = metrics.NewPrometheus()
+	s.adapter = adapter.NewEtcdAdapter(adapter.WithIncludePrefixes(cfg.Prefixes...))
+	s.watchOpts = []watcher.WatchOption{
+		watcher.WithWatchLogger(set.logger),
+		watcher.WithWatchMetrics(s.metrics),
+		watcher.WithWatchTracerProvider(set.tp),
+	}
+	s.log = eventlog.NewMemoryEventLog(cfg.EventLog.Capacity, eventlog.WithLogger(set.logger))
+	s.cache = proxy.NewWatchCacheWithLog(nil, s.log, proxy.WithLogger(set.logger), proxy.WithTracerProvider(set.tp))
+	s.lib = clientlibrary.NewClientLibrary(s.cache, s.log,
+		clientlibrary.WithEtcdClient(s.cli),
+		clientlibrary.WithMetrics(s.metrics),
+		clientlibrary.WithIdleTimeout(sessionIdleTimeout),
+		clientlibrary.WithLogger(set.logger),
+		clientlibrary.WithTracerProvider(set.tp))
+	s.metrics.AttachCache(s.cache)
+	s.metrics.AttachEventLog(s.log)
+	s.metrics.AttachClientLibrary(s.lib)
+	s.admin = admin.NewServer(s.cache,
+		admin.WithEventLog(s.log),
+		admin.WithClientLibrary(s.lib),
+		admin.WithUpstreamRevision(s.metrics.UpstreamRevision),
+		admin.WithMaxRevisionLag(cfg.Admin.MaxRevisionLag),
+		admin.WithMetricsHandler(s.metrics.Handler()))
+	s.compactor = s.newCompactor()
+	if v := cfg.Verify; v.Interval > 0 {
+		opts := []verify.Option{
+			verify.WithPrefixes(cfg.Prefixes...),
+			verify.WithAdapter(s.adapter),
+			verify.WithInterval(time.Duration(v.Interval)),
+			verify.WithRepair(v.Repair),
+			verify.WithMetrics(s.metrics),
+			verify.WithLogger(set.logger),
+		}
+		if v.PageSize > 0 {
+			opts = append(opts, verify.WithPageSize(v.PageSize))
+		}
+		s.verifier = verify.New(s.cache, s.cli, opts...)
+	}
+	return s, nil
+}
+
+func newClient(cfg EtcdConfig, logger *slog.Logger) (*clientv3.Client, error) {
+	ccfg := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: time.Duration(cfg.DialTimeout),
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	}
+	if cfg.TLS.Enabled() {
+		tls, err := cfg.TLS.info().ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		ccfg.TLS = tls
+	}
+	return clientv3.New(ccfg)
+}
+
+// newCompactor builds the compactor for the eviction settings, or returns nil if
+// they set no policy.
+func (s *Stack) newCompactor() *eventlog.Compactor {
+	policies := s.policies()
+	if len(policies) == 0 {
+		return nil
+	}
+	return eventlog.NewCompactor(s.log,
+		eventlog.WithPolicies(policies...),
+		eventlog.WithCompactionInterval(time.Duration(s.cfg.Eviction.Interval)),
+		eventlog.WithCompactionMetrics(s.metrics),
+		eventlog.WithCompactionLogger(s.base))
+}
+
+func (s *Stack) policies() []eventlog.CompactionPolicy {
+	e := s.cfg.Eviction
+	var out []eventlog.CompactionPolicy
+	if e.KeepRevisions > 0 {
+		out = append(out, eventlog.KeepRevisions(e.KeepRevisions))
+	}
+	if e.KeepDuration > 0 {
+		out = append(out, eventlog.KeepDuration(time.Duration(e.KeepDuration)))
+	}
+	if e.KeepBytes > 0 {
+		out = append(out, eventlog.KeepBytes(e.KeepBytes))
+	}
+	if e.FollowEtcd {
+		// etcd rejects an empty key, so probe the start of the keyspace instead.
+		probe := s.prefix
+		if probe == "" {
+			probe = "\x00"
+		}
+		out = append(out, eventlog.UpstreamCompaction(func(ctx context.Context) (int64, error) {
+			return watcher.EtcdCompactRevision(ctx, s.cli, probe)
+		}))
+	}
+	return out
+}
+
+// commonPrefix is the longest prefix shared by prefixes: one etcd watch on it
+// covers them all, and the adapter drops the keys in between.
+func commonPrefix(prefixes []string) string {
+	if len(prefixes) == 0 {
+		return ""
+	}
+	p := prefixes[0]
+	for _, q := range prefixes[1:] {
+		for !strings.HasPrefix(q, p) {
+			p = p[:len(p)-1]
+		}
+	}
+	return p
+}
+
+// Start opens the listeners, loads the cache from the snapshot or etcd, marks
+// the admin server synced and then keeps the cache in sync in the background
+// until ctx is done or Stop is called. It returns once the cache is loaded; if
+// loading fails everything started so far is stopped again.
+func (s *Stack) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return ErrStarted
+	}
+	s.started = true
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.ctx = ctx
+
+	if addr := s.cfg.Admin.Addr; addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return s.abortLocked(err)
+		}
+		s.adminAddr = ln.Addr().String()
+		s.goLocked("admin server", func() error { return s.admin.Serve(ctx, ln) })
+	}
+	if addr := s.cfg.Metrics.Addr; addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return s.abortLocked(err)
+		}
+		s.metricsAddr = ln.Addr().String()
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", s.metrics.Handler())
+		s.goLocked("metrics server", func() error { return admin.ServeHandler(ctx, ln, mux) })
+	}
+
+	rev, err := s.load(ctx)
+	if err != nil {
+		return s.abortLocked(err)
+	}
+	s.admin.MarkSynced()
+	s.logger.Info("cache loaded", logging.Revision(s.cache.Revision()), slog.Int("keys", s.cache.Stats().Keys))
+
+	s.goLocked("watch", func() error { s.watch(ctx, rev); return nil })
+	s.startCompactorLocked()
+	if v := s.verifier; v != nil {
+		s.goLocked("verifier", func() error { v.Run(ctx); return nil })
+	}
+	if path := s.cfg.Snapshot.Path; path != "" {
+		s.goLocked("snapshotter", func() error {
+			return s.cache.RunSnapshotter(ctx, path, time.Duration(s.cfg.Snapshot.Interval))
+		})
+	}
+	return nil
+}
+
+// load fills the cache and returns the revision to watch from.
+func (s *Stack) load(ctx context.Context) (int64, error) {
+	if path := s.cfg.Snapshot.Path; path != "" {
+		return watcher.Restore(ctx, s.cli, s.prefix, path, s.adapter, s.cache, s.watchOpts...)
+	}
+	return watcher.Relist(ctx, s.cli, s.prefix, s.adapter, s.cache, s.watchOpts...)
+}
+
+// watch runs the etcd watch until ctx is done, re-establishing it after
+// failures and re-listing once etcd has compacted the revision it needs.
+func (s *Stack) watch(ctx context.Context, rev int64) {
+	for {
+		err := watcher.WatchWithAdapter(ctx, s.cli, s.prefix, rev, s.adapter, s.cache, s.watchOpts...)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn("watch failed, retrying", logging.Revision(rev), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+		if !errors.Is(err, rpctypes.ErrCompacted) {
+			rev = s.cache.CompleteRevision() + 1
+			continue
+		}
+		next, err := watcher.Relist(ctx, s.cli, s.prefix, s.adapter, s.cache, s.watchOpts...)
+		if err != nil {
+			s.logger.Error("re-list failed", slog.Any("error", err))
+			continue
+		}
+		rev = next
+	}
+}
+
+// startCompactorLocked runs the compactor, if any, until the stack stops or
+// Reload replaces it.
+func (s *Stack) startCompactorLocked() {
+	c := s.compactor
+	if c == nil || s.ctx.Err() != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+	s.stopCompactor = func() {
+		cancel()
+		<-done
+	}
+	s.goLocked("compactor", func() error {
+		defer close(done)
+		c.Run(ctx)
+		return nil
+	})
+}
+
+// Reload applies the settings of cfg that can change while the stack runs: the
+// eviction policy and the revision lag /readyz tolerates. Changes to anything
+// else are logged and ignored until the stack is rebuilt. An invalid cfg is
+// rejected as a whole.
+func (s *Stack) Reload(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cfg.Eviction != s.cfg.Eviction {
+		if s.stopCompactor != nil {
+			s.stopCompactor()
+			s.stopCompactor = nil
+		}
+		s.cfg.Eviction = cfg.Eviction
+		s.compactor = s.newCompactor()
+		if s.started {
+			s.startCompactorLocked()
+		}
+		s.logger.Info("eviction policy reloaded")
+	}
+	if cfg.Admin.MaxRevisionLag != s.cfg.Admin.MaxRevisionLag {
+		s.cfg.Admin.MaxRevisionLag = cfg.Admin.MaxRevisionLag
+		s.admin.SetMaxRevisionLag(cfg.Admin.MaxRevisionLag)
+		s.logger.Info("max revision lag reloaded", slog.Int64("max_revision_lag", cfg.Admin.MaxRevisionLag))
+	}
+	var ignored []string
+	if !reflect.DeepEqual(cfg.Etcd, s.cfg.Etcd) {
+		ignored = append(ignored, "etcd")
+	}
+	if !slices.Equal(cfg.Prefixes, s.cfg.Prefixes) {
+		ignored = append(ignored, "prefixes")
+	}
+	if cfg.EventLog != s.cfg.EventLog {
+		ignored = append(ignored, "eventLog")
+	}
+	if cfg.Snapshot != s.cfg.Snapshot {
+		ignored = append(ignored, "snapshot")
+	}
+	if cfg.Metrics != s.cfg.Metrics {
+		ignored = append(ignored, "metrics")
+	}
+	if cfg.Admin.Addr != s.cfg.Admin.Addr {
+		ignored = append(ignored, "admin.addr")
+	}
+	if cfg.Verify != s.cfg.Verify {
+		ignored = append(ignored, "verify")
+	}
+	if len(ignored) > 0 {
+		s.logger.Warn("configuration changes need a restart to take effect", slog.Any("settings", ignored))
+	}
+	return nil
+}
+
+// goLocked runs fn in the background and records its error for Stop.
+func (s *Stack) goLocked(name string, fn func() error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := fn(); err != nil {
+			s.logger.Error(name+" stopped", slog.Any("error", err))
+			s.mu.Lock()
+			s.errs = append(s.errs, err)
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// abortLocked stops what Start has started so far and returns err.
+func (s *Stack) abortLocked(err error) error {
+	s.cancel()
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.mu.Lock()
+	return err
+}
+
+// Stop stops the background work, waits for it, closes the ClientLibrary and,
+// unless it came from WithEtcdClient, the etcd client. It returns the errors
+// background work stopped with. Calling Stop again returns the same result.
+func (s *Stack) Stop() error {
+	s.stopOnce.Do(func() {
+		// Cancel under mu so that Reload cannot start a compactor after it.
+		s.mu.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+
+		s.mu.Lock()
+		errs := append([]error(nil), s.errs...)
+		s.mu.Unlock()
+		errs = append(errs, s.lib.Close())
+		if s.ownsCli {
+			errs = append(errs, s.cli.Close())
+		}
+		s.stopErr = errors.Join(errs...)
+	})
+	return s.stopErr
+}
+
+// Config returns the configuration in effect, including reloaded settings.
+func (s *Stack) Config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// Client returns the etcd client.
+func (s *Stack) Client() *clientv3.Client { return s.cli }
+
+// Cache returns the WatchCache.
+func (s *Stack) Cache() *proxy.WatchCache { return s.cache }
+
+// EventLog returns the EventLog behind the cache.
+func (s *Stack) EventLog() eventlog.EventLog { return s.log }
+
+// ClientLibrary returns the ClientLibrary serving sessions from the cache.
+func (s *Stack) ClientLibrary() api.ClientLibrary { return s.lib }
+
+// Metrics returns the Prometheus collector every component reports to.
+func (s *Stack) Metrics() *metrics.Prometheus { return s.metrics }
+
+// Verifier returns the consistency checker, or nil if Verify.Interval is not set.
+func (s *Stack) Verifier() *verify.Verifier { return s.verifier }
+
+// Admin returns the admin server, whether or not it listens.
+func (s *Stack) Admin() *admin.Server { return s.admin }
+
+// AdminAddr returns the address the admin server listens on once started, or "".
+func (s *Stack) AdminAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.adminAddr
+}
+
+// MetricsAddr returns the address the metrics listener listens on once started, or "".
+func (s *Stack) MetricsAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metricsAddr
+}
@@ -0,0 +1,167 @@
+package stack
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+)
+
+func httpGet(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestStack(t *testing.T) {
+	endpoint := etcdtest.Start(t)
+	ctx := context.Background()
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}})
+	require.NoError(t, err)
+	defer cli.Close()
+	for _, key := range []string{"/a/1", "/ab", "/c/1"} {
+		_, err := cli.Put(ctx, key, "v")
+		require.NoError(t, err)
+	}
+
+	s, err := New(
+		WithEndpoints(endpoint),
+		WithPrefixes("/a/", "/b/"),
+		WithEventLogCapacity(16),
+		WithEviction(EvictionConfig{KeepRevisions: 2, FollowEtcd: true, Interval: Duration(10 * time.Millisecond)}),
+		WithAdminAddr("127.0.0.1:0"),
+		WithMetricsAddr("127.0.0.1:0"),
+		WithVerify(VerifyConfig{Interval: Duration(10 * time.Millisecond)}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, s.Start(ctx))
+	defer s.Stop()
+	assert.ErrorIs(t, s.Start(ctx), ErrStarted)
+
+	cache := s.Cache()
+	_, ok := cache.Get("/a/1")
+	assert.True(t, ok, "listed on Start")
+	for _, key := range []string{"/ab", "/c/1"} {
+		_, ok := cache.Get(key)
+		assert.False(t, ok, "%s is outside the prefixes", key)
+	}
+
+	sess, err := s.ClientLibrary().NewSession("c")
+	require.NoError(t, err)
+	defer sess.Stop()
+	events, err := sess.WatchPrefix("/b/", cache.Revision()+1)
+	require.NoError(t, err)
+	for _, key := range []string{"/b/1", "/c/2", "/b/2", "/b/3"} {
+		_, err := cli.Put(ctx, key, "v")
+		require.NoError(t, err)
+	}
+	for _, want := range []string{"/b/1", "/b/2", "/b/3"} {
+		select {
+		case ev := <-events:
+			assert.Equal(t, want, ev.Key)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not delivered", want)
+		}
+	}
+	require.Eventually(t, func() bool {
+		return s.EventLog().(interface{ Len() int }).Len() <= 2
+	}, 5*time.Second, 10*time.Millisecond, "evicted down to the last two revisions")
+
+	require.Eventually(t, func() bool {
+		rounds, _ := s.Verifier().Last()
+		return rounds > 0
+	}, 5*time.Second, 10*time.Millisecond, "the verifier runs")
+	_, results := s.Verifier().Last()
+	for _, res := range results {
+		assert.Zero(t, res.Divergent(), res.Prefix)
+	}
+
+	code, _ := httpGet(t, "http://"+s.AdminAddr()+"/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	code, body := httpGet(t, "http://"+s.MetricsAddr()+"/metrics")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "etcdcache_store_keys 4")
+	assert.Contains(t, body, `etcdcache_consistency_divergent_keys{kind="missing"} 0`)
+
+	require.NoError(t, s.Stop())
+	assert.NoError(t, s.Stop())
+	_, err = http.Get("http://" + s.AdminAddr() + "/healthz")
+	assert.Error(t, err, "admin server shut down")
+}
+
+func TestStackRestoresSnapshot(t *testing.T) {
+	endpoint := etcdtest.Start(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	cfg := DefaultConfig()
+	cfg.Etcd.Endpoints = []string{endpoint}
+	cfg.Snapshot = SnapshotConfig{Path: path, Interval: Duration(time.Hour)}
+
+	first, err := New(WithConfig(cfg))
+	require.NoError(t, err)
+	require.NoError(t, first.Start(ctx))
+	_, err = first.Client().Put(ctx, "k", "v1")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, ok := first.Cache().Get("k")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, first.Stop(), "writes the final snapshot")
+
+	second, err := New(WithConfig(cfg))
+	require.NoError(t, err)
+	defer second.Stop()
+	require.NoError(t, second.Start(ctx))
+	obj, ok := second.Cache().Get("k")
+	require.True(t, ok)
+	assert.Equal(t, "v1", string(obj.Value))
+}
+
+func TestReload(t *testing.T) {
+	endpoint := etcdtest.Start(t)
+	ctx := context.Background()
+	s, err := New(WithEndpoints(endpoint))
+	require.NoError(t, err)
+	defer s.Stop()
+	require.NoError(t, s.Start(ctx))
+	for i := 0; i < 5; i++ {
+		_, err := s.Client().Put(ctx, "k", "v")
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return s.EventLog().(interface{ Len() int }).Len() == 5
+	}, 5*time.Second, 10*time.Millisecond, "nothing is evicted without a policy")
+
+	cfg := s.Config()
+	cfg.Eviction = EvictionConfig{KeepRevisions: 1, Interval: Duration(10 * time.Millisecond)}
+	cfg.Admin.MaxRevisionLag = 7
+	cfg.Prefixes = []string{"/ignored/"}
+	require.NoError(t, s.Reload(cfg))
+	require.Eventually(t, func() bool {
+		return s.EventLog().(interface{ Len() int }).Len() <= 1
+	}, 5*time.Second, 10*time.Millisecond, "the reloaded policy evicts")
+	got := s.Config()
+	assert.Equal(t, int64(7), got.Admin.MaxRevisionLag)
+	assert.Empty(t, got.Prefixes, "prefixes need a restart")
+
+	cfg.EventLog.Capacity = 0
+	assert.Error(t, s.Reload(cfg))
+	assert.NoError(t, s.Stop())
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	_, err := New(WithEventLogCapacity(0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,17 @@
+/*
+Package tracing follows one change through the cache with OpenTelemetry.
+
+Tracing is off unless a trace.TracerProvider is passed to the components:
+watcher.WithWatchTracerProvider, proxy.WithTracerProvider and
+clientlibrary.WithTracerProvider. A traced change produces
+
+- watcher.receive: from the etcd watch response arriving to the event being applied,
+- watchcache.apply: WatchCache.AddEvent, with eventlog.append as a child,
+- session.deliver: one per session watch the event is fanned out to, ending
+  when the client has taken it.
+
+The span context travels with the event in api.Event.TraceContext as W3C
+trace context headers, so it survives the EventLog and reaches every session.
+NewProvider builds an SDK provider with a configurable sampling ratio.
+*/
+package tracing
@@ -0,0 +1,123 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName names the tracer of every component.
+const InstrumentationName = "github.com/kaikaila/etcd-caching-gsoc"
+
+// Attribute keys set on every span about one event.
+const (
+	KeyAttr      = attribute.Key("etcdcache.key")
+	RevisionAttr = attribute.Key("etcdcache.revision")
+	TypeAttr     = attribute.Key("etcdcache.event_type")
+	SessionAttr  = attribute.Key("etcdcache.session_id")
+	WatchAttr    = attribute.Key("etcdcache.watch") // the key or prefix a session watches
+)
+
+var propagator = propagation.TraceContext{}
+
+// Tracer returns the package tracer of tp, or nil if tp is nil, which the
+// components take as "tracing disabled".
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		return nil
+	}
+	return tp.Tracer(InstrumentationName)
+}
+
+// Inject returns the W3C trace context of the span in ctx, for api.Event.TraceContext.
+// It returns nil if ctx carries no valid span.
+func Inject(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract returns ctx with the remote span context carried by ev, if any.
+func Extract(ctx context.Context, ev api.Event) context.Context {
+	if len(ev.TraceContext) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(ev.TraceContext))
+}
+
+// EventAttributes describes ev on a span.
+func EventAttributes(ev api.Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		KeyAttr.String(ev.Key),
+		RevisionAttr.Int64(ev.Revision),
+		TypeAttr.String(typeName(ev.Type)),
+	}
+}
+
+func typeName(t api.EventType) string {
+	switch t {
+	case api.EventPut:
+		return "PUT"
+	case api.EventDelete:
+		return "DELETE"
+	case api.EventBookmark:
+		return "BOOKMARK"
+	case api.EventCompacted:
+		return "COMPACTED"
+	}
+	return "UNKNOWN"
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Option configures NewProvider.
+type Option func(*providerConfig)
+
+type providerConfig struct {
+	ratio   float64
+	options []sdktrace.TracerProviderOption
+}
+
+// WithSampleRatio samples the given fraction of new traces (default 1, every
+// trace). Spans of a change follow the decision made where its trace started.
+func WithSampleRatio(r float64) Option {
+	return func(c *providerConfig) {
+		c.ratio = r
+	}
+}
+
+// WithProviderOptions passes options, e.g. a resource, to the SDK provider.
+func WithProviderOptions(opts ...sdktrace.TracerProviderOption) Option {
+	return func(c *providerConfig) {
+		c.options = append(c.options, opts...)
+	}
+}
+
+// NewProvider creates an SDK tracer provider that batches spans to exp.
+// Call Shutdown on it to flush the remaining spans.
+func NewProvider(exp sdktrace.SpanExporter, opts ...Option) *sdktrace.TracerProvider {
+	cfg := providerConfig{ratio: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	options := append([]sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.ratio))),
+	}, cfg.options...)
+	return sdktrace.NewTracerProvider(options...)
+}
@@ -0,0 +1,132 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/clientlibrary"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spansByName flushes tp and indexes the exported spans by name.
+func spansByName(t *testing.T, tp *sdktrace.TracerProvider, exp *tracetest.InMemoryExporter) map[string][]tracetest.SpanStub {
+	t.Helper()
+	require.NoError(t, tp.ForceFlush(context.Background()))
+	out := make(map[string][]tracetest.SpanStub)
+	for _, s := range exp.GetSpans() {
+		out[s.Name] = append(out[s.Name], s)
+	}
+	return out
+}
+
+func TestDeliveryTrace(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := tracing.NewProvider(exp)
+	defer tp.Shutdown(context.Background())
+
+	log := eventlog.NewMemoryEventLog(10)
+	cache := proxy.NewWatchCacheWithLog(nil, log, proxy.WithTracerProvider(tp))
+	cl := clientlibrary.NewClientLibrary(cache, log, clientlibrary.WithTracerProvider(tp))
+	defer cl.Close()
+
+	var watches []<-chan api.Event
+	for _, client := range []string{"a", "b"} {
+		sess, err := cl.NewSession(client)
+		require.NoError(t, err)
+		defer sess.Stop()
+		events, err := sess.Watch("k", 1)
+		require.NoError(t, err)
+		watches = append(watches, events)
+	}
+
+	require.NoError(t, cl.BroadcastUpdate(api.Event{Type: api.EventPut, Key: "k", Value: []byte("v"), Revision: 1}))
+	for _, events := range watches {
+		select {
+		case ev := <-events:
+			assert.Contains(t, ev.TraceContext, "traceparent")
+		case <-time.After(time.Second):
+			t.Fatal("event not delivered")
+		}
+	}
+
+	var spans map[string][]tracetest.SpanStub
+	require.Eventually(t, func() bool {
+		spans = spansByName(t, tp, exp)
+		return len(spans["session.deliver"]) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Len(t, spans["watchcache.apply"], 1)
+	require.Len(t, spans["eventlog.append"], 1)
+	apply := spans["watchcache.apply"][0]
+	assert.False(t, apply.Parent.IsValid(), "a locally ingested event starts its own trace")
+	assert.Contains(t, apply.Attributes, tracing.KeyAttr.String("k"))
+	assert.Contains(t, apply.Attributes, tracing.RevisionAttr.Int64(1))
+
+	assert.Equal(t, apply.SpanContext.SpanID(), spans["eventlog.append"][0].Parent.SpanID())
+	sessions := map[string]bool{}
+	for _, s := range spans["session.deliver"] {
+		assert.Equal(t, apply.SpanContext.TraceID(), s.SpanContext.TraceID())
+		assert.Equal(t, apply.SpanContext.SpanID(), s.Parent.SpanID())
+		for _, attr := range s.Attributes {
+			if attr.Key == tracing.SessionAttr {
+				sessions[attr.Value.AsString()] = true
+			}
+		}
+	}
+	assert.Len(t, sessions, 2, "one fan-out span per session")
+}
+
+func TestRejectedEventRecordsError(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := tracing.NewProvider(exp)
+	defer tp.Shutdown(context.Background())
+
+	cache := proxy.NewWatchCache(nil, proxy.WithTracerProvider(tp))
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "k", Revision: 2}))
+	require.ErrorIs(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "k", Revision: 1}), proxy.ErrInvalidRevision)
+
+	spans := spansByName(t, tp, exp)["watchcache.apply"]
+	require.Len(t, spans, 2)
+	assert.Equal(t, "Error", spans[1].Status.Code.String())
+	require.Len(t, spans[1].Events, 1)
+	assert.Equal(t, "exception", spans[1].Events[0].Name)
+}
+
+func TestSampling(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := tracing.NewProvider(exp, tracing.WithSampleRatio(0))
+	defer tp.Shutdown(context.Background())
+
+	log := eventlog.NewMemoryEventLog(10)
+	cache := proxy.NewWatchCacheWithLog(nil, log, proxy.WithTracerProvider(tp))
+	require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: "k", Revision: 1}))
+	assert.Empty(t, spansByName(t, tp, exp))
+
+	// The decision not to sample still travels with the event.
+	events, err := log.ListSince(1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Contains(t, events[0].TraceContext["traceparent"], "-00")
+}
+
+func TestInjectExtract(t *testing.T) {
+	assert.Nil(t, tracing.Inject(context.Background()))
+	ctx := context.Background()
+	assert.Equal(t, ctx, tracing.Extract(ctx, api.Event{}))
+
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tracing.Tracer(tp).Start(ctx, "root")
+	defer span.End()
+	ev := api.Event{TraceContext: tracing.Inject(ctx)}
+	_, child := tracing.Tracer(tp).Start(tracing.Extract(context.Background(), ev), "child")
+	defer child.End()
+	assert.Equal(t, span.SpanContext().TraceID(), child.SpanContext().TraceID())
+	assert.Nil(t, tracing.Tracer(nil))
+}
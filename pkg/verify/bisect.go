@@ -0,0 +1,146 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// RangeHasher reports the proxy.RangeHash of the key range [key, end) at rev,
+// 0 meaning its latest revision, as WatchCache.Hash does for a local cache.
+type RangeHasher interface {
+	Hash(ctx context.Context, key, end string, rev int64) (proxy.RangeHash, error)
+}
+
+// CacheHasher is the RangeHasher of a local cache.
+type CacheHasher struct {
+	Cache *proxy.WatchCache
+}
+
+func (h CacheHasher) Hash(_ context.Context, key, end string, rev int64) (proxy.RangeHash, error) {
+	return h.Cache.Hash(key, end, rev)
+}
+
+// Hash makes the Verifier the RangeHasher of etcd: it reads the range at rev in
+// pages, passes the keys through the adapter and sums their proxy.HashObj.
+// etcd has no such hash of its own, so every call transfers the whole range.
+func (v *Verifier) Hash(ctx context.Context, key, end string, rev int64) (proxy.RangeHash, error) {
+	var out proxy.RangeHash
+	opts := []clientv3.OpOption{clientv3.WithLimit(v.pageSize)}
+	if end != "" {
+		opts = append(opts, clientv3.WithRange(end))
+	}
+	for {
+		resp, err := v.kv.Get(ctx, key, append(opts, clientv3.WithRev(rev))...)
+		if err != nil {
+			return proxy.RangeHash{}, err
+		}
+		if rev == 0 {
+			// Read the following pages at the same revision.
+			rev = resp.Header.Revision
+		}
+		live := v.translate(resp.Kvs)
+		out.Count += len(live)
+		out.Hash += Hash(live)
+		if !resp.More || len(resp.Kvs) == 0 {
+			out.Revision = rev
+			return out, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// HTTPHasher is the RangeHasher of another proxy, asked through the
+// /debug/hash endpoint of its admin server.
+type HTTPHasher struct {
+	URL    string       // of the admin server, e.g. http://proxy-1:9090
+	Client *http.Client // http.DefaultClient if nil
+}
+
+func (h HTTPHasher) Hash(ctx context.Context, key, end string, rev int64) (proxy.RangeHash, error) {
+	q := url.Values{"key": {key}, "end": {end}, "rev": {strconv.FormatInt(rev, 10)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(h.URL, "/")+"/debug/hash?"+q.Encode(), nil)
+	if err != nil {
+		return proxy.RangeHash{}, err
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return proxy.RangeHash{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return proxy.RangeHash{}, fmt.Errorf("%s: %s: %s", h.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out proxy.RangeHash
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return proxy.RangeHash{}, err
+	}
+	return out, nil
+}
+
+// KeyRange is the etcd key range [Key, End), see proxy.InRange.
+type KeyRange struct {
+	Key string `json:"key"`
+	End string `json:"end"`
+}
+
+// Bisect finds where local and remote disagree on [key, end) at rev, 0 meaning
+// local's revision. While the hashes of a range differ and local holds more
+// than leaf keys in it, the range is split at local's median key and both
+// halves are compared, one level per round of requests. It returns the ranges
+// that still differ, each with at most leaf keys in local, after O(log n)
+// rounds; Range on both sides then shows the divergent keys.
+//
+// Both sides must answer at rev. A proxy that has moved on answers only for
+// ranges unchanged since (see WatchCache.Hash), so under heavy writes retry at
+// a newer revision.
+func Bisect(ctx context.Context, local *proxy.WatchCache, remote RangeHasher, key, end string, rev int64, leaf int) ([]KeyRange, error) {
+	if rev == 0 {
+		rev = local.Revision()
+	}
+	leaf = max(leaf, 1)
+	var out []KeyRange
+	for todo := []KeyRange{{key, end}}; len(todo) > 0; {
+		var next []KeyRange
+		for _, r := range todo {
+			l, err := local.Hash(r.Key, r.End, rev)
+			if err != nil {
+				return nil, err
+			}
+			rh, err := remote.Hash(ctx, r.Key, r.End, rev)
+			if err != nil {
+				return nil, err
+			}
+			if rh.Revision != rev {
+				return nil, fmt.Errorf("remote answered at revision %d, not %d", rh.Revision, rev)
+			}
+			if l.Hash == rh.Hash && l.Count == rh.Count {
+				continue
+			}
+			mid, ok := "", false
+			if l.Count > leaf {
+				mid, ok = local.SplitKey(r.Key, r.End)
+			}
+			if !ok {
+				out = append(out, r)
+				continue
+			}
+			next = append(next, KeyRange{r.Key, mid}, KeyRange{mid, r.End})
+		}
+		todo = next
+	}
+	return out, nil
+}
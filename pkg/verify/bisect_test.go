@@ -0,0 +1,49 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/admin"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBisect(t *testing.T) {
+	var objs []*proxy.StoreObj
+	for i := 0; i < 1000; i++ {
+		objs = append(objs, &proxy.StoreObj{Key: fmt.Sprintf("/k/%04d", i), Value: []byte("v"), Revision: 1, ModRev: 1})
+	}
+	local, remote := proxy.NewWatchCache(nil), proxy.NewWatchCache(nil)
+	local.Replace(objs, 10)
+	diverged := append([]*proxy.StoreObj(nil), objs...)
+	diverged[123] = &proxy.StoreObj{Key: "/k/0123", Value: []byte("stale"), Revision: 1, ModRev: 1}
+	diverged = append(diverged[:700], diverged[701:]...) // /k/0700 missing remotely
+	remote.Replace(diverged, 10)
+
+	srv := httptest.NewServer(admin.NewServer(remote).Handler())
+	defer srv.Close()
+	for name, h := range map[string]RangeHasher{
+		"cache": CacheHasher{remote},
+		"http":  HTTPHasher{URL: srv.URL},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ranges, err := Bisect(context.Background(), local, h, "/k/", "/k0", 0, 4)
+			require.NoError(t, err)
+			require.Len(t, ranges, 2)
+			for i, key := range []string{"/k/0123", "/k/0700"} {
+				assert.True(t, proxy.InRange(key, ranges[i].Key, ranges[i].End), "%s in %v", key, ranges[i])
+				n, err := local.Hash(ranges[i].Key, ranges[i].End, 0)
+				require.NoError(t, err)
+				assert.LessOrEqual(t, n.Count, 4)
+			}
+		})
+	}
+
+	ranges, err := Bisect(context.Background(), local, CacheHasher{local}, "/k/", "/k0", 0, 4)
+	require.NoError(t, err)
+	assert.Empty(t, ranges)
+}
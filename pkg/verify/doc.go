@@ -0,0 +1,20 @@
+/*
+Package verify checks in the background that the cache still agrees with etcd.
+
+- Verifier takes the cache revision and reads each configured prefix from etcd
+  at that revision in pages.
+- Every page's hash is compared with WatchCache.Hash of the same key interval;
+  only pages whose hashes differ are read from the cache and compared key by
+  key, and the keys missing from the cache, extra in it or cached with another
+  value or mod revision are logged and reported through api.MetricsCollector.
+- With WithRepair a divergent page is overwritten with etcd's state through
+  WatchCache.ReplaceRange, a re-list of just that key interval.
+- Bisect narrows a divergence between the cache and another RangeHasher, a
+  second proxy through its admin server (HTTPHasher) or etcd (the Verifier
+  itself), down to a few keys in O(log n) rounds of WatchCache.Hash calls.
+
+A revision etcd has already compacted, or that the cache no longer holds for a
+page because the page changed meanwhile, cannot be compared and skips the
+prefix for that round.
+*/
+package verify
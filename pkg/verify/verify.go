@@ -0,0 +1,345 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// maxLoggedKeys bounds how many divergent keys of a range one log line lists.
+const maxLoggedKeys = 10
+
+// RangeResult is the outcome of comparing one prefix of the cache with etcd.
+type RangeResult struct {
+	Prefix   string
+	Revision int64  // both sides were read at this revision
+	Keys     int    // keys etcd holds under Prefix, after the adapter
+	Hash     uint64 // of etcd's keys under Prefix at Revision, see Hash
+	Pages    int    // pages read from etcd
+	Diffed   int    // pages whose hashes differed and were compared key by key
+	Skipped  bool   // etcd could not serve Revision, nothing was compared
+
+	Missing    []string // in etcd, not in the cache
+	Extra      []string // in the cache, not in etcd
+	Mismatched []string // in both with another value or mod revision
+	Repaired   int      // keys ReplaceRange changed, with WithRepair
+}
+
+// Divergent returns the number of keys on which the cache and etcd disagree.
+func (r RangeResult) Divergent() int {
+	return len(r.Missing) + len(r.Extra) + len(r.Mismatched)
+}
+
+// Verifier compares the cache with etcd in the background.
+//
+// For every prefix it takes the cache revision, then reads the same range from
+// etcd at that revision, one page at a time. Each page's hash is compared with
+// WatchCache.Hash of the same key interval, which copies nothing, and only the
+// cached keys of pages whose hashes differ are copied and compared key by key,
+// so a round holds at most one page of either side.
+type Verifier struct {
+	cache    *proxy.WatchCache
+	kv       clientv3.KV
+	adapter  api.EtcdAdapter
+	prefixes []string
+	interval time.Duration
+	pageSize int64
+	repair   bool
+	metrics  api.MetricsCollector
+	logger   *slog.Logger
+
+	mu     sync.Mutex
+	rounds int64
+	last   []RangeResult
+}
+
+// Option configures a Verifier.
+type Option func(*Verifier)
+
+// WithPrefixes compares only the keys under prefixes (default every key).
+func WithPrefixes(prefixes ...string) Option {
+	return func(v *Verifier) {
+		v.prefixes = prefixes
+	}
+}
+
+// WithAdapter passes etcd's keys through a, as the watch does before they
+// reach the cache, so keys it filters out are not reported missing. a must
+// not rewrite keys out of the prefix they were read from.
+func WithAdapter(a api.EtcdAdapter) Option {
+	return func(v *Verifier) {
+		v.adapter = a
+	}
+}
+
+// WithInterval sets how often Run compares (default ten minutes).
+func WithInterval(d time.Duration) Option {
+	return func(v *Verifier) {
+		v.interval = d
+	}
+}
+
+// WithPageSize sets how many keys are read from etcd per request (default 1000).
+func WithPageSize(n int64) Option {
+	return func(v *Verifier) {
+		v.pageSize = n
+	}
+}
+
+// WithRepair overwrites every divergent page with etcd's state through
+// WatchCache.ReplaceRange, re-listing just that key interval.
+func WithRepair(repair bool) Option {
+	return func(v *Verifier) {
+		v.repair = repair
+	}
+}
+
+// WithMetrics reports every round to m.
+func WithMetrics(m api.MetricsCollector) Option {
+	return func(v *Verifier) {
+		v.metrics = m
+	}
+}
+
+// WithLogger sets the logger divergences and failed rounds are reported to
+// (default slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(v *Verifier) {
+		v.logger = l
+	}
+}
+
+// New creates a verifier comparing cache with the etcd kv reads from.
+func New(cache *proxy.WatchCache, kv clientv3.KV, opts ...Option) *Verifier {
+	v := &Verifier{cache: cache, kv: kv, interval: 10 * time.Minute, pageSize: 1000}
+	for _, opt := range opts {
+		opt(v)
+	}
+	if len(v.prefixes) == 0 {
+		v.prefixes = []string{""}
+	}
+	v.logger = logging.Component(v.logger, "verifier")
+	return v
+}
+
+// CheckOnce compares every prefix and reports the totals to the metrics. A
+// prefix whose revision etcd has compacted, or does not have yet, is skipped;
+// any other error ends the round.
+func (v *Verifier) CheckOnce(ctx context.Context) ([]RangeResult, error) {
+	results := make([]RangeResult, 0, len(v.prefixes))
+	var missing, extra, mismatched int
+	for _, prefix := range v.prefixes {
+		res, err := v.Check(ctx, prefix)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, res)
+		missing += len(res.Missing)
+		extra += len(res.Extra)
+		mismatched += len(res.Mismatched)
+	}
+	v.mu.Lock()
+	v.rounds++
+	v.last = results
+	v.mu.Unlock()
+	if v.metrics != nil {
+		v.metrics.ObserveConsistencyCheck(missing, extra, mismatched)
+	}
+	return results, nil
+}
+
+// Check compares the keys under prefix with etcd at the cache revision.
+func (v *Verifier) Check(ctx context.Context, prefix string) (RangeResult, error) {
+	key, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if prefix == "" {
+		key, end = "\x00", "\x00"
+	}
+	rev := v.cache.Revision()
+	res := RangeResult{Prefix: prefix, Revision: rev}
+	if rev == 0 {
+		// Nothing loaded yet: revision 0 would read etcd's latest state.
+		res.Skipped = true
+		return res, nil
+	}
+
+	start := key
+	for {
+		resp, err := v.kv.Get(ctx, start, clientv3.WithRange(end), clientv3.WithRev(rev), clientv3.WithLimit(v.pageSize))
+		if errors.Is(err, rpctypes.ErrCompacted) || errors.Is(err, rpctypes.ErrFutureRev) {
+			v.logger.Warn("consistency check skipped", slog.String("prefix", prefix), logging.Revision(rev), slog.Any("error", err))
+			res.Skipped = true
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		res.Pages++
+		live := v.translate(resp.Kvs)
+		pageEnd := end
+		if resp.More && len(resp.Kvs) > 0 {
+			pageEnd = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+		}
+
+		page := Hash(live)
+		res.Hash += page
+		res.Keys += len(live)
+		cached, err := v.cache.Hash(start, pageEnd, rev)
+		if err == nil && (cached.Hash != page || cached.Count != len(live)) {
+			res.Diffed++
+			var objs []*proxy.StoreObj
+			if objs, err = v.cachedPage(start, pageEnd, rev); err == nil {
+				diff(&res, objs, live)
+				if v.repair {
+					v.repairPage(&res, start, pageEnd, live)
+				}
+			}
+		}
+		if errors.Is(err, proxy.ErrRangeChanged) || errors.Is(err, proxy.ErrHistoryUnavailable) {
+			// The cache moved on and its state at rev is gone.
+			v.logger.Warn("consistency check skipped", slog.String("prefix", prefix), logging.Revision(rev), slog.Any("error", err))
+			res.Skipped = true
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		if pageEnd == end {
+			break
+		}
+		start = pageEnd
+	}
+
+	if res.Divergent() > 0 {
+		v.logger.Warn("cache diverged from etcd",
+			slog.String("prefix", prefix), logging.Revision(rev),
+			slog.Int("missing", len(res.Missing)), slog.Int("extra", len(res.Extra)), slog.Int("mismatched", len(res.Mismatched)),
+			slog.Any("keys", sample(res)), slog.Int("repaired", res.Repaired))
+	}
+	return res, nil
+}
+
+// cachedPage returns copies of the cached objects in [key, end) as they were at
+// rev, which fails unless the range is unchanged since.
+func (v *Verifier) cachedPage(key, end string, rev int64) ([]*proxy.StoreObj, error) {
+	objs, cur := v.cache.Range(key, end)
+	if cur != rev {
+		if _, err := v.cache.Hash(key, end, rev); err != nil {
+			return nil, err
+		}
+	}
+	return objs, nil
+}
+
+// translate turns etcd's key-values into the objects the cache would hold for them.
+func (v *Verifier) translate(kvs []*mvccpb.KeyValue) []*proxy.StoreObj {
+	out := make([]*proxy.StoreObj, 0, len(kvs))
+	for _, kv := range kvs {
+		obj := &proxy.StoreObj{Key: string(kv.Key), Value: kv.Value, Revision: kv.ModRevision, ModRev: kv.ModRevision}
+		if v.adapter != nil {
+			if !v.adapter.IsWatchableKey(obj.Key) {
+				continue
+			}
+			ev, err := v.adapter.TranslateEtcdEvent(api.EtcdKV{Type: api.EventPut, Key: obj.Key, Value: kv.Value, ModRevision: kv.ModRevision})
+			if err != nil {
+				continue
+			}
+			obj = &proxy.StoreObj{Key: ev.Key, Value: ev.Value, Revision: ev.Revision, ModRev: ev.ModRev}
+		}
+		out = append(out, obj)
+	}
+	return out
+}
+
+func (v *Verifier) repairPage(res *RangeResult, key, end string, live []*proxy.StoreObj) {
+	n, err := v.cache.ReplaceRange(key, end, live, res.Revision)
+	if err != nil {
+		v.logger.Warn("repair failed", logging.Key(key), slog.String("end", end), logging.Revision(res.Revision), slog.Any("error", err))
+		return
+	}
+	res.Repaired += n
+}
+
+// Run calls CheckOnce every interval until ctx is done. A failed round, e.g.
+// etcd being unreachable, is logged and the loop goes on.
+func (v *Verifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := v.CheckOnce(ctx); err != nil && ctx.Err() == nil {
+				v.logger.Warn("consistency check failed", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// Last returns the number of completed rounds and the results of the latest one.
+func (v *Verifier) Last() (int64, []RangeResult) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.rounds, v.last
+}
+
+// Hash returns the hash Check reports for objs, the sum of proxy.HashObj over
+// them, which is the Hash of proxy.RangeHash: a range that agrees with etcd has
+// the same hash in WatchCache.Hash.
+func Hash(objs []*proxy.StoreObj) uint64 {
+	var sum uint64
+	for _, obj := range objs {
+		sum += proxy.HashObj(obj)
+	}
+	return sum
+}
+
+// before reports whether k sorts before the exclusive range end.
+func before(k, end string) bool {
+	return end == "\x00" || k < end
+}
+
+// diff merges two key-ordered lists of the same key interval into res.
+func diff(res *RangeResult, cached, live []*proxy.StoreObj) {
+	i, j := 0, 0
+	for i < len(cached) || j < len(live) {
+		switch {
+		case j == len(live) || i < len(cached) && cached[i].Key < live[j].Key:
+			res.Extra = append(res.Extra, cached[i].Key)
+			i++
+		case i == len(cached) || live[j].Key < cached[i].Key:
+			res.Missing = append(res.Missing, live[j].Key)
+			j++
+		default:
+			if cached[i].ModRev != live[j].ModRev || !bytes.Equal(cached[i].Value, live[j].Value) {
+				res.Mismatched = append(res.Mismatched, live[j].Key)
+			}
+			i++
+			j++
+		}
+	}
+}
+
+// sample returns up to maxLoggedKeys of the divergent keys.
+func sample(res RangeResult) []string {
+	var out []string
+	for _, keys := range [][]string{res.Missing, res.Extra, res.Mismatched} {
+		for _, k := range keys {
+			if len(out) == maxLoggedKeys {
+				return out
+			}
+			out = append(out, k)
+		}
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package verify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/adapter"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/metrics"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/watcher"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	cli := etcdtest.Client(t)
+	ctx := context.Background()
+	for i := 0; i < 25; i++ {
+		_, err := cli.Put(ctx, fmt.Sprintf("/a/%02d", i), "v")
+		require.NoError(t, err)
+	}
+	_, err := cli.Put(ctx, "/b/1", "outside")
+	require.NoError(t, err)
+
+	a := adapter.NewEtcdAdapter(adapter.WithIncludePrefixes("/a/"))
+	log := eventlog.NewMemoryEventLog(64)
+	cache := proxy.NewWatchCacheWithLog(nil, log)
+	_, err = watcher.Relist(ctx, cli, "/", a, cache)
+	require.NoError(t, err)
+	prom := metrics.NewPrometheus()
+	v := New(cache, cli, WithPrefixes("/a/", "/b/"), WithAdapter(a), WithPageSize(10), WithMetrics(prom))
+
+	results, err := v.CheckOnce(ctx)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	clean := results[0]
+	assert.Equal(t, 25, clean.Keys)
+	assert.Equal(t, 3, clean.Pages)
+	assert.Zero(t, clean.Diffed)
+	assert.Zero(t, clean.Divergent())
+	objs, rev := cache.Range("/a/", "/a0")
+	assert.Equal(t, Hash(objs), clean.Hash)
+	assert.Equal(t, rev, clean.Revision)
+	cached, err := cache.Hash("/a/", "/a0", rev)
+	require.NoError(t, err)
+	assert.Equal(t, clean.Hash, cached.Hash, "the cache keeps the same hash incrementally")
+	live, err := v.Hash(ctx, "/a/", "/a0", rev)
+	require.NoError(t, err)
+	assert.Equal(t, cached, live)
+	assert.Zero(t, results[1].Keys, "/b/ is filtered by the adapter")
+
+	// Corrupt one page of the cache at its current revision.
+	objs[3].Value = []byte("stale")      // /a/03
+	objs = append(objs[:4], objs[5:]...) // drop /a/04
+	objs = append(objs, &proxy.StoreObj{Key: "/a/05x", Value: []byte("x"), Revision: rev, ModRev: rev})
+	cache.Replace(objs, rev)
+
+	res, err := v.Check(ctx, "/a/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a/04"}, res.Missing)
+	assert.Equal(t, []string{"/a/05x"}, res.Extra)
+	assert.Equal(t, []string{"/a/03"}, res.Mismatched)
+	assert.Equal(t, 1, res.Diffed, "only the first page differs")
+	assert.Equal(t, clean.Hash, res.Hash, "etcd did not change")
+
+	_, err = v.CheckOnce(ctx)
+	require.NoError(t, err)
+	assert.NoError(t, testutil.GatherAndCompare(prom.Registry(), strings.NewReader(`
+# HELP etcdcache_consistency_checks_total Comparisons of the cache with etcd.
+# TYPE etcdcache_consistency_checks_total counter
+etcdcache_consistency_checks_total 2
+# HELP etcdcache_consistency_divergent_keys Keys on which the last comparison found the cache and etcd to differ, by kind: missing, extra or mismatched.
+# TYPE etcdcache_consistency_divergent_keys gauge
+etcdcache_consistency_divergent_keys{kind="extra"} 1
+etcdcache_consistency_divergent_keys{kind="mismatched"} 1
+etcdcache_consistency_divergent_keys{kind="missing"} 1
+`), "etcdcache_consistency_checks_total", "etcdcache_consistency_divergent_keys"))
+
+	// With repair the divergent page is re-listed.
+	v = New(cache, cli, WithPrefixes("/a/"), WithAdapter(a), WithPageSize(10), WithRepair(true))
+	res, err = v.Check(ctx, "/a/")
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Repaired)
+	res, err = v.Check(ctx, "/a/")
+	require.NoError(t, err)
+	assert.Zero(t, res.Divergent())
+	obj, ok := cache.Get("/a/03")
+	require.True(t, ok)
+	assert.Equal(t, "v", string(obj.Value))
+}
+
+func TestCheckSkipsCompactedRevision(t *testing.T) {
+	cli := etcdtest.Client(t)
+	ctx := context.Background()
+	_, err := cli.Put(ctx, "k", "1")
+	require.NoError(t, err)
+	cache := proxy.NewWatchCache(nil)
+	_, err = watcher.Relist(ctx, cli, "k", adapter.NewEtcdAdapter(), cache)
+	require.NoError(t, err)
+	resp, err := cli.Put(ctx, "k", "2")
+	require.NoError(t, err)
+	_, err = cli.Compact(ctx, resp.Header.Revision)
+	require.NoError(t, err)
+
+	res, err := New(cache, cli).Check(ctx, "")
+	require.NoError(t, err)
+	assert.True(t, res.Skipped)
+	assert.Zero(t, res.Divergent())
+}
+
+func TestCachedPage(t *testing.T) {
+	cache := proxy.NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(8))
+	put := func(key string, rev int64) {
+		t.Helper()
+		require.NoError(t, cache.AddEvent(api.Event{Type: api.EventPut, Key: key, Value: []byte("v"), Revision: rev, ModRev: rev}))
+	}
+	put("/a/1", 1)
+	put("/b/1", 2)
+	v := New(cache, nil)
+
+	objs, err := v.cachedPage("/a/", "/a0", 1)
+	require.NoError(t, err, "/a/ is unchanged since revision 1")
+	require.Len(t, objs, 1)
+	assert.Equal(t, "/a/1", objs[0].Key)
+
+	put("/a/2", 3)
+	_, err = v.cachedPage("/a/", "/a0", 1)
+	assert.ErrorIs(t, err, proxy.ErrRangeChanged)
+}
@@ -0,0 +1,45 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdCompactRevision returns etcd's current compact revision: the oldest
+// revision etcd still serves, or 0 if nothing has been compacted. etcd has no
+// call that reports it, so it is found by binary search with count-only reads of
+// key, each failing with ErrCompacted below the compact revision.
+func EtcdCompactRevision(ctx context.Context, cli *clientv3.Client, key string) (int64, error) {
+	head, err := cli.Get(ctx, key, clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	compacted := func(rev int64) (bool, error) {
+		_, err := cli.Get(ctx, key, clientv3.WithRev(rev), clientv3.WithCountOnly())
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			return true, nil
+		}
+		return false, err
+	}
+	// Invariant: lo is compacted (or 0), hi is served.
+	lo, hi := int64(0), head.Header.Revision
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		c, err := compacted(mid)
+		if err != nil {
+			return 0, err
+		}
+		if c {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return 0, nil
+	}
+	return hi, nil
+}
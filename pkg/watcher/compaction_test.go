@@ -0,0 +1,30 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+)
+
+func TestEtcdCompactRevision(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		put(t, cli, "/app/a", "v")
+	}
+	rev, err := EtcdCompactRevision(ctx, cli, "/app/")
+	require.NoError(t, err)
+	assert.Zero(t, rev)
+
+	_, err = cli.Compact(ctx, 7)
+	require.NoError(t, err)
+	rev, err = EtcdCompactRevision(ctx, cli, "/app/")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), rev)
+}
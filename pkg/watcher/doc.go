@@ -7,7 +7,10 @@ that can be passed into the WatchCache or other consumers.
 Core components:
 
 - WatchKey: a wrapper for watching a specific etcd key, supporting callback or channel-based consumption.
-- EventTransformer: a planned utility to normalize etcd responses into unified event models.
+- WatchWithAdapter: the ingestion pipeline that turns etcd watch responses into cache events
+  through an api.EtcdAdapter (filtering, key rewriting, validation) and applies them to a WatchCache.
+- Restore / Relist: restart from an on-disk cache snapshot, falling back to a full list
+  when etcd has compacted past it.
 
 This package abstracts away the low-level stream handling, allowing other modules to consume
 semantic events without dealing with raw etcd WatchResponses.
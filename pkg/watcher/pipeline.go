@@ -0,0 +1,184 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/tracing"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EventApplier is the ingestion end of the watch pipeline; *proxy.WatchCache implements it.
+type EventApplier interface {
+	AddEvent(ev api.Event) error
+}
+
+// ProgressApplier is implemented by an EventApplier that can advance its
+// revision on a watch progress notification, as *proxy.WatchCache does.
+type ProgressApplier interface {
+	Progress(rev int64)
+}
+
+// KVFromEvent converts an etcd watch event into the adapter's input type.
+func KVFromEvent(ev *clientv3.Event) api.EtcdKV {
+	kv := api.EtcdKV{
+		Key:            string(ev.Kv.Key),
+		ModRevision:    ev.Kv.ModRevision,
+		CreateRevision: ev.Kv.CreateRevision,
+		Version:        ev.Kv.Version,
+		Lease:          ev.Kv.Lease,
+	}
+	switch ev.Type {
+	case clientv3.EventTypePut:
+		kv.Type = api.EventPut
+		kv.Value = ev.Kv.Value
+	case clientv3.EventTypeDelete:
+		kv.Type = api.EventDelete
+	default:
+		kv.Type = api.EventType(ev.Type)
+	}
+	return kv
+}
+
+// WatchOption configures WatchWithAdapter and the WatchKey functions.
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	metrics  api.MetricsCollector
+	tracer   trace.Tracer
+	logger   *slog.Logger
+	pageSize int64
+}
+
+func newWatchConfig(opts []WatchOption) watchConfig {
+	cfg := watchConfig{pageSize: 1000}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.logger = logging.Component(cfg.logger, "watcher")
+	return cfg
+}
+
+// WithWatchLogger sets the logger for failed watches and for events that are
+// rejected or skipped (default slog.Default()).
+func WithWatchLogger(l *slog.Logger) WatchOption {
+	return func(c *watchConfig) {
+		c.logger = l
+	}
+}
+
+// WithListPageSize sets how many keys Relist reads from etcd per request
+// (default 1000).
+func WithListPageSize(n int64) WatchOption {
+	return func(c *watchConfig) {
+		c.pageSize = n
+	}
+}
+
+// WithWatchMetrics reports the upstream revision and the time every event takes
+// to apply to m. It also requests progress notifications from etcd, so the
+// upstream revision keeps moving while no watched key changes.
+func WithWatchMetrics(m api.MetricsCollector) WatchOption {
+	return func(c *watchConfig) {
+		c.metrics = m
+	}
+}
+
+// WithWatchTracerProvider starts a trace for every accepted event with a
+// watcher.receive span, beginning when the watch response arrived and ending once
+// dst has applied the event. Its context is passed on in Event.TraceContext.
+func WithWatchTracerProvider(tp trace.TracerProvider) WatchOption {
+	return func(c *watchConfig) {
+		c.tracer = tracing.Tracer(tp)
+	}
+}
+
+// WatchWithAdapter watches every key under prefix, starting at fromRev (0 for
+// "from now"), passes each event through adapter and applies the accepted ones
+// to dst. Events the adapter filters or rejects never reach dst; rejected ones
+// end up in the adapter's dead-letter channel. Accepted events are stamped with
+// the time the watch response arrived and the etcd cluster and member it came from.
+// Progress notifications, periodic or asked for with clientv3.Client.RequestProgress,
+// advance dst's revision if it is a ProgressApplier, and so does the end of every
+// watch response, which completes the revision of its last event.
+//
+// It blocks until ctx is done or the watch fails, e.g. with rpctypes.ErrCompacted
+// when fromRev has been compacted, and returns the reason.
+func WatchWithAdapter(ctx context.Context, cli *clientv3.Client, prefix string, fromRev int64, adapter api.EtcdAdapter, dst EventApplier, opts ...WatchOption) error {
+	cfg := newWatchConfig(opts)
+	watchOpts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if fromRev > 0 {
+		watchOpts = append(watchOpts, clientv3.WithRev(fromRev))
+	}
+	if cfg.metrics != nil {
+		watchOpts = append(watchOpts, clientv3.WithProgressNotify())
+	}
+	for resp := range cli.Watch(ctx, prefix, watchOpts...) {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		observed := time.Now()
+		if cfg.metrics != nil {
+			cfg.metrics.ObserveUpstreamRevision(resp.Header.Revision)
+		}
+		if resp.IsProgressNotify() {
+			// Every change up to the header revision has been delivered.
+			if p, ok := dst.(ProgressApplier); ok {
+				p.Progress(resp.Header.Revision)
+			}
+			continue
+		}
+		origin := api.Origin{Kind: api.OriginEtcd, ClusterID: resp.Header.ClusterId, MemberID: resp.Header.MemberId}
+		for _, ev := range resp.Events {
+			kv := KVFromEvent(ev)
+			if !adapter.IsWatchableKey(kv.Key) {
+				continue
+			}
+			cacheEv, err := adapter.TranslateEtcdEvent(kv)
+			if err != nil {
+				cfg.logger.Warn("adapter rejected event", logging.Key(kv.Key), logging.Revision(kv.ModRevision), slog.Any("error", err))
+				continue
+			}
+			cacheEv.ObservedAt, cacheEv.Origin = observed, origin
+			var span trace.Span
+			if cfg.tracer != nil {
+				var spanCtx context.Context
+				spanCtx, span = cfg.tracer.Start(ctx, "watcher.receive", trace.WithTimestamp(observed),
+					trace.WithAttributes(tracing.EventAttributes(cacheEv)...))
+				cacheEv.TraceContext = tracing.Inject(spanCtx)
+			}
+			start := time.Now()
+			err = dst.AddEvent(cacheEv)
+			if cfg.metrics != nil {
+				cfg.metrics.ObserveApplyLatency(time.Since(start))
+			}
+			// Replays of already applied revisions are expected after a restart.
+			if err != nil && errors.Is(err, proxy.ErrInvalidRevision) {
+				cfg.logger.Debug("skipped replayed event", logging.Key(cacheEv.Key), logging.Revision(cacheEv.Revision))
+				if span != nil {
+					span.AddEvent("replay skipped")
+				}
+				err = nil
+			}
+			if span != nil {
+				tracing.End(span, err)
+			}
+			if err != nil {
+				cfg.logger.Error("applying event failed", logging.Key(cacheEv.Key), logging.Revision(cacheEv.Revision), slog.Any("error", err))
+				return err
+			}
+		}
+		if p, ok := dst.(ProgressApplier); ok && len(resp.Events) > 0 {
+			// etcd does not split a revision across watch responses, so the
+			// last event's revision is complete.
+			p.Progress(resp.Events[len(resp.Events)-1].Kv.ModRevision)
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,131 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/adapter"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/metrics"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWatchWithAdapter_StampsOrigin(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	log := eventlog.NewMemoryEventLog(10)
+	cache := proxy.NewWatchCacheWithLog(nil, log)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	before := time.Now()
+	rev := put(t, cli, "/app/a", "1")
+	go WatchWithAdapter(ctx, cli, "/app/", rev, adapter.NewEtcdAdapter(), cache)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, cache.WaitForRevision(waitCtx, rev))
+
+	events, err := log.ListSince(rev)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	ev := events[0]
+	status, err := cli.Status(ctx, cli.Endpoints()[0])
+	require.NoError(t, err)
+	assert.Equal(t, api.Origin{Kind: api.OriginEtcd, ClusterID: status.Header.ClusterId, MemberID: status.Header.MemberId}, ev.Origin)
+	assert.False(t, ev.ObservedAt.Before(before))
+	assert.False(t, ev.IngestedAt.Before(ev.ObservedAt))
+}
+
+func TestWatchWithAdapter_Metrics(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	cache := proxy.NewWatchCache(nil)
+	prom := metrics.NewPrometheus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rev := put(t, cli, "/app/a", "1")
+	go WatchWithAdapter(ctx, cli, "/app/", rev, adapter.NewEtcdAdapter(), cache, WithWatchMetrics(prom))
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, cache.WaitForRevision(waitCtx, rev))
+
+	// Writes outside the prefix are not watched but still move the upstream revision.
+	other := put(t, cli, "/other", "1")
+	require.Eventually(t, func() bool { return prom.UpstreamRevision() >= other }, 5*time.Second, 10*time.Millisecond)
+	families, err := prom.Registry().Gather()
+	require.NoError(t, err)
+	var applied uint64
+	for _, mf := range families {
+		if mf.GetName() == "etcdcache_apply_latency_seconds" {
+			applied = mf.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	assert.Equal(t, uint64(1), applied)
+}
+
+func TestWatchWithAdapter_Progress(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	cache := proxy.NewWatchCache(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rev := put(t, cli, "/app/a", "1")
+	go WatchWithAdapter(ctx, cli, "/app/", rev, adapter.NewEtcdAdapter(), cache)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, cache.WaitForRevision(waitCtx, rev))
+
+	// Nothing under the prefix changes, yet a requested progress notification
+	// tells the cache it is current at etcd's revision.
+	other := put(t, cli, "/other", "1")
+	require.Eventually(t, func() bool {
+		require.NoError(t, cli.RequestProgress(ctx))
+		return cache.Revision() >= other
+	}, 5*time.Second, 50*time.Millisecond)
+	_, ok := cache.Get("/other")
+	assert.False(t, ok)
+}
+
+func TestWatchWithAdapter_Tracing(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	log := eventlog.NewMemoryEventLog(10)
+	cache := proxy.NewWatchCacheWithLog(nil, log, proxy.WithTracerProvider(tp))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rev := put(t, cli, "/app/a", "1")
+	go WatchWithAdapter(ctx, cli, "/app/", rev, adapter.NewEtcdAdapter(), cache, WithWatchTracerProvider(tp))
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, cache.WaitForRevision(waitCtx, rev))
+
+	// The receive span ends right after the apply returns.
+	var receive, apply tracetest.SpanStub
+	require.Eventually(t, func() bool {
+		for _, s := range exp.GetSpans() {
+			switch s.Name {
+			case "watcher.receive":
+				receive = s
+			case "watchcache.apply":
+				apply = s
+			}
+		}
+		return receive.Name != "" && apply.Name != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, receive.SpanContext.SpanID(), apply.Parent.SpanID())
+
+	events, err := log.ListSince(rev)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Contains(t, events[0].TraceContext["traceparent"], receive.SpanContext.SpanID().String(),
+		"the logged event carries the receive span, so sessions join the same trace")
+	assert.False(t, receive.StartTime.After(events[0].ObservedAt))
+}
@@ -0,0 +1,107 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/api"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Restore brings cache up to date after a restart and returns the revision to
+// pass to WatchWithAdapter.
+//
+// It loads the snapshot at snapshotPath (a missing or corrupt file counts as no
+// snapshot), replays the tail of the cache's EventLog on top of it, and then
+// checks that etcd still has the history after that revision. If it does, the
+// watch resumes right after the restored revision. If there is no snapshot, or
+// etcd has compacted past it, the cache is re-listed from etcd instead.
+// Only WithWatchLogger and WithListPageSize apply among opts.
+func Restore(ctx context.Context, cli *clientv3.Client, prefix, snapshotPath string, adapter api.EtcdAdapter, cache *proxy.WatchCache, opts ...WatchOption) (int64, error) {
+	logger := newWatchConfig(opts).logger
+	switch _, err := cache.LoadSnapshot(snapshotPath); {
+	case errors.Is(err, os.ErrNotExist):
+		logger.Info("no snapshot to restore", slog.String("path", snapshotPath))
+	case errors.Is(err, proxy.ErrCorruptSnapshot):
+		logger.Warn("ignoring corrupt snapshot", slog.String("path", snapshotPath), slog.Any("error", err))
+	case err != nil:
+		return 0, err
+	}
+	rev, err := cache.ReplayLog()
+	if err != nil {
+		return 0, err
+	}
+	if rev > 0 {
+		_, err := cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithCountOnly())
+		switch {
+		case err == nil:
+			logger.Info("restored cache", logging.Revision(rev))
+			return rev + 1, nil
+		case !errors.Is(err, rpctypes.ErrCompacted) && !errors.Is(err, rpctypes.ErrFutureRev):
+			return 0, err
+		}
+		// Compacted: the changes after rev are gone. Future revision: etcd was
+		// restored from an older backup. Either way only a fresh list is correct.
+		logger.Warn("restored revision unusable, re-listing", logging.Revision(rev), slog.Any("error", err))
+	}
+	return Relist(ctx, cli, prefix, adapter, cache, opts...)
+}
+
+// Relist replaces the contents of cache with the keys under prefix as etcd has
+// them now and returns the revision to watch from. The keys are read in pages
+// of WithListPageSize, all at the revision of the first one. They are passed
+// through adapter exactly as watch events are, so keys it does not watch are
+// skipped; only WithWatchLogger and WithListPageSize apply among opts.
+func Relist(ctx context.Context, cli *clientv3.Client, prefix string, adapter api.EtcdAdapter, cache *proxy.WatchCache, opts ...WatchOption) (int64, error) {
+	cfg := newWatchConfig(opts)
+	key, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	if prefix == "" {
+		key, end = "\x00", "\x00"
+	}
+	var objs []*proxy.StoreObj
+	var rev int64
+	for {
+		getOpts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(cfg.pageSize)}
+		if rev > 0 {
+			getOpts = append(getOpts, clientv3.WithRev(rev))
+		}
+		resp, err := cli.Get(ctx, key, getOpts...)
+		if err != nil {
+			return 0, err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+		for _, kv := range resp.Kvs {
+			if !adapter.IsWatchableKey(string(kv.Key)) {
+				continue
+			}
+			ev, err := adapter.TranslateEtcdEvent(api.EtcdKV{
+				Type:           api.EventPut,
+				Key:            string(kv.Key),
+				Value:          kv.Value,
+				ModRevision:    kv.ModRevision,
+				CreateRevision: kv.CreateRevision,
+				Version:        kv.Version,
+				Lease:          kv.Lease,
+			})
+			if err != nil {
+				cfg.logger.Warn("adapter rejected key", logging.Key(string(kv.Key)), logging.Revision(kv.ModRevision), slog.Any("error", err))
+				continue
+			}
+			objs = append(objs, &proxy.StoreObj{Key: ev.Key, Value: ev.Value, Revision: ev.Revision, ModRev: ev.ModRev,
+				CreateRev: ev.CreateRev, Version: ev.Version, Lease: ev.Lease})
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	cache.Replace(objs, rev)
+	return rev + 1, nil
+}
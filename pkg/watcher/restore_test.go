@@ -0,0 +1,121 @@
+package watcher
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kaikaila/etcd-caching-gsoc/internal/etcdtest"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/adapter"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/eventlog"
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func put(t *testing.T, cli *clientv3.Client, key, val string) int64 {
+	t.Helper()
+	resp, err := cli.Put(context.Background(), key, val)
+	require.NoError(t, err)
+	return resp.Header.Revision
+}
+
+func TestRestore_ResumesAfterSnapshot(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snap")
+
+	put(t, cli, "/app/a", "1")
+	before := proxy.NewWatchCache(nil)
+	_, err := Relist(ctx, cli, "/app/", adapter.NewEtcdAdapter(), before)
+	require.NoError(t, err)
+	snapRev, err := before.WriteSnapshot(path)
+	require.NoError(t, err)
+
+	// Changes made while the cache was down.
+	put(t, cli, "/app/b", "2")
+	_, err = cli.Delete(ctx, "/app/a")
+	require.NoError(t, err)
+
+	after := proxy.NewWatchCacheWithLog(nil, eventlog.NewMemoryEventLog(16))
+	fromRev, err := Restore(ctx, cli, "/app/", path, adapter.NewEtcdAdapter(), after)
+	require.NoError(t, err)
+	assert.Equal(t, snapRev+1, fromRev)
+	_, ok := after.Get("/app/a")
+	assert.True(t, ok, "snapshot state is served before the watch catches up")
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go WatchWithAdapter(watchCtx, cli, "/app/", fromRev, adapter.NewEtcdAdapter(), after)
+	head, err := cli.Get(ctx, "/app/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	require.NoError(t, err)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	require.NoError(t, after.WaitForRevision(waitCtx, head.Header.Revision))
+
+	_, ok = after.Get("/app/a")
+	assert.False(t, ok)
+	obj, ok := after.Get("/app/b")
+	require.True(t, ok)
+	assert.Equal(t, "2", string(obj.Value))
+}
+
+func TestRestore_RelistsWhenCompacted(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snap")
+
+	put(t, cli, "/app/a", "1")
+	before := proxy.NewWatchCache(nil)
+	_, err := Relist(ctx, cli, "/app/", adapter.NewEtcdAdapter(), before)
+	require.NoError(t, err)
+	_, err = before.WriteSnapshot(path)
+	require.NoError(t, err)
+
+	put(t, cli, "/app/a", "2")
+	last := put(t, cli, "/app/b", "3")
+	_, err = cli.Compact(ctx, last)
+	require.NoError(t, err)
+
+	after := proxy.NewWatchCache(nil)
+	fromRev, err := Restore(ctx, cli, "/app/", path, adapter.NewEtcdAdapter(), after)
+	require.NoError(t, err)
+	assert.Equal(t, last+1, fromRev)
+	assert.Equal(t, last, after.Revision())
+	obj, ok := after.Get("/app/a")
+	require.True(t, ok)
+	assert.Equal(t, "2", string(obj.Value))
+}
+
+func TestRestore_WithoutSnapshotLists(t *testing.T) {
+	cli := etcdtest.Client(t, etcdtest.WithProgressNotify(100*time.Millisecond))
+	rev := put(t, cli, "/app/a", "1")
+	put(t, cli, "/other/x", "1")
+
+	cache := proxy.NewWatchCache(nil)
+	fromRev, err := Restore(context.Background(), cli, "/app/", filepath.Join(t.TempDir(), "missing"), adapter.NewEtcdAdapter(), cache)
+	require.NoError(t, err)
+	assert.Equal(t, rev+2, fromRev)
+	_, ok := cache.Get("/app/a")
+	assert.True(t, ok)
+	_, ok = cache.Get("/other/x")
+	assert.False(t, ok)
+}
+
+func TestRelist_ReadsPages(t *testing.T) {
+	cli := etcdtest.Client(t)
+	for _, k := range []string{"/app/a", "/app/b", "/app/c"} {
+		put(t, cli, k, "1")
+	}
+	rev := put(t, cli, "/other/x", "1")
+
+	cache := proxy.NewWatchCache(nil)
+	fromRev, err := Relist(context.Background(), cli, "/app/", adapter.NewEtcdAdapter(), cache, WithListPageSize(2))
+	require.NoError(t, err)
+	assert.Equal(t, rev+1, fromRev)
+	objs, _ := cache.Range("/app/", "/app0")
+	assert.Len(t, objs, 3)
+	assert.Equal(t, rev, cache.Revision())
+}
@@ -2,26 +2,30 @@ package watcher // 类似 Java 的 package 声明，比如 package com.example.m
 
 import (
 	"context" // 类似 Java 的 java.util.concurrent.CancellationException + Future cancel 管理
-	"fmt"     // 类似 Java 的 System.out.println
+	"log/slog"
 
-	// Java 的 java.time 包
+	"github.com/kaikaila/etcd-caching-gsoc/pkg/logging"
 	clientv3 "go.etcd.io/etcd/client/v3" // 导入 etcd 的 Go 客户端，类似 Java 的第三方依赖
 )
 
 // Go 中函数以小写字母开头表示 “包内可见”，类似 Java 的 package-private 函数
 // 等价于：void watchKey(Client cli, String key)
-func WatchKey(cli *clientv3.Client, key string, onPut func(string, string), onDelete func(string)) {
+func WatchKey(cli *clientv3.Client, key string, onPut func(string, string), onDelete func(string), opts ...WatchOption) {
 	// 相当于：Context ctx = new Context(); 用于控制取消、超时等
 	ctx := context.Background()
 
 	// 相当于：cli.watch(ctx, key)，返回一个异步的事件流（channel）
 	rch := cli.Watch(ctx, key)
 
-	// 类似 Java：System.out.println("Start watching key: " + key);
-	fmt.Printf("Start watching key: %s\n", key)
+	logger := newWatchConfig(opts).logger
+	logger.Info("start watching", logging.Key(key))
 
 	// Go 的 channel 可以 for 循环消费，类似 Java 的 while(true) + queue.take()
 	for wresp := range rch {
+		if err := wresp.Err(); err != nil {
+			logger.Error("watch failed", logging.Key(key), slog.Any("error", err))
+			return
+		}
 		// 每个响应里可能有多个事件，比如 PUT、DELETE 等
 		for _, ev := range wresp.Events {
 			switch ev.Type {
@@ -35,10 +39,15 @@ func WatchKey(cli *clientv3.Client, key string, onPut func(string, string), onDe
 }
 
 // for memoryCache
-func WatchKeySimple(cli *clientv3.Client, key string, onPut func(string, string), onDelete func(string)) {
+func WatchKeySimple(cli *clientv3.Client, key string, onPut func(string, string), onDelete func(string), opts ...WatchOption) {
+	logger := newWatchConfig(opts).logger
 	ch := cli.Watch(context.Background(), key, clientv3.WithPrefix())
 	go func() {
 		for resp := range ch {
+			if err := resp.Err(); err != nil {
+				logger.Error("watch failed", logging.Key(key), slog.Any("error", err))
+				return
+			}
 			for _, ev := range resp.Events {
 				k := string(ev.Kv.Key)
 				v := string(ev.Kv.Value)
@@ -54,10 +63,15 @@ func WatchKeySimple(cli *clientv3.Client, key string, onPut func(string, string)
 }
 
 //for watchCache
-func WatchKeyWithRevision(cli *clientv3.Client, key string, onPut func(string, string, int64), onDelete func(string, int64)) {
+func WatchKeyWithRevision(cli *clientv3.Client, key string, onPut func(string, string, int64), onDelete func(string, int64), opts ...WatchOption) {
+	logger := newWatchConfig(opts).logger
 	ch := cli.Watch(context.Background(), key, clientv3.WithPrefix())
 	go func() {
 		for resp := range ch {
+			if err := resp.Err(); err != nil {
+				logger.Error("watch failed", logging.Key(key), slog.Any("error", err))
+				return
+			}
 			for _, ev := range resp.Events {
 				k := string(ev.Kv.Key)
 				v := string(ev.Kv.Value)